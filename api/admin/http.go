@@ -0,0 +1,397 @@
+package adminHttp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/audit"
+	"github.com/selatoz/gateway/middleware/auth"
+	"github.com/selatoz/gateway/middleware/mtls"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/audit/svc"
+	"github.com/selatoz/gateway/internal/client/svc"
+	"github.com/selatoz/gateway/internal/lockout/repo"
+	"github.com/selatoz/gateway/internal/lockout/svc"
+	"github.com/selatoz/gateway/internal/role/svc"
+	"github.com/selatoz/gateway/internal/token/svc"
+	"github.com/selatoz/gateway/internal/user/svc"
+)
+
+// Set constants
+const (
+	// Errors
+	ErrInvalidUserID		= "Invalid user id"
+	ErrMissingContext		= "Missing context"
+	ErrUserNotFound		= "User not found"
+	ErrFirstPartyOnly		= "Impersonation requires a first party session"
+	ErrSelfImpersonation	= "Cannot impersonate yourself"
+	ErrImpersonationScope	= "Cannot impersonate a user with permissions you do not hold"
+	ErrAuditFailed			= "Failed to record the impersonation"
+)
+
+// GetUserRolesHandler lists the roles of a user
+func GetUserRolesHandler(roleService roleSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidUserID})
+			return
+		}
+
+		// Get the roles
+		roles, err := roleService.GetUserRoles(uint(userID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Build the response
+		res := validHttp.RolesResponse{Roles: []validHttp.RoleResponse{}}
+		for _, role := range roles {
+			perms := []string{}
+			for _, perm := range role.Permissions {
+				perms = append(perms, perm.Name)
+			}
+			res.Roles = append(res.Roles, validHttp.RoleResponse{Name: role.Name, Permissions: perms})
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// AssignRoleHandler gives a role to a user
+func AssignRoleHandler(roleService roleSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidUserID})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.AssignRoleRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Assign the role
+		if err := roleService.AssignRole(uint(userID), req.Role); err != nil {
+			handleRoleError(c, err)
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Role assigned"})
+	}
+}
+
+// RemoveRoleHandler takes a role away from a user
+func RemoveRoleHandler(roleService roleSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidUserID})
+			return
+		}
+
+		// Remove the role
+		if err := roleService.RemoveRole(uint(userID), c.Param("role")); err != nil {
+			handleRoleError(c, err)
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Role removed"})
+	}
+}
+
+// CreateClientHandler registers an OAuth client, the secret is only returned in this response
+func CreateClientHandler(clientService clientSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.CreateClientRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Register the client
+		cl, secret, err := clientService.CreateClient(req.Name, req.RedirectURIs, req.Scopes, req.GrantTypes, req.Public, req.TLSSubject)
+		if err != nil {
+			if err == clientSvc.ErrInvalidRedirectURI || err == clientSvc.ErrInvalidGrantType || err == clientSvc.ErrInvalidTLSSubject {
+				c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, validHttp.ClientResponse{
+			ClientID:		cl.ClientID,
+			ClientSecret:	secret,
+			Name:				cl.Name,
+			RedirectURIs:	cl.RedirectURIList(),
+			Scopes:			cl.AllowedScopeList(),
+			GrantTypes:		cl.GrantTypeList(),
+			Public:			cl.Public,
+			TLSSubject:		cl.TLSSubject,
+		})
+	}
+}
+
+// UnlockUserHandler lifts the lockout of a user before it runs out
+func UnlockUserHandler(lockoutService lockoutSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidUserID})
+			return
+		}
+
+		// Read auth context, the admin is recorded in the event
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Unlock the user
+		if err := lockoutService.Unlock(uint(userID), authCtx.UserID); err != nil {
+			if err == lockoutSvc.ErrNotLocked || errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "User unlocked"})
+	}
+}
+
+// ImpersonateUserHandler issues an access token for the user held by the admin, for support purposes
+// The token carries the act claim naming the admin, cannot be refreshed and is refused by the sensitive routes.
+// Every attempt is recorded in the audit log.
+func ImpersonateUserHandler(userService userSvc.Svc, roleService roleSvc.Svc, tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidUserID})
+			return
+		}
+
+		// Read auth context, only admins signed in themselves can impersonate
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+		if authCtx.ClientID != "" || authCtx.APIKeyID != 0 {
+			auditImpersonation(c, authCtx.UserID, uint(userID), ErrFirstPartyOnly)
+			c.JSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrFirstPartyOnly})
+			return
+		}
+		if uint(userID) == authCtx.UserID {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrSelfImpersonation})
+			return
+		}
+
+		// Ensure the user exists
+		if _, err := userService.GetById(uint(userID)); err != nil {
+			auditImpersonation(c, authCtx.UserID, uint(userID), ErrUserNotFound)
+			c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: ErrUserNotFound})
+			return
+		}
+
+		// The admin must hold every permission of the user, or impersonation would grant more
+		_, adminScopes, err := roleService.GetUserAccess(authCtx.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		_, userScopes, err := roleService.GetUserAccess(uint(userID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		for _, scope := range userScopes {
+			if !contains(adminScopes, scope) {
+				auditImpersonation(c, authCtx.UserID, uint(userID), ErrImpersonationScope)
+				c.JSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrImpersonationScope})
+				return
+			}
+		}
+
+		// Record the impersonation before the token exists, no token is issued unrecorded
+		err = mwaudit.RecordRequired(c, &auditRepo.AuditEvent{
+			Type:			auditSvc.EventImpersonation,
+			Outcome:		auditSvc.OutcomeSuccess,
+			Method:		auditSvc.MethodAdmin,
+			ActorID:		authCtx.UserID,
+			UserID:		uint(userID),
+		})
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: ErrAuditFailed})
+			return
+		}
+
+		// Generate the token, bound to the certificate of the admin when enabled
+		binding := tokenSvc.Binding{CertThumbprint: mwmtls.BoundThumbprint(c)}
+		at, err := tokenService.GenerateDelegatedToken(uint(userID), "", "", nil, tokenSvc.Actor{UserID: authCtx.UserID}, binding, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Set the token header
+		c.Header(mwauth.HeaderAuthorization, mwauth.SchemeBearer+at.TokenString)
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Impersonation started"})
+	}
+}
+
+// auditImpersonation records an impersonation of the user by the admin, a reason makes it a failure
+func auditImpersonation(c *gin.Context, adminID uint, userID uint, reason string) {
+	outcome := auditSvc.OutcomeSuccess
+	if reason != "" {
+		outcome = auditSvc.OutcomeFailure
+	}
+
+	mwaudit.Record(c, &auditRepo.AuditEvent{
+		Type:			auditSvc.EventImpersonation,
+		Outcome:		outcome,
+		Reason:		reason,
+		Method:		auditSvc.MethodAdmin,
+		ActorID:		adminID,
+		UserID:		userID,
+	})
+}
+
+// GetLockoutEventsHandler lists the lockout events, newest first
+func GetLockoutEventsHandler(lockoutService lockoutSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the query parameters
+		var req validHttp.LockoutEventsRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Get the events
+		events, err := lockoutService.ListEvents(&lockoutRepo.EventFilter{
+			UserID:		req.UserID,
+			EventType:	req.EventType,
+			Before:		req.Before,
+			Limit:		req.Limit,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Build the response, the id of the last event pages to the older ones
+		res := validHttp.LockoutEventsResponse{Events: []validHttp.LockoutEventResponse{}}
+		for _, e := range events {
+			res.Events = append(res.Events, validHttp.LockoutEventResponse{
+				ID:				e.ID,
+				Key:				e.Key,
+				UserID:			e.UserID,
+				EventType:		e.EventType,
+				IP:				e.IP,
+				Failures:		e.Failures,
+				LockedUntil:	e.LockedUntil,
+				ActorID:			e.ActorID,
+				CreatedAt:		e.CreatedAt,
+			})
+		}
+		if len(events) > 0 {
+			res.NextBefore = events[len(events)-1].ID
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// GetAuditEventsHandler lists the audit events, newest first
+func GetAuditEventsHandler(auditService auditSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the query parameters
+		var req validHttp.AuditEventsRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Get the events
+		events, err := auditService.ListEvents(&auditRepo.EventFilter{
+			Type:			req.Type,
+			Outcome:		req.Outcome,
+			ActorID:		req.ActorID,
+			UserID:		req.UserID,
+			IP:			req.IP,
+			RequestID:	req.RequestID,
+			Since:		req.Since,
+			Until:		req.Until,
+			Before:		req.Before,
+			Limit:		req.Limit,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Build the response, the id of the last event pages to the older ones
+		res := validHttp.AuditEventsResponse{Events: []validHttp.AuditEventResponse{}}
+		for _, e := range events {
+			res.Events = append(res.Events, validHttp.AuditEventResponse{
+				ID:			e.ID,
+				CreatedAt:	e.CreatedAt,
+				Type:			e.Type,
+				Outcome:		e.Outcome,
+				Reason:		e.Reason,
+				Method:		e.Method,
+				ActorID:		e.ActorID,
+				UserID:		e.UserID,
+				ClientID:	e.ClientID,
+				IP:			e.IP,
+				UserAgent:	e.UserAgent,
+				RequestID:	e.RequestID,
+			})
+		}
+		if len(events) > 0 {
+			res.NextBefore = events[len(events)-1].ID
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// handleRoleError maps the role service errors to responses
+func handleRoleError(c *gin.Context, err error) {
+	switch err {
+	case roleSvc.ErrRoleNotFound, roleSvc.ErrUserNotFound:
+		c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+	}
+}
+
+// contains reports whether the value is in the list
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
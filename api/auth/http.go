@@ -1,15 +1,37 @@
 package authHttp
 
 import (
+	"errors"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/audit"
 	"github.com/selatoz/gateway/middleware/auth"
+	"github.com/selatoz/gateway/middleware/csrf"
+	"github.com/selatoz/gateway/middleware/mtls"
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/cookielib"
+	"github.com/selatoz/gateway/pkg/dpoplib"
+	"github.com/selatoz/gateway/pkg/passwordlib"
+	"github.com/selatoz/gateway/pkg/ratelib"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/apikey/svc"
+	"github.com/selatoz/gateway/internal/audit/svc"
+	"github.com/selatoz/gateway/internal/federation/svc"
+	"github.com/selatoz/gateway/internal/lockout/svc"
+	"github.com/selatoz/gateway/internal/magiclink/svc"
+	"github.com/selatoz/gateway/internal/mfa/svc"
 	"github.com/selatoz/gateway/internal/user/svc"
+	"github.com/selatoz/gateway/internal/token/repo"
 	"github.com/selatoz/gateway/internal/token/svc"
+	"github.com/selatoz/gateway/internal/verification/svc"
+	"github.com/selatoz/gateway/internal/webauthn/svc"
 )
 
 // Set constants
@@ -20,6 +42,19 @@ const (
 	ErrFailedToGenerateRefreshToken 	= "Failed to generate <r> token"
 	ErrFailedToGenerateAccessToken	= "Failed to generate <a> token"
 	ErrUserAlreadyExists					= "User already exists"
+	ErrAPIKeyLogout						= "API keys are revoked through /user/api-keys"
+	ErrTooManyRequests					= "Too many requests"
+	ErrServerBusy							= "Server busy, try again later"
+
+	// Headers
+	HeaderRetryAfter = "Retry-After"
+
+	// Second factors offered after the password
+	MFAMethodTOTP			= "totp"
+	MFAMethodWebAuthn		= "webauthn"
+
+	// Cookie binding a federated sign in to the browser that started it
+	CookieFederationBinding = "federation_binding"
 )
 
 type UsersResponse struct {
@@ -34,7 +69,7 @@ func GetUsersHandler(userService userSvc.Svc) gin.HandlerFunc {
 }
 
 // LoginHandler handles user login request
-func LoginHandler(userService userSvc.Svc, tokenService tokenSvc.Svc) gin.HandlerFunc {
+func LoginHandler(userService userSvc.Svc, tokenService tokenSvc.Svc, mfaService mfaSvc.Svc, webauthnService webauthnSvc.Svc, lockoutService lockoutSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Bind the request body to a LoginRequest struct
 		var req validHttp.LoginRequest
@@ -43,32 +78,452 @@ func LoginHandler(userService userSvc.Svc, tokenService tokenSvc.Svc) gin.Handle
 			return
 		}
 
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
 		// Get the user agent
 		userAgent := c.Request.UserAgent()
 
+		// Refuse locked or throttled accounts and addresses before checking the password
+		retryAfter, err := lockoutService.Check(req.Email, c.ClientIP())
+		if err != nil {
+			if err == lockoutSvc.ErrLocked || err == lockoutSvc.ErrThrottled {
+				audit(c, auditSvc.EventLogin, auditSvc.MethodPassword, 0, err.Error())
+				c.Header(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				c.JSON(http.StatusTooManyRequests, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
 		// Authenticate the user
 		u, err := userService.Login(req.Email, req.Password)
 		if err != nil {
+			if err == userSvc.ErrInvalidPassword {
+				var userID uint
+				if known, err := userService.GetByEmail(req.Email); err == nil {
+					userID = known.ID
+				}
+				if err := lockoutService.RecordFailure(req.Email, c.ClientIP(), userID); err != nil {
+					c.Error(err)
+				}
+				audit(c, auditSvc.EventLogin, auditSvc.MethodPassword, userID, err.Error())
+			}
+			if err == passwordlib.ErrBusy {
+				serverBusy(c)
+				return
+			}
 			c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: ErrInvalidCredentials})
 			return
 		}
+		if err := lockoutService.RecordSuccess(req.Email); err != nil {
+			c.Error(err)
+		}
+
+		// Handle second factor, the tokens are issued by the MFA verification
+		if challengeSecondFactor(c, u.ID, mfaService, webauthnService) {
+			return
+		}
 
 		// Generate the tokens
-		at, rt, err := tokenService.GenerateTokens(u.ID, userAgent)
+		at, rt, err := tokenService.GenerateTokens(u.ID, binding, userAgent, c.ClientIP())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
 			return
 		}
 
-		// Set the token headers
-		c.Header(mwauth.HeaderAuthorization, "Bearer "+at.TokenString)
-		c.Header(mwauth.HeaderRefreshAuthorization, rt.TokenString)
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
 
 		// Return the token in a LoginResponse struct
+		audit(c, auditSvc.EventLogin, auditSvc.MethodPassword, u.ID, "")
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
+	}
+}
+
+// challengeSecondFactor responds with an MFA challenge when the user enrolled a second factor
+// It reports whether a response was written, in which case no tokens must be issued
+func challengeSecondFactor(c *gin.Context, userID uint, mfaService mfaSvc.Svc, webauthnService webauthnSvc.Svc) bool {
+	methods := []string{}
+	enabled, err := mfaService.Enabled(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return true
+	}
+	if enabled {
+		methods = append(methods, MFAMethodTOTP)
+	}
+	hasPasskeys, err := webauthnService.HasCredentials(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return true
+	}
+	if hasPasskeys {
+		methods = append(methods, MFAMethodWebAuthn)
+	}
+	if len(methods) == 0 {
+		return false
+	}
+
+	token, expiresAt, err := mfaService.CreateChallenge(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return true
+	}
+
+	audit(c, auditSvc.EventMFAChallenge, "", userID, "")
+	c.JSON(http.StatusOK, validHttp.MFAChallengeResponse{MFARequired: true, MFAToken: token, Methods: methods, ExpiresAt: expiresAt})
+	return true
+}
+
+// MagicLinkHandler sends a sign in link or code to the email
+// The response is the same whether the account exists or not
+func MagicLinkHandler(magicLinkService magicLinkSvc.Svc, ipLimiter ratelib.Limiter, emailLimiter ratelib.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.MagicLinkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if req.Method == "" {
+			req.Method = magicLinkSvc.MethodLink
+		}
+
+		// Limit the requests of the client and the deliveries to one address
+		if !allow(c, ipLimiter, c.ClientIP()) || !allow(c, emailLimiter, strings.ToLower(req.Email)) {
+			return
+		}
+
+		// Start the login
+		requestID, expiresAt, err := magicLinkService.Request(req.Email, req.Method, c.Request.UserAgent())
+		if err != nil {
+			if err == magicLinkSvc.ErrInvalidMethod {
+				c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, validHttp.MagicLinkResponse{RequestID: requestID, ExpiresAt: expiresAt})
+	}
+}
+
+// MagicLinkVerifyHandler completes a login with the link and issues the tokens
+func MagicLinkVerifyHandler(magicLinkService magicLinkSvc.Svc, tokenService tokenSvc.Svc, mfaService mfaSvc.Svc, webauthnService webauthnSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the query parameters
+		var req validHttp.MagicLinkVerifyRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
+		// Verify the link
+		userID, err := magicLinkService.VerifyLink(req.Token, c.Request.UserAgent())
+		if err != nil {
+			audit(c, auditSvc.EventLogin, auditSvc.MethodMagicLink, 0, err.Error())
+			handleMagicLinkError(c, err)
+			return
+		}
+
+		// Handle second factor, the tokens are issued by the MFA verification
+		if challengeSecondFactor(c, userID, mfaService, webauthnService) {
+			return
+		}
+
+		// Generate the tokens
+		at, rt, err := tokenService.GenerateTokens(userID, binding, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
+
+		audit(c, auditSvc.EventLogin, auditSvc.MethodMagicLink, userID, "")
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
+	}
+}
+
+// MagicCodeVerifyHandler completes a login with the code and issues the tokens
+func MagicCodeVerifyHandler(magicLinkService magicLinkSvc.Svc, tokenService tokenSvc.Svc, mfaService mfaSvc.Svc, webauthnService webauthnSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.MagicCodeVerifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
+		// Verify the code
+		userID, err := magicLinkService.VerifyCode(req.RequestID, req.Code, c.Request.UserAgent())
+		if err != nil {
+			audit(c, auditSvc.EventLogin, auditSvc.MethodMagicLink, 0, err.Error())
+			handleMagicLinkError(c, err)
+			return
+		}
+
+		// Handle second factor, the tokens are issued by the MFA verification
+		if challengeSecondFactor(c, userID, mfaService, webauthnService) {
+			return
+		}
+
+		// Generate the tokens
+		at, rt, err := tokenService.GenerateTokens(userID, binding, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
+
+		audit(c, auditSvc.EventLogin, auditSvc.MethodMagicLink, userID, "")
 		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
 	}
 }
 
+// handleMagicLinkError maps the passwordless login errors to responses
+func handleMagicLinkError(c *gin.Context, err error) {
+	switch err {
+	case magicLinkSvc.ErrLoginInvalid, magicLinkSvc.ErrCodeInvalid:
+		c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+	}
+}
+
+// MFAVerifyHandler completes a login with the second factor and issues the tokens
+func MFAVerifyHandler(mfaService mfaSvc.Svc, tokenService tokenSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.MFAVerifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
+		// Verify the code
+		userID, err := mfaService.VerifyChallenge(req.MFAToken, req.Code)
+		if err != nil {
+			audit(c, auditSvc.EventLogin, auditSvc.MethodTOTP, 0, err.Error())
+			switch err {
+			case mfaSvc.ErrChallengeInvalid, mfaSvc.ErrCodeInvalid, mfaSvc.ErrMFANotEnabled:
+				c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			}
+			return
+		}
+
+		// Generate the tokens
+		at, rt, err := tokenService.GenerateTokens(userID, binding, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
+
+		audit(c, auditSvc.EventLogin, auditSvc.MethodTOTP, userID, "")
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
+	}
+}
+
+// MFAWebAuthnBeginHandler returns the options to complete a login with a passkey as second factor
+func MFAWebAuthnBeginHandler(mfaService mfaSvc.Svc, webauthnService webauthnSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.WebAuthnMFABeginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Read the user of the pending login
+		userID, err := mfaService.GetChallengeUser(req.MFAToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Start the ceremony
+		token, options, err := webauthnService.BeginSecondFactor(userID)
+		if err != nil {
+			if err == webauthnSvc.ErrNoCredentials {
+				c.JSON(http.StatusConflict, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.WebAuthnLoginOptionsResponse{Token: token, PublicKey: options})
+	}
+}
+
+// MFAWebAuthnFinishHandler completes a login with a passkey as second factor and issues the tokens
+func MFAWebAuthnFinishHandler(mfaService mfaSvc.Svc, webauthnService webauthnSvc.Svc, tokenService tokenSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.WebAuthnMFAAssertionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
+		// Read the user of the pending login
+		userID, err := mfaService.GetChallengeUser(req.MFAToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Verify the assertion, then complete the pending login
+		if err := webauthnService.FinishSecondFactor(userID, req.Token, assertion(&req.WebAuthnAssertionRequest)); err != nil {
+			audit(c, auditSvc.EventLogin, auditSvc.MethodWebAuthn, userID, err.Error())
+			handleWebAuthnError(c, err)
+			return
+		}
+		if _, err := mfaService.CompleteChallenge(req.MFAToken); err != nil {
+			c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Generate the tokens
+		at, rt, err := tokenService.GenerateTokens(userID, binding, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
+
+		audit(c, auditSvc.EventLogin, auditSvc.MethodWebAuthn, userID, "")
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
+	}
+}
+
+// WebAuthnLoginBeginHandler returns the options to log in with a passkey instead of a password
+func WebAuthnLoginBeginHandler(webauthnService webauthnSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Start the ceremony
+		token, options, err := webauthnService.BeginLogin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.WebAuthnLoginOptionsResponse{Token: token, PublicKey: options})
+	}
+}
+
+// WebAuthnLoginFinishHandler completes a login with a passkey and issues the tokens
+// The authenticator verified the user, so no second factor is asked
+func WebAuthnLoginFinishHandler(webauthnService webauthnSvc.Svc, tokenService tokenSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.WebAuthnAssertionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
+		// Verify the assertion
+		userID, err := webauthnService.FinishLogin(req.Token, assertion(&req))
+		if err != nil {
+			audit(c, auditSvc.EventLogin, auditSvc.MethodWebAuthn, 0, err.Error())
+			handleWebAuthnError(c, err)
+			return
+		}
+
+		// Generate the tokens
+		at, rt, err := tokenService.GenerateTokens(userID, binding, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
+
+		audit(c, auditSvc.EventLogin, auditSvc.MethodWebAuthn, userID, "")
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
+	}
+}
+
+// assertion maps the request to the assertion verified by the WebAuthn service
+func assertion(req *validHttp.WebAuthnAssertionRequest) *webauthnSvc.Assertion {
+	return &webauthnSvc.Assertion{
+		CredentialID:			req.CredentialID,
+		ClientDataJSON:		req.ClientDataJSON,
+		AuthenticatorData:	req.AuthenticatorData,
+		Signature:				req.Signature,
+		UserHandle:				req.UserHandle,
+	}
+}
+
+// handleWebAuthnError maps the WebAuthn service errors of a login to responses
+func handleWebAuthnError(c *gin.Context, err error) {
+	switch err {
+	case webauthnSvc.ErrChallengeInvalid, webauthnSvc.ErrCredentialInvalid, webauthnSvc.ErrCredentialCloned:
+		c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+	}
+}
+
 // LogoutHandler handles user logout request
 func LogoutHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -86,19 +541,33 @@ func LogoutHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
 			return
 		}
 
+		// API keys are revoked through their own endpoint
+		if authCtx.APIKeyID != 0 {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrAPIKeyLogout})
+			return
+		}
+
 		err := tokenService.DeleteAccessToken(authCtx.AccessToken, true)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
 			return
 		}
 
+		// Clear the session cookies of browsers
+		if cookielib.TokensInCookies() {
+			cookielib.Clear(c, cookielib.CookieAccessToken, cookielib.PathSession, true)
+			cookielib.Clear(c, cookielib.CookieRefreshToken, cookielib.PathRefresh, true)
+			cookielib.Clear(c, cookielib.CookieCSRF, cookielib.PathSession, false)
+		}
+
 		// Handle success
+		audit(c, auditSvc.EventLogout, "", authCtx.UserID, "")
 		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
 	}
 }
 
 // RegisterHandler handles user registration request
-func RegisterHandler(userService userSvc.Svc, tokenService tokenSvc.Svc) gin.HandlerFunc {
+func RegisterHandler(userService userSvc.Svc, tokenService tokenSvc.Svc, verificationService verificationSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Bind the request body to a RegisterRequest struct
 		var req validHttp.RegisterRequest
@@ -107,36 +576,324 @@ func RegisterHandler(userService userSvc.Svc, tokenService tokenSvc.Svc) gin.Han
 			return
 		}
 
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
 		// Get the user agent
 		userAgent := c.Request.UserAgent()
 
 		// Check if user with the same email exists
 		if _, err := userService.GetByEmail(req.Email); err == nil {
-			c.JSON(http.StatusConflict, validHttp.ErrorResponse{Error: err.Error()})
+			audit(c, auditSvc.EventRegister, "", 0, ErrUserAlreadyExists)
+			c.JSON(http.StatusConflict, validHttp.ErrorResponse{Error: ErrUserAlreadyExists})
 			return
 		}
 
 		// Register the user
 		u, err := userService.Register(req.Email, req.Password)
+		if err != nil {
+			audit(c, auditSvc.EventRegister, "", 0, err.Error())
+			handlePasswordError(c, err)
+			return
+		}
+
+		audit(c, auditSvc.EventRegister, "", u.ID, "")
+
+		// Mail the verification link, the user can ask for a new one if it fails
+		if err := verificationService.SendEmailVerification(u.ID); err != nil {
+			c.Error(err)
+		}
 
 		// Generate the tokens
-		at, rt, err := tokenService.GenerateTokens(u.ID, userAgent)
+		at, rt, err := tokenService.GenerateTokens(u.ID, binding, userAgent, c.ClientIP())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
 			return
 		}
 
-		// Set the token headers
-		c.Header(mwauth.HeaderAuthorization, "Bearer "+at.TokenString)
-		c.Header(mwauth.HeaderRefreshAuthorization, rt.TokenString)
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
 
 		// Return the token in a RegisterResponse struct
 		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Register success"})
 	}
 }
 
+// VerifyEmailHandler handles the verification link mailed to the user
+func VerifyEmailHandler(verificationService verificationSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the query parameters
+		var req validHttp.VerifyEmailRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Verify the email
+		if _, err := verificationService.VerifyEmail(req.Token); err != nil {
+			if err == verificationSvc.ErrTokenInvalid {
+				c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Email verified"})
+	}
+}
+
+// ResendVerificationHandler mails a new verification link to the user
+func ResendVerificationHandler(verificationService verificationSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Send the link
+		if err := verificationService.SendEmailVerification(authCtx.UserID); err != nil {
+			if err == verificationSvc.ErrEmailAlreadyVerified {
+				c.JSON(http.StatusConflict, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Verification email sent"})
+	}
+}
+
+// PasswordForgotHandler mails a password reset link
+// The response is the same whether the account exists or not
+func PasswordForgotHandler(verificationService verificationSvc.Svc, ipLimiter ratelib.Limiter, emailLimiter ratelib.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.PasswordForgotRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Limit the requests of the client
+		if !allow(c, ipLimiter, c.ClientIP()) {
+			return
+		}
+
+		// Limit the mails sent to one address without telling the client
+		// The same normalized address is limited and looked up, so its case cannot dodge the limit
+		email := strings.ToLower(strings.TrimSpace(req.Email))
+		res, err := emailLimiter.Allow(email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Send in the background, so the response time does not reveal whether the account exists
+		if res.Allowed {
+			go func() {
+				if err := verificationService.SendPasswordReset(email); err != nil {
+					log.Printf("password reset mail failed: %s", err)
+				}
+			}()
+		}
+
+		c.JSON(http.StatusAccepted, validHttp.SuccessResponse{Message: "If the account exists, a reset link was sent"})
+	}
+}
+
+// PasswordResetHandler sets a new password with a reset link and signs the user out everywhere
+// The API keys and the provider identities are removed too, as whoever took the account over may hold them
+func PasswordResetHandler(verificationService verificationSvc.Svc, userService userSvc.Svc, tokenService tokenSvc.Svc, apiKeyService apiKeySvc.Svc, federationService federationSvc.Svc, ipLimiter ratelib.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.PasswordResetRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Limit the requests of the client
+		if !allow(c, ipLimiter, c.ClientIP()) {
+			return
+		}
+
+		// Check the new password before the link is spent, so a refused one can be corrected
+		userID, err := verificationService.CheckPasswordReset(req.Token)
+		if err != nil {
+			handleResetError(c, err)
+			return
+		}
+		if err := userService.ValidatePassword(userID, req.Password); err != nil {
+			handlePasswordError(c, err)
+			return
+		}
+
+		// Use the link
+		userID, err = verificationService.ConsumePasswordReset(req.Token)
+		if err != nil {
+			handleResetError(c, err)
+			return
+		}
+
+		// Revoke the existing credentials, then set the password
+		if err := tokenService.RevokeAllSessions(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := apiKeyService.RevokeAllKeys(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := federationService.UnlinkAll(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if err := userService.SetPassword(userID, req.Password); err != nil {
+			handlePasswordError(c, err)
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Password reset"})
+	}
+}
+
+// audit records an authentication event of the request, a reason makes it a failure
+func audit(c *gin.Context, eventType string, method string, userID uint, reason string) {
+	outcome := auditSvc.OutcomeSuccess
+	if reason != "" {
+		outcome = auditSvc.OutcomeFailure
+	}
+
+	// The actor is the impersonator of a delegated session
+	actorID := userID
+	if v, ok := c.Get("auth"); ok {
+		if authCtx, ok := v.(*mwauth.AuthContext); ok && authCtx.ActorID != 0 {
+			actorID = authCtx.ActorID
+		}
+	}
+
+	mwaudit.Record(c, &auditRepo.AuditEvent{
+		Type:			eventType,
+		Outcome:		outcome,
+		Reason:		reason,
+		Method:		method,
+		ActorID:		actorID,
+		UserID:		userID,
+	})
+}
+
+// handleResetError maps the errors of a password reset link to responses
+func handleResetError(c *gin.Context, err error) {
+	if err == verificationSvc.ErrTokenInvalid {
+		c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+}
+
+// handlePasswordError responds with the rules a new password breaks, or with the error
+func handlePasswordError(c *gin.Context, err error) {
+	var policyErr *passwordlib.PolicyError
+	if errors.As(err, &policyErr) {
+		res := validHttp.ValidationErrorResponse{Error: policyErr.Error(), Fields: []validHttp.FieldError{}}
+		for _, v := range policyErr.Violations {
+			res.Fields = append(res.Fields, validHttp.FieldError{Field: "password", Code: v.Code, Message: v.Message})
+		}
+		c.JSON(http.StatusUnprocessableEntity, res)
+		return
+	}
+	if err == passwordlib.ErrBusy {
+		serverBusy(c)
+		return
+	}
+	c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+}
+
+// serverBusy answers a request refused because every password hashing slot is taken
+func serverBusy(c *gin.Context) {
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, validHttp.ErrorResponse{Error: ErrServerBusy})
+}
+
+// tokenBinding returns the client certificate and DPoP key the issued tokens are bound to, refusing an invalid DPoP proof
+func tokenBinding(c *gin.Context, dpopVerifier *dpoplib.Verifier) (tokenSvc.Binding, bool) {
+	binding := tokenSvc.Binding{CertThumbprint: mwmtls.BoundThumbprint(c)}
+
+	proof, err := mwauth.VerifyDPoP(c, dpopVerifier, "")
+	if err != nil {
+		if !dpoplib.Refused(err) {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return binding, false
+		}
+		c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+		return binding, false
+	}
+	if proof != nil {
+		binding.JKT = proof.JKT
+	}
+
+	return binding, true
+}
+
+// tokenScheme returns the scheme an access token is sent with, DPoP when it is bound to a DPoP key
+func tokenScheme(binding tokenSvc.Binding) string {
+	if binding.JKT != "" {
+		return mwauth.SchemeDPoP
+	}
+
+	return mwauth.SchemeBearer
+}
+
+// sendTokens hands the tokens to the client, in the response headers or in the session cookies of browsers
+// Tokens bound to a DPoP key are always sent in the headers, cookies come with a new CSRF token
+func sendTokens(c *gin.Context, at *tokenRepo.AccessToken, rt *tokenRepo.RefreshToken, binding tokenSvc.Binding) bool {
+	if !cookielib.TokensInCookies() || binding.JKT != "" {
+		c.Header(mwauth.HeaderAuthorization, tokenScheme(binding)+at.TokenString)
+		c.Header(mwauth.HeaderRefreshAuthorization, rt.TokenString)
+		return true
+	}
+
+	// Set the session cookies, the refresh token is only sent to the refresh endpoint
+	cookielib.Set(c, cookielib.CookieAccessToken, at.TokenString, at.ExpiresAt, cookielib.PathSession, true)
+	cookielib.Set(c, cookielib.CookieRefreshToken, rt.TokenString, rt.ExpiresAt, cookielib.PathRefresh, true)
+	if err := mwcsrf.Issue(c, rt.ExpiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// allow counts the request against the limiter, responding with 429 when the key is over its limit
+func allow(c *gin.Context, limiter ratelib.Limiter, key string) bool {
+	res, err := limiter.Allow(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return false
+	}
+	if !res.Allowed {
+		c.Header(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, validHttp.ErrorResponse{Error: ErrTooManyRequests})
+		return false
+	}
+
+	return true
+}
+
 // RefreshTokenHandler handles access token refreshing
-func RefreshAccessHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
+func RefreshAccessHandler(tokenService tokenSvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Bind the request body to a RegisterRequest struct
 		var req validHttp.RefreshAccessRequest
@@ -145,38 +902,130 @@ func RefreshAccessHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
 			return
 		}
 
+		// Verify the DPoP proof, the tokens are then bound to its key and to the client certificate
+		binding, ok := tokenBinding(c, dpopVerifier)
+		if !ok {
+			return
+		}
+
 		// Get the user agent
 		userAgent := c.Request.UserAgent()
 
-		// Get the token from the header
+		// Get the token from the header, or from the refresh cookie of browsers
 		currRt := c.GetHeader("Authorization")
-		currRt = strings.TrimPrefix(currRt, "Bearer ")
+		currRt = strings.TrimPrefix(strings.TrimPrefix(currRt, mwauth.SchemeBearer), mwauth.SchemeDPoP)
+		if currRt == "" && cookielib.TokensInCookies() {
+			currRt, _ = c.Cookie(cookielib.CookieRefreshToken)
+		}
+
+		// Rotate the refresh token and issue new tokens
+		at, rt, err := tokenService.RotateRefreshToken(currRt, "", binding, userAgent, c.ClientIP())
+		if err != nil {
+			audit(c, auditSvc.EventTokenRefresh, "", 0, err.Error())
+			switch err.Error() {
+			case tokenSvc.ErrTokenReused, tokenSvc.ErrTokenInvalid, tokenSvc.ErrTokenExpired, tokenSvc.ErrTokenBindingInvalid:
+				c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			}
+			return
+		}
+
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, binding) {
+			return
+		}
+
+		// Handle success
+		audit(c, auditSvc.EventTokenRefresh, "", rt.UserID, "")
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Refresh success"})
+	}
+}
+// FederatedLoginHandler redirects the user to sign in at an upstream provider
+func FederatedLoginHandler(federationService federationSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Start the sign in
+		provider := c.Param("provider")
+		authURL, binding, err := federationService.Begin(provider)
+		if err != nil {
+			if err == federationSvc.ErrProviderNotFound {
+				c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusBadGateway, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
 
-		// Validate the refresh token
-		userID, _, err := tokenService.ValidateToken(currRt, false)
+		// Bind the sign in to this browser until the callback
+		secure := strings.HasPrefix(cfglib.DefaultConf.AppIssuer, "https://")
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(CookieFederationBinding, binding, int(federationSvc.StateLifetime.Seconds()), "/auth/federated/"+provider, "", secure, true)
+
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// FederatedCallbackHandler completes the sign in at an upstream provider and issues our tokens
+func FederatedCallbackHandler(federationService federationSvc.Svc, tokenService tokenSvc.Svc, mfaService mfaSvc.Svc, webauthnService webauthnSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the query parameters
+		var req validHttp.FederatedCallbackRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle refusal at the provider
+		if req.Error != "" {
+			audit(c, auditSvc.EventLogin, auditSvc.MethodFederated, 0, req.Error)
+			c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: req.Error})
+			return
+		}
+
+		// Read and clear the browser binding
+		provider := c.Param("provider")
+		binding, err := c.Cookie(CookieFederationBinding)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: federationSvc.ErrStateInvalid.Error()})
+			return
+		}
+		c.SetCookie(CookieFederationBinding, "", -1, "/auth/federated/"+provider, "", strings.HasPrefix(cfglib.DefaultConf.AppIssuer, "https://"), true)
+
+		// Complete the sign in
+		u, err := federationService.Complete(provider, req.State, binding, req.Code)
 		if err != nil {
-			 c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
-			 return
+			audit(c, auditSvc.EventLogin, auditSvc.MethodFederated, 0, err.Error())
+			switch err {
+			case federationSvc.ErrProviderNotFound:
+				c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: err.Error()})
+			case federationSvc.ErrStateInvalid:
+				c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			case federationSvc.ErrLoginFailed, federationSvc.ErrEmailRequired, federationSvc.ErrEmailUnverified, federationSvc.ErrEmailNotVerified:
+				c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			}
+			return
 		}
 
-		// Delete the old tokens
-		if err := tokenService.DeleteRefreshToken(currRt); err != nil {
-			 c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
-			 return
+		// Require the second factor before issuing tokens, the provider only proves the first
+		if challengeSecondFactor(c, u.ID, mfaService, webauthnService) {
+			return
 		}
 
-		// Issue new tokens
-		at, rt, err := tokenService.GenerateTokens(userID, userAgent)
+		// Generate the tokens
+		at, rt, err := tokenService.GenerateTokens(u.ID, tokenSvc.Binding{}, c.Request.UserAgent(), c.ClientIP())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
 			return
 		}
 
-		// Add the new tokens to the response header
-		c.Header(mwauth.HeaderAuthorization, "Bearer " + at.TokenString)
-		c.Header(mwauth.HeaderRefreshAuthorization, rt.TokenString)
+		// Hand the tokens to the client
+		if !sendTokens(c, at, rt, tokenSvc.Binding{}) {
+			return
+		}
 
-		// Handle success
-		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Refresh success"})
+		audit(c, auditSvc.EventLogin, auditSvc.MethodFederated, u.ID, "")
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Login success"})
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,384 @@
+package oauthHttp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/audit"
+	"github.com/selatoz/gateway/middleware/auth"
+	"github.com/selatoz/gateway/middleware/client"
+	"github.com/selatoz/gateway/middleware/mtls"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/audit/svc"
+	"github.com/selatoz/gateway/internal/oauth/svc"
+	"github.com/selatoz/gateway/internal/token/repo"
+	"github.com/selatoz/gateway/internal/token/svc"
+	"github.com/selatoz/gateway/internal/user/svc"
+)
+
+// Set constants
+const (
+	// Errors (RFC 6749)
+	ErrInvalidRequest = "invalid_request"
+
+	// Errors
+	ErrMissingContext = "Missing context"
+	ErrAuditFailed = "Failed to record the token exchange"
+)
+
+// AuthorizeHandler validates an authorization request and returns the consent to show to the user
+func AuthorizeHandler(oauthService oauthSvc.Svc, tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context, only first party sessions reach consent
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the query parameters
+		var req validHttp.AuthorizeRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.OAuthErrorResponse{Error: ErrInvalidRequest, ErrorDescription: err.Error()})
+			return
+		}
+
+		// Validate the request, the session start is when the user authenticated
+		ar := authorizationRequest(req)
+		authTime, err := tokenService.SessionStartedAt(authCtx.SessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		ar.AuthTime = authTime
+		consent, err := oauthService.Authorize(ar)
+		if err != nil {
+			handleAuthorizeError(c, ar, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.ConsentResponse{
+			ClientID:		consent.Client.ClientID,
+			ClientName:		consent.Client.Name,
+			RedirectURI:	consent.RedirectURI,
+			Scopes:			consent.Scopes,
+		})
+	}
+}
+
+// ConsentHandler records the decision of the user and returns where to redirect them
+func ConsentHandler(oauthService oauthSvc.Svc, tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context, only first party sessions reach consent
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.ConsentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.OAuthErrorResponse{Error: ErrInvalidRequest, ErrorDescription: err.Error()})
+			return
+		}
+
+		// Issue the code or report the refusal
+		ar := authorizationRequest(req.AuthorizeRequest)
+		var redirectTo string
+		var err error
+		ar.AuthTime, err = tokenService.SessionStartedAt(authCtx.SessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		if req.Approved {
+			redirectTo, err = oauthService.Approve(ar, authCtx.UserID)
+		} else {
+			redirectTo, err = oauthService.Deny(ar)
+		}
+		if err != nil {
+			handleAuthorizeError(c, ar, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.AuthorizeResponse{RedirectTo: redirectTo})
+	}
+}
+
+// TokenHandler issues tokens for the authorization_code, refresh_token, client_credentials and token exchange grants
+// Every token exchange is recorded in the audit log as an impersonation, the token is not issued unrecorded
+func TokenHandler(oauthService oauthSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read client context
+		clientCtx := c.MustGet("client").(*mwclient.ClientContext)
+		if clientCtx == nil {
+			c.JSON(http.StatusUnauthorized, validHttp.OAuthErrorResponse{Error: oauthSvc.ErrInvalidClient})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.TokenRequest
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.OAuthErrorResponse{Error: ErrInvalidRequest, ErrorDescription: err.Error()})
+			return
+		}
+
+		// Handle the grant, tokens are bound to the client certificate when enabled
+		userAgent := c.Request.UserAgent()
+		binding := tokenSvc.Binding{CertThumbprint: mwmtls.BoundThumbprint(c)}
+		var tokens *oauthSvc.Tokens
+		var cat *tokenRepo.ClientAccessToken
+		var dat *tokenRepo.AccessToken
+		var err error
+		switch req.GrantType {
+		case oauthSvc.GrantTypeAuthorizationCode:
+			tokens, err = oauthService.ExchangeCode(clientCtx.ClientID, req.Code, req.RedirectURI, req.CodeVerifier, binding, userAgent, c.ClientIP())
+		case oauthSvc.GrantTypeRefreshToken:
+			tokens, err = oauthService.Refresh(clientCtx.ClientID, req.RefreshToken, binding, userAgent, c.ClientIP())
+		case oauthSvc.GrantTypeClientCredentials:
+			cat, err = oauthService.ClientCredentials(clientCtx.ClientID, req.Scope, binding)
+		case oauthSvc.GrantTypeTokenExchange:
+			var ex *oauthSvc.TokenExchange
+			ex, err = oauthService.ExchangeToken(clientCtx.ClientID, tokenExchangeRequest(req), binding)
+			if err != nil {
+				mwaudit.Record(c, exchangeEvent(clientCtx.ClientID, nil, err.Error()))
+				break
+			}
+			if err := mwaudit.RecordRequired(c, exchangeEvent(clientCtx.ClientID, ex, "")); err != nil {
+				c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: ErrAuditFailed})
+				return
+			}
+			dat, err = oauthService.IssueExchangedToken(ex, binding, userAgent, c.ClientIP())
+		default:
+			err = &oauthSvc.Error{Code: oauthSvc.ErrUnsupportedGrantType}
+		}
+		if err != nil {
+			if e, ok := err.(*oauthSvc.Error); ok {
+				c.JSON(http.StatusBadRequest, validHttp.OAuthErrorResponse{Error: e.Code, ErrorDescription: e.Description})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Tokens must not be cached
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+		if cat != nil {
+			c.JSON(http.StatusOK, tokenResponse(cat.TokenString, cat.ExpiresAt, cat.Scope, nil))
+			return
+		}
+		if dat != nil {
+			res := tokenResponse(dat.TokenString, dat.ExpiresAt, dat.Scope, nil)
+			res.IssuedTokenType = oauthSvc.TokenTypeAccessToken
+			c.JSON(http.StatusOK, res)
+			return
+		}
+		res := tokenResponse(tokens.AccessToken.TokenString, tokens.AccessToken.ExpiresAt, tokens.AccessToken.Scope, tokens.RefreshToken)
+		res.IDToken = tokens.IDToken
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// tokenResponse builds the token endpoint response
+func tokenResponse(accessToken string, expiresAt time.Time, scope string, rt *tokenRepo.RefreshToken) validHttp.TokenResponse {
+	res := validHttp.TokenResponse{
+		AccessToken:	accessToken,
+		TokenType:		"Bearer",
+		ExpiresIn:		int64(time.Until(expiresAt).Seconds()),
+		Scope:			scope,
+	}
+	if rt != nil {
+		res.RefreshToken = rt.TokenString
+	}
+
+	return res
+}
+
+// tokenExchangeRequest converts the bound parameters to a service request
+func tokenExchangeRequest(req validHttp.TokenRequest) oauthSvc.TokenExchangeRequest {
+	return oauthSvc.TokenExchangeRequest{
+		SubjectToken:			req.SubjectToken,
+		SubjectTokenType:		req.SubjectTokenType,
+		ActorToken:				req.ActorToken,
+		ActorTokenType:		req.ActorTokenType,
+		RequestedTokenType:	req.RequestedTokenType,
+		Audience:				req.Audience,
+		Scope:					req.Scope,
+	}
+}
+
+// exchangeEvent returns the audit event of a token exchange, an impersonation of the user of the subject token
+// The actor is the user of the actor token, none when the client acts on its own
+func exchangeEvent(clientID string, ex *oauthSvc.TokenExchange, reason string) *auditRepo.AuditEvent {
+	e := &auditRepo.AuditEvent{
+		Type:			auditSvc.EventImpersonation,
+		Outcome:		auditSvc.OutcomeSuccess,
+		Reason:		reason,
+		Method:		auditSvc.MethodTokenExchange,
+		ClientID:	clientID,
+	}
+	if reason != "" {
+		e.Outcome = auditSvc.OutcomeFailure
+	}
+	if ex != nil {
+		e.UserID = ex.UserID
+		e.ActorID = ex.Actor.UserID
+	}
+
+	return e
+}
+
+// authorizationRequest converts the bound parameters to a service request
+func authorizationRequest(req validHttp.AuthorizeRequest) oauthSvc.AuthorizationRequest {
+	return oauthSvc.AuthorizationRequest{
+		ResponseType:			req.ResponseType,
+		ClientID:				req.ClientID,
+		RedirectURI:			req.RedirectURI,
+		Scope:					req.Scope,
+		State:					req.State,
+		CodeChallenge:			req.CodeChallenge,
+		CodeChallengeMethod:	req.CodeChallengeMethod,
+		Nonce:					req.Nonce,
+		MaxAge:					req.MaxAge,
+	}
+}
+
+// handleAuthorizeError reports an authorization error, with the redirect to the client when allowed
+func handleAuthorizeError(c *gin.Context, req oauthSvc.AuthorizationRequest, err error) {
+	e, ok := err.(*oauthSvc.Error)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	res := validHttp.OAuthErrorResponse{Error: e.Code, ErrorDescription: e.Description}
+	if e.RedirectURI != "" {
+		res.RedirectTo = oauthSvc.ErrorRedirect(req, e)
+	}
+	c.JSON(http.StatusBadRequest, res)
+}
+
+// IntrospectHandler reports whether a token is active (RFC 7662)
+func IntrospectHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.IntrospectRequest
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidRequest})
+			return
+		}
+
+		// Introspect the token
+		in, err := tokenService.Introspect(req.Token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle inactive token, no other information is disclosed
+		if !in.Active {
+			c.JSON(http.StatusOK, validHttp.IntrospectResponse{Active: false})
+			return
+		}
+
+		// The subject of a client held token is the client itself
+		sub := in.ClientID
+		if in.Principal == tokenSvc.PrincipalUser {
+			sub = strconv.FormatUint(uint64(in.UserID), 10)
+		}
+
+		// Report the DPoP key or the certificate the token is bound to
+		var cnf *validHttp.Confirmation
+		if in.JKT != "" || in.CertThumbprint != "" {
+			cnf = &validHttp.Confirmation{JKT: in.JKT, X5T: in.CertThumbprint}
+		}
+
+		// Report who acts on behalf of the user of a delegated token
+		var act *validHttp.ActorClaim
+		if in.Actor != nil {
+			act = &validHttp.ActorClaim{ClientID: in.Actor.ClientID}
+			if in.Actor.UserID != 0 {
+				act.Sub = strconv.FormatUint(uint64(in.Actor.UserID), 10)
+			}
+		}
+
+		c.JSON(http.StatusOK, validHttp.IntrospectResponse{
+			Active:		true,
+			Sub:			sub,
+			Exp:			in.ExpiresAt.Unix(),
+			Iat:			in.IssuedAt.Unix(),
+			Scope:		strings.Join(in.Scopes, " "),
+			ClientID:	in.ClientID,
+			TokenType:	in.TokenType,
+			Cnf:			cnf,
+			Act:			act,
+			Aud:			in.Audience,
+		})
+	}
+}
+
+// RevokeHandler revokes an access or a refresh token (RFC 7009)
+func RevokeHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Bind the request body
+		var req validHttp.RevokeRequest
+		if err := c.ShouldBind(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidRequest})
+			return
+		}
+
+		// Read client context
+		clientCtx := c.MustGet("client").(*mwclient.ClientContext)
+		if clientCtx == nil {
+			c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: oauthSvc.ErrInvalidClient})
+			return
+		}
+
+		// Revoke the token, unknown tokens are not an error
+		if err := tokenService.RevokeToken(req.Token, req.TokenTypeHint, clientCtx.ClientID); err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.Status(http.StatusOK)
+	}
+}
+
+// UserInfoHandler returns the claims about the user allowed by the scopes of the access token (OpenID Connect)
+func UserInfoHandler(userService userSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Get the user
+		user, err := userService.GetById(authCtx.UserID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: tokenSvc.ErrTokenUserInvalid})
+			return
+		}
+
+		// Add the claims of each granted scope
+		res := validHttp.UserInfoResponse{Sub: strconv.FormatUint(uint64(user.ID), 10)}
+		if authCtx.HasScopes(tokenSvc.ScopeEmail) {
+			verified := user.EmailVerifiedAt != nil
+			res.Email = user.Email
+			res.EmailVerified = &verified
+		}
+		if authCtx.HasScopes(tokenSvc.ScopeProfile) {
+			res.UpdatedAt = user.UpdatedAt.Unix()
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
@@ -0,0 +1,572 @@
+package userHttp
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/auth"
+	"github.com/selatoz/gateway/internal/apikey/repo"
+	"github.com/selatoz/gateway/internal/apikey/svc"
+	"github.com/selatoz/gateway/internal/federation/svc"
+	"github.com/selatoz/gateway/internal/mfa/svc"
+	"github.com/selatoz/gateway/internal/token/svc"
+	"github.com/selatoz/gateway/internal/webauthn/svc"
+)
+
+// Set constants
+const (
+	// Errors
+	ErrMissingContext		= "Missing context"
+	ErrCurrentSession		= "Use logout to end the current session"
+	ErrInvalidAPIKeyID	= "Invalid api key id"
+	ErrInvalidCredentialID	= "Invalid credential id"
+	ErrRecentSignInRequired	= "Sign in again to add a passkey"
+	ErrRecentSignInRemove	= "Sign in again to remove a passkey"
+
+	// Time after signing in during which a passkey can be added or removed without a second factor
+	RecentSignInWindow = 5 * time.Minute
+)
+
+// ListSessionsHandler lists the active sessions of the user
+func ListSessionsHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Get the sessions
+		sessions, err := tokenService.ListSessions(authCtx.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Build the response
+		res := validHttp.SessionsResponse{Sessions: []validHttp.SessionResponse{}}
+		for _, session := range sessions {
+			res.Sessions = append(res.Sessions, validHttp.SessionResponse{
+				ID:				session.ID,
+				UserAgent:	session.UserAgent,
+				IP:				session.IP,
+				CreatedAt:	session.CreatedAt,
+				LastUsedAt:	session.LastUsedAt,
+				Current:		session.ID == authCtx.SessionID,
+			})
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// RevokeSessionHandler revokes one session of the user
+func RevokeSessionHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// The current session is ended through logout
+		sessionID := c.Param("id")
+		if sessionID == authCtx.SessionID {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrCurrentSession})
+			return
+		}
+
+		// Revoke the session
+		err := tokenService.RevokeSession(authCtx.UserID, sessionID)
+		if err != nil {
+			if err.Error() == tokenSvc.ErrSessionNotFound {
+				c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Session revoked"})
+	}
+}
+
+// RevokeOtherSessionsHandler revokes every session of the user except the current one
+func RevokeOtherSessionsHandler(tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Revoke the sessions
+		err := tokenService.RevokeOtherSessions(authCtx.UserID, authCtx.SessionID)
+		if err != nil {
+			if err.Error() == tokenSvc.ErrSessionNotFound {
+				c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Sessions revoked"})
+	}
+}
+
+// ListAPIKeysHandler lists the API keys of the user
+func ListAPIKeysHandler(apiKeyService apiKeySvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Get the keys
+		keys, err := apiKeyService.ListKeys(authCtx.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Build the response
+		res := validHttp.APIKeysResponse{APIKeys: []validHttp.APIKeyResponse{}}
+		for i := range keys {
+			res.APIKeys = append(res.APIKeys, apiKeyResponse(&keys[i], ""))
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// CreateAPIKeyHandler mints an API key for the user, the key is only returned in this response
+func CreateAPIKeyHandler(apiKeyService apiKeySvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.CreateAPIKeyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Create the key
+		k, key, err := apiKeyService.CreateKey(authCtx.UserID, req.Name, req.Scopes, req.ExpiresAt)
+		if err != nil {
+			if err == apiKeySvc.ErrInvalidScope || err == apiKeySvc.ErrInvalidExpiry {
+				c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, apiKeyResponse(k, key))
+	}
+}
+
+// RevokeAPIKeyHandler revokes one API key of the user
+func RevokeAPIKeyHandler(apiKeyService apiKeySvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Read the key id
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidAPIKeyID})
+			return
+		}
+
+		// Revoke the key
+		if err := apiKeyService.RevokeKey(authCtx.UserID, uint(id)); err != nil {
+			if err == apiKeySvc.ErrKeyNotFound {
+				c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "API key revoked"})
+	}
+}
+
+// ListIdentitiesHandler lists the upstream provider identities linked to the user
+func ListIdentitiesHandler(federationService federationSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Get the identities
+		identities, err := federationService.ListIdentities(authCtx.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Build the response
+		res := validHttp.IdentitiesResponse{Identities: []validHttp.IdentityResponse{}}
+		for _, identity := range identities {
+			res.Identities = append(res.Identities, validHttp.IdentityResponse{
+				Provider:	identity.Provider,
+				Email:		identity.Email,
+				CreatedAt:	identity.CreatedAt,
+			})
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// apiKeyResponse builds the response for an API key, the key itself is only set on creation
+func apiKeyResponse(k *apiKeyRepo.APIKey, key string) validHttp.APIKeyResponse {
+	return validHttp.APIKeyResponse{
+		ID:				k.ID,
+		Name:				k.Name,
+		Prefix:			apiKeySvc.KeyPrefix + k.Prefix,
+		Key:				key,
+		Scopes:			strings.Fields(k.Scope),
+		CreatedAt:		k.CreatedAt,
+		ExpiresAt:		k.ExpiresAt,
+		LastUsedAt:		k.LastUsedAt,
+		LastUsedIP:		k.LastUsedIP,
+	}
+}
+
+// EnrollTOTPHandler starts the enrollment of an authenticator app
+func EnrollTOTPHandler(mfaService mfaSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Generate the secret
+		enrollment, err := mfaService.EnrollTOTP(authCtx.UserID)
+		if err != nil {
+			handleMFAError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.TOTPEnrollmentResponse{
+			Secret:			enrollment.Secret,
+			OTPAuthURI:		enrollment.URI,
+		})
+	}
+}
+
+// ConfirmTOTPHandler enables the authenticator app with a code and returns the recovery codes
+func ConfirmTOTPHandler(mfaService mfaSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Confirm the enrollment
+		codes, err := mfaService.ConfirmTOTP(authCtx.UserID, req.Code)
+		if err != nil {
+			handleMFAError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// DisableTOTPHandler removes the authenticator app, proven with a code or a recovery code
+func DisableTOTPHandler(mfaService mfaSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Disable the second factor
+		if err := mfaService.DisableTOTP(authCtx.UserID, req.Code); err != nil {
+			handleMFAError(c, err)
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "MFA disabled"})
+	}
+}
+
+// RegenerateRecoveryCodesHandler replaces the recovery codes, proven with a code
+func RegenerateRecoveryCodesHandler(mfaService mfaSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.MFACodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Replace the codes
+		codes, err := mfaService.RegenerateRecoveryCodes(authCtx.UserID, req.Code)
+		if err != nil {
+			handleMFAError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// handleMFAError maps the MFA service errors to responses
+func handleMFAError(c *gin.Context, err error) {
+	switch err {
+	case mfaSvc.ErrCodeInvalid:
+		c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+	case mfaSvc.ErrMFAAlreadyEnabled, mfaSvc.ErrMFANotEnabled, mfaSvc.ErrMFANotEnrolled:
+		c.JSON(http.StatusConflict, validHttp.ErrorResponse{Error: err.Error()})
+	case mfaSvc.ErrTooManyAttempts:
+		c.JSON(http.StatusTooManyRequests, validHttp.ErrorResponse{Error: err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+	}
+}
+
+// BeginWebAuthnRegistrationHandler returns the options to register a new passkey
+// Users with a second factor must prove it with a code, others must have signed in recently
+func BeginWebAuthnRegistrationHandler(webauthnService webauthnSvc.Svc, mfaService mfaSvc.Svc, tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the request body, which may be omitted without a second factor
+		var req validHttp.WebAuthnRegistrationBeginRequest
+		if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Require the second factor, or a recent sign in without one
+		if !stepUp(c, mfaService, tokenService, authCtx, req.Code, ErrRecentSignInRequired) {
+			return
+		}
+
+		// Start the ceremony
+		token, options, err := webauthnService.BeginRegistration(authCtx.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, validHttp.WebAuthnRegistrationOptionsResponse{Token: token, PublicKey: options})
+	}
+}
+
+// FinishWebAuthnRegistrationHandler verifies the response of the authenticator and stores the passkey
+func FinishWebAuthnRegistrationHandler(webauthnService webauthnSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Bind the request body
+		var req validHttp.WebAuthnRegistrationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Register the credential
+		cred, err := webauthnService.FinishRegistration(authCtx.UserID, req.Token, req.Name, &webauthnSvc.Attestation{
+			ClientDataJSON:		req.ClientDataJSON,
+			AttestationObject:	req.AttestationObject,
+			Transports:				req.Transports,
+		})
+		if err != nil {
+			switch err {
+			case webauthnSvc.ErrChallengeInvalid, webauthnSvc.ErrCredentialInvalid:
+				c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			case webauthnSvc.ErrCredentialExists:
+				c.JSON(http.StatusConflict, validHttp.ErrorResponse{Error: err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, validHttp.WebAuthnCredentialResponse{
+			ID:				cred.ID,
+			Name:				cred.Name,
+			Transports:		strings.Fields(cred.Transports),
+			CreatedAt:		cred.CreatedAt,
+			LastUsedAt:		cred.LastUsedAt,
+		})
+	}
+}
+
+// ListWebAuthnCredentialsHandler lists the passkeys of the user
+func ListWebAuthnCredentialsHandler(webauthnService webauthnSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Get the credentials
+		creds, err := webauthnService.ListCredentials(authCtx.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Build the response
+		res := validHttp.WebAuthnCredentialsResponse{Credentials: []validHttp.WebAuthnCredentialResponse{}}
+		for _, cred := range creds {
+			res.Credentials = append(res.Credentials, validHttp.WebAuthnCredentialResponse{
+				ID:				cred.ID,
+				Name:				cred.Name,
+				Transports:		strings.Fields(cred.Transports),
+				CreatedAt:		cred.CreatedAt,
+				LastUsedAt:		cred.LastUsedAt,
+			})
+		}
+
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// stepUp checks the code of a user with a second factor, or that the session of a user without one started recently
+// A refused request is answered, with the given error when the session is too old
+func stepUp(c *gin.Context, mfaService mfaSvc.Svc, tokenService tokenSvc.Svc, authCtx *mwauth.AuthContext, code string, errTooOld string) bool {
+	enabled, err := mfaService.Enabled(authCtx.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return false
+	}
+	if enabled {
+		if err := mfaService.VerifyCode(authCtx.UserID, code); err != nil {
+			handleMFAError(c, err)
+			return false
+		}
+		return true
+	}
+
+	startedAt, err := tokenService.SessionStartedAt(authCtx.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return false
+	}
+	if time.Since(startedAt) > RecentSignInWindow {
+		c.JSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: errTooOld})
+		return false
+	}
+
+	return true
+}
+
+// DeleteWebAuthnCredentialHandler removes a passkey of the user
+// Users with a second factor must prove it with a code, others must have signed in recently
+func DeleteWebAuthnCredentialHandler(webauthnService webauthnSvc.Svc, mfaService mfaSvc.Svc, tokenService tokenSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Read auth context
+		authCtx := c.MustGet("auth").(*mwauth.AuthContext)
+		if authCtx == nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrMissingContext})
+			return
+		}
+
+		// Read the credential id
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: ErrInvalidCredentialID})
+			return
+		}
+
+		// Bind the request body, which may be omitted without a second factor
+		var req validHttp.WebAuthnCredentialDeleteRequest
+		if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Require the second factor, or a recent sign in without one
+		if !stepUp(c, mfaService, tokenService, authCtx, req.Code, ErrRecentSignInRemove) {
+			return
+		}
+
+		// Delete the credential
+		if err := webauthnService.DeleteCredential(authCtx.UserID, uint(id)); err != nil {
+			if err == webauthnSvc.ErrCredentialNotFound {
+				c.JSON(http.StatusNotFound, validHttp.ErrorResponse{Error: err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Handle success
+		c.JSON(http.StatusOK, validHttp.SuccessResponse{Message: "Passkey removed"})
+	}
+}
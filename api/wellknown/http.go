@@ -0,0 +1,56 @@
+package wellknownHttp
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/internal/key/svc"
+	"github.com/selatoz/gateway/internal/oauth/svc"
+	"github.com/selatoz/gateway/internal/token/svc"
+)
+
+// JWKSHandler publishes the public keys used to verify issued tokens
+func JWKSHandler(keyService keySvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the verification keys
+		set, err := keyService.JWKS()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Allow downstream services to cache the key set
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, set)
+	}
+}
+
+// OpenIDConfigurationHandler publishes the OpenID Connect discovery document
+func OpenIDConfigurationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		issuer := strings.TrimSuffix(cfglib.DefaultConf.AppIssuer, "/")
+
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, validHttp.OpenIDConfigurationResponse{
+			Issuer:										issuer,
+			AuthorizationEndpoint:					issuer + "/oauth/authorize",
+			TokenEndpoint:								issuer + "/oauth/token",
+			UserInfoEndpoint:							issuer + "/userinfo",
+			JWKSURI:										issuer + "/.well-known/jwks.json",
+			IntrospectionEndpoint:					issuer + "/oauth/introspect",
+			RevocationEndpoint:						issuer + "/oauth/revoke",
+			ScopesSupported:							tokenSvc.IdentityScopes,
+			ResponseTypesSupported:					[]string{oauthSvc.ResponseTypeCode},
+			GrantTypesSupported:						[]string{oauthSvc.GrantTypeAuthorizationCode, oauthSvc.GrantTypeRefreshToken, oauthSvc.GrantTypeClientCredentials, oauthSvc.GrantTypeTokenExchange},
+			SubjectTypesSupported:					[]string{"public"},
+			IDTokenSigningAlgValuesSupported:	[]string{cfglib.DefaultConf.TokenSigningAlg},
+			TokenEndpointAuthMethodsSupported:	[]string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:		[]string{oauthSvc.CodeChallengeMethodS256},
+			ClaimsSupported:							[]string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "at_hash", "email", "email_verified", "updated_at"},
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package apiKeyRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// File handles data logic related to the API keys
+
+// This defines an APIKey struct that represents a long-lived key held by a user
+// Only the hash of the key is stored, the prefix identifies the key for display and lookup
+type APIKey struct {
+	gorm.Model
+	User				*userRepo.User	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint				`json:"user_id" gorm:"index"`
+	Name				string			`json:"name"`
+	Prefix			string			`json:"prefix" gorm:"uniqueIndex"`
+	KeyHash			string			`json:"-" gorm:"uniqueIndex"`
+	Scope				string			`json:"scope"`
+	ExpiresAt		*time.Time		`json:"expires_at"`
+	LastUsedAt		*time.Time		`json:"last_used_at"`
+	LastUsedIP		string			`json:"last_used_ip"`
+}
+
+// Repository provides methods for interacting with the API keys in the database
+type Repo interface {
+	CreateKey(k *APIKey) (*APIKey, error)
+	GetKeyByPrefix(prefix string) (*APIKey, error)
+	GetKeysByUser(userID uint) ([]APIKey, error)
+	TouchKey(id uint, ip string, usedAt time.Time, interval time.Duration) (error)
+	DeleteKey(userID uint, id uint) (bool, error)
+	DeleteKeysByUser(userID uint) (error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// CreateKey creates an entry in the API keys table
+func (r *repo) CreateKey(k *APIKey) (*APIKey, error) {
+	if err := r.db.Create(k).Error; err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// GetKeyByPrefix returns the API key with the given prefix
+func (r *repo) GetKeyByPrefix(prefix string) (*APIKey, error) {
+	var k APIKey
+	err := r.db.Where("prefix = ?", prefix).First(&k).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("api key not found")
+		}
+		return nil, err
+	}
+	return &k, nil
+}
+
+// GetKeysByUser returns the API keys of a user, newest first
+func (r *repo) GetKeysByUser(userID uint) ([]APIKey, error) {
+	var keys []APIKey
+	err := r.db.Where("user_id = ?", userID).Order("created_at desc").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// TouchKey records the last use of an API key, at most once per interval
+func (r *repo) TouchKey(id uint, ip string, usedAt time.Time, interval time.Duration) error {
+	return r.db.Model(&APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, usedAt.Add(-interval)).
+		Updates(map[string]interface{}{"last_used_ip": ip, "last_used_at": usedAt}).Error
+}
+
+// DeleteKey deletes an API key of a user, reporting whether it existed
+func (r *repo) DeleteKey(userID uint, id uint) (bool, error) {
+	res := r.db.Where("id = ? AND user_id = ?", id, userID).Delete(&APIKey{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// DeleteKeysByUser deletes every API key of a user
+func (r *repo) DeleteKeysByUser(userID uint) error {
+	return r.db.Where("user_id = ?", userID).Delete(&APIKey{}).Error
+}
@@ -0,0 +1,212 @@
+package apiKeySvc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/internal/apikey/repo"
+	"github.com/selatoz/gateway/internal/role/svc"
+)
+
+// Define constants
+const (
+	// Keys look like sgw_live_<prefix>_<secret>
+	KeyPrefix = "sgw_live_"
+
+	// Minimum time between two recorded uses of a key
+	KeyTouchInterval = time.Minute
+)
+
+// Define errors
+var (
+	ErrKeyInvalid		= errors.New("invalid api key")
+	ErrKeyExpired		= errors.New("api key expired")
+	ErrKeyNotFound		= errors.New("api key not found")
+	ErrInvalidScope	= errors.New("invalid scope")
+	ErrInvalidExpiry	= errors.New("expiry must be in the future")
+)
+
+// Svc is an interface for defining the methods that the API key service will provide.
+type Svc interface {
+	CreateKey(userID uint, name string, scopes []string, expiresAt *time.Time) (*apiKeyRepo.APIKey, string, error)
+	ListKeys(userID uint) ([]apiKeyRepo.APIKey, error)
+	RevokeKey(userID uint, id uint) (error)
+	RevokeAllKeys(userID uint) (error)
+	Authenticate(key string, ip string) (*apiKeyRepo.APIKey, []string, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for API keys.
+type svc struct {
+	repo				apiKeyRepo.Repo
+	roleService		roleSvc.Svc
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB, roleService roleSvc.Svc) Svc {
+	return &svc{
+		repo: apiKeyRepo.NewRepo(db),
+		roleService: roleService,
+	}
+}
+
+// CreateKey mints a new API key for the user, the key is only returned here
+// Requested scopes must be held by the user, no scopes means the key acts with all the user's permissions
+func (s *svc) CreateKey(userID uint, name string, scopes []string, expiresAt *time.Time) (*apiKeyRepo.APIKey, string, error) {
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, "", ErrInvalidExpiry
+	}
+
+	// Ensure the user holds the requested scopes
+	_, userScopes, err := s.roleService.GetUserAccess(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, scope := range scopes {
+		if !contains(userScopes, scope) {
+			return nil, "", ErrInvalidScope
+		}
+	}
+
+	// Generate the key
+	prefix, err := randomHex(4)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := cryptolib.RandomString(32)
+	if err != nil {
+		return nil, "", err
+	}
+	key := KeyPrefix + prefix + "_" + secret
+
+	k, err := s.repo.CreateKey(&apiKeyRepo.APIKey{
+		UserID:		userID,
+		Name:			name,
+		Prefix:		prefix,
+		KeyHash:		hashKey(key),
+		Scope:		strings.Join(scopes, " "),
+		ExpiresAt:	expiresAt,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return k, key, nil
+}
+
+// ListKeys returns the API keys of the user
+func (s *svc) ListKeys(userID uint) ([]apiKeyRepo.APIKey, error) {
+	return s.repo.GetKeysByUser(userID)
+}
+
+// RevokeKey deletes an API key of the user
+func (s *svc) RevokeKey(userID uint, id uint) error {
+	found, err := s.repo.DeleteKey(userID, id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// RevokeAllKeys revokes every API key of the user, when the account may have been taken over
+func (s *svc) RevokeAllKeys(userID uint) error {
+	return s.repo.DeleteKeysByUser(userID)
+}
+
+// Authenticate validates an API key, records its use and returns the scopes it currently grants
+// The scopes are limited to the permissions the user still holds
+func (s *svc) Authenticate(key string, ip string) (*apiKeyRepo.APIKey, []string, error) {
+	// Find the key by its prefix
+	prefix, ok := parseKey(key)
+	if !ok {
+		return nil, nil, ErrKeyInvalid
+	}
+	k, err := s.repo.GetKeyByPrefix(prefix)
+	if err != nil {
+		return nil, nil, ErrKeyInvalid
+	}
+
+	// Compare the key hashes in constant time
+	if subtle.ConstantTimeCompare([]byte(hashKey(key)), []byte(k.KeyHash)) != 1 {
+		return nil, nil, ErrKeyInvalid
+	}
+
+	// Handle expired key
+	now := time.Now()
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return nil, nil, ErrKeyExpired
+	}
+
+	// Compute the granted scopes
+	_, userScopes, err := s.roleService.GetUserAccess(k.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	scopes := userScopes
+	if k.Scope != "" {
+		scopes = []string{}
+		for _, scope := range strings.Fields(k.Scope) {
+			if contains(userScopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	// Record the use of the key
+	if err := s.repo.TouchKey(k.ID, ip, now, KeyTouchInterval); err != nil {
+		return nil, nil, err
+	}
+
+	return k, scopes, nil
+}
+
+// parseKey returns the prefix of a well formed key
+func parseKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, KeyPrefix) {
+		return "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, KeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// API keys are random, so a plain SHA-256 digest is enough to store them
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// randomHex returns a hex encoded string of n random bytes
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
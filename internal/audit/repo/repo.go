@@ -0,0 +1,126 @@
+package auditRepo
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// File handles data logic related to the audit log
+
+// This defines an AuditEvent struct that records an authentication event
+// Events are never updated nor deleted, so the struct has no update or deletion timestamps
+// ActorID is the user who acted, UserID the user the event is about, they differ for admin actions
+type AuditEvent struct {
+	ID					uint					`json:"id" gorm:"primaryKey"`
+	CreatedAt		time.Time			`json:"created_at" gorm:"index"`
+	Type				string				`json:"type" gorm:"index"`
+	Outcome			string				`json:"outcome" gorm:"index"`
+	Reason			string				`json:"reason,omitempty"`
+	Method			string				`json:"method,omitempty"`
+	ActorID			uint					`json:"actor_id,omitempty" gorm:"index"`
+	UserID			uint					`json:"user_id,omitempty" gorm:"index"`
+	ClientID			string				`json:"client_id,omitempty"`
+	IP					string				`json:"ip,omitempty" gorm:"index"`
+	UserAgent		string				`json:"user_agent,omitempty"`
+	RequestID		string				`json:"request_id,omitempty" gorm:"index"`
+}
+
+// EventFilter selects audit events, zero values match everything
+// Events are returned newest first, Before is the id of the last event of the previous page
+type EventFilter struct {
+	Type			string
+	Outcome		string
+	ActorID		uint
+	UserID		uint
+	IP				string
+	RequestID	string
+	Since			*time.Time
+	Until			*time.Time
+	Before		uint
+	Limit			int
+}
+
+// Repository provides methods for interacting with the audit log in the database
+// It has no method to change or delete events
+type Repo interface {
+	CreateEvent(e *AuditEvent) (*AuditEvent, error)
+	GetEvents(filter *EventFilter) ([]AuditEvent, error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// MigrateAppendOnly makes the database refuse updates and deletions of audit events
+func MigrateAppendOnly(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'audit events are append-only';
+			END;
+			$$ LANGUAGE plpgsql`).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Exec(`DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events`).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+			FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only()`).Error
+	})
+}
+
+// CreateEvent creates an entry in the audit events table
+func (r *repo) CreateEvent(e *AuditEvent) (*AuditEvent, error) {
+	if err := r.db.Create(e).Error; err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// GetEvents returns the audit events matching the filter, newest first
+func (r *repo) GetEvents(filter *EventFilter) ([]AuditEvent, error) {
+	q := r.db.Model(&AuditEvent{})
+	if filter.Type != "" {
+		q = q.Where("type = ?", filter.Type)
+	}
+	if filter.Outcome != "" {
+		q = q.Where("outcome = ?", filter.Outcome)
+	}
+	if filter.ActorID != 0 {
+		q = q.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.UserID != 0 {
+		q = q.Where("user_id = ?", filter.UserID)
+	}
+	if filter.IP != "" {
+		q = q.Where("ip = ?", filter.IP)
+	}
+	if filter.RequestID != "" {
+		q = q.Where("request_id = ?", filter.RequestID)
+	}
+	if filter.Since != nil {
+		q = q.Where("created_at >= ?", *filter.Since)
+	}
+	if filter.Until != nil {
+		q = q.Where("created_at < ?", *filter.Until)
+	}
+	if filter.Before != 0 {
+		q = q.Where("id < ?", filter.Before)
+	}
+
+	var events []AuditEvent
+	if err := q.Order("id DESC").Limit(filter.Limit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,57 @@
+package auditSvc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/internal/audit/repo"
+)
+
+// Sink exports the audit events recorded in the database to another system
+type Sink interface {
+	Write(e *auditRepo.AuditEvent) (error)
+}
+
+// NewSinks returns the sinks enabled by the configuration
+func NewSinks(config *cfglib.Config) ([]Sink, error) {
+	sinks := []Sink{}
+	if config.AuditLogFile != "" {
+		sink, err := NewFileSink(config.AuditLogFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+// fileSink appends the events to a file as JSON lines
+type fileSink struct {
+	mu		sync.Mutex
+	file	*os.File
+	enc	*json.Encoder
+}
+
+// NewFileSink returns a sink appending the events to the file at the path, one JSON object per line
+func NewFileSink(path string) (Sink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *fileSink) Write(e *auditRepo.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(e)
+}
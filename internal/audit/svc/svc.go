@@ -0,0 +1,95 @@
+package auditSvc
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/audit/repo"
+)
+
+// Define constants
+const (
+	// Types of audit events
+	EventLogin						= "login"
+	EventMFAChallenge				= "mfa_challenge"
+	EventLogout						= "logout"
+	EventRegister					= "register"
+	EventTokenRefresh				= "token_refresh"
+	EventTokenValidation			= "token_validation"
+	EventRefreshTokenReused		= "refresh_token_reused"
+	EventSessionRevoked			= "session_revoked"
+	EventPasswordChanged			= "password_changed"
+	EventPasswordRehashed		= "password_rehashed"
+	EventImpersonation			= "impersonation"
+
+	// Outcomes of audit events
+	OutcomeSuccess	= "success"
+	OutcomeFailure	= "failure"
+
+	// Authentication methods of login events
+	MethodPassword		= "password"
+	MethodTOTP			= "totp"
+	MethodWebAuthn		= "webauthn"
+	MethodMagicLink	= "magic_link"
+	MethodFederated	= "federated"
+
+	// Ways an impersonation is started
+	MethodAdmin				= "admin"
+	MethodTokenExchange	= "token_exchange"
+
+	// Audit events returned per page
+	DefaultEventLimit	= 50
+	MaxEventLimit		= 200
+)
+
+// Svc is an interface for defining the methods that the audit service will provide.
+type Svc interface {
+	Record(e *auditRepo.AuditEvent) (error)
+	ListEvents(filter *auditRepo.EventFilter) ([]auditRepo.AuditEvent, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for the audit log.
+type svc struct {
+	repo		auditRepo.Repo
+	sinks		[]Sink
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+// Recorded events are also written to the given sinks.
+func NewSvc(db *gorm.DB, sinks ...Sink) Svc {
+	return &svc{
+		repo: auditRepo.NewRepo(db),
+		sinks: sinks,
+	}
+}
+
+// Record stores the event, then exports it to the sinks
+// Only a failure to store the event is returned, sink failures are logged
+func (s *svc) Record(e *auditRepo.AuditEvent) error {
+	if e.Outcome == "" {
+		e.Outcome = OutcomeSuccess
+	}
+	if _, err := s.repo.CreateEvent(e); err != nil {
+		return err
+	}
+
+	for _, sink := range s.sinks {
+		if err := sink.Write(e); err != nil {
+			log.Printf("audit sink failed: %s", err)
+		}
+	}
+	return nil
+}
+
+// ListEvents returns the audit events matching the filter, newest first
+func (s *svc) ListEvents(filter *auditRepo.EventFilter) ([]auditRepo.AuditEvent, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultEventLimit
+	}
+	if filter.Limit > MaxEventLimit {
+		filter.Limit = MaxEventLimit
+	}
+
+	return s.repo.GetEvents(filter)
+}
@@ -0,0 +1,102 @@
+package clientRepo
+
+import (
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// File handles data logic related to the OAuth clients
+
+// This defines a Client struct that represents a registered OAuth client
+type Client struct {
+	gorm.Model
+	ClientID			string		`json:"client_id" gorm:"uniqueIndex"`
+	SecretHash		string		`json:"-"`
+	Name				string		`json:"name"`
+	RedirectURIs	string		`json:"redirect_uris"`
+	AllowedScopes	string		`json:"allowed_scopes"`
+	GrantTypes		string		`json:"grant_types" gorm:"default:'authorization_code refresh_token'"`
+	Public			bool			`json:"public"`
+	TLSSubject		string		`json:"tls_subject" gorm:"index"`
+}
+
+// Redirect URIs, allowed scopes and grant types are stored space separated
+
+// RedirectURIList returns the registered redirect URIs
+func (cl *Client) RedirectURIList() []string {
+	return strings.Fields(cl.RedirectURIs)
+}
+
+// AllowedScopeList returns the scopes the client may request
+func (cl *Client) AllowedScopeList() []string {
+	return strings.Fields(cl.AllowedScopes)
+}
+
+// GrantTypeList returns the grant types the client may use
+func (cl *Client) GrantTypeList() []string {
+	return strings.Fields(cl.GrantTypes)
+}
+
+// HasGrantType reports whether the client may use the given grant type
+func (cl *Client) HasGrantType(grantType string) bool {
+	for _, g := range strings.Fields(cl.GrantTypes) {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+// Repository provides methods for interacting with the clients in the database
+type Repo interface {
+	CreateClient(cl *Client) (*Client, error)
+	GetByClientID(clientID string) (*Client, error)
+	GetByTLSSubjects(subjects []string) (*Client, error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// CreateClient creates an entry in the clients table
+func (r *repo) CreateClient(cl *Client) (*Client, error) {
+	if err := r.db.Create(cl).Error; err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+// GetByClientID returns the client with the given client id
+func (r *repo) GetByClientID(clientID string) (*Client, error) {
+	var cl Client
+	err := r.db.Where("client_id = ?", clientID).First(&cl).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("client not found")
+		}
+		return nil, err
+	}
+	return &cl, nil
+}
+
+// GetByTLSSubjects returns the oldest client registered with one of the certificate subjects
+func (r *repo) GetByTLSSubjects(subjects []string) (*Client, error) {
+	var cl Client
+	err := r.db.Where("tls_subject IN ?", subjects).Order("id").First(&cl).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("client not found")
+		}
+		return nil, err
+	}
+	return &cl, nil
+}
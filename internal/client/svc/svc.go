@@ -0,0 +1,179 @@
+package clientSvc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/internal/client/repo"
+)
+
+// Define errors
+var (
+	ErrInvalidClient = errors.New("invalid_client")
+	ErrInvalidRedirectURI = errors.New("invalid redirect uri")
+	ErrInvalidGrantType = errors.New("invalid grant type")
+	ErrInvalidTLSSubject = errors.New("public clients cannot authenticate with a certificate")
+)
+
+// Define constants
+const (
+	// Grant types a client can be registered for
+	GrantTypeAuthorizationCode		= "authorization_code"
+	GrantTypeRefreshToken			= "refresh_token"
+	GrantTypeClientCredentials		= "client_credentials"
+	GrantTypeTokenExchange			= "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// DefaultGrantTypes are used when a client is registered without grant types
+var DefaultGrantTypes = []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken}
+
+// Svc is an interface for defining the methods that the client service will provide.
+type Svc interface {
+	Authenticate(clientID string, secret string) (*clientRepo.Client, error)
+	AuthenticatePublic(clientID string) (*clientRepo.Client, error)
+	AuthenticateCertificate(identities []string) (*clientRepo.Client, error)
+	GetClient(clientID string) (*clientRepo.Client, error)
+	CreateClient(name string, redirectURIs []string, scopes []string, grantTypes []string, public bool, tlsSubject string) (*clientRepo.Client, string, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for client-related operations.
+type svc struct {
+	repo clientRepo.Repo
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB) Svc {
+	repo := clientRepo.NewRepo(db)
+	return &svc{repo}
+}
+
+// Authenticate checks the client credentials
+func (s *svc) Authenticate(clientID string, secret string) (*clientRepo.Client, error) {
+	cl, err := s.repo.GetByClientID(clientID)
+	if err != nil || cl.Public {
+		return nil, ErrInvalidClient
+	}
+
+	// Compare the secret hashes in constant time
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(cl.SecretHash)) != 1 {
+		return nil, ErrInvalidClient
+	}
+
+	return cl, nil
+}
+
+// AuthenticatePublic identifies a public client, which has no secret
+func (s *svc) AuthenticatePublic(clientID string) (*clientRepo.Client, error) {
+	cl, err := s.repo.GetByClientID(clientID)
+	if err != nil || !cl.Public {
+		return nil, ErrInvalidClient
+	}
+
+	return cl, nil
+}
+
+// AuthenticateCertificate identifies the client registered with one of the identities of a verified certificate
+// Only confidential clients can authenticate with a certificate
+func (s *svc) AuthenticateCertificate(identities []string) (*clientRepo.Client, error) {
+	// Empty identities would match the clients registered without a subject
+	subjects := []string{}
+	for _, identity := range identities {
+		if identity != "" {
+			subjects = append(subjects, identity)
+		}
+	}
+	if len(subjects) == 0 {
+		return nil, ErrInvalidClient
+	}
+
+	cl, err := s.repo.GetByTLSSubjects(subjects)
+	if err != nil || cl.Public {
+		return nil, ErrInvalidClient
+	}
+
+	return cl, nil
+}
+
+// GetClient returns the client with the given client id
+func (s *svc) GetClient(clientID string) (*clientRepo.Client, error) {
+	cl, err := s.repo.GetByClientID(clientID)
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+
+	return cl, nil
+}
+
+// CreateClient registers a new client, the generated secret is only returned here
+// Public clients, such as single page apps, get no secret and cannot use the client credentials grant
+// Confidential clients can also authenticate with a certificate holding the TLS subject, a subject DN or a prefixed alternative name
+func (s *svc) CreateClient(name string, redirectURIs []string, scopes []string, grantTypes []string, public bool, tlsSubject string) (*clientRepo.Client, string, error) {
+	// Validate the grant types
+	if len(grantTypes) == 0 {
+		grantTypes = DefaultGrantTypes
+	}
+	for _, g := range grantTypes {
+		switch g {
+		case GrantTypeAuthorizationCode, GrantTypeRefreshToken:
+		case GrantTypeClientCredentials, GrantTypeTokenExchange:
+			if public {
+				return nil, "", ErrInvalidGrantType
+			}
+		default:
+			return nil, "", ErrInvalidGrantType
+		}
+	}
+
+	if public && tlsSubject != "" {
+		return nil, "", ErrInvalidTLSSubject
+	}
+
+	// Redirect URIs must be absolute and without fragment
+	for _, uri := range redirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || strings.ContainsAny(uri, " ") {
+			return nil, "", ErrInvalidRedirectURI
+		}
+	}
+
+	clientID, err := cryptolib.RandomString(16)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := ""
+	if !public {
+		secret, err = cryptolib.RandomString(32)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	cl, err := s.repo.CreateClient(&clientRepo.Client{
+		ClientID:		clientID,
+		SecretHash:		hashSecret(secret),
+		Name:				name,
+		RedirectURIs:	strings.Join(redirectURIs, " "),
+		AllowedScopes:	strings.Join(scopes, " "),
+		GrantTypes:		strings.Join(grantTypes, " "),
+		Public:			public,
+		TLSSubject:		strings.TrimSpace(tlsSubject),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return cl, secret, nil
+}
+
+// Client secrets are random, so a plain SHA-256 digest is enough to store them
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
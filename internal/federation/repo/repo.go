@@ -0,0 +1,134 @@
+package federationRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// File handles data logic related to the identities of users at upstream providers
+
+// This defines a FederatedIdentity struct that links a user to an account at an upstream provider
+// A user can have one identity per provider account
+type FederatedIdentity struct {
+	gorm.Model
+	User      		*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	Provider			string				`json:"provider" gorm:"uniqueIndex:idx_federated_identity"`
+	Subject			string				`json:"subject" gorm:"uniqueIndex:idx_federated_identity"`
+	Email				string				`json:"email"`
+}
+
+// This defines a FederationState struct that holds a pending sign in at an upstream provider
+// The state is only stored hashed, the binding ties it to the browser that started the sign in
+type FederationState struct {
+	gorm.Model
+	StateHash		string				`json:"-" gorm:"uniqueIndex"`
+	BindingHash		string				`json:"-"`
+	Provider			string				`json:"provider"`
+	Nonce				string				`json:"-"`
+	CodeVerifier	string				`json:"-"`
+	ExpiresAt		time.Time			`json:"expires_at" gorm:"index"`
+}
+
+// Repository provides methods for interacting with the federated identities in the database
+type Repo interface {
+	CreateIdentity(fi *FederatedIdentity) (*FederatedIdentity, error)
+	GetIdentity(provider string, subject string) (*FederatedIdentity, error)
+	GetIdentitiesByUser(userID uint) ([]FederatedIdentity, error)
+	DeleteIdentitiesByUser(userID uint) (error)
+
+	CreateState(state string, fs *FederationState) (*FederationState, error)
+	ConsumeState(state string) (*FederationState, error)
+	DeleteExpiredStates(before time.Time) (error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// CreateIdentity creates an entry in the federated identities table
+func (r *repo) CreateIdentity(fi *FederatedIdentity) (*FederatedIdentity, error) {
+	if err := r.db.Create(fi).Error; err != nil {
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+// GetIdentity returns the identity of the subject at the provider
+func (r *repo) GetIdentity(provider string, subject string) (*FederatedIdentity, error) {
+	var fi FederatedIdentity
+	err := r.db.Where("provider = ? AND subject = ?", provider, subject).First(&fi).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("identity not found")
+		}
+		return nil, err
+	}
+	return &fi, nil
+}
+
+// GetIdentitiesByUser returns the identities linked to a user
+func (r *repo) GetIdentitiesByUser(userID uint) ([]FederatedIdentity, error) {
+	var identities []FederatedIdentity
+	err := r.db.Where("user_id = ?", userID).Order("created_at asc").Find(&identities).Error
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// DeleteIdentitiesByUser deletes the identities linked to a user, they can be linked again by signing in
+func (r *repo) DeleteIdentitiesByUser(userID uint) error {
+	return r.db.Unscoped().Where("user_id = ?", userID).Delete(&FederatedIdentity{}).Error
+}
+
+// CreateState creates an entry in the federation states table
+func (r *repo) CreateState(state string, fs *FederationState) (*FederationState, error) {
+	fs.StateHash = cryptolib.HashValue(state)
+
+	if err := r.db.Create(fs).Error; err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+// ConsumeState returns the pending sign in with the given state and deletes it, so it can only be used once
+func (r *repo) ConsumeState(state string) (*FederationState, error) {
+	var fs FederationState
+	err := r.db.Where("state_hash = ?", cryptolib.HashValue(state)).First(&fs).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("state not found")
+		}
+		return nil, err
+	}
+
+	// Only the request that deletes the state may use it
+	res := r.db.Unscoped().Where("id = ?", fs.ID).Delete(&FederationState{})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected != 1 {
+		return nil, errors.New("state not found")
+	}
+
+	return &fs, nil
+}
+
+// DeleteExpiredStates deletes the pending sign ins that expired before the given time
+func (r *repo) DeleteExpiredStates(before time.Time) error {
+	return r.db.Unscoped().Where("expires_at < ?", before).Delete(&FederationState{}).Error
+}
@@ -0,0 +1,232 @@
+package federationSvc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/oidclib"
+	"github.com/selatoz/gateway/internal/federation/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	// Time the user has to complete the sign in at the provider
+	StateLifetime = 10 * time.Minute
+)
+
+// Define errors
+var (
+	ErrProviderNotFound	= errors.New("provider not found")
+	ErrStateInvalid		= errors.New("invalid state")
+	ErrLoginFailed			= errors.New("federated login failed")
+	ErrEmailRequired		= errors.New("provider returned no email")
+	ErrEmailUnverified	= errors.New("email already registered to another account")
+	ErrEmailNotVerified	= errors.New("provider did not verify the email")
+)
+
+// Svc is an interface for defining the methods that the federation service will provide.
+type Svc interface {
+	Begin(provider string) (string, string, error)
+	Complete(provider string, state string, binding string, code string) (*userRepo.User, error)
+	ListIdentities(userID uint) ([]federationRepo.FederatedIdentity, error)
+	UnlinkAll(userID uint) (error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for federated login.
+type svc struct {
+	repo			federationRepo.Repo
+	userRepo		userRepo.Repo
+	mu				sync.Mutex
+	providers	map[string]*oidclib.Provider
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB) Svc {
+	return &svc{
+		repo: federationRepo.NewRepo(db),
+		userRepo: userRepo.NewRepo(db),
+		providers: make(map[string]*oidclib.Provider),
+	}
+}
+
+// Begin starts a sign in at the provider
+// It returns the URL to send the user to and the binding to keep in the browser until the callback
+func (s *svc) Begin(provider string) (string, string, error) {
+	p, cfg, err := s.provider(provider)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Generate the values tying the callback to this request
+	state, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Store the pending sign in, removing the abandoned ones
+	now := time.Now()
+	if err := s.repo.DeleteExpiredStates(now); err != nil {
+		return "", "", err
+	}
+	_, err = s.repo.CreateState(state, &federationRepo.FederationState{
+		BindingHash:	cryptolib.HashValue(binding),
+		Provider:		provider,
+		Nonce:			nonce,
+		CodeVerifier:	verifier,
+		ExpiresAt:		now.Add(StateLifetime),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return p.AuthCodeURL(RedirectURI(provider), cfg.Scopes, state, nonce, codeChallenge(verifier)), binding, nil
+}
+
+// Complete finishes a sign in at the provider and returns the signed in user
+// Unknown identities are linked to the user with the same email, or to a new user, only when the provider verified the email
+func (s *svc) Complete(provider string, state string, binding string, code string) (*userRepo.User, error) {
+	p, _, err := s.provider(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the state against the browser binding
+	fs, err := s.repo.ConsumeState(state)
+	if err != nil || fs.Provider != provider || time.Now().After(fs.ExpiresAt) {
+		return nil, ErrStateInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(cryptolib.HashValue(binding)), []byte(fs.BindingHash)) != 1 {
+		return nil, ErrStateInvalid
+	}
+
+	// Exchange the code and verify the id_token
+	tokens, err := p.Exchange(code, RedirectURI(provider), fs.CodeVerifier)
+	if err != nil {
+		return nil, ErrLoginFailed
+	}
+	identity, err := p.VerifyIDToken(tokens.IDToken, fs.Nonce)
+	if err != nil {
+		return nil, ErrLoginFailed
+	}
+
+	// Handle known identity
+	fi, err := s.repo.GetIdentity(provider, identity.Subject)
+	if err == nil {
+		return s.userRepo.GetById(fi.UserID)
+	}
+
+	// Some providers only return the email from the userinfo endpoint
+	if identity.Email == "" && tokens.AccessToken != "" {
+		if info, err := p.UserInfo(tokens.AccessToken, identity.Subject); err == nil {
+			identity = info
+		}
+	}
+	if identity.Email == "" {
+		return nil, ErrEmailRequired
+	}
+	email := identity.Email
+
+	// Link to the existing user only when the provider verified the email
+	u, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+
+		// Create the user, who has no password
+		// Unverified emails are refused, the real owner would later claim an account linked to this identity
+		if !identity.EmailVerified {
+			return nil, ErrEmailNotVerified
+		}
+		u, err = s.userRepo.NewUser(email, "")
+		if err != nil {
+			return nil, err
+		}
+	} else if !identity.EmailVerified {
+		return nil, ErrEmailUnverified
+	}
+
+	// The provider vouches for the email
+	if identity.EmailVerified && u.EmailVerifiedAt == nil {
+		if err := s.userRepo.SetEmailVerified(u.ID, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = s.repo.CreateIdentity(&federationRepo.FederatedIdentity{
+		UserID:		u.ID,
+		Provider:	provider,
+		Subject:		identity.Subject,
+		Email:		email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// ListIdentities returns the provider identities linked to the user
+func (s *svc) ListIdentities(userID uint) ([]federationRepo.FederatedIdentity, error) {
+	return s.repo.GetIdentitiesByUser(userID)
+}
+
+// UnlinkAll removes the provider identities linked to the user, when the account may have been taken over
+func (s *svc) UnlinkAll(userID uint) error {
+	return s.repo.DeleteIdentitiesByUser(userID)
+}
+
+// RedirectURI returns the callback URI to register at the provider
+func RedirectURI(provider string) string {
+	return strings.TrimSuffix(cfglib.DefaultConf.AppIssuer, "/") + "/auth/federated/" + provider + "/callback"
+}
+
+// provider returns the configured provider, discovering its metadata on first use
+func (s *svc) provider(name string) (*oidclib.Provider, *cfglib.FederationProvider, error) {
+	cfg, ok := cfglib.DefaultConf.FederationProviders[name]
+	if !ok {
+		return nil, nil, ErrProviderNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.providers[name]; ok {
+		return p, &cfg, nil
+	}
+	p, err := oidclib.Discover(cfg.Issuer, cfg.ClientID, cfg.ClientSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.providers[name] = p
+
+	return p, &cfg, nil
+}
+
+// codeChallenge returns the S256 code challenge of the verifier (RFC 7636)
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,259 @@
+package federationSvc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/jwklib"
+	"github.com/selatoz/gateway/pkg/oidclib"
+	"github.com/selatoz/gateway/internal/federation/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	testProvider	= "test"
+	testClientID	= "gateway"
+	testState		= "state"
+	testBinding		= "binding"
+	testNonce		= "nonce"
+	testEmail		= "user@example.com"
+)
+
+// fakeFederationRepo holds a single pending sign in and the linked identities in memory
+type fakeFederationRepo struct {
+	state			*federationRepo.FederationState
+	identities	[]federationRepo.FederatedIdentity
+}
+
+func (r *fakeFederationRepo) CreateIdentity(fi *federationRepo.FederatedIdentity) (*federationRepo.FederatedIdentity, error) {
+	r.identities = append(r.identities, *fi)
+	return fi, nil
+}
+
+func (r *fakeFederationRepo) GetIdentity(provider string, subject string) (*federationRepo.FederatedIdentity, error) {
+	for i := range r.identities {
+		if r.identities[i].Provider == provider && r.identities[i].Subject == subject {
+			return &r.identities[i], nil
+		}
+	}
+	return nil, errors.New("identity not found")
+}
+
+func (r *fakeFederationRepo) GetIdentitiesByUser(userID uint) ([]federationRepo.FederatedIdentity, error) {
+	return r.identities, nil
+}
+
+func (r *fakeFederationRepo) DeleteIdentitiesByUser(userID uint) error {
+	kept := r.identities[:0]
+	for _, fi := range r.identities {
+		if fi.UserID != userID {
+			kept = append(kept, fi)
+		}
+	}
+	r.identities = kept
+	return nil
+}
+
+func (r *fakeFederationRepo) CreateState(state string, fs *federationRepo.FederationState) (*federationRepo.FederationState, error) {
+	r.state = fs
+	return fs, nil
+}
+
+func (r *fakeFederationRepo) ConsumeState(state string) (*federationRepo.FederationState, error) {
+	fs := r.state
+	r.state = nil
+	if fs == nil || state != testState {
+		return nil, errors.New("state not found")
+	}
+	return fs, nil
+}
+
+func (r *fakeFederationRepo) DeleteExpiredStates(before time.Time) error {
+	return nil
+}
+
+// fakeUserRepo holds the users in memory
+type fakeUserRepo struct {
+	users	[]*userRepo.User
+}
+
+func (r *fakeUserRepo) GetByEmail(email string) (*userRepo.User, error) {
+	for _, u := range r.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeUserRepo) GetByEmailFold(email string) (*userRepo.User, error) {
+	for _, u := range r.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeUserRepo) GetById(userID uint) (*userRepo.User, error) {
+	for _, u := range r.users {
+		if u.ID == userID {
+			return u, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeUserRepo) NewUser(email string, password string) (*userRepo.User, error) {
+	u := &userRepo.User{Email: email, Password: password}
+	u.ID = uint(len(r.users) + 1)
+	r.users = append(r.users, u)
+	return u, nil
+}
+
+func (r *fakeUserRepo) SetEmailVerified(userID uint, verifiedAt time.Time) error {
+	u, err := r.GetById(userID)
+	if err != nil {
+		return err
+	}
+	u.EmailVerifiedAt = &verifiedAt
+	return nil
+}
+
+func (r *fakeUserRepo) UpdatePassword(userID uint, password string) error {
+	return nil
+}
+
+// newTestSvc returns a service signing in through a local provider whose id_token reports emailVerified
+func newTestSvc(t *testing.T, emailVerified bool) (*svc, *fakeUserRepo, *fakeFederationRepo) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidclib.Metadata{
+			Issuer:						server.URL,
+			AuthorizationEndpoint:	server.URL + "/authorize",
+			TokenEndpoint:				server.URL + "/token",
+			JWKSURI:						server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, _ := jwklib.FromPublicKey(&key.PublicKey)
+		jwk.Kid = "test-key"
+		jwk.Alg = "RS256"
+		json.NewEncoder(w).Encode(jwklib.JWKSet{Keys: []jwklib.JWK{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		jt := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":					server.URL,
+			"sub":					"subject",
+			"aud":					testClientID,
+			"nonce":				testNonce,
+			"exp":					time.Now().Add(time.Minute).Unix(),
+			"email":				testEmail,
+			"email_verified":	emailVerified,
+		})
+		jt.Header["kid"] = "test-key"
+		raw, err := jt.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(oidclib.Tokens{TokenType: "Bearer", IDToken: raw})
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	// Configure the provider
+	prev := cfglib.DefaultConf
+	cfglib.DefaultConf = &cfglib.Config{
+		AppIssuer: "https://gateway.example",
+		FederationProviders: map[string]cfglib.FederationProvider{
+			testProvider: {Issuer: server.URL, ClientID: testClientID, ClientSecret: "secret"},
+		},
+	}
+	t.Cleanup(func() { cfglib.DefaultConf = prev })
+
+	users := &fakeUserRepo{}
+	fed := &fakeFederationRepo{state: &federationRepo.FederationState{
+		BindingHash:	cryptolib.HashValue(testBinding),
+		Provider:		testProvider,
+		Nonce:			testNonce,
+		CodeVerifier:	"verifier",
+		ExpiresAt:		time.Now().Add(StateLifetime),
+	}}
+	s := &svc{repo: fed, userRepo: users, providers: make(map[string]*oidclib.Provider)}
+
+	return s, users, fed
+}
+
+func TestCompleteRefusesUnverifiedEmailForNewUser(t *testing.T) {
+	s, users, fed := newTestSvc(t, false)
+
+	// An unverified email must not create an account
+	if _, err := s.Complete(testProvider, testState, testBinding, "code"); err != ErrEmailNotVerified {
+		t.Fatalf("expected ErrEmailNotVerified, got %v", err)
+	}
+	if len(users.users) != 0 || len(fed.identities) != 0 {
+		t.Fatal("user or identity created for an unverified email")
+	}
+}
+
+func TestCompleteCreatesUserForVerifiedEmail(t *testing.T) {
+	s, users, fed := newTestSvc(t, true)
+
+	u, err := s.Complete(testProvider, testState, testBinding, "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != testEmail || u.EmailVerifiedAt == nil {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	if len(users.users) != 1 || len(fed.identities) != 1 {
+		t.Fatal("user or identity not created")
+	}
+}
+
+func TestCompleteRefusesUnverifiedEmailForExistingUser(t *testing.T) {
+	s, users, fed := newTestSvc(t, false)
+	if _, err := users.NewUser(testEmail, "hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The identity must not be linked to the account holding the email
+	if _, err := s.Complete(testProvider, testState, testBinding, "code"); err != ErrEmailUnverified {
+		t.Fatalf("expected ErrEmailUnverified, got %v", err)
+	}
+	if len(fed.identities) != 0 {
+		t.Fatal("identity linked for an unverified email")
+	}
+}
+
+func TestCompleteRefusesWrongBinding(t *testing.T) {
+	s, users, _ := newTestSvc(t, true)
+
+	// The callback must come from the browser that started the sign in
+	if _, err := s.Complete(testProvider, testState, "other", "code"); err != ErrStateInvalid {
+		t.Fatalf("expected ErrStateInvalid, got %v", err)
+	}
+	if len(users.users) != 0 {
+		t.Fatal("user created for a foreign callback")
+	}
+}
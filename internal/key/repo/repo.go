@@ -0,0 +1,116 @@
+package keyRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// File handles data logic related to the keys used to sign tokens
+
+// Key of the Postgres advisory lock serializing the rotations between replicas
+const rotationLockKey = 0x6b657972
+
+// This defines a SigningKey struct that represents an asymmetric signing key
+// The private key is stored PEM encoded and encrypted with the app secret
+type SigningKey struct {
+	gorm.Model
+	Kid				string			`json:"kid" gorm:"uniqueIndex"`
+	Algorithm		string			`json:"algorithm"`
+	PrivateKey		string			`json:"-"`
+	RetiredAt		*time.Time		`json:"retired_at" gorm:"index"`
+}
+
+// Repository provides methods for interacting with the signing keys in the database
+type Repo interface {
+	CreateKey(kid string, algorithm string, privateKey string) (*SigningKey, error)
+	GetActiveKey() (*SigningKey, error)
+	GetKey(kid string) (*SigningKey, error)
+	GetVerificationKeys(retiredAfter time.Time) ([]SigningKey, error)
+	RetireKeys(exceptKid string, retiredAt time.Time) (error)
+	DeleteRetiredKeys(retiredBefore time.Time) (error)
+	WithRotationLock(fn func(tx Repo) error) (error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// WithRotationLock runs fn in a transaction holding the rotation lock, so a single replica rotates at a time
+// The lock is released when the transaction ends
+func (r *repo) WithRotationLock(fn func(tx Repo) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", rotationLockKey).Error; err != nil {
+			return err
+		}
+		return fn(&repo{tx})
+	})
+}
+
+// CreateKey creates an entry in the signing keys table
+func (r *repo) CreateKey(kid string, algorithm string, privateKey string) (*SigningKey, error) {
+	k := &SigningKey{
+		Kid:			kid,
+		Algorithm:	algorithm,
+		PrivateKey:	privateKey,
+	}
+
+	if err := r.db.Create(k).Error; err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// GetActiveKey returns the newest key that has not been retired
+func (r *repo) GetActiveKey() (*SigningKey, error) {
+	var k SigningKey
+	err := r.db.Where("retired_at IS NULL").Order("created_at desc").First(&k).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("key not found")
+		}
+		return nil, err
+	}
+	return &k, nil
+}
+
+// GetKey returns the key with the given id
+func (r *repo) GetKey(kid string) (*SigningKey, error) {
+	var k SigningKey
+	err := r.db.Where("kid = ?", kid).First(&k).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("key not found")
+		}
+		return nil, err
+	}
+	return &k, nil
+}
+
+// GetVerificationKeys returns the active keys and the keys retired after the given time
+func (r *repo) GetVerificationKeys(retiredAfter time.Time) ([]SigningKey, error) {
+	var keys []SigningKey
+	err := r.db.Where("retired_at IS NULL OR retired_at > ?", retiredAfter).Order("created_at desc").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RetireKeys marks every active key except the given one as retired
+func (r *repo) RetireKeys(exceptKid string, retiredAt time.Time) error {
+	return r.db.Model(&SigningKey{}).Where("retired_at IS NULL AND kid <> ?", exceptKid).Update("retired_at", retiredAt).Error
+}
+
+// DeleteRetiredKeys deletes the keys retired before the given time
+func (r *repo) DeleteRetiredKeys(retiredBefore time.Time) error {
+	return r.db.Where("retired_at < ?", retiredBefore).Delete(&SigningKey{}).Error
+}
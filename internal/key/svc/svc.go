@@ -0,0 +1,320 @@
+package keySvc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/pkg/jwklib"
+	"github.com/selatoz/gateway/internal/key/repo"
+)
+
+// Define constants
+const (
+	// Errors
+	ErrKeyNotFound				= "signing key not found"
+	ErrUnsupportedAlgorithm	= "unsupported signing algorithm"
+
+	// Supported algorithms
+	AlgRS256	= "RS256"
+	AlgES256	= "ES256"
+	AlgEdDSA	= "EdDSA"
+
+	// PEM block type used for the stored private keys
+	pemPrivateKey = "PRIVATE KEY"
+)
+
+// CheckConfig refuses a signing algorithm no key can be generated for
+func CheckConfig(config *cfglib.Config) error {
+	switch config.TokenSigningAlg {
+	case AlgRS256, AlgES256, AlgEdDSA:
+		return nil
+	}
+
+	return errors.New(ErrUnsupportedAlgorithm)
+}
+
+// Key holds a parsed signing key
+type Key struct {
+	Kid			string
+	Method		jwt.SigningMethod
+	Private		crypto.Signer
+	Public		crypto.PublicKey
+	CreatedAt	time.Time
+	RetiredAt	*time.Time
+}
+
+// Svc is an interface for defining the methods that the key service will provide.
+type Svc interface {
+	SigningKey() (*Key, error)
+	VerificationKey(kid string) (*Key, error)
+	Rotate() (*Key, error)
+	JWKS() (*jwklib.JWKSet, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for signing keys.
+type svc struct {
+	repo		keyRepo.Repo
+	mu			sync.Mutex
+	cache		map[string]*Key
+	rotateMu	sync.Mutex
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB) Svc {
+	return &svc{
+		repo: keyRepo.NewRepo(db),
+		cache: make(map[string]*Key),
+	}
+}
+
+// SigningKey returns the active signing key, rotating it when it is older than the configured rotation period
+// Concurrent callers, in this process or another replica, rotate once: the state is checked again under the locks
+func (s *svc) SigningKey() (*Key, error) {
+	k, err := s.repo.GetActiveKey()
+	if err == nil && !stale(k) {
+		return s.parse(k)
+	}
+
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+
+	var active *keyRepo.SigningKey
+	err = s.repo.WithRotationLock(func(tx keyRepo.Repo) error {
+		// Handle a rotation done while waiting for the locks
+		k, err := tx.GetActiveKey()
+		if err == nil && !stale(k) {
+			active = k
+			return nil
+		}
+
+		// Handle first start, when no key exists yet, and expired key
+		active, err = s.rotate(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.parse(active)
+}
+
+// VerificationKey returns the key with the given id, as long as it is still valid for verification
+func (s *svc) VerificationKey(kid string) (*Key, error) {
+	if kid == "" {
+		return nil, errors.New(ErrKeyNotFound)
+	}
+
+	k, err := s.repo.GetKey(kid)
+	if err != nil {
+		return nil, errors.New(ErrKeyNotFound)
+	}
+
+	// Retired keys stay valid until every token they signed has expired
+	if k.RetiredAt != nil && k.RetiredAt.Before(verificationCutoff()) {
+		return nil, errors.New(ErrKeyNotFound)
+	}
+
+	return s.parse(k)
+}
+
+// Rotate generates a new signing key and retires the previous ones
+func (s *svc) Rotate() (*Key, error) {
+	s.rotateMu.Lock()
+	defer s.rotateMu.Unlock()
+
+	var k *keyRepo.SigningKey
+	err := s.repo.WithRotationLock(func(tx keyRepo.Repo) error {
+		var err error
+		k, err = s.rotate(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.parse(k)
+}
+
+// rotate stores a new signing key and retires the previous ones, within the rotation lock
+func (s *svc) rotate(tx keyRepo.Repo) (*keyRepo.SigningKey, error) {
+	alg := cfglib.DefaultConf.TokenSigningAlg
+
+	// Generate the private key
+	priv, err := generateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the public key thumbprint as the key id
+	jwk, err := jwklib.FromPublicKey(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	kid, err := jwk.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode and encrypt the private key
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := cryptolib.Encrypt(cfglib.DefaultConf.AppSecret, pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Bytes: der}))
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the new key, then retire the others
+	k, err := tx.CreateKey(kid, alg, enc)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := tx.RetireKeys(kid, now); err != nil {
+		return nil, err
+	}
+
+	// Remove keys that can no longer verify any token
+	if err := tx.DeleteRetiredKeys(verificationCutoff()); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cache = make(map[string]*Key)
+	s.mu.Unlock()
+
+	return k, nil
+}
+
+// JWKS returns the public keys that are valid for verification
+func (s *svc) JWKS() (*jwklib.JWKSet, error) {
+	keys, err := s.repo.GetVerificationKeys(verificationCutoff())
+	if err != nil {
+		return nil, err
+	}
+
+	set := &jwklib.JWKSet{Keys: []jwklib.JWK{}}
+	for i := range keys {
+		k, err := s.parse(&keys[i])
+		if err != nil {
+			return nil, err
+		}
+
+		jwk, err := jwklib.FromPublicKey(k.Public)
+		if err != nil {
+			return nil, err
+		}
+		jwk.Kid = k.Kid
+		jwk.Alg = k.Method.Alg()
+		jwk.Use = "sig"
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set, nil
+}
+
+// parse decrypts and decodes a stored key, caching the result by key id
+func (s *svc) parse(sk *keyRepo.SigningKey) (*Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Handle cached key, refreshing the retirement state
+	if k, ok := s.cache[sk.Kid]; ok {
+		k.RetiredAt = sk.RetiredAt
+		return k, nil
+	}
+
+	method := signingMethod(sk.Algorithm)
+	if method == nil {
+		return nil, errors.New(ErrUnsupportedAlgorithm)
+	}
+
+	// Decrypt and decode the private key
+	b, err := cryptolib.Decrypt(cfglib.DefaultConf.AppSecret, sk.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != pemPrivateKey {
+		return nil, errors.New(ErrKeyNotFound)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New(ErrUnsupportedAlgorithm)
+	}
+
+	k := &Key{
+		Kid:			sk.Kid,
+		Method:		method,
+		Private:		signer,
+		Public:		signer.Public(),
+		CreatedAt:	sk.CreatedAt,
+		RetiredAt:	sk.RetiredAt,
+	}
+	s.cache[sk.Kid] = k
+
+	return k, nil
+}
+
+// stale reports whether the key is older than the configured rotation period
+func stale(k *keyRepo.SigningKey) bool {
+	rotation := time.Duration(cfglib.DefaultConf.TokenKeyRotation * float32(time.Hour))
+	return rotation > 0 && time.Now().After(k.CreatedAt.Add(rotation))
+}
+
+// verificationCutoff returns the retirement time before which a key can no longer have valid tokens
+func verificationCutoff() time.Time {
+	lifetime := cfglib.DefaultConf.TokenExpRefresh
+	if cfglib.DefaultConf.TokenExpAccess > lifetime {
+		lifetime = cfglib.DefaultConf.TokenExpAccess
+	}
+
+	return time.Now().Add(-time.Duration(lifetime * float32(time.Hour)))
+}
+
+// signingMethod maps an algorithm name to its jwt-go signing method
+func signingMethod(alg string) jwt.SigningMethod {
+	switch alg {
+	case AlgRS256:
+		return jwt.SigningMethodRS256
+	case AlgES256:
+		return jwt.SigningMethodES256
+	case AlgEdDSA:
+		return jwklib.EdDSA
+	}
+
+	return nil
+}
+
+// generateKey creates a new private key for the given algorithm
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case AlgRS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+
+	return nil, errors.New(ErrUnsupportedAlgorithm)
+}
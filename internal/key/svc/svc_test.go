@@ -0,0 +1,230 @@
+package keySvc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/internal/key/repo"
+)
+
+// fakeKeyRepo holds the signing keys in memory
+type fakeKeyRepo struct {
+	keys	[]*keyRepo.SigningKey
+}
+
+func (r *fakeKeyRepo) CreateKey(kid string, algorithm string, privateKey string) (*keyRepo.SigningKey, error) {
+	k := &keyRepo.SigningKey{Kid: kid, Algorithm: algorithm, PrivateKey: privateKey}
+	k.ID = uint(len(r.keys) + 1)
+	k.CreatedAt = time.Now()
+	r.keys = append(r.keys, k)
+	return k, nil
+}
+
+func (r *fakeKeyRepo) GetActiveKey() (*keyRepo.SigningKey, error) {
+	var active *keyRepo.SigningKey
+	for _, k := range r.keys {
+		if k.RetiredAt == nil && (active == nil || k.CreatedAt.After(active.CreatedAt)) {
+			active = k
+		}
+	}
+	if active == nil {
+		return nil, errors.New("key not found")
+	}
+	return active, nil
+}
+
+func (r *fakeKeyRepo) GetKey(kid string) (*keyRepo.SigningKey, error) {
+	for _, k := range r.keys {
+		if k.Kid == kid {
+			return k, nil
+		}
+	}
+	return nil, errors.New("key not found")
+}
+
+func (r *fakeKeyRepo) GetVerificationKeys(retiredAfter time.Time) ([]keyRepo.SigningKey, error) {
+	keys := []keyRepo.SigningKey{}
+	for _, k := range r.keys {
+		if k.RetiredAt == nil || k.RetiredAt.After(retiredAfter) {
+			keys = append(keys, *k)
+		}
+	}
+	return keys, nil
+}
+
+func (r *fakeKeyRepo) RetireKeys(exceptKid string, retiredAt time.Time) error {
+	for _, k := range r.keys {
+		if k.RetiredAt == nil && k.Kid != exceptKid {
+			at := retiredAt
+			k.RetiredAt = &at
+		}
+	}
+	return nil
+}
+
+func (r *fakeKeyRepo) DeleteRetiredKeys(retiredBefore time.Time) error {
+	kept := r.keys[:0]
+	for _, k := range r.keys {
+		if k.RetiredAt == nil || !k.RetiredAt.Before(retiredBefore) {
+			kept = append(kept, k)
+		}
+	}
+	r.keys = kept
+	return nil
+}
+
+func (r *fakeKeyRepo) WithRotationLock(fn func(tx keyRepo.Repo) error) error {
+	return fn(r)
+}
+
+// newTestSvc returns a service signing with ES256 keys rotated every 720 hours
+// Tokens live at most 168 hours, so retired keys verify for 168 hours
+func newTestSvc(t *testing.T) (*svc, *fakeKeyRepo) {
+	prev := cfglib.DefaultConf
+	cfglib.DefaultConf = &cfglib.Config{
+		AppSecret:				"test-secret",
+		TokenSigningAlg:		AlgES256,
+		TokenKeyRotation:		720,
+		TokenExpAccess:		1,
+		TokenExpRefresh:		168,
+	}
+	t.Cleanup(func() { cfglib.DefaultConf = prev })
+
+	r := &fakeKeyRepo{}
+	return &svc{repo: r, cache: make(map[string]*Key)}, r
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	cases := []struct {
+		name			string
+		age			time.Duration
+		rotation		float32
+		rotated		bool
+	}{
+		{"fresh key", time.Hour, 720, false},
+		{"stale key", 721 * time.Hour, 720, true},
+		{"rotation disabled", 10000 * time.Hour, 0, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, r := newTestSvc(t)
+			cfglib.DefaultConf.TokenKeyRotation = tc.rotation
+
+			// Handle first start
+			first, err := s.SigningKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.keys) != 1 {
+				t.Fatalf("expected 1 key, got %d", len(r.keys))
+			}
+			r.keys[0].CreatedAt = time.Now().Add(-tc.age)
+
+			k, err := s.SigningKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (k.Kid != first.Kid) != tc.rotated {
+				t.Fatalf("rotated = %v, want %v", k.Kid != first.Kid, tc.rotated)
+			}
+			if !tc.rotated {
+				return
+			}
+
+			// The previous key is retired but still verifies
+			old, err := r.GetKey(first.Kid)
+			if err != nil || old.RetiredAt == nil {
+				t.Fatal("previous key not retired")
+			}
+			if _, err := s.VerificationKey(first.Kid); err != nil {
+				t.Fatalf("previous key refused for verification: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerificationKeyCutoff(t *testing.T) {
+	cases := []struct {
+		name			string
+		retired		time.Duration
+		valid			bool
+	}{
+		{"active key", 0, true},
+		{"recently retired", time.Hour, true},
+		{"retired within the token lifetime", 167 * time.Hour, true},
+		{"retired past the token lifetime", 169 * time.Hour, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, r := newTestSvc(t)
+			k, err := s.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.retired > 0 {
+				at := time.Now().Add(-tc.retired)
+				r.keys[0].RetiredAt = &at
+			}
+
+			_, err = s.VerificationKey(k.Kid)
+			if (err == nil) != tc.valid {
+				t.Fatalf("valid = %v, want %v (%v)", err == nil, tc.valid, err)
+			}
+
+			// The published keys match the keys accepted for verification
+			set, err := s.JWKS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(set.Keys) == 1) != tc.valid {
+				t.Fatalf("published %d keys", len(set.Keys))
+			}
+		})
+	}
+}
+
+func TestVerificationKeyUnknown(t *testing.T) {
+	s, _ := newTestSvc(t)
+	if _, err := s.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kid := range []string{"", "unknown"} {
+		if _, err := s.VerificationKey(kid); err == nil {
+			t.Errorf("kid %q accepted", kid)
+		}
+	}
+}
+
+func TestRotateDeletesExpiredKeys(t *testing.T) {
+	s, r := newTestSvc(t)
+	first, err := s.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retire the first key past the cutoff, the next rotation removes it
+	at := time.Now().Add(-200 * time.Hour)
+	r.keys[0].RetiredAt = &at
+	third, err := s.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.GetKey(first.Kid); err == nil {
+		t.Error("expired key kept")
+	}
+	if _, err := s.VerificationKey(second.Kid); err != nil {
+		t.Errorf("retired key refused: %v", err)
+	}
+	active, err := r.GetActiveKey()
+	if err != nil || active.Kid != third.Kid {
+		t.Error("newest key not active")
+	}
+}
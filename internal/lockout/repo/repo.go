@@ -0,0 +1,167 @@
+package lockoutRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// File handles data logic related to failed logins and lockouts
+
+// Define errors
+var ErrThrottleNotFound = errors.New("throttle not found")
+
+// This defines a LoginThrottle struct that counts the recent failed logins of an account or an IP address
+// Key is "account:<email>" or "ip:<address>", accounts are tracked by email so unknown emails behave the same
+// Lockouts counts the consecutive lockouts, each one lasting longer than the previous
+type LoginThrottle struct {
+	gorm.Model
+	Key				string				`json:"key" gorm:"uniqueIndex"`
+	Failures			int					`json:"failures"`
+	Lockouts			int					`json:"lockouts"`
+	LastFailureAt	time.Time			`json:"last_failure_at"`
+	LockedUntil		*time.Time			`json:"locked_until"`
+}
+
+// This defines a LockoutEvent struct that records a lockout or an unlock
+// UserID is zero for IP addresses and unknown emails, ActorID is the admin of a manual unlock
+type LockoutEvent struct {
+	gorm.Model
+	Key				string				`json:"key" gorm:"index"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	EventType		string				`json:"event_type" gorm:"index"`
+	IP					string				`json:"ip"`
+	Failures			int					`json:"failures"`
+	LockedUntil		*time.Time			`json:"locked_until"`
+	ActorID			uint					`json:"actor_id"`
+}
+
+// EventFilter selects lockout events, zero values match everything
+// Events are returned newest first, Before is the id of the last event of the previous page
+type EventFilter struct {
+	UserID		uint
+	EventType	string
+	Key			string
+	Before		uint
+	Limit			int
+}
+
+// Repository provides methods for interacting with the lockout records in the database
+type Repo interface {
+	GetThrottle(key string) (*LoginThrottle, error)
+	RecordFailure(key string, at time.Time, window time.Duration, memory time.Duration) (*LoginThrottle, error)
+	Lock(key string, until time.Time, at time.Time) (bool, error)
+	Unlock(key string, lockedUntil time.Time) (bool, error)
+	DeleteThrottle(key string) (bool, error)
+
+	CreateEvent(e *LockoutEvent) (*LockoutEvent, error)
+	GetEvents(filter *EventFilter) ([]LockoutEvent, error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// GetThrottle returns the failure count of the given key
+func (r *repo) GetThrottle(key string) (*LoginThrottle, error) {
+	var t LoginThrottle
+	err := r.db.Where("key = ?", key).First(&t).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrThrottleNotFound
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+// RecordFailure counts a failed login for the key
+// Failures older than the window and lockouts older than the memory are forgotten
+func (r *repo) RecordFailure(key string, at time.Time, window time.Duration, memory time.Duration) (*LoginThrottle, error) {
+	t := LoginThrottle{Key: key, Failures: 1, LastFailureAt: at}
+	err := r.db.Clauses(clause.OnConflict{
+		Columns:		[]clause.Column{{Name: "key"}},
+		DoUpdates:	clause.Assignments(map[string]interface{}{
+			"failures":				gorm.Expr("CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END", at.Add(-window)),
+			"lockouts":				gorm.Expr("CASE WHEN login_throttles.last_failure_at < ? THEN 0 ELSE login_throttles.lockouts END", at.Add(-memory)),
+			"last_failure_at":	at,
+			"updated_at":			at,
+		}),
+	}).Create(&t).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetThrottle(key)
+}
+
+// Lock locks the key until the given time, reporting false when it is already locked
+func (r *repo) Lock(key string, until time.Time, at time.Time) (bool, error) {
+	res := r.db.Model(&LoginThrottle{}).Where("key = ? AND (locked_until IS NULL OR locked_until < ?)", key, at).
+		Updates(map[string]interface{}{"locked_until": until, "lockouts": gorm.Expr("lockouts + 1")})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// Unlock clears an expired lock and the failures, keeping the lockout count
+// It reports false when another request already did
+func (r *repo) Unlock(key string, lockedUntil time.Time) (bool, error) {
+	res := r.db.Model(&LoginThrottle{}).Where("key = ? AND locked_until = ?", key, lockedUntil).
+		Updates(map[string]interface{}{"locked_until": nil, "failures": 0})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteThrottle forgets the failures and lockouts of the key, reporting false when there were none
+func (r *repo) DeleteThrottle(key string) (bool, error) {
+	res := r.db.Unscoped().Where("key = ?", key).Delete(&LoginThrottle{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// CreateEvent creates an entry in the lockout events table
+func (r *repo) CreateEvent(e *LockoutEvent) (*LockoutEvent, error) {
+	if err := r.db.Create(e).Error; err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// GetEvents returns the lockout events matching the filter, newest first
+func (r *repo) GetEvents(filter *EventFilter) ([]LockoutEvent, error) {
+	q := r.db.Model(&LockoutEvent{})
+	if filter.UserID != 0 {
+		q = q.Where("user_id = ?", filter.UserID)
+	}
+	if filter.EventType != "" {
+		q = q.Where("event_type = ?", filter.EventType)
+	}
+	if filter.Key != "" {
+		q = q.Where("key = ?", filter.Key)
+	}
+	if filter.Before != 0 {
+		q = q.Where("id < ?", filter.Before)
+	}
+
+	var events []LockoutEvent
+	if err := q.Order("id DESC").Limit(filter.Limit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
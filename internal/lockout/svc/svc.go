@@ -0,0 +1,273 @@
+package lockoutSvc
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/lockout/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	// Types of lockout events
+	EventLocked				= "locked"
+	EventUnlocked			= "unlocked"
+	EventAdminUnlocked	= "admin_unlocked"
+
+	// Failures older than the window are forgotten
+	FailureWindow = 15 * time.Minute
+
+	// Lockouts are forgotten a day after the last failure
+	LockoutMemory = 24 * time.Hour
+
+	// The first lockout lasts LockoutDuration, each following one twice as long
+	LockoutDuration		= 15 * time.Minute
+	LockoutMaxDuration	= 24 * time.Hour
+
+	// Past the backoff threshold, each failure doubles the wait before the next attempt
+	BackoffBase	= time.Second
+	BackoffMax	= 5 * time.Minute
+
+	// Lockout events returned per page
+	DefaultEventLimit	= 50
+	MaxEventLimit		= 200
+)
+
+// Define errors
+var (
+	ErrLocked		= errors.New("too many failed logins, try again later")
+	ErrThrottled	= errors.New("too many failed logins, slow down")
+	ErrNotLocked	= errors.New("account is not locked")
+)
+
+// policy holds the limits of a kind of key
+// Addresses are shared behind NATs and proxies, so they are allowed many more failures than accounts
+type policy struct {
+	prefix			string
+	backoffAfter	int
+	lockAfter		int
+}
+
+var (
+	accountPolicy	= policy{prefix: "account:", backoffAfter: 3, lockAfter: 5}
+	ipPolicy			= policy{prefix: "ip:", backoffAfter: 20, lockAfter: 50}
+)
+
+// Svc is an interface for defining the methods that the lockout service will provide.
+type Svc interface {
+	Check(email string, ip string) (time.Duration, error)
+	RecordFailure(email string, ip string, userID uint) (error)
+	RecordSuccess(email string) (error)
+	Unlock(userID uint, actorID uint) (error)
+	ListEvents(filter *lockoutRepo.EventFilter) ([]lockoutRepo.LockoutEvent, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for login throttling.
+type svc struct {
+	repo			lockoutRepo.Repo
+	userRepo		userRepo.Repo
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB) Svc {
+	return &svc{
+		repo: lockoutRepo.NewRepo(db),
+		userRepo: userRepo.NewRepo(db),
+	}
+}
+
+// Check reports whether a login for the email may be attempted from the address
+// When it may not, it returns the time left before the next attempt
+// Emails are tracked whether an account exists or not, so the answer does not reveal accounts
+// Failing to read the failures is an error, logins are not let through unchecked
+func (s *svc) Check(email string, ip string) (time.Duration, error) {
+	now := time.Now()
+	for _, k := range []struct{ p policy; value string }{{accountPolicy, accountValue(email)}, {ipPolicy, ip}} {
+		t, err := s.repo.GetThrottle(k.p.prefix + k.value)
+		if err == lockoutRepo.ErrThrottleNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		// Locked keys unlock by themselves once the lock ran out
+		if t.LockedUntil != nil {
+			if now.Before(*t.LockedUntil) {
+				return t.LockedUntil.Sub(now), ErrLocked
+			}
+			if err := s.expire(t, k.p, ip); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		// Apply the backoff of recent failures
+		if t.LastFailureAt.Before(now.Add(-FailureWindow)) {
+			continue
+		}
+		if wait := backoff(t.Failures, k.p); wait > 0 {
+			if next := t.LastFailureAt.Add(wait); now.Before(next) {
+				return next.Sub(now), ErrThrottled
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// RecordFailure counts a failed login for the email and the address, locking them past their limit
+// userID is zero when no account has the email
+func (s *svc) RecordFailure(email string, ip string, userID uint) error {
+	if err := s.recordFailure(accountPolicy, accountValue(email), userID, ip); err != nil {
+		return err
+	}
+
+	return s.recordFailure(ipPolicy, ip, 0, ip)
+}
+
+// RecordSuccess forgets the failures of the email after a successful login
+// The address keeps its failures, a valid login must not hide a spray across accounts
+func (s *svc) RecordSuccess(email string) error {
+	_, err := s.repo.DeleteThrottle(accountPolicy.prefix + accountValue(email))
+	return err
+}
+
+// Unlock lifts the lockout and the backoff of a user before they run out
+func (s *svc) Unlock(userID uint, actorID uint) error {
+	u, err := s.userRepo.GetById(userID)
+	if err != nil {
+		return err
+	}
+
+	key := accountPolicy.prefix + accountValue(u.Email)
+	t, err := s.repo.GetThrottle(key)
+	if err == lockoutRepo.ErrThrottleNotFound {
+		return ErrNotLocked
+	}
+	if err != nil {
+		return err
+	}
+	deleted, err := s.repo.DeleteThrottle(key)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrNotLocked
+	}
+
+	_, err = s.repo.CreateEvent(&lockoutRepo.LockoutEvent{
+		Key:				key,
+		UserID:			userID,
+		EventType:		EventAdminUnlocked,
+		Failures:		t.Failures,
+		LockedUntil:	t.LockedUntil,
+		ActorID:			actorID,
+	})
+	return err
+}
+
+// ListEvents returns the lockout events matching the filter, newest first
+func (s *svc) ListEvents(filter *lockoutRepo.EventFilter) ([]lockoutRepo.LockoutEvent, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultEventLimit
+	}
+	if filter.Limit > MaxEventLimit {
+		filter.Limit = MaxEventLimit
+	}
+
+	return s.repo.GetEvents(filter)
+}
+
+// recordFailure counts a failure for the key and locks it once it reached the limit of its policy
+func (s *svc) recordFailure(p policy, value string, userID uint, ip string) error {
+	now := time.Now()
+	key := p.prefix + value
+	t, err := s.repo.RecordFailure(key, now, FailureWindow, LockoutMemory)
+	if err != nil {
+		return err
+	}
+	if t.Failures < p.lockAfter {
+		return nil
+	}
+
+	// Only the request that locks the key records the event
+	until := now.Add(lockoutDuration(t.Lockouts))
+	locked, err := s.repo.Lock(key, until, now)
+	if err != nil || !locked {
+		return err
+	}
+
+	_, err = s.repo.CreateEvent(&lockoutRepo.LockoutEvent{
+		Key:				key,
+		UserID:			userID,
+		EventType:		EventLocked,
+		IP:				ip,
+		Failures:		t.Failures,
+		LockedUntil:	&until,
+	})
+	return err
+}
+
+// expire clears a lock that ran out, only the request that clears it records the event
+func (s *svc) expire(t *lockoutRepo.LoginThrottle, p policy, ip string) error {
+	unlocked, err := s.repo.Unlock(t.Key, *t.LockedUntil)
+	if err != nil || !unlocked {
+		return err
+	}
+
+	// Find the account of the email, if any
+	var userID uint
+	if p == accountPolicy {
+		if u, err := s.userRepo.GetByEmail(strings.TrimPrefix(t.Key, p.prefix)); err == nil {
+			userID = u.ID
+		}
+	}
+
+	_, err = s.repo.CreateEvent(&lockoutRepo.LockoutEvent{
+		Key:				t.Key,
+		UserID:			userID,
+		EventType:		EventUnlocked,
+		IP:				ip,
+		Failures:		t.Failures,
+		LockedUntil:	t.LockedUntil,
+	})
+	return err
+}
+
+// backoff returns the wait after the given number of consecutive failures
+func backoff(failures int, p policy) time.Duration {
+	if failures < p.backoffAfter {
+		return 0
+	}
+
+	wait := BackoffBase
+	for i := p.backoffAfter; i < failures && wait < BackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > BackoffMax {
+		wait = BackoffMax
+	}
+	return wait
+}
+
+// lockoutDuration returns the length of the next lockout after the given number of earlier ones
+func lockoutDuration(lockouts int) time.Duration {
+	d := LockoutDuration
+	for i := 0; i < lockouts && d < LockoutMaxDuration; i++ {
+		d *= 2
+	}
+	if d > LockoutMaxDuration {
+		d = LockoutMaxDuration
+	}
+	return d
+}
+
+// accountValue normalizes the email so its case does not split its failures
+func accountValue(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,140 @@
+package lockoutSvc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/selatoz/gateway/internal/lockout/repo"
+)
+
+// fakeLockoutRepo holds the throttles in memory, failing every read when err is set
+type fakeLockoutRepo struct {
+	throttles	map[string]*lockoutRepo.LoginThrottle
+	err			error
+}
+
+func (r *fakeLockoutRepo) GetThrottle(key string) (*lockoutRepo.LoginThrottle, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	t, ok := r.throttles[key]
+	if !ok {
+		return nil, lockoutRepo.ErrThrottleNotFound
+	}
+	return t, nil
+}
+
+func (r *fakeLockoutRepo) RecordFailure(key string, at time.Time, window time.Duration, memory time.Duration) (*lockoutRepo.LoginThrottle, error) {
+	return nil, errors.New("not supported")
+}
+
+func (r *fakeLockoutRepo) Lock(key string, until time.Time, at time.Time) (bool, error) {
+	return false, nil
+}
+
+func (r *fakeLockoutRepo) Unlock(key string, lockedUntil time.Time) (bool, error) {
+	return false, nil
+}
+
+func (r *fakeLockoutRepo) DeleteThrottle(key string) (bool, error) {
+	return false, nil
+}
+
+func (r *fakeLockoutRepo) CreateEvent(e *lockoutRepo.LockoutEvent) (*lockoutRepo.LockoutEvent, error) {
+	return e, nil
+}
+
+func (r *fakeLockoutRepo) GetEvents(filter *lockoutRepo.EventFilter) ([]lockoutRepo.LockoutEvent, error) {
+	return nil, nil
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		failures		int
+		p				policy
+		want			time.Duration
+	}{
+		{0, accountPolicy, 0},
+		{2, accountPolicy, 0},
+		{3, accountPolicy, time.Second},
+		{4, accountPolicy, 2 * time.Second},
+		{6, accountPolicy, 8 * time.Second},
+		{11, accountPolicy, 256 * time.Second},
+		{12, accountPolicy, BackoffMax},
+		{1000, accountPolicy, BackoffMax},
+		{19, ipPolicy, 0},
+		{20, ipPolicy, time.Second},
+		{22, ipPolicy, 4 * time.Second},
+	}
+	for _, tc := range cases {
+		if got := backoff(tc.failures, tc.p); got != tc.want {
+			t.Errorf("backoff(%d, %s) = %s, want %s", tc.failures, tc.p.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	cases := []struct {
+		lockouts		int
+		want			time.Duration
+	}{
+		{0, 15 * time.Minute},
+		{1, 30 * time.Minute},
+		{2, time.Hour},
+		{6, 16 * time.Hour},
+		{7, LockoutMaxDuration},
+		{1000, LockoutMaxDuration},
+	}
+	for _, tc := range cases {
+		if got := lockoutDuration(tc.lockouts); got != tc.want {
+			t.Errorf("lockoutDuration(%d) = %s, want %s", tc.lockouts, got, tc.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	future := now.Add(time.Minute)
+	cases := []struct {
+		name			string
+		throttles	map[string]*lockoutRepo.LoginThrottle
+		repoErr		error
+		err			error
+	}{
+		{"no failures", nil, nil, nil},
+		{"failures below the backoff", map[string]*lockoutRepo.LoginThrottle{
+			"account:user@example.com": {Key: "account:user@example.com", Failures: 2, LastFailureAt: now},
+		}, nil, nil},
+		{"account in backoff", map[string]*lockoutRepo.LoginThrottle{
+			"account:user@example.com": {Key: "account:user@example.com", Failures: 4, LastFailureAt: now},
+		}, nil, ErrThrottled},
+		{"backoff ran out", map[string]*lockoutRepo.LoginThrottle{
+			"account:user@example.com": {Key: "account:user@example.com", Failures: 4, LastFailureAt: now.Add(-time.Minute)},
+		}, nil, nil},
+		{"failures out of the window", map[string]*lockoutRepo.LoginThrottle{
+			"account:user@example.com": {Key: "account:user@example.com", Failures: 12, LastFailureAt: now.Add(-FailureWindow - time.Minute)},
+		}, nil, nil},
+		{"account locked", map[string]*lockoutRepo.LoginThrottle{
+			"account:user@example.com": {Key: "account:user@example.com", Failures: 5, LastFailureAt: now, LockedUntil: &future},
+		}, nil, ErrLocked},
+		{"address locked", map[string]*lockoutRepo.LoginThrottle{
+			"ip:192.0.2.1": {Key: "ip:192.0.2.1", Failures: 50, LastFailureAt: now, LockedUntil: &future},
+		}, nil, ErrLocked},
+		{"database down", nil, errors.New("connection refused"), errors.New("connection refused")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &svc{repo: &fakeLockoutRepo{throttles: tc.throttles, err: tc.repoErr}}
+
+			// Emails are matched whatever their case
+			wait, err := s.Check(" User@Example.com", "192.0.2.1")
+			if (err == nil) != (tc.err == nil) || (err != nil && err.Error() != tc.err.Error()) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if (tc.err == ErrLocked || tc.err == ErrThrottled) != (wait > 0) {
+				t.Fatalf("unexpected wait %s", wait)
+			}
+		})
+	}
+}
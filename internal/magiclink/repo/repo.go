@@ -0,0 +1,98 @@
+package magicLinkRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// File handles data logic related to passwordless logins
+
+// This defines a MagicLogin struct that holds a pending passwordless login
+// RequestHash identifies the login, SecretHash is the keyed hash of the link nonce or of the code
+// The login can only be completed from the user agent that asked for it
+type MagicLogin struct {
+	gorm.Model
+	User      		*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	RequestHash		string				`json:"-" gorm:"uniqueIndex"`
+	Method			string				`json:"method"`
+	SecretHash		string				`json:"-"`
+	UserAgentHash	string				`json:"-"`
+	Attempts			int					`json:"attempts"`
+	ExpiresAt		time.Time			`json:"expires_at" gorm:"index"`
+}
+
+// Repository provides methods for interacting with the passwordless logins in the database
+type Repo interface {
+	CreateLogin(ml *MagicLogin) (*MagicLogin, error)
+	GetLogin(requestHash string) (*MagicLogin, error)
+	ClaimAttempt(id uint, maxAttempts int) (bool, error)
+	DeleteLogin(id uint) (bool, error)
+	DeletePendingLogins(userID uint) (error)
+	DeleteExpiredLogins(before time.Time) (error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// CreateLogin creates an entry in the magic logins table
+func (r *repo) CreateLogin(ml *MagicLogin) (*MagicLogin, error) {
+	if err := r.db.Create(ml).Error; err != nil {
+		return nil, err
+	}
+
+	return ml, nil
+}
+
+// GetLogin returns the login with the given request hash
+func (r *repo) GetLogin(requestHash string) (*MagicLogin, error) {
+	var ml MagicLogin
+	err := r.db.Where("request_hash = ?", requestHash).First(&ml).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("login not found")
+		}
+		return nil, err
+	}
+	return &ml, nil
+}
+
+// ClaimAttempt counts an attempt at a login, reporting false when maxAttempts were already made
+// The check and the increment are a single statement, so concurrent requests cannot exceed the limit
+func (r *repo) ClaimAttempt(id uint, maxAttempts int) (bool, error) {
+	res := r.db.Model(&MagicLogin{}).Where("id = ? AND attempts < ?", id, maxAttempts).Update("attempts", gorm.Expr("attempts + 1"))
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteLogin deletes a login, reporting false when another request already did
+func (r *repo) DeleteLogin(id uint) (bool, error) {
+	res := r.db.Unscoped().Where("id = ?", id).Delete(&MagicLogin{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeletePendingLogins deletes the pending logins of a user, so only the latest link or code works
+func (r *repo) DeletePendingLogins(userID uint) error {
+	return r.db.Unscoped().Where("user_id = ?", userID).Delete(&MagicLogin{}).Error
+}
+
+// DeleteExpiredLogins deletes the logins that expired before the given time
+func (r *repo) DeleteExpiredLogins(before time.Time) error {
+	return r.db.Unscoped().Where("expires_at < ?", before).Delete(&MagicLogin{}).Error
+}
@@ -0,0 +1,59 @@
+package magicLinkSvc
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/maillib"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Sender delivers the link or the code of a passwordless login to the user
+type Sender interface {
+	SendLink(u *userRepo.User, link string, expiresAt time.Time) (error)
+	SendCode(u *userRepo.User, code string, expiresAt time.Time) (error)
+}
+
+// mailSender delivers the logins by email
+type mailSender struct {
+	mailer	maillib.Mailer
+}
+
+// NewMailSender returns a sender mailing the logins with the given mailer
+func NewMailSender(mailer maillib.Mailer) Sender {
+	return &mailSender{mailer: mailer}
+}
+
+func (s *mailSender) SendLink(u *userRepo.User, link string, expiresAt time.Time) error {
+	return s.send("magic_link", u, map[string]interface{}{
+		"AppName":		cfglib.DefaultConf.AppName,
+		"Email":			u.Email,
+		"Link":			link,
+		"ExpiresIn":	expiresIn(expiresAt),
+	})
+}
+
+func (s *mailSender) SendCode(u *userRepo.User, code string, expiresAt time.Time) error {
+	return s.send("login_code", u, map[string]interface{}{
+		"AppName":		cfglib.DefaultConf.AppName,
+		"Email":			u.Email,
+		"Code":			code,
+		"ExpiresIn":	expiresIn(expiresAt),
+	})
+}
+
+func (s *mailSender) send(template string, u *userRepo.User, data map[string]interface{}) error {
+	msg, err := maillib.Render(template, u.Email, data)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(msg)
+}
+
+// expiresIn returns the remaining lifetime in minutes, as shown to the user
+func expiresIn(expiresAt time.Time) string {
+	return fmt.Sprintf("%d minutes", int(math.Round(time.Until(expiresAt).Minutes())))
+}
@@ -0,0 +1,240 @@
+package magicLinkSvc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/internal/magiclink/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	// Ways of delivering a login
+	MethodLink	= "link"
+	MethodCode	= "code"
+
+	// Time the user has to complete a login
+	LoginLifetime = 15 * time.Minute
+
+	// Codes allowed per login
+	LoginMaxAttempts = 5
+
+	// Digits of a login code
+	CodeDigits = 6
+)
+
+// Define errors
+var (
+	ErrInvalidMethod	= errors.New("invalid login method")
+	ErrLoginInvalid	= errors.New("invalid or expired login")
+	ErrCodeInvalid		= errors.New("invalid code")
+)
+
+// Svc is an interface for defining the methods that the passwordless login service will provide.
+type Svc interface {
+	Request(email string, method string, userAgent string) (string, time.Time, error)
+	VerifyLink(token string, userAgent string) (uint, error)
+	VerifyCode(requestID string, code string, userAgent string) (uint, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for passwordless logins.
+type svc struct {
+	repo			magicLinkRepo.Repo
+	userRepo		userRepo.Repo
+	sender		Sender
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB, sender Sender) Svc {
+	return &svc{
+		repo: magicLinkRepo.NewRepo(db),
+		userRepo: userRepo.NewRepo(db),
+		sender: sender,
+	}
+}
+
+// Request starts a passwordless login and returns its request id, needed to submit a code
+// The lookup and the delivery run in the background, so the response does not reveal whether the account exists
+func (s *svc) Request(email string, method string, userAgent string) (string, time.Time, error) {
+	if method != MethodLink && method != MethodCode {
+		return "", time.Time{}, ErrInvalidMethod
+	}
+
+	requestID, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(LoginLifetime)
+
+	go func() {
+		err := s.deliver(email, method, userAgent, requestID, expiresAt)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("magic link delivery failed: %s", err)
+		}
+	}()
+
+	return requestID, expiresAt, nil
+}
+
+// VerifyLink completes a login with the signed link and returns the user
+func (s *svc) VerifyLink(token string, userAgent string) (uint, error) {
+	// Tokens look like <request id>.<nonce>.<signature>
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, ErrLoginInvalid
+	}
+	if !hmac.Equal([]byte(keyedHash(parts[0] + "." + parts[1])), []byte(parts[2])) {
+		return 0, ErrLoginInvalid
+	}
+
+	ml, err := s.pendingLogin(parts[0], MethodLink, userAgent)
+	if err != nil {
+		return 0, err
+	}
+	if !hmac.Equal([]byte(keyedHash(parts[1])), []byte(ml.SecretHash)) {
+		return 0, ErrLoginInvalid
+	}
+
+	return s.complete(ml)
+}
+
+// VerifyCode completes a login with the code and returns the user
+// The login is dropped after too many codes
+// Unknown requests fail like wrong codes, as request ids are also handed out for unknown emails
+func (s *svc) VerifyCode(requestID string, code string, userAgent string) (uint, error) {
+	ml, err := s.pendingLogin(requestID, MethodCode, userAgent)
+	if err != nil {
+		return 0, ErrCodeInvalid
+	}
+
+	// Count the attempt before checking the code, so concurrent requests cannot exceed the limit
+	claimed, err := s.repo.ClaimAttempt(ml.ID, LoginMaxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	if !claimed {
+		return 0, ErrCodeInvalid
+	}
+	if !hmac.Equal([]byte(keyedHash(strings.TrimSpace(code))), []byte(ml.SecretHash)) {
+		return 0, ErrCodeInvalid
+	}
+
+	return s.complete(ml)
+}
+
+// deliver stores the login of a known user and sends the link or the code
+func (s *svc) deliver(email string, method string, userAgent string, requestID string, expiresAt time.Time) error {
+	u, err := s.userRepo.GetByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	// Generate the secret
+	var secret string
+	if method == MethodLink {
+		secret, err = cryptolib.RandomString(32)
+	} else {
+		secret, err = randomCode(CodeDigits)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Store the login, only the latest one of the user works
+	if err := s.repo.DeleteExpiredLogins(time.Now()); err != nil {
+		return err
+	}
+	if err := s.repo.DeletePendingLogins(u.ID); err != nil {
+		return err
+	}
+	_, err = s.repo.CreateLogin(&magicLinkRepo.MagicLogin{
+		UserID:			u.ID,
+		RequestHash:	cryptolib.HashValue(requestID),
+		Method:			method,
+		SecretHash:		keyedHash(secret),
+		UserAgentHash:	cryptolib.HashValue(userAgent),
+		ExpiresAt:		expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	if method == MethodCode {
+		return s.sender.SendCode(u, secret, expiresAt)
+	}
+	payload := requestID + "." + secret
+	return s.sender.SendLink(u, loginURL(payload + "." + keyedHash(payload)), expiresAt)
+}
+
+// pendingLogin returns the login of the request, it must be used with its method and from the same user agent
+func (s *svc) pendingLogin(requestID string, method string, userAgent string) (*magicLinkRepo.MagicLogin, error) {
+	ml, err := s.repo.GetLogin(cryptolib.HashValue(requestID))
+	if err != nil || ml.Method != method || time.Now().After(ml.ExpiresAt) || ml.Attempts >= LoginMaxAttempts {
+		return nil, ErrLoginInvalid
+	}
+	if !hmac.Equal([]byte(cryptolib.HashValue(userAgent)), []byte(ml.UserAgentHash)) {
+		return nil, ErrLoginInvalid
+	}
+
+	return ml, nil
+}
+
+// complete uses the login, only the request that deletes it logs in
+func (s *svc) complete(ml *magicLinkRepo.MagicLogin) (uint, error) {
+	deleted, err := s.repo.DeleteLogin(ml.ID)
+	if err != nil {
+		return 0, err
+	}
+	if !deleted {
+		return 0, ErrLoginInvalid
+	}
+
+	return ml.UserID, nil
+}
+
+// loginURL returns the link carrying the token
+func loginURL(token string) string {
+	base := cfglib.DefaultConf.MagicLinkURL
+	if base == "" {
+		base = strings.TrimSuffix(cfglib.DefaultConf.AppIssuer, "/") + "/auth/magic-link/verify"
+	}
+
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + "token=" + url.QueryEscape(token)
+}
+
+// keyedHash returns the HMAC of the value keyed with the app secret
+// Codes only have a million values, so their stored hashes must not be computable without the key
+func keyedHash(value string) string {
+	mac := hmac.New(sha256.New, []byte(cfglib.DefaultConf.AppSecret))
+	mac.Write([]byte("magic_link." + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// randomCode returns a random code of n digits
+func randomCode(n int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", n, v), nil
+}
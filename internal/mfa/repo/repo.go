@@ -0,0 +1,220 @@
+package mfaRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// File handles data logic related to multi-factor authentication
+
+// This defines a TOTPSecret struct that holds the authenticator app secret of a user
+// The secret is encrypted with the app secret, it is enabled once confirmed
+// LastUsedStep is the time step of the last accepted code, so a code cannot be replayed
+// CodeAttempts counts the codes entered for sensitive changes since CodeAttemptedAt, reset by a valid one
+type TOTPSecret struct {
+	gorm.Model
+	User      		*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"uniqueIndex"`
+	Secret			string				`json:"-"`
+	ConfirmedAt		*time.Time			`json:"confirmed_at"`
+	LastUsedStep	int64					`json:"-"`
+	CodeAttempts	int					`json:"-"`
+	CodeAttemptedAt	*time.Time			`json:"-"`
+}
+
+// This defines a RecoveryCode struct that represents a single-use recovery code
+type RecoveryCode struct {
+	gorm.Model
+	User      		*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	CodeHash			string				`json:"-" gorm:"index"`
+	UsedAt			*time.Time			`json:"used_at"`
+}
+
+// This defines an MFAChallenge struct that holds a password login waiting for the second factor
+type MFAChallenge struct {
+	gorm.Model
+	User      		*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	TokenHash		string				`json:"-" gorm:"uniqueIndex"`
+	Attempts			int					`json:"attempts"`
+	ExpiresAt		time.Time			`json:"expires_at" gorm:"index"`
+}
+
+// Repository provides methods for interacting with the MFA records in the database
+type Repo interface {
+	GetTOTP(userID uint) (*TOTPSecret, error)
+	SaveTOTP(t *TOTPSecret) (*TOTPSecret, error)
+	ConfirmTOTP(userID uint, confirmedAt time.Time, step int64) (error)
+	UseTOTPStep(userID uint, step int64) (bool, error)
+	DeleteTOTP(userID uint) (error)
+	ClaimCodeAttempt(userID uint, maxAttempts int, since time.Time, at time.Time) (bool, error)
+	ResetCodeAttempts(userID uint) (error)
+
+	ReplaceRecoveryCodes(userID uint, codeHashes []string) (error)
+	UseRecoveryCode(userID uint, codeHash string, usedAt time.Time) (bool, error)
+
+	CreateChallenge(ch *MFAChallenge) (*MFAChallenge, error)
+	GetChallenge(tokenHash string) (*MFAChallenge, error)
+	ClaimChallengeAttempt(id uint, maxAttempts int) (bool, error)
+	DeleteChallenge(id uint) (bool, error)
+	DeleteExpiredChallenges(before time.Time) (error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// GetTOTP returns the TOTP secret of a user
+func (r *repo) GetTOTP(userID uint) (*TOTPSecret, error) {
+	var t TOTPSecret
+	err := r.db.Where("user_id = ?", userID).First(&t).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("totp not found")
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+// SaveTOTP replaces the TOTP secret of a user
+func (r *repo) SaveTOTP(t *TOTPSecret) (*TOTPSecret, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", t.UserID).Delete(&TOTPSecret{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(t).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// ConfirmTOTP enables the TOTP secret of a user, recording the step of the confirming code
+func (r *repo) ConfirmTOTP(userID uint, confirmedAt time.Time, step int64) error {
+	return r.db.Model(&TOTPSecret{}).Where("user_id = ?", userID).
+		Updates(map[string]interface{}{"confirmed_at": confirmedAt, "last_used_step": step}).Error
+}
+
+// UseTOTPStep records the step of an accepted code, reporting false when it was already used
+func (r *repo) UseTOTPStep(userID uint, step int64) (bool, error) {
+	res := r.db.Model(&TOTPSecret{}).Where("user_id = ? AND last_used_step < ?", userID, step).Update("last_used_step", step)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteTOTP deletes the TOTP secret and the recovery codes of a user
+func (r *repo) DeleteTOTP(userID uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", userID).Delete(&TOTPSecret{}).Error
+	})
+}
+
+// ClaimCodeAttempt counts an attempt at a code of the user, reporting false when maxAttempts were already made
+// Attempts made before since no longer count, the check and the increment are a single statement
+func (r *repo) ClaimCodeAttempt(userID uint, maxAttempts int, since time.Time, at time.Time) (bool, error) {
+	res := r.db.Model(&TOTPSecret{}).
+		Where("user_id = ? AND (code_attempts < ? OR code_attempted_at IS NULL OR code_attempted_at < ?)", userID, maxAttempts, since).
+		Updates(map[string]interface{}{
+			"code_attempts":		gorm.Expr("CASE WHEN code_attempted_at IS NULL OR code_attempted_at < ? THEN 1 ELSE code_attempts + 1 END", since),
+			"code_attempted_at":	at,
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// ResetCodeAttempts clears the attempts of the user once a code was accepted
+func (r *repo) ResetCodeAttempts(userID uint) error {
+	return r.db.Model(&TOTPSecret{}).Where("user_id = ?", userID).
+		Updates(map[string]interface{}{"code_attempts": 0, "code_attempted_at": nil}).Error
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user
+func (r *repo) ReplaceRecoveryCodes(userID uint, codeHashes []string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		codes := make([]RecoveryCode, 0, len(codeHashes))
+		for _, hash := range codeHashes {
+			codes = append(codes, RecoveryCode{UserID: userID, CodeHash: hash})
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// UseRecoveryCode marks a recovery code of a user as used, reporting false when it is unknown or already used
+func (r *repo) UseRecoveryCode(userID uint, codeHash string, usedAt time.Time) (bool, error) {
+	res := r.db.Model(&RecoveryCode{}).Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).Update("used_at", usedAt)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// CreateChallenge creates an entry in the MFA challenges table
+func (r *repo) CreateChallenge(ch *MFAChallenge) (*MFAChallenge, error) {
+	if err := r.db.Create(ch).Error; err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// GetChallenge returns the challenge with the given token hash
+func (r *repo) GetChallenge(tokenHash string) (*MFAChallenge, error) {
+	var ch MFAChallenge
+	err := r.db.Where("token_hash = ?", tokenHash).First(&ch).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("challenge not found")
+		}
+		return nil, err
+	}
+	return &ch, nil
+}
+
+// ClaimChallengeAttempt counts an attempt at a challenge, reporting false when maxAttempts were already made
+// The check and the increment are a single statement, so concurrent requests cannot exceed the limit
+func (r *repo) ClaimChallengeAttempt(id uint, maxAttempts int) (bool, error) {
+	res := r.db.Model(&MFAChallenge{}).Where("id = ? AND attempts < ?", id, maxAttempts).Update("attempts", gorm.Expr("attempts + 1"))
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteChallenge deletes a challenge, reporting false when another request already did
+func (r *repo) DeleteChallenge(id uint) (bool, error) {
+	res := r.db.Unscoped().Where("id = ?", id).Delete(&MFAChallenge{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteExpiredChallenges deletes the challenges that expired before the given time
+func (r *repo) DeleteExpiredChallenges(before time.Time) error {
+	return r.db.Unscoped().Where("expires_at < ?", before).Delete(&MFAChallenge{}).Error
+}
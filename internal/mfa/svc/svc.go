@@ -0,0 +1,356 @@
+package mfaSvc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/pkg/totplib"
+	"github.com/selatoz/gateway/internal/mfa/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	// Time the user has to enter the second factor after the password
+	ChallengeLifetime = 5 * time.Minute
+
+	// Codes allowed per challenge
+	ChallengeMaxAttempts = 5
+
+	// Codes allowed per window to prove the second factor before a sensitive change
+	CodeMaxAttempts = 5
+	CodeAttemptWindow = 15 * time.Minute
+
+	// Time steps accepted on each side of the current one, for clock skew
+	TOTPSkew = 1
+
+	// Number of recovery codes generated at once
+	RecoveryCodeCount = 10
+)
+
+// Define errors
+var (
+	ErrMFAAlreadyEnabled		= errors.New("mfa already enabled")
+	ErrMFANotEnabled			= errors.New("mfa not enabled")
+	ErrMFANotEnrolled			= errors.New("mfa enrollment not started")
+	ErrCodeInvalid				= errors.New("invalid code")
+	ErrChallengeInvalid		= errors.New("invalid or expired mfa challenge")
+	ErrTooManyAttempts		= errors.New("too many codes entered, try again later")
+)
+
+// Enrollment holds what the user needs to add the secret to an authenticator app
+type Enrollment struct {
+	Secret	string
+	URI		string
+}
+
+// Svc is an interface for defining the methods that the MFA service will provide.
+type Svc interface {
+	Enabled(userID uint) (bool, error)
+	EnrollTOTP(userID uint) (*Enrollment, error)
+	ConfirmTOTP(userID uint, code string) ([]string, error)
+	DisableTOTP(userID uint, code string) (error)
+	RegenerateRecoveryCodes(userID uint, code string) ([]string, error)
+	VerifyCode(userID uint, code string) (error)
+	CreateChallenge(userID uint) (string, time.Time, error)
+	VerifyChallenge(token string, code string) (uint, error)
+	GetChallengeUser(token string) (uint, error)
+	CompleteChallenge(token string) (uint, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for multi-factor authentication.
+type svc struct {
+	repo			mfaRepo.Repo
+	userRepo		userRepo.Repo
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB) Svc {
+	return &svc{
+		repo: mfaRepo.NewRepo(db),
+		userRepo: userRepo.NewRepo(db),
+	}
+}
+
+// Enabled reports whether the user has a confirmed second factor
+func (s *svc) Enabled(userID uint) (bool, error) {
+	t, err := s.repo.GetTOTP(userID)
+	if err != nil {
+		return false, nil
+	}
+
+	return t.ConfirmedAt != nil, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user, enabled once confirmed with a code
+func (s *svc) EnrollTOTP(userID uint) (*Enrollment, error) {
+	if enabled, _ := s.Enabled(userID); enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	u, err := s.userRepo.GetById(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Generate and store the encrypted secret
+	secret, err := totplib.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	enc, err := cryptolib.Encrypt(cfglib.DefaultConf.AppSecret, []byte(secret))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.SaveTOTP(&mfaRepo.TOTPSecret{UserID: userID, Secret: enc}); err != nil {
+		return nil, err
+	}
+
+	return &Enrollment{
+		Secret:	secret,
+		URI:		totplib.URI(cfglib.DefaultConf.AppName, u.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables the pending secret with a valid code and returns the recovery codes
+func (s *svc) ConfirmTOTP(userID uint, code string) ([]string, error) {
+	t, err := s.repo.GetTOTP(userID)
+	if err != nil {
+		return nil, ErrMFANotEnrolled
+	}
+	if t.ConfirmedAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	// Validate the code
+	now := time.Now()
+	step, ok, err := s.validateTOTP(t, code, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrCodeInvalid
+	}
+
+	if err := s.repo.ConfirmTOTP(userID, now, step); err != nil {
+		return nil, err
+	}
+
+	return s.generateRecoveryCodes(userID)
+}
+
+// DisableTOTP removes the second factor, which must be proven with a code or a recovery code
+func (s *svc) DisableTOTP(userID uint, code string) error {
+	if err := s.proveCode(userID, code); err != nil {
+		return err
+	}
+
+	return s.repo.DeleteTOTP(userID)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, the second factor must be proven with a code
+func (s *svc) RegenerateRecoveryCodes(userID uint, code string) ([]string, error) {
+	if err := s.proveCode(userID, code); err != nil {
+		return nil, err
+	}
+
+	return s.generateRecoveryCodes(userID)
+}
+
+// VerifyCode proves the user holds the second factor before a sensitive change, with a code or a recovery code
+func (s *svc) VerifyCode(userID uint, code string) error {
+	return s.proveCode(userID, code)
+}
+
+// CreateChallenge starts the second step of a login, the token is exchanged with a code
+func (s *svc) CreateChallenge(userID uint) (string, time.Time, error) {
+	// Remove the abandoned challenges
+	now := time.Now()
+	if err := s.repo.DeleteExpiredChallenges(now); err != nil {
+		return "", time.Time{}, err
+	}
+
+	token, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := now.Add(ChallengeLifetime)
+	_, err = s.repo.CreateChallenge(&mfaRepo.MFAChallenge{
+		UserID:		userID,
+		TokenHash:	cryptolib.HashValue(token),
+		ExpiresAt:	expiresAt,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// VerifyChallenge completes a login with a TOTP or a recovery code and returns the user
+// The challenge can only be completed once and is dropped after too many codes
+func (s *svc) VerifyChallenge(token string, code string) (uint, error) {
+	ch, err := s.repo.GetChallenge(cryptolib.HashValue(token))
+	if err != nil || time.Now().After(ch.ExpiresAt) {
+		return 0, ErrChallengeInvalid
+	}
+
+	// Count the attempt before checking the code, so concurrent requests cannot exceed the limit
+	claimed, err := s.repo.ClaimChallengeAttempt(ch.ID, ChallengeMaxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	if !claimed {
+		return 0, ErrChallengeInvalid
+	}
+
+	// Validate the code
+	if err := s.verifyCode(ch.UserID, code); err != nil {
+		return 0, err
+	}
+
+	// Only the request that deletes the challenge completes the login
+	deleted, err := s.repo.DeleteChallenge(ch.ID)
+	if err != nil {
+		return 0, err
+	}
+	if !deleted {
+		return 0, ErrChallengeInvalid
+	}
+
+	return ch.UserID, nil
+}
+
+// GetChallengeUser returns the user of a pending challenge, for second factors verified by another service
+func (s *svc) GetChallengeUser(token string) (uint, error) {
+	ch, err := s.repo.GetChallenge(cryptolib.HashValue(token))
+	if err != nil || time.Now().After(ch.ExpiresAt) || ch.Attempts >= ChallengeMaxAttempts {
+		return 0, ErrChallengeInvalid
+	}
+
+	return ch.UserID, nil
+}
+
+// CompleteChallenge completes a login once the second factor was verified by another service
+func (s *svc) CompleteChallenge(token string) (uint, error) {
+	ch, err := s.repo.GetChallenge(cryptolib.HashValue(token))
+	if err != nil || time.Now().After(ch.ExpiresAt) || ch.Attempts >= ChallengeMaxAttempts {
+		return 0, ErrChallengeInvalid
+	}
+
+	// Only the request that deletes the challenge completes the login
+	deleted, err := s.repo.DeleteChallenge(ch.ID)
+	if err != nil {
+		return 0, err
+	}
+	if !deleted {
+		return 0, ErrChallengeInvalid
+	}
+
+	return ch.UserID, nil
+}
+
+// proveCode verifies a code outside of a login, limiting the attempts per user
+// The attempt is counted before the code is checked, so concurrent requests cannot exceed the limit
+func (s *svc) proveCode(userID uint, code string) error {
+	now := time.Now()
+	claimed, err := s.repo.ClaimCodeAttempt(userID, CodeMaxAttempts, now.Add(-CodeAttemptWindow), now)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		// Users without a second factor have no row to count on
+		if enabled, err := s.Enabled(userID); err != nil || !enabled {
+			return ErrMFANotEnabled
+		}
+		return ErrTooManyAttempts
+	}
+
+	if err := s.verifyCode(userID, code); err != nil {
+		return err
+	}
+
+	return s.repo.ResetCodeAttempts(userID)
+}
+
+// verifyCode accepts a TOTP code of an unused time step or an unused recovery code
+func (s *svc) verifyCode(userID uint, code string) error {
+	t, err := s.repo.GetTOTP(userID)
+	if err != nil || t.ConfirmedAt == nil {
+		return ErrMFANotEnabled
+	}
+
+	// Handle TOTP code, refusing a step that was already used
+	step, ok, err := s.validateTOTP(t, code, time.Now())
+	if err != nil {
+		return err
+	}
+	if ok {
+		fresh, err := s.repo.UseTOTPStep(userID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrCodeInvalid
+		}
+		return nil
+	}
+
+	// Handle recovery code
+	used, err := s.repo.UseRecoveryCode(userID, cryptolib.HashValue(normalizeRecoveryCode(code)), time.Now())
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrCodeInvalid
+	}
+
+	return nil
+}
+
+// validateTOTP decrypts the secret and checks the code against it
+func (s *svc) validateTOTP(t *mfaRepo.TOTPSecret, code string, at time.Time) (int64, bool, error) {
+	secret, err := cryptolib.Decrypt(cfglib.DefaultConf.AppSecret, t.Secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	step, ok := totplib.Validate(string(secret), code, at, TOTPSkew)
+	return step, ok, nil
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user, only their hashes are stored
+func (s *svc) generateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		// Codes look like xxxx-xxxx
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, cryptolib.HashValue(normalizeRecoveryCode(code)))
+	}
+
+	if err := s.repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes typed by the user
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
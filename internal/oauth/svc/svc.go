@@ -0,0 +1,518 @@
+package oauthSvc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/internal/client/repo"
+	"github.com/selatoz/gateway/internal/client/svc"
+	"github.com/selatoz/gateway/internal/token/repo"
+	"github.com/selatoz/gateway/internal/token/svc"
+)
+
+// Define constants
+const (
+	// Error codes (RFC 6749)
+	ErrInvalidRequest				= "invalid_request"
+	ErrInvalidClient				= "invalid_client"
+	ErrInvalidGrant				= "invalid_grant"
+	ErrUnauthorizedClient		= "unauthorized_client"
+	ErrUnsupportedGrantType		= "unsupported_grant_type"
+	ErrUnsupportedResponseType	= "unsupported_response_type"
+	ErrInvalidScope				= "invalid_scope"
+	ErrAccessDenied				= "access_denied"
+
+	// Error codes (RFC 8693)
+	ErrInvalidTarget				= "invalid_target"
+
+	// Error codes (OpenID Connect)
+	ErrLoginRequired				= "login_required"
+
+	// Supported values
+	ResponseTypeCode			= "code"
+	GrantTypeAuthorizationCode	= clientSvc.GrantTypeAuthorizationCode
+	GrantTypeRefreshToken		= clientSvc.GrantTypeRefreshToken
+	GrantTypeClientCredentials	= clientSvc.GrantTypeClientCredentials
+	GrantTypeTokenExchange		= clientSvc.GrantTypeTokenExchange
+	CodeChallengeMethodS256	= "S256"
+
+	// Token types of the token exchange (RFC 8693), only access tokens are exchanged
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+	// Lifetime of an authorization code
+	CodeLifetime = 5 * time.Minute
+)
+
+// Error is an OAuth error
+// RedirectURI is set when the error may be reported to the client through its redirect URI
+type Error struct {
+	Code				string
+	Description		string
+	RedirectURI		string
+}
+
+func (e *Error) Error() string {
+	return e.Code
+}
+
+// AuthorizationRequest holds the parameters of an authorization request
+type AuthorizationRequest struct {
+	ResponseType			string
+	ClientID					string
+	RedirectURI				string
+	Scope						string
+	State						string
+	CodeChallenge			string
+	CodeChallengeMethod	string
+	Nonce						string
+	MaxAge					*int
+	AuthTime					time.Time
+}
+
+// TokenExchangeRequest holds the parameters of a token exchange request (RFC 8693)
+// The actor token is optional, the client itself acts without it
+// The audience is the registered client the token is meant for, or the issuer for this gateway, the exchanging client by default
+type TokenExchangeRequest struct {
+	SubjectToken			string
+	SubjectTokenType		string
+	ActorToken				string
+	ActorTokenType			string
+	RequestedTokenType	string
+	Audience					[]string
+	Scope						string
+}
+
+// Tokens holds the tokens issued by the token endpoint
+// IDToken is only set when the openid scope was granted
+type Tokens struct {
+	AccessToken		*tokenRepo.AccessToken
+	RefreshToken	*tokenRepo.RefreshToken
+	IDToken			string
+}
+
+// TokenExchange is a validated token exchange, the token is issued once it is recorded
+// The actor is the user of the actor token, or the client acting on its own
+type TokenExchange struct {
+	ClientID		string
+	UserID		uint
+	Actor			tokenSvc.Actor
+	Audience		string
+	Scopes		[]string
+}
+
+// Consent describes what the user is asked to approve
+type Consent struct {
+	Client			*clientRepo.Client
+	RedirectURI		string
+	Scopes			[]string
+}
+
+// Svc is an interface for defining the methods that the OAuth service will provide.
+type Svc interface {
+	Authorize(req AuthorizationRequest) (*Consent, error)
+	Approve(req AuthorizationRequest, userID uint) (string, error)
+	Deny(req AuthorizationRequest) (string, error)
+	ExchangeCode(clientID string, code string, redirectURI string, codeVerifier string, binding tokenSvc.Binding, userAgent string, ip string) (*Tokens, error)
+	Refresh(clientID string, refreshToken string, binding tokenSvc.Binding, userAgent string, ip string) (*Tokens, error)
+	ClientCredentials(clientID string, scope string, binding tokenSvc.Binding) (*tokenRepo.ClientAccessToken, error)
+	ExchangeToken(clientID string, req TokenExchangeRequest, binding tokenSvc.Binding) (*TokenExchange, error)
+	IssueExchangedToken(ex *TokenExchange, binding tokenSvc.Binding, userAgent string, ip string) (*tokenRepo.AccessToken, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for the OAuth flows.
+type svc struct {
+	tokenRepo		tokenRepo.Repo
+	clientService	clientSvc.Svc
+	tokenService	tokenSvc.Svc
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB, clientService clientSvc.Svc, tokenService tokenSvc.Svc) Svc {
+	return &svc{
+		tokenRepo: tokenRepo.NewRepo(db),
+		clientService: clientService,
+		tokenService: tokenService,
+	}
+}
+
+// Authorize validates an authorization request and returns the consent to show to the user
+func (s *svc) Authorize(req AuthorizationRequest) (*Consent, error) {
+	// Errors about the client or the redirect URI must not be redirected
+	cl, err := s.clientService.GetClient(req.ClientID)
+	if err != nil {
+		return nil, &Error{Code: ErrInvalidClient}
+	}
+	redirectURI, ok := matchRedirectURI(cl, req.RedirectURI)
+	if !ok {
+		return nil, &Error{Code: ErrInvalidRequest, Description: "redirect_uri not registered"}
+	}
+
+	// Validate the rest of the request
+	if req.ResponseType != ResponseTypeCode {
+		return nil, &Error{Code: ErrUnsupportedResponseType, RedirectURI: redirectURI}
+	}
+	if !cl.HasGrantType(GrantTypeAuthorizationCode) {
+		return nil, &Error{Code: ErrUnauthorizedClient, RedirectURI: redirectURI}
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != CodeChallengeMethodS256 {
+		return nil, &Error{Code: ErrInvalidRequest, Description: "code_challenge with S256 method required", RedirectURI: redirectURI}
+	}
+
+	// Default to the allowed scopes, requested scopes must all be allowed
+	scopes := cl.AllowedScopeList()
+	if req.Scope != "" {
+		scopes = strings.Fields(req.Scope)
+		for _, scope := range scopes {
+			if !contains(cl.AllowedScopeList(), scope) {
+				return nil, &Error{Code: ErrInvalidScope, RedirectURI: redirectURI}
+			}
+		}
+	}
+
+	// OpenID Connect requests must name the redirect URI
+	if contains(scopes, tokenSvc.ScopeOpenID) && req.RedirectURI == "" {
+		return nil, &Error{Code: ErrInvalidRequest, Description: "redirect_uri required"}
+	}
+
+	// Handle authentication older than the requested max age
+	if req.MaxAge != nil && time.Since(req.AuthTime) > time.Duration(*req.MaxAge)*time.Second {
+		return nil, &Error{Code: ErrLoginRequired, RedirectURI: redirectURI}
+	}
+
+	return &Consent{
+		Client:			cl,
+		RedirectURI:	redirectURI,
+		Scopes:			scopes,
+	}, nil
+}
+
+// Approve issues an authorization code and returns the URI to redirect the user to
+func (s *svc) Approve(req AuthorizationRequest, userID uint) (string, error) {
+	consent, err := s.Authorize(req)
+	if err != nil {
+		return "", err
+	}
+
+	// Generate and store the code
+	// The redirect URI is stored as requested, the token request must repeat it
+	code, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = s.tokenRepo.CreateAuthorizationCode(code, &tokenRepo.AuthorizationCode{
+		UserID:					userID,
+		ClientID:				consent.Client.ClientID,
+		RedirectURI:			req.RedirectURI,
+		Scope:					strings.Join(consent.Scopes, " "),
+		CodeChallenge:			req.CodeChallenge,
+		CodeChallengeMethod:	req.CodeChallengeMethod,
+		Nonce:					req.Nonce,
+		AuthTime:				req.AuthTime,
+		ExpiresAt:				time.Now().Add(CodeLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return redirectURL(consent.RedirectURI, url.Values{"code": {code}}, req.State), nil
+}
+
+// Deny returns the URI to redirect the user to after refusing the consent
+func (s *svc) Deny(req AuthorizationRequest) (string, error) {
+	consent, err := s.Authorize(req)
+	if err != nil {
+		return "", err
+	}
+
+	return redirectURL(consent.RedirectURI, url.Values{"error": {ErrAccessDenied}}, req.State), nil
+}
+
+// ErrorRedirect returns the URI reporting a redirectable error to the client
+func ErrorRedirect(req AuthorizationRequest, e *Error) string {
+	params := url.Values{"error": {e.Code}}
+	if e.Description != "" {
+		params.Set("error_description", e.Description)
+	}
+
+	return redirectURL(e.RedirectURI, params, req.State)
+}
+
+// ExchangeCode exchanges an authorization code for tokens, verifying the PKCE code verifier
+// A code presented twice revokes the tokens issued for it
+func (s *svc) ExchangeCode(clientID string, code string, redirectURI string, codeVerifier string, binding tokenSvc.Binding, userAgent string, ip string) (*Tokens, error) {
+	if err := s.checkGrantType(clientID, GrantTypeAuthorizationCode); err != nil {
+		return nil, err
+	}
+
+	ac, firstUse, err := s.tokenRepo.ConsumeAuthorizationCode(code, time.Now())
+	if err != nil {
+		return nil, &Error{Code: ErrInvalidGrant}
+	}
+
+	// Handle replayed code
+	if !firstUse {
+		if ac.FamilyID != "" {
+			if err := s.tokenService.RevokeFamily(ac.FamilyID); err != nil {
+				return nil, err
+			}
+		}
+		return nil, &Error{Code: ErrInvalidGrant}
+	}
+
+	// Validate the code against the request
+	if ac.ClientID != clientID || ac.RedirectURI != redirectURI || time.Now().After(ac.ExpiresAt) {
+		return nil, &Error{Code: ErrInvalidGrant}
+	}
+	if !verifyCodeChallenge(ac.CodeChallenge, codeVerifier) {
+		return nil, &Error{Code: ErrInvalidGrant, Description: "code_verifier invalid"}
+	}
+
+	// Issue the tokens and link them to the code
+	at, rt, err := s.tokenService.GenerateClientTokens(ac.UserID, ac.ClientID, strings.Fields(ac.Scope), binding, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.tokenRepo.SetAuthorizationCodeFamily(ac.ID, rt.FamilyID); err != nil {
+		return nil, err
+	}
+
+	// Issue the id_token when the openid scope was granted
+	tokens := &Tokens{AccessToken: at, RefreshToken: rt}
+	if contains(strings.Fields(ac.Scope), tokenSvc.ScopeOpenID) {
+		tokens.IDToken, err = s.tokenService.GenerateIDToken(ac.UserID, ac.ClientID, ac.Nonce, ac.AuthTime, at.TokenString)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
+
+// Refresh rotates a refresh token issued to the client
+func (s *svc) Refresh(clientID string, refreshToken string, binding tokenSvc.Binding, userAgent string, ip string) (*Tokens, error) {
+	if err := s.checkGrantType(clientID, GrantTypeRefreshToken); err != nil {
+		return nil, err
+	}
+
+	at, rt, err := s.tokenService.RotateRefreshToken(refreshToken, clientID, binding, userAgent, ip)
+	if err != nil {
+		switch err.Error() {
+		case tokenSvc.ErrTokenReused, tokenSvc.ErrTokenInvalid, tokenSvc.ErrTokenExpired:
+			return nil, &Error{Code: ErrInvalidGrant}
+		}
+		return nil, err
+	}
+
+	return &Tokens{AccessToken: at, RefreshToken: rt}, nil
+}
+
+// ClientCredentials issues an access token to the client itself, for service to service calls
+// Only confidential clients registered for the grant may use it, and no refresh token is issued
+func (s *svc) ClientCredentials(clientID string, scope string, binding tokenSvc.Binding) (*tokenRepo.ClientAccessToken, error) {
+	cl, err := s.clientService.GetClient(clientID)
+	if err != nil {
+		return nil, &Error{Code: ErrInvalidClient}
+	}
+	if cl.Public || !cl.HasGrantType(GrantTypeClientCredentials) {
+		return nil, &Error{Code: ErrUnauthorizedClient}
+	}
+
+	// Default to the allowed scopes, requested scopes must all be allowed
+	scopes := cl.AllowedScopeList()
+	if scope != "" {
+		scopes = strings.Fields(scope)
+		for _, sc := range scopes {
+			if !contains(cl.AllowedScopeList(), sc) {
+				return nil, &Error{Code: ErrInvalidScope}
+			}
+		}
+	}
+
+	return s.tokenService.GenerateClientCredentialsToken(cl.ClientID, scopes, binding)
+}
+
+// ExchangeToken validates a token exchange for the user of the subject token, acted on by the user of the actor token,
+// or by the client when no actor token is given
+// Only confidential clients registered for the grant may use it, delegated tokens cannot be exchanged again.
+// The token is limited to the scopes of the subject token the client is allowed, and no refresh token is issued.
+func (s *svc) ExchangeToken(clientID string, req TokenExchangeRequest, binding tokenSvc.Binding) (*TokenExchange, error) {
+	cl, err := s.clientService.GetClient(clientID)
+	if err != nil {
+		return nil, &Error{Code: ErrInvalidClient}
+	}
+	if cl.Public || !cl.HasGrantType(GrantTypeTokenExchange) {
+		return nil, &Error{Code: ErrUnauthorizedClient}
+	}
+	if req.SubjectToken == "" || req.SubjectTokenType != TokenTypeAccessToken {
+		return nil, &Error{Code: ErrInvalidRequest, Description: "subject_token of type " + TokenTypeAccessToken + " required"}
+	}
+	if req.RequestedTokenType != "" && req.RequestedTokenType != TokenTypeAccessToken {
+		return nil, &Error{Code: ErrInvalidRequest, Description: "only access tokens can be requested"}
+	}
+
+	// Validate the subject token
+	subject, err := s.delegableToken(req.SubjectToken, binding)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the actor token, the client acts without it
+	actor := &tokenSvc.Actor{ClientID: cl.ClientID}
+	if req.ActorToken != "" || req.ActorTokenType != "" {
+		if req.ActorToken == "" || req.ActorTokenType != TokenTypeAccessToken {
+			return nil, &Error{Code: ErrInvalidRequest, Description: "actor_token of type " + TokenTypeAccessToken + " required"}
+		}
+		act, err := s.delegableToken(req.ActorToken, binding)
+		if err != nil {
+			return nil, err
+		}
+		if act.UserID == subject.UserID {
+			return nil, &Error{Code: ErrInvalidGrant, Description: "actor is the subject"}
+		}
+		actor = &tokenSvc.Actor{UserID: act.UserID}
+	}
+
+	// Default to the scopes of the subject token the client is allowed, requested scopes must all be among them
+	scopes := intersect(subject.Scopes, cl.AllowedScopeList())
+
+	// Resolve the audience, the issuer targets this gateway, a target client also limits the scopes to the ones it is allowed
+	audience := cl.ClientID
+	if len(req.Audience) > 1 {
+		return nil, &Error{Code: ErrInvalidTarget, Description: "only one audience is supported"}
+	}
+	if len(req.Audience) == 1 {
+		if req.Audience[0] == cfglib.DefaultConf.AppIssuer {
+			audience = req.Audience[0]
+		} else {
+			target, err := s.clientService.GetClient(req.Audience[0])
+			if err != nil {
+				return nil, &Error{Code: ErrInvalidTarget, Description: "unknown audience"}
+			}
+			audience = target.ClientID
+			scopes = intersect(scopes, target.AllowedScopeList())
+		}
+	}
+	if req.Scope != "" {
+		requested := strings.Fields(req.Scope)
+		for _, sc := range requested {
+			if !contains(scopes, sc) {
+				return nil, &Error{Code: ErrInvalidScope}
+			}
+		}
+		scopes = requested
+	}
+
+	return &TokenExchange{ClientID: cl.ClientID, UserID: subject.UserID, Actor: *actor, Audience: audience, Scopes: scopes}, nil
+}
+
+// IssueExchangedToken issues the access token of a validated token exchange
+func (s *svc) IssueExchangedToken(ex *TokenExchange, binding tokenSvc.Binding, userAgent string, ip string) (*tokenRepo.AccessToken, error) {
+	return s.tokenService.GenerateDelegatedToken(ex.UserID, ex.ClientID, ex.Audience, ex.Scopes, ex.Actor, binding, userAgent, ip)
+}
+
+// delegableToken validates an access token held by a user that may be exchanged
+// Tokens bound to a DPoP key are refused, the client cannot prove the key, tokens bound to a certificate must come over it
+func (s *svc) delegableToken(token string, binding tokenSvc.Binding) (*tokenSvc.Introspection, error) {
+	in, err := s.tokenService.Introspect(token)
+	if err != nil {
+		return nil, err
+	}
+	if !in.Active || in.Principal != tokenSvc.PrincipalUser || in.TokenType != tokenSvc.TokenTypeHintAccess {
+		return nil, &Error{Code: ErrInvalidGrant}
+	}
+	if in.Actor != nil {
+		return nil, &Error{Code: ErrInvalidGrant, Description: tokenSvc.ErrTokenDelegated}
+	}
+	if in.JKT != "" || (in.CertThumbprint != "" && in.CertThumbprint != binding.CertThumbprint) {
+		return nil, &Error{Code: ErrInvalidGrant, Description: tokenSvc.ErrTokenBindingInvalid}
+	}
+
+	return in, nil
+}
+
+// checkGrantType ensures the client is registered for the grant type
+func (s *svc) checkGrantType(clientID string, grantType string) error {
+	cl, err := s.clientService.GetClient(clientID)
+	if err != nil {
+		return &Error{Code: ErrInvalidClient}
+	}
+	if !cl.HasGrantType(grantType) {
+		return &Error{Code: ErrUnauthorizedClient}
+	}
+
+	return nil
+}
+
+// matchRedirectURI returns the redirect URI to use, which must exactly match a registered one
+// It may be omitted when the client has a single registered redirect URI
+func matchRedirectURI(cl *clientRepo.Client, redirectURI string) (string, bool) {
+	registered := cl.RedirectURIList()
+	if redirectURI == "" {
+		if len(registered) == 1 {
+			return registered[0], true
+		}
+		return "", false
+	}
+
+	return redirectURI, contains(registered, redirectURI)
+}
+
+// verifyCodeChallenge checks the code verifier against the S256 code challenge (RFC 7636)
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// redirectURL adds the parameters and the state to the redirect URI
+func redirectURL(redirectURI string, params url.Values, state string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	q := u.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// intersect returns the values found in both lists, in the order of the first
+func intersect(values []string, others []string) []string {
+	result := []string{}
+	for _, v := range values {
+		if contains(others, v) {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
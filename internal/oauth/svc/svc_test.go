@@ -0,0 +1,200 @@
+package oauthSvc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/internal/client/repo"
+	"github.com/selatoz/gateway/internal/token/svc"
+)
+
+// fakeClientSvc knows the registered clients by id
+type fakeClientSvc struct {
+	clients	map[string]*clientRepo.Client
+}
+
+func (s *fakeClientSvc) Authenticate(clientID string, secret string) (*clientRepo.Client, error) {
+	return s.GetClient(clientID)
+}
+
+func (s *fakeClientSvc) AuthenticatePublic(clientID string) (*clientRepo.Client, error) {
+	return s.GetClient(clientID)
+}
+
+func (s *fakeClientSvc) AuthenticateCertificate(identities []string) (*clientRepo.Client, error) {
+	return nil, errors.New("client not found")
+}
+
+func (s *fakeClientSvc) GetClient(clientID string) (*clientRepo.Client, error) {
+	cl, ok := s.clients[clientID]
+	if !ok {
+		return nil, errors.New("client not found")
+	}
+	return cl, nil
+}
+
+func (s *fakeClientSvc) CreateClient(name string, redirectURIs []string, scopes []string, grantTypes []string, public bool, tlsSubject string) (*clientRepo.Client, string, error) {
+	return nil, "", errors.New("not supported")
+}
+
+// fakeTokenSvc introspects the tokens it knows, the other methods are not used by the exchange
+type fakeTokenSvc struct {
+	tokenSvc.Svc
+	tokens	map[string]*tokenSvc.Introspection
+}
+
+func (s *fakeTokenSvc) Introspect(token string) (*tokenSvc.Introspection, error) {
+	in, ok := s.tokens[token]
+	if !ok {
+		return &tokenSvc.Introspection{Active: false}, nil
+	}
+	return in, nil
+}
+
+// challenge returns the S256 code challenge of the verifier
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := strings.Repeat("a", 43)
+	cases := []struct {
+		name			string
+		challenge	string
+		verifier		string
+		valid			bool
+	}{
+		{"matching verifier", challenge(verifier), verifier, true},
+		{"longest verifier", challenge(strings.Repeat("b", 128)), strings.Repeat("b", 128), true},
+		{"other verifier", challenge(verifier), strings.Repeat("c", 43), false},
+		{"plain challenge", verifier, verifier, false},
+		{"verifier too short", challenge(strings.Repeat("d", 42)), strings.Repeat("d", 42), false},
+		{"verifier too long", challenge(strings.Repeat("e", 129)), strings.Repeat("e", 129), false},
+		{"empty verifier", challenge(""), "", false},
+	}
+	for _, tc := range cases {
+		if got := verifyCodeChallenge(tc.challenge, tc.verifier); got != tc.valid {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.valid)
+		}
+	}
+}
+
+func TestAuthorizeRequiresS256(t *testing.T) {
+	s := &svc{clientService: &fakeClientSvc{clients: map[string]*clientRepo.Client{
+		"app": {ClientID: "app", RedirectURIs: "https://app.example/callback", AllowedScopes: "profile", GrantTypes: GrantTypeAuthorizationCode, Public: true},
+	}}}
+
+	cases := []struct {
+		name			string
+		challenge	string
+		method		string
+		valid			bool
+	}{
+		{"S256", challenge(strings.Repeat("a", 43)), CodeChallengeMethodS256, true},
+		{"plain", strings.Repeat("a", 43), "plain", false},
+		{"no method", challenge(strings.Repeat("a", 43)), "", false},
+		{"no challenge", "", CodeChallengeMethodS256, false},
+	}
+	for _, tc := range cases {
+		_, err := s.Authorize(AuthorizationRequest{
+			ResponseType:			ResponseTypeCode,
+			ClientID:				"app",
+			RedirectURI:			"https://app.example/callback",
+			CodeChallenge:			tc.challenge,
+			CodeChallengeMethod:	tc.method,
+		})
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid = %v, want %v (%v)", tc.name, err == nil, tc.valid, err)
+			continue
+		}
+
+		// Refusals are reported to the client through its redirect URI
+		if e, ok := err.(*Error); err != nil && (!ok || e.Code != ErrInvalidRequest || e.RedirectURI == "") {
+			t.Errorf("%s: unexpected error %+v", tc.name, err)
+		}
+	}
+}
+
+func TestExchangeToken(t *testing.T) {
+	prev := cfglib.DefaultConf
+	cfglib.DefaultConf = &cfglib.Config{AppIssuer: "https://gateway.example"}
+	t.Cleanup(func() { cfglib.DefaultConf = prev })
+
+	access := func(userID uint, scopes ...string) *tokenSvc.Introspection {
+		return &tokenSvc.Introspection{Active: true, Principal: tokenSvc.PrincipalUser, UserID: userID, Scopes: scopes, TokenType: tokenSvc.TokenTypeHintAccess}
+	}
+	delegated := access(1, "profile")
+	delegated.Actor = &tokenSvc.Actor{ClientID: "other"}
+	bound := access(1, "profile")
+	bound.JKT = "thumbprint"
+
+	s := &svc{
+		clientService: &fakeClientSvc{clients: map[string]*clientRepo.Client{
+			"backend":	{ClientID: "backend", AllowedScopes: "profile orders:read orders:write", GrantTypes: GrantTypeTokenExchange},
+			"orders":	{ClientID: "orders", AllowedScopes: "orders:read billing"},
+			"spa":		{ClientID: "spa", AllowedScopes: "profile", GrantTypes: GrantTypeTokenExchange, Public: true},
+		}},
+		tokenService: &fakeTokenSvc{tokens: map[string]*tokenSvc.Introspection{
+			"user":			access(1, "profile", "orders:read", "billing"),
+			"admin":			access(2, "profile"),
+			"delegated":		delegated,
+			"bound":			bound,
+		}},
+	}
+
+	cases := []struct {
+		name			string
+		clientID		string
+		req			TokenExchangeRequest
+		audience		string
+		scopes		[]string
+		actor		tokenSvc.Actor
+		err			string
+	}{
+		{"defaults to the client", "backend", TokenExchangeRequest{}, "backend", []string{"profile", "orders:read"}, tokenSvc.Actor{ClientID: "backend"}, ""},
+		{"target client narrows the scopes", "backend", TokenExchangeRequest{Audience: []string{"orders"}}, "orders", []string{"orders:read"}, tokenSvc.Actor{ClientID: "backend"}, ""},
+		{"issuer keeps the scopes", "backend", TokenExchangeRequest{Audience: []string{"https://gateway.example"}}, "https://gateway.example", []string{"profile", "orders:read"}, tokenSvc.Actor{ClientID: "backend"}, ""},
+		{"requested scope", "backend", TokenExchangeRequest{Scope: "orders:read"}, "backend", []string{"orders:read"}, tokenSvc.Actor{ClientID: "backend"}, ""},
+		{"scope of the subject the client is not allowed", "backend", TokenExchangeRequest{Scope: "billing"}, "", nil, tokenSvc.Actor{}, ErrInvalidScope},
+		{"scope the subject does not hold", "backend", TokenExchangeRequest{Scope: "orders:write"}, "", nil, tokenSvc.Actor{}, ErrInvalidScope},
+		{"scope the target client is not allowed", "backend", TokenExchangeRequest{Audience: []string{"orders"}, Scope: "profile"}, "", nil, tokenSvc.Actor{}, ErrInvalidScope},
+		{"several audiences", "backend", TokenExchangeRequest{Audience: []string{"orders", "backend"}}, "", nil, tokenSvc.Actor{}, ErrInvalidTarget},
+		{"unknown audience", "backend", TokenExchangeRequest{Audience: []string{"https://evil.example"}}, "", nil, tokenSvc.Actor{}, ErrInvalidTarget},
+		{"user acting", "backend", TokenExchangeRequest{ActorToken: "admin", ActorTokenType: TokenTypeAccessToken}, "backend", []string{"profile", "orders:read"}, tokenSvc.Actor{UserID: 2}, ""},
+		{"actor is the subject", "backend", TokenExchangeRequest{ActorToken: "user", ActorTokenType: TokenTypeAccessToken}, "", nil, tokenSvc.Actor{}, ErrInvalidGrant},
+		{"actor token of another type", "backend", TokenExchangeRequest{ActorToken: "admin"}, "", nil, tokenSvc.Actor{}, ErrInvalidRequest},
+		{"delegated subject", "backend", TokenExchangeRequest{SubjectToken: "delegated"}, "", nil, tokenSvc.Actor{}, ErrInvalidGrant},
+		{"subject bound to a DPoP key", "backend", TokenExchangeRequest{SubjectToken: "bound"}, "", nil, tokenSvc.Actor{}, ErrInvalidGrant},
+		{"revoked subject", "backend", TokenExchangeRequest{SubjectToken: "revoked"}, "", nil, tokenSvc.Actor{}, ErrInvalidGrant},
+		{"refresh token requested", "backend", TokenExchangeRequest{RequestedTokenType: "urn:ietf:params:oauth:token-type:refresh_token"}, "", nil, tokenSvc.Actor{}, ErrInvalidRequest},
+		{"client without the grant", "orders", TokenExchangeRequest{}, "", nil, tokenSvc.Actor{}, ErrUnauthorizedClient},
+		{"public client", "spa", TokenExchangeRequest{}, "", nil, tokenSvc.Actor{}, ErrUnauthorizedClient},
+	}
+	for _, tc := range cases {
+		req := tc.req
+		if req.SubjectToken == "" {
+			req.SubjectToken = "user"
+		}
+		req.SubjectTokenType = TokenTypeAccessToken
+
+		ex, err := s.ExchangeToken(tc.clientID, req, tokenSvc.Binding{})
+		if tc.err != "" {
+			if e, ok := err.(*Error); !ok || e.Code != tc.err {
+				t.Errorf("%s: expected %s, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if ex.UserID != 1 || ex.ClientID != tc.clientID || ex.Audience != tc.audience || ex.Actor != tc.actor || strings.Join(ex.Scopes, " ") != strings.Join(tc.scopes, " ") {
+			t.Errorf("%s: unexpected exchange %+v", tc.name, ex)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package roleRepo
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// File handles data logic related to roles and permissions
+
+// This defines a Permission struct that represents a scope that can be granted through roles
+type Permission struct {
+	gorm.Model
+	Name				string				`json:"name" gorm:"uniqueIndex"`
+}
+
+// This defines a Role struct that represents a named set of permissions
+type Role struct {
+	gorm.Model
+	Name				string				`json:"name" gorm:"uniqueIndex"`
+	Permissions		[]Permission		`json:"permissions" gorm:"many2many:role_permissions"`
+}
+
+// This defines a UserRole struct that links a user to a role
+type UserRole struct {
+	User				*userRepo.User		`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	Role				*Role					`json:"role" gorm:"foreignKey:RoleID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"primaryKey"`
+	RoleID			uint					`json:"role_id" gorm:"primaryKey"`
+}
+
+// Repository provides methods for interacting with the roles in the database
+type Repo interface {
+	GetRoleByName(name string) (*Role, error)
+	EnsureRole(name string, permissions []string) (*Role, error)
+	GetRolesByUser(userID uint) ([]Role, error)
+	AssignRole(userID uint, roleID uint) (error)
+	RemoveRole(userID uint, roleID uint) (error)
+	CountUsersWithRole(roleID uint) (int64, error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// GetRoleByName returns the role with the given name along with its permissions
+func (r *repo) GetRoleByName(name string) (*Role, error) {
+	var role Role
+	err := r.db.Preload("Permissions").Where("name = ?", name).First(&role).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("role not found")
+		}
+		return nil, err
+	}
+	return &role, nil
+}
+
+// EnsureRole creates the role and its permissions if they do not exist yet
+// Permissions missing from an existing role are added to it
+func (r *repo) EnsureRole(name string, permissions []string) (*Role, error) {
+	var role Role
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Find or create the role
+		if err := tx.Where(Role{Name: name}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+
+		// Find or create the permissions
+		perms := make([]Permission, 0, len(permissions))
+		for _, p := range permissions {
+			var perm Permission
+			if err := tx.Where(Permission{Name: p}).FirstOrCreate(&perm).Error; err != nil {
+				return err
+			}
+			perms = append(perms, perm)
+		}
+
+		// Link the permissions to the role
+		if len(perms) > 0 {
+			return tx.Model(&role).Association("Permissions").Append(perms)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// GetRolesByUser returns the roles of a user along with their permissions
+func (r *repo) GetRolesByUser(userID uint) ([]Role, error) {
+	var roles []Role
+	err := r.db.Preload("Permissions").
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+		Where("user_roles.user_id = ?", userID).
+		Order("roles.name").
+		Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AssignRole links the role to the user, assigning an already assigned role is a no-op
+func (r *repo) AssignRole(userID uint, roleID uint) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&UserRole{UserID: userID, RoleID: roleID}).Error
+}
+
+// RemoveRole unlinks the role from the user
+func (r *repo) RemoveRole(userID uint, roleID uint) error {
+	return r.db.Where("user_id = ? AND role_id = ?", userID, roleID).Delete(&UserRole{}).Error
+}
+
+// CountUsersWithRole returns the number of users holding the role
+func (r *repo) CountUsersWithRole(roleID uint) (int64, error) {
+	var count int64
+	err := r.db.Model(&UserRole{}).Where("role_id = ?", roleID).Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,161 @@
+package roleSvc
+
+import (
+	"errors"
+	"sort"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/role/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	// Roles
+	RoleAdmin = "admin"
+
+	// Permissions, which are granted as token scopes
+	PermUsersRead	= "users:read"
+	PermUsersWrite	= "users:write"
+	PermRolesRead	= "roles:read"
+	PermRolesWrite	= "roles:write"
+	PermClientsWrite	= "clients:write"
+	PermAuditRead		= "audit:read"
+	PermUsersImpersonate	= "users:impersonate"
+)
+
+// Define errors
+var (
+	ErrRoleNotFound	= errors.New("role not found")
+	ErrUserNotFound	= errors.New("user not found")
+)
+
+// DefaultRoles lists the roles created on startup with their permissions
+var DefaultRoles = map[string][]string{
+	RoleAdmin: {PermUsersRead, PermUsersWrite, PermRolesRead, PermRolesWrite, PermClientsWrite, PermAuditRead, PermUsersImpersonate},
+}
+
+// Svc is an interface for defining the methods that the role service will provide.
+type Svc interface {
+	GetUserRoles(userID uint) ([]roleRepo.Role, error)
+	GetUserAccess(userID uint) ([]string, []string, error)
+	AssignRole(userID uint, role string) (error)
+	RemoveRole(userID uint, role string) (error)
+	Seed(adminEmail string) (error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for role-related operations.
+type svc struct {
+	repo			roleRepo.Repo
+	userRepo		userRepo.Repo
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB) Svc {
+	return &svc{
+		repo: roleRepo.NewRepo(db),
+		userRepo: userRepo.NewRepo(db),
+	}
+}
+
+// GetUserRoles returns the roles of a user
+func (s *svc) GetUserRoles(userID uint) ([]roleRepo.Role, error) {
+	return s.repo.GetRolesByUser(userID)
+}
+
+// GetUserAccess returns the role names of a user and the scopes granted by them
+func (s *svc) GetUserAccess(userID uint) ([]string, []string, error) {
+	roles, err := s.repo.GetRolesByUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Collect the role names and the distinct permissions
+	names := make([]string, 0, len(roles))
+	seen := make(map[string]bool)
+	scopes := []string{}
+	for _, role := range roles {
+		names = append(names, role.Name)
+		for _, perm := range role.Permissions {
+			if !seen[perm.Name] {
+				seen[perm.Name] = true
+				scopes = append(scopes, perm.Name)
+			}
+		}
+	}
+	sort.Strings(scopes)
+
+	return names, scopes, nil
+}
+
+// AssignRole gives the role to the user
+func (s *svc) AssignRole(userID uint, role string) error {
+	r, u, err := s.lookup(userID, role)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.AssignRole(u.ID, r.ID)
+}
+
+// RemoveRole takes the role away from the user
+func (s *svc) RemoveRole(userID uint, role string) error {
+	r, u, err := s.lookup(userID, role)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.RemoveRole(u.ID, r.ID)
+}
+
+// Seed creates the default roles and grants the admin role to the configured admin user
+// The role is only granted while no admin exists and once the user has verified the email
+func (s *svc) Seed(adminEmail string) error {
+	for name, perms := range DefaultRoles {
+		if _, err := s.repo.EnsureRole(name, perms); err != nil {
+			return err
+		}
+	}
+
+	// Handle no admin configured
+	if adminEmail == "" {
+		return nil
+	}
+
+	// Handle admin already granted
+	r, err := s.repo.GetRoleByName(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	count, err := s.repo.CountUsersWithRole(r.ID)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// Handle not registered yet or email not proven
+	u, err := s.userRepo.GetByEmail(adminEmail)
+	if err != nil || u.EmailVerifiedAt == nil {
+		return nil
+	}
+
+	return s.repo.AssignRole(u.ID, r.ID)
+}
+
+// lookup returns the role and the user, ensuring both exist
+func (s *svc) lookup(userID uint, role string) (*roleRepo.Role, *userRepo.User, error) {
+	r, err := s.repo.GetRoleByName(role)
+	if err != nil {
+		return nil, nil, ErrRoleNotFound
+	}
+
+	u, err := s.userRepo.GetById(userID)
+	if err != nil {
+		return nil, nil, ErrUserNotFound
+	}
+
+	return r, u, nil
+}
@@ -1,18 +1,42 @@
 package routes
 
 import (
-	"fmt"
+	"time"
 	"net/http"
-	"hash/fnv"
-	"encoding/base64"
 	
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
 	"github.com/selatoz/gateway/api/auth"
+	"github.com/selatoz/gateway/api/admin"
+	"github.com/selatoz/gateway/api/oauth"
+	"github.com/selatoz/gateway/api/user"
+	"github.com/selatoz/gateway/api/wellknown"
+	"github.com/selatoz/gateway/middleware/audit"
 	"github.com/selatoz/gateway/middleware/auth"
+	"github.com/selatoz/gateway/middleware/client"
+	"github.com/selatoz/gateway/middleware/csrf"
+	"github.com/selatoz/gateway/middleware/mtls"
+	"github.com/selatoz/gateway/middleware/ratelimit"
+	"github.com/selatoz/gateway/internal/apikey/svc"
+	"github.com/selatoz/gateway/internal/audit/svc"
+	"github.com/selatoz/gateway/internal/client/svc"
+	"github.com/selatoz/gateway/internal/federation/svc"
+	"github.com/selatoz/gateway/internal/lockout/svc"
+	"github.com/selatoz/gateway/internal/magiclink/svc"
+	"github.com/selatoz/gateway/internal/oauth/svc"
+	"github.com/selatoz/gateway/internal/key/svc"
+	"github.com/selatoz/gateway/internal/mfa/svc"
+	"github.com/selatoz/gateway/internal/role/svc"
 	"github.com/selatoz/gateway/internal/user/svc"
 	"github.com/selatoz/gateway/internal/token/svc"
+	"github.com/selatoz/gateway/internal/verification/svc"
+	"github.com/selatoz/gateway/internal/webauthn/svc"
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/dpoplib"
+	"github.com/selatoz/gateway/pkg/maillib"
+	"github.com/selatoz/gateway/pkg/passwordlib"
+	"github.com/selatoz/gateway/pkg/ratelib"
 )
 
 // Context represents the extended gin.Context type
@@ -29,20 +53,44 @@ type Route struct {
 	Middleware	[]gin.HandlerFunc
 }
 
-// RouteGroup represents a group of routes, 
-// grouped based on the middleware they use.
-type RouteGroup struct {
-	Middleware []gin.HandlerFunc
-	Routes     []Route
-}
-
 // Routes represents a collection of API routes.
 type Routes []Route
 
 // Initializes the router object with the routes
-func NewRoutes(router *gin.Engine, db *gorm.DB) {
-	userService := userSvc.NewSvc(db)
-	tokenService := tokenSvc.NewSvc(db)
+func NewRoutes(router *gin.Engine, db *gorm.DB, mailer maillib.Mailer, rateLimits ratelib.Backend, dpopReplay dpoplib.ReplayCache, passwordPolicy *passwordlib.Policy, passwordHasher passwordlib.Hasher, auditSinks []auditSvc.Sink) {
+	auditService := auditSvc.NewSvc(db, auditSinks...)
+	userService := userSvc.NewSvc(db, passwordPolicy, passwordHasher, auditService)
+	keyService := keySvc.NewSvc(db)
+	roleService := roleSvc.NewSvc(db)
+	tokenService := tokenSvc.NewSvc(db, keyService, roleService, auditService)
+	apiKeyService := apiKeySvc.NewSvc(db, roleService)
+	clientService := clientSvc.NewSvc(db)
+	oauthService := oauthSvc.NewSvc(db, clientService, tokenService)
+	federationService := federationSvc.NewSvc(db)
+	mfaService := mfaSvc.NewSvc(db)
+	webauthnService := webauthnSvc.NewSvc(db)
+	verificationService := verificationSvc.NewSvc(db, mailer)
+	magicLinkService := magicLinkSvc.NewSvc(db, magicLinkSvc.NewMailSender(mailer))
+	lockoutService := lockoutSvc.NewSvc(db)
+
+	// Verifier of the DPoP proofs binding tokens to a key of the client
+	dpopVerifier := dpoplib.NewVerifier(dpopReplay)
+
+	// Limits of the password reset requests
+	conf := cfglib.DefaultConf
+	passwordIPLimiter := rateLimits.NewLimiter("password_ip", conf.RateLimitPasswordIP, time.Hour)
+	passwordEmailLimiter := rateLimits.NewLimiter("password_email", conf.RateLimitPasswordEmail, time.Hour)
+
+	// Limits of the passwordless login requests
+	magicLinkIPLimiter := rateLimits.NewLimiter("magic_link_ip", conf.RateLimitMagicLinkIP, time.Hour)
+	magicLinkEmailLimiter := rateLimits.NewLimiter("magic_link_email", conf.RateLimitMagicLinkEmail, time.Hour)
+
+	// Limits of the unauthenticated auth endpoints, the API and the OAuth clients
+	// ipLimit runs before the credentials are checked, so invalid ones cannot be tried unlimited
+	authLimit := mwratelimit.Limit(rateLimits.NewLimiter("auth", conf.RateLimitAuth, time.Minute), mwratelimit.ByIP)
+	ipLimit := mwratelimit.Limit(rateLimits.NewLimiter("api_ip", conf.RateLimitAPIIP, time.Minute), mwratelimit.ByIP)
+	userLimit := mwratelimit.Limit(rateLimits.NewLimiter("api", conf.RateLimitAPI, time.Minute), mwratelimit.ByAPIKey, mwratelimit.ByUser, mwratelimit.ByClient, mwratelimit.ByIP)
+	clientLimit := mwratelimit.Limit(rateLimits.NewLimiter("oauth", conf.RateLimitOAuth, time.Minute), mwratelimit.ByClient, mwratelimit.ByIP)
 
 	// Define API routes
 	apiRoutes := Routes{
@@ -50,32 +98,308 @@ func NewRoutes(router *gin.Engine, db *gorm.DB) {
 			Method:  	"GET",
 			Path:    	"/users",
 			Handler: 	authHttp.GetUsersHandler(userService),
-			Middleware: []gin.HandlerFunc{mwauth.Authorize(tokenService)},
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.AuthorizePrincipals(tokenService, apiKeyService, dpopVerifier, mwauth.PrincipalUser, mwauth.PrincipalClient), userLimit, mwauth.RequireScopes(roleSvc.PermUsersRead)},
 		},
 		{
 			Method:  "POST",
 			Path:    "/user/logout",
 			Handler: authHttp.LogoutHandler(tokenService),
-			Middleware: []gin.HandlerFunc{mwauth.Authorize(tokenService)},
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit},
+		},
+		{
+			Method:  "GET",
+			Path:    "/user/sessions",
+			Handler: userHttp.ListSessionsHandler(tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/user/sessions/:id",
+			Handler: userHttp.RevokeSessionHandler(tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "GET",
+			Path:    "/user/api-keys",
+			Handler: userHttp.ListAPIKeysHandler(apiKeyService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/user/api-keys",
+			Handler: userHttp.CreateAPIKeyHandler(apiKeyService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireVerifiedEmail(userService), mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/user/api-keys/:id",
+			Handler: userHttp.RevokeAPIKeyHandler(apiKeyService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "GET",
+			Path:    "/user/identities",
+			Handler: userHttp.ListIdentitiesHandler(federationService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/user/mfa/totp",
+			Handler: userHttp.EnrollTOTPHandler(mfaService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/user/mfa/totp/confirm",
+			Handler: userHttp.ConfirmTOTPHandler(mfaService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/user/mfa/totp",
+			Handler: userHttp.DisableTOTPHandler(mfaService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/user/mfa/recovery-codes",
+			Handler: userHttp.RegenerateRecoveryCodesHandler(mfaService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/user/webauthn/register/begin",
+			Handler: userHttp.BeginWebAuthnRegistrationHandler(webauthnService, mfaService, tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/user/webauthn/register/finish",
+			Handler: userHttp.FinishWebAuthnRegistrationHandler(webauthnService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "GET",
+			Path:    "/user/webauthn/credentials",
+			Handler: userHttp.ListWebAuthnCredentialsHandler(webauthnService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/user/webauthn/credentials/:id",
+			Handler: userHttp.DeleteWebAuthnCredentialHandler(webauthnService, mfaService, tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/user/sessions",
+			Handler: userHttp.RevokeOtherSessionsHandler(tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
 		},
 		{
 			Method:  "POST",
 			Path:    "/auth/login",
-			Handler: authHttp.LoginHandler(userService, tokenService),
-			Middleware: nil,
+			Handler: authHttp.LoginHandler(userService, tokenService, mfaService, webauthnService, lockoutService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
 		},
 		{
 			Method:  "POST",
 			Path:    "/auth/register",
-			Handler: authHttp.RegisterHandler(userService, tokenService),
-			Middleware: nil,
+			Handler: authHttp.RegisterHandler(userService, tokenService, verificationService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
 		},
 		{
 			Method:  "POST",
 			Path:    "/auth/refresh-access",
-			Handler: authHttp.RefreshAccessHandler(tokenService),
+			Handler: authHttp.RefreshAccessHandler(tokenService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "GET",
+			Path:    "/auth/verify-email",
+			Handler: authHttp.VerifyEmailHandler(verificationService),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/verify-email/resend",
+			Handler: authHttp.ResendVerificationHandler(verificationService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/password/forgot",
+			Handler: authHttp.PasswordForgotHandler(verificationService, passwordIPLimiter, passwordEmailLimiter),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/password/reset",
+			Handler: authHttp.PasswordResetHandler(verificationService, userService, tokenService, apiKeyService, federationService, passwordIPLimiter),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/magic-link",
+			Handler: authHttp.MagicLinkHandler(magicLinkService, magicLinkIPLimiter, magicLinkEmailLimiter),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "GET",
+			Path:    "/auth/magic-link/verify",
+			Handler: authHttp.MagicLinkVerifyHandler(magicLinkService, tokenService, mfaService, webauthnService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/magic-link/verify",
+			Handler: authHttp.MagicCodeVerifyHandler(magicLinkService, tokenService, mfaService, webauthnService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/mfa/verify",
+			Handler: authHttp.MFAVerifyHandler(mfaService, tokenService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/mfa/webauthn/begin",
+			Handler: authHttp.MFAWebAuthnBeginHandler(mfaService, webauthnService),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/mfa/webauthn/finish",
+			Handler: authHttp.MFAWebAuthnFinishHandler(mfaService, webauthnService, tokenService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/webauthn/login/begin",
+			Handler: authHttp.WebAuthnLoginBeginHandler(webauthnService),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/auth/webauthn/login/finish",
+			Handler: authHttp.WebAuthnLoginFinishHandler(webauthnService, tokenService, dpopVerifier),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "GET",
+			Path:    "/auth/federated/:provider",
+			Handler: authHttp.FederatedLoginHandler(federationService),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "GET",
+			Path:    "/auth/federated/:provider/callback",
+			Handler: authHttp.FederatedCallbackHandler(federationService, tokenService, mfaService, webauthnService),
+			Middleware: []gin.HandlerFunc{authLimit},
+		},
+		{
+			Method:  "GET",
+			Path:    "/.well-known/jwks.json",
+			Handler: wellknownHttp.JWKSHandler(keyService),
+			Middleware: nil,
+		},
+		{
+			Method:  "GET",
+			Path:    "/.well-known/openid-configuration",
+			Handler: wellknownHttp.OpenIDConfigurationHandler(),
 			Middleware: nil,
 		},
+		{
+			Method:  "GET",
+			Path:    "/userinfo",
+			Handler: oauthHttp.UserInfoHandler(userService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(tokenSvc.ScopeOpenID)},
+		},
+		{
+			Method:  "POST",
+			Path:    "/userinfo",
+			Handler: oauthHttp.UserInfoHandler(userService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(tokenSvc.ScopeOpenID)},
+		},
+		{
+			Method:  "GET",
+			Path:    "/admin/users/:id/roles",
+			Handler: adminHttp.GetUserRolesHandler(roleService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermUsersRead, roleSvc.PermRolesRead), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/admin/users/:id/roles",
+			Handler: adminHttp.AssignRoleHandler(roleService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermRolesWrite), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "DELETE",
+			Path:    "/admin/users/:id/roles/:role",
+			Handler: adminHttp.RemoveRoleHandler(roleService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermRolesWrite), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/admin/users/:id/unlock",
+			Handler: adminHttp.UnlockUserHandler(lockoutService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermUsersWrite), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/admin/users/:id/impersonate",
+			Handler: adminHttp.ImpersonateUserHandler(userService, roleService, tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermUsersImpersonate), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "GET",
+			Path:    "/admin/lockout-events",
+			Handler: adminHttp.GetLockoutEventsHandler(lockoutService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermAuditRead), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "GET",
+			Path:    "/admin/audit-events",
+			Handler: adminHttp.GetAuditEventsHandler(auditService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermAuditRead), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/admin/clients",
+			Handler: adminHttp.CreateClientHandler(clientService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireScopes(roleSvc.PermClientsWrite), mwauth.ForbidImpersonation()},
+		},
+		{
+			Method:  "GET",
+			Path:    "/oauth/authorize",
+			Handler: oauthHttp.AuthorizeHandler(oauthService, tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/oauth/authorize",
+			Handler: oauthHttp.ConsentHandler(oauthService, tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwauth.Authorize(tokenService, apiKeyService, dpopVerifier), userLimit, mwauth.RequireFirstParty()},
+		},
+		{
+			Method:  "POST",
+			Path:    "/oauth/token",
+			Handler: oauthHttp.TokenHandler(oauthService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwclient.Authenticate(clientService, true), clientLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/oauth/introspect",
+			Handler: oauthHttp.IntrospectHandler(tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwclient.Authenticate(clientService, false), clientLimit},
+		},
+		{
+			Method:  "POST",
+			Path:    "/oauth/revoke",
+			Handler: oauthHttp.RevokeHandler(tokenService),
+			Middleware: []gin.HandlerFunc{ipLimit, mwclient.Authenticate(clientService, true), clientLimit},
+		},
 	}
 
 	// Define TEST routes
@@ -90,6 +414,15 @@ func NewRoutes(router *gin.Engine, db *gorm.DB) {
 		},
 	}
 
+	// Give each request an id and the audit log
+	router.Use(mwaudit.Capture(auditService))
+
+	// Read the verified client certificate and the client it identifies
+	router.Use(mwmtls.Capture(clientService))
+
+	// Refuse state-changing requests authenticated by a session cookie without the CSRF token
+	router.Use(mwcsrf.Protect())
+
 	// Register API routes
 	apiRoutes.RegisterRoute(router)
 
@@ -97,46 +430,11 @@ func NewRoutes(router *gin.Engine, db *gorm.DB) {
 	testRoutes.RegisterRoute(router)
 }
 
-func getMiddlewareHash(mw []gin.HandlerFunc) string {
-	// Handle nil
-	if mw != nil {
-		h := fnv.New32a()
-		for _, f := range mw {
-			 h.Write([]byte(fmt.Sprintf("%p", f)))
-		}
-		return base64.URLEncoding.EncodeToString(h.Sum(nil))
-	}
-
-	return "no_mw"
-}
-
 // Register registers the API routes with the provided Gin router.
+// Each route gets its own middleware chain, closures of the same function cannot be told apart to share one
 func (routes Routes) RegisterRoute(router *gin.Engine) {
-	// Group routes by middleware
-	groups := make(map[string]RouteGroup)
 	for _, route := range routes {
-		key := getMiddlewareHash(route.Middleware)
-		group, ok := groups[key]
-		if !ok {
-			 group = RouteGroup{
-				  Middleware: route.Middleware,
-			 }
-		}
-		group.Routes = append(group.Routes, route)
-		groups[key] = group
-  }
-  
-  // Register routes with their respective middleware groups
-	for _, group := range groups {
-		chain := router.Group("/")
-		chain.Use(group.Middleware...)
-		for _, route := range group.Routes {
-			chain.Handle(route.Method, route.Path, route.Handler)
-		}
+		handlers := append(append([]gin.HandlerFunc{}, route.Middleware...), route.Handler)
+		router.Handle(route.Method, route.Path, handlers...)
 	}
 }
-
-
-
-
-
@@ -3,6 +3,9 @@ package tokenRepo
 import (
 	"time"
 	"errors"
+	"strings"
+	"crypto/sha256"
+	"encoding/hex"
 
 	"gorm.io/gorm"
 
@@ -11,6 +14,12 @@ import (
 
 // File handles data logic related to access and refresh tokens
 
+// Only the SHA-256 digest of a token and a short display prefix are stored,
+// TokenString is only set on freshly created tokens so they can be handed to the client
+
+// Length of the display prefix stored alongside the token hash
+const tokenPrefixLength = 8
+
 // This defines an AccessToken struct to be used as the access tokens used for authentication
 type AccessToken struct {
 	gorm.Model
@@ -20,7 +29,11 @@ type AccessToken struct {
 	RefreshTokenID	uint					`json:"refresh_token_id",gorm:"index"`
 	UserAgent		string				`json:"user_agent",gorm:"index"`
 	TokenName		string				`json:"token_name",gorm:"index"`
-	TokenString		string				`json:"token_string",gorm:"uniqueIndex"`
+	TokenString		string				`json:"-" gorm:"-"`
+	TokenHash		string				`json:"-" gorm:"uniqueIndex"`
+	TokenPrefix		string				`json:"token_prefix"`
+	ClientID			string				`json:"client_id" gorm:"index"`
+	Scope				string				`json:"scope"`
 	ExpiresAt		time.Time			`json:"expires_at"`
 }
 
@@ -32,19 +45,92 @@ type RefreshToken struct {
 	UserID			uint					`json:"user_id,"gorm:"index"`
 	UserAgent		string				`json:"user_agent",gorm:"index"`
 	TokenName		string				`json:"token_name",gorm:"index"`
-	TokenString		string				`json:"token_string",gorm:"uniqueIndex"`
+	TokenString		string				`json:"-" gorm:"-"`
+	TokenHash		string				`json:"-" gorm:"uniqueIndex"`
+	TokenPrefix		string				`json:"token_prefix"`
+	ClientID			string				`json:"client_id" gorm:"index"`
+	Scope				string				`json:"scope"`
+	FamilyID			string				`json:"family_id" gorm:"index"`
+	ParentID			*uint					`json:"parent_id" gorm:"index"`
+	RotatedAt		*time.Time			`json:"rotated_at"`
+	JKT				string				`json:"jkt"`
+	CertThumbprint	string				`json:"cert_thumbprint"`
+	ActorID			uint					`json:"actor_id" gorm:"index"`
+	ActorClientID	string				`json:"actor_client_id"`
+	Audience			string				`json:"audience"`
+	IP					string				`json:"ip"`
+	LastUsedAt		*time.Time			`json:"last_used_at"`
 	ExpiresAt		time.Time			`json:"expires_at"`
 }
 
+// This defines a ClientAccessToken struct to be used as the access tokens issued to clients acting on their own behalf
+type ClientAccessToken struct {
+	gorm.Model
+	ClientID			string				`json:"client_id" gorm:"index"`
+	TokenName		string				`json:"token_name"`
+	TokenString		string				`json:"-" gorm:"-"`
+	TokenHash		string				`json:"-" gorm:"uniqueIndex"`
+	TokenPrefix		string				`json:"token_prefix"`
+	Scope				string				`json:"scope"`
+	ExpiresAt		time.Time			`json:"expires_at"`
+}
+
+// This defines a SecurityEvent struct that records suspicious token activity
+type SecurityEvent struct {
+	gorm.Model
+	UserID			uint					`json:"user_id" gorm:"index"`
+	FamilyID			string				`json:"family_id" gorm:"index"`
+	EventType		string				`json:"event_type" gorm:"index"`
+	UserAgent		string				`json:"user_agent"`
+	IP					string				`json:"ip"`
+}
+
+// This defines an AuthorizationCode struct that represents an OAuth authorization code
+// FamilyID links the code to the refresh token family issued in exchange for it
+type AuthorizationCode struct {
+	gorm.Model
+	User      				*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID					uint					`json:"user_id" gorm:"index"`
+	ClientID					string				`json:"client_id" gorm:"index"`
+	CodeHash					string				`json:"-" gorm:"uniqueIndex"`
+	RedirectURI				string				`json:"redirect_uri"`
+	Scope						string				`json:"scope"`
+	CodeChallenge			string				`json:"-"`
+	CodeChallengeMethod	string				`json:"-"`
+	Nonce						string				`json:"-"`
+	AuthTime					time.Time			`json:"auth_time"`
+	FamilyID					string				`json:"family_id"`
+	UsedAt					*time.Time			`json:"used_at"`
+	ExpiresAt				time.Time			`json:"expires_at"`
+}
+
 // Repository provides methods for interacting with the profiles in the database
 type Repo interface {
-	CreateAccessToken(userID uint, refreshTokenID uint, userAgent string, name string, token string, expiresAt time.Time) (*AccessToken, error)
+	CreateAccessToken(at *AccessToken) (*AccessToken, error)
 	GetAccessToken(token string) (*AccessToken, error)
 	DeleteAccessToken(token string, deleteRefreshToken bool) (error)
+	DeleteAccessTokensByRefreshToken(refreshTokenID uint) (error)
 
-	CreateRefreshToken(userID uint, userAgent string, name string, token string, expiresAt time.Time) (*RefreshToken, error)
+	CreateRefreshToken(rt *RefreshToken) (*RefreshToken, error)
 	GetRefreshToken(token string) (*RefreshToken, error)
+	GetActiveRefreshTokensByUser(userID uint) ([]RefreshToken, error)
+	GetRefreshTokenFamilyStarts(familyIDs []string) (map[string]time.Time, error)
+	MarkRefreshTokenRotated(id uint, rotatedAt time.Time) (bool, error)
+	TouchRefreshToken(id uint, ip string, usedAt time.Time, interval time.Duration) (error)
 	DeleteRefreshToken(token string) (error)
+	DeleteRefreshTokenFamily(familyID string) (error)
+	DeleteRefreshTokenFamiliesByUser(userID uint, exceptFamilyID string) (error)
+	DeleteTokensByUser(userID uint) (error)
+
+	CreateClientAccessToken(at *ClientAccessToken) (*ClientAccessToken, error)
+	GetClientAccessToken(token string) (*ClientAccessToken, error)
+	DeleteClientAccessToken(token string) (error)
+
+	CreateSecurityEvent(userID uint, familyID string, eventType string, userAgent string, ip string) (*SecurityEvent, error)
+
+	CreateAuthorizationCode(code string, ac *AuthorizationCode) (*AuthorizationCode, error)
+	ConsumeAuthorizationCode(code string, usedAt time.Time) (*AuthorizationCode, bool, error)
+	SetAuthorizationCodeFamily(id uint, familyID string) (error)
 }
 
 // Provides the implementation of the repo
@@ -58,16 +144,11 @@ func NewRepo(db *gorm.DB) Repo {
 }
 
 // CreateAccessToken creates an entry in the access tokens table.
-func (r *repo) CreateAccessToken(userID uint, refreshTokenID uint, userAgent string, name string, token string, expiresAt time.Time) (*AccessToken, error) {
+// Only the hash and the prefix of TokenString are stored
+func (r *repo) CreateAccessToken(at *AccessToken) (*AccessToken, error) {
 	// Create a new personal access token in the database
-	at := &AccessToken{
-		 UserID:    		userID,
-		 RefreshTokenID:	refreshTokenID,
-		 UserAgent:			userAgent,
-		 TokenName:      	name,
-		 TokenString:     token,
-		 ExpiresAt: 		expiresAt,
-	}
+	at.TokenHash = HashToken(at.TokenString)
+	at.TokenPrefix = tokenPrefix(at.TokenString)
 
 	if err := r.db.Create(at).Error; err != nil {
 		 return nil, err
@@ -79,7 +160,7 @@ func (r *repo) CreateAccessToken(userID uint, refreshTokenID uint, userAgent str
 // GetAccessToken returns an access token with the given value
 func (r *repo) GetAccessToken(token string) (*AccessToken, error) {
 	var at AccessToken
-	err := r.db.Where("token_string = ?", token).First(&at).Error
+	err := r.db.Preload("RefreshToken").Where("token_hash = ?", HashToken(token)).First(&at).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, errors.New("token not found")
@@ -94,7 +175,7 @@ func (r *repo) DeleteAccessToken(token string, deleteRefreshToken bool) error {
 	var at AccessToken
 
 	// Find the matching access token
-	err := r.db.Preload("RefreshToken").Where("token_string = ?", token).First(&at).Error
+	err := r.db.Where("token_hash = ?", HashToken(token)).First(&at).Error
 	if err != nil {
 		// Handle already deleted
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -108,23 +189,26 @@ func (r *repo) DeleteAccessToken(token string, deleteRefreshToken bool) error {
 	// Delete refresh token requested
 	// Which deletes the refresh token and all related access tokens
 	if (deleteRefreshToken) {
-		return r.DeleteRefreshToken(at.RefreshToken.TokenString);
+		return r.deleteRefreshTokenByID(at.RefreshTokenID);
 	}
 
 	// Only delete the access token
-	return r.db.Where("token_string = ?", token).Delete(&at).Error
+	return r.db.Delete(&at).Error
+}
+
+// DeleteAccessTokensByRefreshToken deletes all access tokens issued with the given refresh token
+func (r *repo) DeleteAccessTokensByRefreshToken(refreshTokenID uint) error {
+	return r.db.Where("refresh_token_id = ?", refreshTokenID).Delete(&AccessToken{}).Error
 }
 
 // CreateRefreshToken creates an entry in the access tokens table.
-func (r *repo) CreateRefreshToken(userID uint, userAgent string, name string, token string, expiresAt time.Time) (*RefreshToken, error) {
+// Only the hash and the prefix of TokenString are stored
+func (r *repo) CreateRefreshToken(rt *RefreshToken) (*RefreshToken, error) {
 	// Create a new personal access token in the database
-	rt := &RefreshToken{
-		 UserID:    	userID,
-		 UserAgent:		userAgent,
-		 TokenName:    name,
-		 TokenString:  token,
-		 ExpiresAt: 	expiresAt,
-	}
+	now := time.Now()
+	rt.TokenHash = HashToken(rt.TokenString)
+	rt.TokenPrefix = tokenPrefix(rt.TokenString)
+	rt.LastUsedAt = &now
 
 	if err := r.db.Create(rt).Error; err != nil {
 		 return nil, err
@@ -136,7 +220,7 @@ func (r *repo) CreateRefreshToken(userID uint, userAgent string, name string, to
 // GetRefreshToken returns an access token with the given value
 func (r *repo) GetRefreshToken(token string) (*RefreshToken, error) {
 	var rt RefreshToken
-	err := r.db.Where("token_string = ?", token).First(&rt).Error
+	err := r.db.Where("token_hash = ?", HashToken(token)).First(&rt).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, errors.New("token not found")
@@ -151,7 +235,7 @@ func (r *repo) DeleteRefreshToken(token string) error {
 	var rt RefreshToken
 
 	// Find the matching refresh token
-	err := r.db.Where("token_string = ?", token).First(&rt).Error
+	err := r.db.Where("token_hash = ?", HashToken(token)).First(&rt).Error
 	if err != nil {
 		// Handle already deleted
 		if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -162,16 +246,256 @@ func (r *repo) DeleteRefreshToken(token string) error {
 		return err
 	}
 
+	return r.deleteRefreshTokenByID(rt.ID)
+}
+
+// deleteRefreshTokenByID deletes the refresh token with the given id along with all referenced access tokens
+func (r *repo) deleteRefreshTokenByID(id uint) error {
 	// Delete all access tokens associated with the refresh token
-	err = r.db.Where("refresh_token_id = ?", rt.ID).Delete(&AccessToken{}).Error
+	err := r.db.Where("refresh_token_id = ?", id).Delete(&AccessToken{}).Error
 	if err != nil {
 		return err
 	}
 
 	// Delete the refresh token
-	err = r.db.Delete(&rt).Error
+	return r.db.Where("id = ?", id).Delete(&RefreshToken{}).Error
+}
+
+// GetActiveRefreshTokensByUser returns the unexpired refresh tokens of a user that have not been rotated
+func (r *repo) GetActiveRefreshTokensByUser(userID uint) ([]RefreshToken, error) {
+	var rts []RefreshToken
+	err := r.db.Where("user_id = ? AND rotated_at IS NULL AND expires_at > ?", userID, time.Now()).Order("last_used_at desc").Find(&rts).Error
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return rts, nil
+}
+
+// GetRefreshTokenFamilyStarts returns the creation time of the first token of each given family
+func (r *repo) GetRefreshTokenFamilyStarts(familyIDs []string) (map[string]time.Time, error) {
+	var rows []struct {
+		FamilyID		string
+		StartedAt	time.Time
+	}
+	err := r.db.Model(&RefreshToken{}).Select("family_id, MIN(created_at) AS started_at").Where("family_id IN ?", familyIDs).Group("family_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	starts := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		starts[row.FamilyID] = row.StartedAt
+	}
+	return starts, nil
+}
+
+// MarkRefreshTokenRotated flags the refresh token as used
+// Returns false if the token had already been rotated by another request
+func (r *repo) MarkRefreshTokenRotated(id uint, rotatedAt time.Time) (bool, error) {
+	res := r.db.Model(&RefreshToken{}).Where("id = ? AND rotated_at IS NULL", id).Update("rotated_at", rotatedAt)
+	if res.Error != nil {
+		return false, res.Error
+	}
+
+	return res.RowsAffected == 1, nil
+}
+
+// TouchRefreshToken records the last use of a refresh token session
+// Updates are skipped when the last recorded use is more recent than the interval
+func (r *repo) TouchRefreshToken(id uint, ip string, usedAt time.Time, interval time.Duration) error {
+	return r.db.Model(&RefreshToken{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, usedAt.Add(-interval)).
+		Updates(map[string]interface{}{"ip": ip, "last_used_at": usedAt}).Error
+}
+
+// DeleteRefreshTokenFamily deletes every refresh token of a family along with all referenced access tokens
+func (r *repo) DeleteRefreshTokenFamily(familyID string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// Delete all access tokens associated with the family
+		family := tx.Model(&RefreshToken{}).Select("id").Where("family_id = ?", familyID)
+		err := tx.Where("refresh_token_id IN (?)", family).Delete(&AccessToken{}).Error
+		if err != nil {
+			return err
+		}
+
+		// Delete the refresh tokens
+		return tx.Where("family_id = ?", familyID).Delete(&RefreshToken{}).Error
+	})
+}
+
+// DeleteRefreshTokenFamiliesByUser deletes every refresh token family of a user except the given one
+func (r *repo) DeleteRefreshTokenFamiliesByUser(userID uint, exceptFamilyID string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// Delete all access tokens associated with the families
+		families := tx.Model(&RefreshToken{}).Select("id").Where("user_id = ? AND family_id <> ?", userID, exceptFamilyID)
+		err := tx.Where("refresh_token_id IN (?)", families).Delete(&AccessToken{}).Error
+		if err != nil {
+			return err
+		}
+
+		// Delete the refresh tokens
+		return tx.Where("user_id = ? AND family_id <> ?", userID, exceptFamilyID).Delete(&RefreshToken{}).Error
+	})
+}
+
+// DeleteTokensByUser deletes every access and refresh token of a user
+func (r *repo) DeleteTokensByUser(userID uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&AccessToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&RefreshToken{}).Error
+	})
+}
+
+// CreateClientAccessToken creates an entry in the client access tokens table.
+// Only the hash and the prefix of TokenString are stored
+func (r *repo) CreateClientAccessToken(at *ClientAccessToken) (*ClientAccessToken, error) {
+	at.TokenHash = HashToken(at.TokenString)
+	at.TokenPrefix = tokenPrefix(at.TokenString)
+
+	if err := r.db.Create(at).Error; err != nil {
+		return nil, err
+	}
+
+	return at, nil
+}
+
+// GetClientAccessToken returns a client access token with the given value
+func (r *repo) GetClientAccessToken(token string) (*ClientAccessToken, error) {
+	var at ClientAccessToken
+	err := r.db.Where("token_hash = ?", HashToken(token)).First(&at).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("token not found")
+		}
+		return nil, err
+	}
+	return &at, nil
+}
+
+// DeleteClientAccessToken deletes the matching client access token
+func (r *repo) DeleteClientAccessToken(token string) error {
+	return r.db.Where("token_hash = ?", HashToken(token)).Delete(&ClientAccessToken{}).Error
+}
+
+// CreateSecurityEvent creates an entry in the security events table
+func (r *repo) CreateSecurityEvent(userID uint, familyID string, eventType string, userAgent string, ip string) (*SecurityEvent, error) {
+	e := &SecurityEvent{
+		UserID:		userID,
+		FamilyID:	familyID,
+		EventType:	eventType,
+		UserAgent:	userAgent,
+		IP:			ip,
+	}
+
+	if err := r.db.Create(e).Error; err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// CreateAuthorizationCode creates an entry in the authorization codes table, storing only the hash of the code
+func (r *repo) CreateAuthorizationCode(code string, ac *AuthorizationCode) (*AuthorizationCode, error) {
+	ac.CodeHash = HashToken(code)
+
+	if err := r.db.Create(ac).Error; err != nil {
+		return nil, err
+	}
+
+	return ac, nil
+}
+
+// ConsumeAuthorizationCode returns the matching authorization code and marks it as used
+// Returns false if the code had already been used
+func (r *repo) ConsumeAuthorizationCode(code string, usedAt time.Time) (*AuthorizationCode, bool, error) {
+	var ac AuthorizationCode
+	err := r.db.Where("code_hash = ?", HashToken(code)).First(&ac).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, errors.New("code not found")
+		}
+		return nil, false, err
+	}
+
+	// Mark the code as used, unless another request already did
+	res := r.db.Model(&AuthorizationCode{}).Where("id = ? AND used_at IS NULL", ac.ID).Update("used_at", usedAt)
+	if res.Error != nil {
+		return nil, false, res.Error
+	}
+
+	return &ac, res.RowsAffected == 1, nil
+}
+
+// SetAuthorizationCodeFamily links the code to the refresh token family issued for it
+func (r *repo) SetAuthorizationCodeFamily(id uint, familyID string) error {
+	return r.db.Model(&AuthorizationCode{}).Where("id = ?", id).Update("family_id", familyID).Error
+}
+
+// HashToken returns the hex encoded SHA-256 digest used to store and look up a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenPrefix returns the display prefix of a token
+// JWT headers are shared by all tokens, so the prefix is taken from the signature
+func tokenPrefix(token string) string {
+	if i := strings.LastIndex(token, "."); i >= 0 {
+		token = token[i+1:]
+	}
+	if len(token) > tokenPrefixLength {
+		token = token[:tokenPrefixLength]
+	}
+
+	return token
+}
+
+// MigrateTokenHashes replaces the plain token strings of existing rows with their hashes
+// Must run before the schema migration, which creates the unique index on the hashes
+func MigrateTokenHashes(db *gorm.DB) error {
+	m := db.Migrator()
+	for _, model := range []interface{}{&AccessToken{}, &RefreshToken{}} {
+		// Handle new or already migrated tables
+		if !m.HasTable(model) || !m.HasColumn(model, "token_string") {
+			continue
+		}
+
+		// Add the new columns without their indexes
+		for _, field := range []string{"TokenHash", "TokenPrefix"} {
+			if !m.HasColumn(model, field) {
+				if err := m.AddColumn(model, field); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Rehash the existing rows, including soft deleted ones
+		var rows []struct {
+			ID				uint
+			TokenString	string
+		}
+		err := db.Model(model).Unscoped().Select("id, token_string").Where("token_string <> ''").FindInBatches(&rows, 500, func(tx *gorm.DB, batch int) error {
+			for _, row := range rows {
+				err := db.Model(model).Unscoped().Where("id = ?", row.ID).Updates(map[string]interface{}{
+					"token_hash":		HashToken(row.TokenString),
+					"token_prefix":	tokenPrefix(row.TokenString),
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		// Drop the plain token strings
+		if err := m.DropColumn(model, "token_string"); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -1,14 +1,24 @@
 package tokenSvc
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"errors"
+	"log"
+	"strconv"
 	"strings"
 	"time"
 
 	"gorm.io/gorm"
 	"github.com/dgrijalva/jwt-go"
 
+	"github.com/selatoz/gateway/pkg/cryptolib"
 	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/audit/svc"
+	"github.com/selatoz/gateway/internal/key/svc"
+	"github.com/selatoz/gateway/internal/role/svc"
 	"github.com/selatoz/gateway/internal/token/repo"
 	"github.com/selatoz/gateway/internal/user/repo"
 )
@@ -20,38 +30,142 @@ const (
 	ErrTokenInvalid			= "token invalid"
 	ErrTokenUserInvalid		= "token user invalid"
 	ErrTokenClaimsInvalid 	= "token claims invalid"
+	ErrTokenReused				= "token reused"
+	ErrTokenRevoked			= "token revoked"
+	ErrSessionNotFound		= "session not found"
+	ErrTokenBindingInvalid	= "token binding invalid"
+	ErrTokenDelegated			= "token already delegated"
+
+	// Security event types
+	EventRefreshTokenReused	= "refresh_token_reused"
+
+	// Minimum interval between two recorded uses of a session
+	SessionTouchInterval = time.Minute
+
+	// Principal types, a token is held by a user or by a client acting on its own behalf
+	PrincipalUser		= "user"
+	PrincipalClient	= "client"
+
+	// Token type hints (RFC 7009)
+	TokenTypeHintAccess	= "access_token"
+	TokenTypeHintRefresh	= "refresh_token"
+
+	// Identity scopes (OpenID Connect), granted to clients without a matching permission
+	ScopeOpenID		= "openid"
+	ScopeProfile	= "profile"
+	ScopeEmail		= "email"
 
 	// These names are used to determine if the token is an access token or a refresh token
 	AccessTokenName	= "jwt_access"
 	RefreshTokenName	= "jwt_refresh"
 )
 
+// IdentityScopes lists the identity scopes a client can be granted
+var IdentityScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail}
+
 // Svc is an interface for defining the methods that the user service will provide.
 type Svc interface {
 	GetAccessToken(token string) (*tokenRepo.AccessToken, error)
-	GenerateTokens(userID uint, userAgent string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error)
-	GenerateAccessToken(userID uint, refreshTokenID uint, userAgent string) (*tokenRepo.AccessToken, error)
-	GenerateRefreshToken(userID uint, userAgent string) (*tokenRepo.RefreshToken, error)
+	GenerateTokens(userID uint, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error)
+	GenerateClientTokens(userID uint, clientID string, scopes []string, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error)
+	GenerateDelegatedToken(userID uint, clientID string, audience string, scopes []string, actor Actor, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, error)
+	GenerateAccessToken(rt *tokenRepo.RefreshToken) (*tokenRepo.AccessToken, error)
+	GenerateRefreshToken(userID uint, userAgent string, ip string) (*tokenRepo.RefreshToken, error)
+	GenerateClientCredentialsToken(clientID string, scopes []string, binding Binding) (*tokenRepo.ClientAccessToken, error)
+	GetClientAccessToken(token string) (*tokenRepo.ClientAccessToken, error)
+	GenerateIDToken(userID uint, clientID string, nonce string, authTime time.Time, accessToken string) (string, error)
+	RotateRefreshToken(token string, clientID string, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error)
 	DeleteRefreshToken(token string) (error)
 	DeleteAccessToken(token string, deleteRelatedRefreshToken bool) (error)
 	ValidateToken(token string, allowExpired bool) (uint, string, error)
+	ParseToken(token string, allowExpired bool) (*Claims, error)
+	ListSessions(userID uint) ([]Session, error)
+	SessionStartedAt(sessionID string) (time.Time, error)
+	TouchSession(at *tokenRepo.AccessToken, ip string) (error)
+	RevokeSession(userID uint, sessionID string) (error)
+	RevokeOtherSessions(userID uint, currentSessionID string) (error)
+	RevokeAllSessions(userID uint) (error)
+	Introspect(token string) (*Introspection, error)
+	RevokeToken(token string, tokenTypeHint string, clientID string) (error)
+	RevokeFamily(familyID string) (error)
 	// Add more methods here as needed
 }
 
+// Binding holds the keys a token is bound to, the token is a plain bearer token when both are empty
+// JKT is the thumbprint of a DPoP key (RFC 9449), CertThumbprint the thumbprint of a client certificate (RFC 8705)
+type Binding struct {
+	JKT				string
+	CertThumbprint	string
+}
+
+// Actor identifies who acts on behalf of the user of a delegated token, as carried in the act claim (RFC 8693)
+// The actor is a user, such as an admin impersonating the user, or a client when no user acts
+type Actor struct {
+	UserID		uint
+	ClientID		string
+}
+
+// Claims holds the validated claims of a token
+// Actor is only set on delegated tokens
+type Claims struct {
+	Principal	string
+	UserID		uint
+	ClientID		string
+	Name			string
+	Roles			[]string
+	Scopes		[]string
+	JKT			string
+	CertThumbprint	string
+	Actor			*Actor
+	Audience		string
+	ExpiresAt	time.Time
+}
+
+// Session describes a login session, which is a refresh token family
+type Session struct {
+	ID				string
+	UserAgent	string
+	IP				string
+	CreatedAt	time.Time
+	LastUsedAt	*time.Time
+}
+
+// Introspection describes the state of a token (RFC 7662)
+type Introspection struct {
+	Active		bool
+	Principal	string
+	UserID		uint
+	ClientID		string
+	Scopes		[]string
+	TokenType	string
+	JKT			string
+	CertThumbprint	string
+	Actor			*Actor
+	Audience		string
+	IssuedAt		time.Time
+	ExpiresAt	time.Time
+}
+
 // svc is an implementation of the UserSvc interface that handles the business logic for user-related operations.
 type svc struct {
 	repo 			tokenRepo.Repo
 	userRepo		userRepo.Repo
+	keyService	keySvc.Svc
+	roleService	roleSvc.Svc
+	auditService	auditSvc.Svc
 }
 
 // NewSvc creates a new instance of svc and returns it as a Svc interface.
-func NewSvc(db *gorm.DB) Svc {
+func NewSvc(db *gorm.DB, keyService keySvc.Svc, roleService roleSvc.Svc, auditService auditSvc.Svc) Svc {
 	ur := userRepo.NewRepo(db)
 	tr := tokenRepo.NewRepo(db)
 
 	return &svc{
 		repo: tr,
 		userRepo: ur,
+		keyService: keyService,
+		roleService: roleService,
+		auditService: auditService,
 	}
 }
 
@@ -60,22 +174,52 @@ func (s *svc) GetAccessToken(token string) (*tokenRepo.AccessToken, error) {
 	return s.repo.GetAccessToken(token);
 }
 
+// GetClientAccessToken provides access to get the client access token record
+func (s *svc) GetClientAccessToken(token string) (*tokenRepo.ClientAccessToken, error) {
+	return s.repo.GetClientAccessToken(token);
+}
+
 /*
  * This method generates both the access and the refresh tokens,
  * stores them in the appropriate database tables,
  * and returns them.
  * 
  * @userID - the id of the user to which the tokens will belong
+ * @binding - the keys the tokens are bound to, empty for bearer tokens
 */
-func (s *svc) GenerateTokens(userID uint, userAgent string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error) {
+func (s *svc) GenerateTokens(userID uint, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error) {
+	return s.GenerateClientTokens(userID, "", nil, binding, userAgent, ip)
+}
+
+/*
+ * This method generates the access and the refresh tokens issued to an OAuth client,
+ * limited to the granted scopes.
+ * First party tokens have an empty client id and carry all the scopes of the user.
+ * Bound tokens can only be used with proofs signed by the DPoP key or over the client certificate.
+ */
+func (s *svc) GenerateClientTokens(userID uint, clientID string, scopes []string, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error) {
+	familyID, err := cryptolib.RandomString(16)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Generate the refresh token first, as it is needed to make the access token
-	rt, err := s.GenerateRefreshToken(userID, userAgent)
+	rt, err := s.generateRefreshToken(&tokenRepo.RefreshToken{
+		UserID:		userID,
+		UserAgent:	userAgent,
+		IP:			ip,
+		ClientID:	clientID,
+		Scope:		strings.Join(scopes, " "),
+		FamilyID:	familyID,
+		JKT:			binding.JKT,
+		CertThumbprint:	binding.CertThumbprint,
+	})
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Generate the access token using the refresh token
-	at, err := s.GenerateAccessToken(userID, rt.ID, userAgent)
+	at, err := s.GenerateAccessToken(rt)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -84,64 +228,348 @@ func (s *svc) GenerateTokens(userID uint, userAgent string) (*tokenRepo.AccessTo
 	return at, rt, nil
 }
 
+/*
+ * This method generates an access token for the user held by an actor acting on their behalf,
+ * limited to the given scopes, or to all the scopes of the user for first party tokens.
+ * The token carries the act claim, and the aud claim when an audience is given, and is not refreshable:
+ * its refresh token only anchors the session, it is not handed out and expires with the access token.
+ */
+func (s *svc) GenerateDelegatedToken(userID uint, clientID string, audience string, scopes []string, actor Actor, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, error) {
+	familyID, err := cryptolib.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	// End the session with the access token
+	tokenExpiration := time.Duration(cfglib.DefaultConf.TokenExpAccess)
+	expiresAt := time.Unix(time.Now().Add(tokenExpiration * time.Hour).Unix(), 0)
+
+	rt, err := s.generateRefreshToken(&tokenRepo.RefreshToken{
+		UserID:		userID,
+		UserAgent:	userAgent,
+		IP:			ip,
+		ClientID:	clientID,
+		Scope:		strings.Join(scopes, " "),
+		FamilyID:	familyID,
+		JKT:			binding.JKT,
+		CertThumbprint:	binding.CertThumbprint,
+		ActorID:		actor.UserID,
+		ActorClientID:	actor.ClientID,
+		Audience:	audience,
+		ExpiresAt:	expiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GenerateAccessToken(rt)
+}
+
 /* 
  * This method generates a JSON Web Token (JWT) with a payload that includes the user ID and a short expiration time.
- * The token is signed using a secret key provided in the application configuration.
+ * The token is signed using the active signing key.
+ * The user, client, granted scopes and key binding are taken from the refresh token.
  */
-func (s *svc) GenerateAccessToken(userID uint, refreshTokenID uint, userAgent string) (*tokenRepo.AccessToken, error) {
+func (s *svc) GenerateAccessToken(rt *tokenRepo.RefreshToken) (*tokenRepo.AccessToken, error) {
 	// Load configs
-	secretKey := cfglib.DefaultConf.AppSecret
 	tokenExpiration := time.Duration(cfglib.DefaultConf.TokenExpAccess)
 	expiresAt := time.Unix(time.Now().Add(tokenExpiration * time.Hour).Unix(), 0)
 
-	// Generate a new JWT token
-	token := jwt.New(jwt.SigningMethodHS256)
-	
+	// Load the roles and scopes of the user
+	roles, scopes, err := s.roleService.GetUserAccess(rt.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Limit client tokens to the granted scopes the user still holds, identity scopes need no permission
+	if rt.ClientID != "" {
+		granted := strings.Fields(rt.Scope)
+		roles = []string{}
+		scopes = append(intersect(granted, scopes), intersect(granted, IdentityScopes)...)
+	}
+
 	// Set claims for the token
-	claims := token.Claims.(jwt.MapClaims)
+	jti, err := cryptolib.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	claims["jti"] = jti
 	claims["authorized"] = true
-	claims["user_id"] = userID
+	claims["user_id"] = rt.UserID
 	claims["name"] = AccessTokenName
 	claims["exp"] = expiresAt
+	claims["roles"] = roles
+	claims["scope"] = strings.Join(scopes, " ")
+	if rt.ClientID != "" {
+		claims["client_id"] = rt.ClientID
+	}
+	if cnf := confirmation(Binding{JKT: rt.JKT, CertThumbprint: rt.CertThumbprint}); cnf != nil {
+		claims["cnf"] = cnf
+	}
+	if act := actorClaim(Actor{UserID: rt.ActorID, ClientID: rt.ActorClientID}); act != nil {
+		claims["act"] = act
+	}
+	if rt.Audience != "" {
+		claims["aud"] = rt.Audience
+	}
 
 	// Sign the token
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := s.signToken(claims)
 	if err != nil {
 		return nil, err
 	}
 
 	// Store in the database
-	return s.repo.CreateAccessToken(userID, refreshTokenID, userAgent, AccessTokenName, tokenString, expiresAt)
+	return s.repo.CreateAccessToken(&tokenRepo.AccessToken{
+		UserID:				rt.UserID,
+		RefreshTokenID:	rt.ID,
+		UserAgent:			rt.UserAgent,
+		TokenName:			AccessTokenName,
+		TokenString:		tokenString,
+		ClientID:			rt.ClientID,
+		Scope:				strings.Join(scopes, " "),
+		ExpiresAt:			expiresAt,
+	})
 }
 
 /* 
  * This method generates a JSON Web Token (JWT) with a payload that includes the user ID and a long expiration time.
- * The token is signed using a secret key provided in the application configuration.
+ * The token is signed using the active signing key and starts a new token family.
+ */
+func (s *svc) GenerateRefreshToken(userID uint, userAgent string, ip string) (*tokenRepo.RefreshToken, error) {
+	familyID, err := cryptolib.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.generateRefreshToken(&tokenRepo.RefreshToken{
+		UserID:		userID,
+		UserAgent:	userAgent,
+		IP:			ip,
+		FamilyID:	familyID,
+	})
+}
+
+/*
+ * This method generates an access token held by the client itself (client credentials grant).
+ * The token has no user and no refresh token.
  */
- func (s *svc) GenerateRefreshToken(userID uint, userAgent string) (*tokenRepo.RefreshToken, error) {
+func (s *svc) GenerateClientCredentialsToken(clientID string, scopes []string, binding Binding) (*tokenRepo.ClientAccessToken, error) {
+	// Load configs
+	tokenExpiration := time.Duration(cfglib.DefaultConf.TokenExpAccess)
+	expiresAt := time.Unix(time.Now().Add(tokenExpiration * time.Hour).Unix(), 0)
+
+	// Set claims for the token
+	jti, err := cryptolib.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	claims["jti"] = jti
+	claims["authorized"] = true
+	claims["client_id"] = clientID
+	claims["name"] = AccessTokenName
+	claims["exp"] = expiresAt
+	claims["scope"] = strings.Join(scopes, " ")
+	if cnf := confirmation(binding); cnf != nil {
+		claims["cnf"] = cnf
+	}
+
+	// Sign the token
+	tokenString, err := s.signToken(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store in the database
+	return s.repo.CreateClientAccessToken(&tokenRepo.ClientAccessToken{
+		ClientID:		clientID,
+		TokenName:		AccessTokenName,
+		TokenString:	tokenString,
+		Scope:			strings.Join(scopes, " "),
+		ExpiresAt:		expiresAt,
+	})
+}
+
+/*
+ * This method generates an OpenID Connect id_token for the user, issued to the client.
+ * The at_hash claim binds it to the access token issued alongside it.
+ */
+func (s *svc) GenerateIDToken(userID uint, clientID string, nonce string, authTime time.Time, accessToken string) (string, error) {
+	key, err := s.keyService.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	// Load configs
+	now := time.Now()
+	tokenExpiration := time.Duration(cfglib.DefaultConf.TokenExpAccess * float32(time.Hour))
+
+	// Set claims for the token, times are numeric dates as required by the spec
+	claims := jwt.MapClaims{}
+	claims["iss"] = cfglib.DefaultConf.AppIssuer
+	claims["sub"] = strconv.FormatUint(uint64(userID), 10)
+	claims["aud"] = clientID
+	claims["exp"] = now.Add(tokenExpiration).Unix()
+	claims["iat"] = now.Unix()
+	claims["auth_time"] = authTime.Unix()
+	claims["at_hash"] = atHash(key.Method.Alg(), accessToken)
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	// Sign the token
+	return signWithKey(key, claims)
+}
+
+/*
+ * This method rotates a refresh token, issuing a new token pair in the same family.
+ * Presenting a token that was already rotated revokes the whole family,
+ * unless it happens within the grace window from the same client.
+ * The token must have been issued to the given client, which is empty for first party tokens.
+ * A token bound to a DPoP key must be presented with a proof of the same key,
+ * an unbound token presented with a proof becomes bound to its key.
+ * The new access token is bound to the certificate of the request, which may have been renewed.
+ */
+func (s *svc) RotateRefreshToken(token string, clientID string, binding Binding, userAgent string, ip string) (*tokenRepo.AccessToken, *tokenRepo.RefreshToken, error) {
+	// Validate the refresh token
+	userID, name, err := s.ValidateToken(token, false)
+	if err != nil {
+		if err.Error() == ErrTokenExpired {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New(ErrTokenInvalid)
+	}
+	if name != RefreshTokenName {
+		return nil, nil, errors.New(ErrTokenInvalid)
+	}
+
+	// Find the stored token, revoked tokens are no longer stored
+	token = strings.TrimPrefix(token, "Bearer ")
+	currRt, err := s.repo.GetRefreshToken(token)
+	if err != nil || currRt.UserID != userID || currRt.ClientID != clientID {
+		return nil, nil, errors.New(ErrTokenInvalid)
+	}
+	if (currRt.JKT != "" && currRt.JKT != binding.JKT) || (currRt.CertThumbprint != "" && currRt.CertThumbprint != binding.CertThumbprint) {
+		return nil, nil, errors.New(ErrTokenBindingInvalid)
+	}
+
+	// Mark the token as rotated
+	now := time.Now()
+	rotated, err := s.repo.MarkRefreshTokenRotated(currRt.ID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Handle reuse of an already rotated token
+	if !rotated {
+		if currRt.RotatedAt == nil {
+			// Rotated by a concurrent request since it was read
+			currRt, err = s.repo.GetRefreshToken(token)
+			if err != nil || currRt.RotatedAt == nil {
+				return nil, nil, errors.New(ErrTokenInvalid)
+			}
+		}
+
+		grace := time.Duration(cfglib.DefaultConf.TokenRefreshGrace * float32(time.Second))
+		if currRt.UserAgent != userAgent || now.After(currRt.RotatedAt.Add(grace)) {
+			// Revoke the family and record the event
+			if err := s.repo.DeleteRefreshTokenFamily(currRt.FamilyID); err != nil {
+				return nil, nil, err
+			}
+			if _, err := s.repo.CreateSecurityEvent(currRt.UserID, currRt.FamilyID, EventRefreshTokenReused, userAgent, ip); err != nil {
+				return nil, nil, err
+			}
+			err := s.auditService.Record(&auditRepo.AuditEvent{
+				Type:			auditSvc.EventRefreshTokenReused,
+				Outcome:		auditSvc.OutcomeFailure,
+				Reason:		"family " + currRt.FamilyID + " revoked",
+				UserID:		currRt.UserID,
+				ClientID:	currRt.ClientID,
+				IP:			ip,
+				UserAgent:	userAgent,
+			})
+			if err != nil {
+				log.Printf("audit of refresh token reuse failed: %s", err)
+			}
+
+			return nil, nil, errors.New(ErrTokenReused)
+		}
+	}
+
+	// Revoke the access tokens issued with the old refresh token
+	if err := s.repo.DeleteAccessTokensByRefreshToken(currRt.ID); err != nil {
+		return nil, nil, err
+	}
+
+	// Issue new tokens in the same family
+	parentID := currRt.ID
+	rt, err := s.generateRefreshToken(&tokenRepo.RefreshToken{
+		UserID:		currRt.UserID,
+		UserAgent:	userAgent,
+		IP:			ip,
+		ClientID:	currRt.ClientID,
+		Scope:		currRt.Scope,
+		FamilyID:	currRt.FamilyID,
+		ParentID:	&parentID,
+		JKT:			binding.JKT,
+		CertThumbprint:	binding.CertThumbprint,
+		ActorID:		currRt.ActorID,
+		ActorClientID:	currRt.ActorClientID,
+		Audience:	currRt.Audience,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	at, err := s.GenerateAccessToken(rt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return at, rt, nil
+}
+
+/*
+ * This method signs and stores a refresh token.
+ * The user, client, scope and token family are taken from the given record,
+ * the expiration too when it is set.
+ */
+func (s *svc) generateRefreshToken(rt *tokenRepo.RefreshToken) (*tokenRepo.RefreshToken, error) {
 	// Load configs
-	secretKey := cfglib.DefaultConf.AppSecret
 	tokenExpiration := time.Duration(cfglib.DefaultConf.TokenExpRefresh)
 	expiresAt := time.Unix(time.Now().Add(tokenExpiration * time.Hour).Unix(), 0)
+	if !rt.ExpiresAt.IsZero() {
+		expiresAt = rt.ExpiresAt
+	}
 
-	// Generate a new JWT token
-	token := jwt.New(jwt.SigningMethodHS256)
-	
 	// Set claims for the token
-	claims := token.Claims.(jwt.MapClaims)
+	jti, err := cryptolib.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	claims["jti"] = jti
 	claims["authorized"] = true
-	claims["user_id"] = userID
+	claims["user_id"] = rt.UserID
 	claims["name"] = RefreshTokenName
 	claims["exp"] = expiresAt
+	if rt.ClientID != "" {
+		claims["client_id"] = rt.ClientID
+	}
 
 	// Sign the token
-	tokenString, err := token.SignedString([]byte(secretKey))
+	tokenString, err := s.signToken(claims)
 	if err != nil {
 		return nil, err
 	}
 
 	// Store in the database
-	return s.repo.CreateRefreshToken(userID, userAgent, RefreshTokenName, tokenString, expiresAt)
+	rt.TokenName = RefreshTokenName
+	rt.TokenString = tokenString
+	rt.ExpiresAt = expiresAt
+	return s.repo.CreateRefreshToken(rt)
 }
 
 /*
@@ -163,60 +591,482 @@ func (s *svc) DeleteRefreshToken(token string) (error) {
  * Returns <userId, tokenString, error>
  */
 func (s *svc) ValidateToken(token string, allowExpired bool) (uint, string, error) {
-	// Load configs
-	secretKey := cfglib.DefaultConf.AppSecret
+	claims, err := s.ParseToken(token, allowExpired)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return claims.UserID, claims.Name, nil
+}
 
+/*
+ * This method validates a JWT and returns its claims if the token is valid.
+ */
+func (s *svc) ParseToken(token string, allowExpired bool) (*Claims, error) {
 	// Remove "Bearer " prefix from token
 	token = strings.TrimPrefix(token, "Bearer ")
 
 	// Validate the token string
-	jt, err := jwt.Parse(token, func(jt *jwt.Token) (interface{}, error) {
-		if _, ok := jt.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New(ErrTokenInvalid)
-		}
-
-		return []byte(secretKey), nil
-	})
-
+	jt, err := jwt.Parse(token, s.keyFunc)
 	if err != nil {
-		return 0, "", err
+		return nil, err
 	}
 
 	if claims, ok := jt.Claims.(jwt.MapClaims); ok && jt.Valid {
 		// Handle invalid claims
-		uid, ok := claims["user_id"].(float64)
-		if !ok {
-			return 0, "", errors.New(ErrTokenClaimsInvalid + " <user>")
-		}
 		exp, ok := claims["exp"].(string)
 		if !ok {
-			return 0, "", errors.New(ErrTokenClaimsInvalid + " <exp>")
+			return nil, errors.New(ErrTokenClaimsInvalid + " <exp>")
 		}
 		name, ok := claims["name"].(string)
 		if !ok {
-			return 0, "", errors.New(ErrTokenClaimsInvalid + " <name>")
+			return nil, errors.New(ErrTokenClaimsInvalid + " <name>")
+		}
+		expTime, err := time.Parse(time.RFC3339, exp)
+		if err != nil {
+			return nil, err
 		}
 
 		// Handle expired token
-		if !allowExpired {
-			expTime, err := time.Parse(time.RFC3339, exp)
-			if err != nil {
-				return 0, "", err
-			}
+		if !allowExpired && time.Now().UTC().After(expTime) {
+			return nil, errors.New(ErrTokenExpired)
+		}
 
-			if time.Now().UTC().After(expTime) {
-				return 0, "", errors.New(ErrTokenExpired)
+		// Read the optional claims
+		roles := stringsClaim(claims["roles"])
+		scope, _ := claims["scope"].(string)
+		clientID, _ := claims["client_id"].(string)
+		cnf, _ := claims["cnf"].(map[string]interface{})
+		jkt, _ := cnf["jkt"].(string)
+		x5t, _ := cnf["x5t#S256"].(string)
+		actor, err := parseActorClaim(claims["act"])
+		if err != nil {
+			return nil, err
+		}
+		audience, _ := claims["aud"].(string)
+
+		// Handle client held token, which has no user
+		uid, ok := claims["user_id"].(float64)
+		if !ok {
+			if clientID == "" || name != AccessTokenName {
+				return nil, errors.New(ErrTokenClaimsInvalid + " <user>")
 			}
+
+			return &Claims{
+				Principal:	PrincipalClient,
+				ClientID:	clientID,
+				Name:			name,
+				Roles:		[]string{},
+				Scopes:		strings.Fields(scope),
+				JKT:			jkt,
+				CertThumbprint:	x5t,
+				ExpiresAt:	expTime,
+			}, nil
 		}
 
 		// Handle token mismatch
 		user, err := s.userRepo.GetById(uint(uid))
 		if (err != nil || user.ID != uint(uid)) {
-			return 0, "", errors.New(ErrTokenUserInvalid)
+			return nil, errors.New(ErrTokenUserInvalid)
+		}
+
+		return &Claims{
+			Principal:	PrincipalUser,
+			UserID:		user.ID,
+			ClientID:	clientID,
+			Name:			name,
+			Roles:		roles,
+			Scopes:		strings.Fields(scope),
+			JKT:			jkt,
+			CertThumbprint:	x5t,
+			Actor:		actor,
+			Audience:	audience,
+			ExpiresAt:	expTime,
+		}, nil
+	}
+
+	return nil, errors.New(ErrTokenInvalid)
+}
+
+/*
+ * This method lists the active sessions of a user, most recently used first.
+ */
+func (s *svc) ListSessions(userID uint) ([]Session, error) {
+	rts, err := s.repo.GetActiveRefreshTokensByUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the start time of every session
+	familyIDs := make([]string, 0, len(rts))
+	for _, rt := range rts {
+		familyIDs = append(familyIDs, rt.FamilyID)
+	}
+	starts, err := s.repo.GetRefreshTokenFamilyStarts(familyIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]Session, 0, len(rts))
+	for _, rt := range rts {
+		createdAt, ok := starts[rt.FamilyID]
+		if !ok {
+			createdAt = rt.CreatedAt
+		}
+
+		sessions = append(sessions, Session{
+			ID:				rt.FamilyID,
+			UserAgent:	rt.UserAgent,
+			IP:				rt.IP,
+			CreatedAt:	createdAt,
+			LastUsedAt:	rt.LastUsedAt,
+		})
+	}
+
+	return sessions, nil
+}
+
+/*
+ * This method returns the time the session started, which is when the user authenticated.
+ */
+func (s *svc) SessionStartedAt(sessionID string) (time.Time, error) {
+	starts, err := s.repo.GetRefreshTokenFamilyStarts([]string{sessionID})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	startedAt, ok := starts[sessionID]
+	if !ok {
+		return time.Time{}, errors.New(ErrSessionNotFound)
+	}
+
+	return startedAt, nil
+}
+
+/*
+ * This method records the use of an access token on its session.
+ */
+func (s *svc) TouchSession(at *tokenRepo.AccessToken, ip string) (error) {
+	return s.repo.TouchRefreshToken(at.RefreshTokenID, ip, time.Now(), SessionTouchInterval)
+}
+
+/*
+ * This method revokes a session of the user, along with all its tokens.
+ */
+func (s *svc) RevokeSession(userID uint, sessionID string) (error) {
+	sessions, err := s.ListSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the session belongs to the user
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			if err := s.repo.DeleteRefreshTokenFamily(sessionID); err != nil {
+				return err
+			}
+			s.recordRevocation(userID, "session " + sessionID)
+			return nil
+		}
+	}
+
+	return errors.New(ErrSessionNotFound)
+}
+
+/*
+ * This method revokes every session of the user except the current one.
+ * A current session is required, callers without one, such as API keys, would revoke every session.
+ */
+func (s *svc) RevokeOtherSessions(userID uint, currentSessionID string) (error) {
+	if currentSessionID == "" {
+		return errors.New(ErrSessionNotFound)
+	}
+	if err := s.repo.DeleteRefreshTokenFamiliesByUser(userID, currentSessionID); err != nil {
+		return err
+	}
+
+	s.recordRevocation(userID, "all sessions but " + currentSessionID)
+	return nil
+}
+
+/*
+ * This method revokes every access and refresh token of the user, for when the credentials changed.
+ */
+func (s *svc) RevokeAllSessions(userID uint) (error) {
+	if err := s.repo.DeleteTokensByUser(userID); err != nil {
+		return err
+	}
+
+	s.recordRevocation(userID, "all sessions")
+	return nil
+}
+
+/*
+ * This method records the revocation of sessions of the user in the audit log.
+ * The sessions are already revoked, a failure is logged rather than failing the revocation.
+ */
+func (s *svc) recordRevocation(userID uint, reason string) {
+	err := s.auditService.Record(&auditRepo.AuditEvent{
+		Type:		auditSvc.EventSessionRevoked,
+		Reason:	reason,
+		UserID:	userID,
+	})
+	if err != nil {
+		log.Printf("audit of session revocation failed: %s", err)
+	}
+}
+
+/*
+ * This method reports whether a token is active.
+ * Tokens that are invalid, expired or revoked are reported as inactive without an error.
+ */
+func (s *svc) Introspect(token string) (*Introspection, error) {
+	inactive := &Introspection{Active: false}
+	token = strings.TrimPrefix(token, "Bearer ")
+
+	// Validate the token
+	claims, err := s.ParseToken(token, false)
+	if err != nil {
+		return inactive, nil
+	}
+	userID := claims.UserID
+
+	// Handle client held token
+	if claims.Principal == PrincipalClient {
+		at, err := s.repo.GetClientAccessToken(token)
+		if err != nil || at.ClientID != claims.ClientID {
+			return inactive, nil
+		}
+		return &Introspection{Active: true, Principal: PrincipalClient, ClientID: at.ClientID, Scopes: strings.Fields(at.Scope), TokenType: TokenTypeHintAccess, CertThumbprint: claims.CertThumbprint, IssuedAt: at.CreatedAt, ExpiresAt: at.ExpiresAt}, nil
+	}
+
+	// Ensure the token has not been revoked
+	switch claims.Name {
+	case AccessTokenName:
+		at, err := s.repo.GetAccessToken(token)
+		if err != nil || at.UserID != userID || at.RefreshToken == nil {
+			return inactive, nil
+		}
+		return &Introspection{Active: true, Principal: PrincipalUser, UserID: userID, ClientID: at.ClientID, Scopes: strings.Fields(at.Scope), TokenType: TokenTypeHintAccess, JKT: claims.JKT, CertThumbprint: claims.CertThumbprint, Actor: claims.Actor, Audience: claims.Audience, IssuedAt: at.CreatedAt, ExpiresAt: at.ExpiresAt}, nil
+	case RefreshTokenName:
+		rt, err := s.repo.GetRefreshToken(token)
+		if err != nil || rt.UserID != userID || rt.RotatedAt != nil {
+			return inactive, nil
 		}
+		return &Introspection{Active: true, Principal: PrincipalUser, UserID: userID, ClientID: rt.ClientID, Scopes: strings.Fields(rt.Scope), TokenType: TokenTypeHintRefresh, JKT: rt.JKT, Actor: sessionActor(rt), Audience: rt.Audience, IssuedAt: rt.CreatedAt, ExpiresAt: rt.ExpiresAt}, nil
+	}
+
+	return inactive, nil
+}
+
+/*
+ * This method revokes an access or a refresh token (RFC 7009).
+ * Revoking a refresh token revokes its whole family.
+ * A client can only revoke the tokens issued to it, unknown tokens and the others,
+ * first party ones included, are ignored as the spec asks.
+ */
+func (s *svc) RevokeToken(token string, tokenTypeHint string, clientID string) (error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if clientID == "" {
+		return nil
+	}
+
+	// Look up the hinted type first
+	revokeAccess := func() (bool, error) {
+		// Handle client held token
+		if cat, err := s.repo.GetClientAccessToken(token); err == nil {
+			if cat.ClientID != clientID {
+				return true, nil
+			}
+			return true, s.repo.DeleteClientAccessToken(token)
+		}
+
+		at, err := s.repo.GetAccessToken(token)
+		if err != nil {
+			return false, nil
+		}
+		if at.ClientID != clientID {
+			return true, nil
+		}
+		return true, s.repo.DeleteAccessToken(token, false)
+	}
+	revokeRefresh := func() (bool, error) {
+		rt, err := s.repo.GetRefreshToken(token)
+		if err != nil {
+			return false, nil
+		}
+		if rt.ClientID != clientID {
+			return true, nil
+		}
+		return true, s.repo.DeleteRefreshTokenFamily(rt.FamilyID)
+	}
+	order := []func() (bool, error){revokeAccess, revokeRefresh}
+	if tokenTypeHint == TokenTypeHintRefresh {
+		order = []func() (bool, error){revokeRefresh, revokeAccess}
+	}
+
+	for _, revoke := range order {
+		if found, err := revoke(); found {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * This method revokes every token of a refresh token family.
+ */
+func (s *svc) RevokeFamily(familyID string) (error) {
+	return s.repo.DeleteRefreshTokenFamily(familyID)
+}
+
+/*
+ * This method signs the claims with the active signing key,
+ * stamping the key id in the token header.
+ */
+func (s *svc) signToken(claims jwt.MapClaims) (string, error) {
+	key, err := s.keyService.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	return signWithKey(key, claims)
+}
+
+// signWithKey signs the claims with the given key, stamping the key id in the token header
+func signWithKey(key *keySvc.Key, claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Kid
+
+	return token.SignedString(key.Private)
+}
+
+// atHash returns the left half of the access token hash, using the hash of the signing algorithm
+func atHash(alg string, accessToken string) string {
+	var sum []byte
+	switch alg {
+	case keySvc.AlgEdDSA:
+		h := sha512.Sum512([]byte(accessToken))
+		sum = h[:]
+	default:
+		h := sha256.Sum256([]byte(accessToken))
+		sum = h[:]
+	}
+
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
 
-		return user.ID, name, nil
+/*
+ * This method resolves the verification key of a token from its kid header.
+ * The token algorithm must match the algorithm of the key.
+ */
+func (s *svc) keyFunc(jt *jwt.Token) (interface{}, error) {
+	kid, _ := jt.Header["kid"].(string)
+	key, err := s.keyService.VerificationKey(kid)
+	if err != nil {
+		return nil, errors.New(ErrTokenInvalid)
+	}
+
+	if jt.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New(ErrTokenInvalid)
+	}
+
+	return key.Public, nil
+}
+
+// confirmation returns the cnf claim of a bound token (RFC 7800), or nil for a bearer token
+func confirmation(binding Binding) map[string]string {
+	cnf := map[string]string{}
+	if binding.JKT != "" {
+		cnf["jkt"] = binding.JKT
+	}
+	if binding.CertThumbprint != "" {
+		cnf["x5t#S256"] = binding.CertThumbprint
+	}
+	if len(cnf) == 0 {
+		return nil
+	}
+
+	return cnf
+}
+
+// actorClaim builds the act claim of a delegated token, or nil when no one acts on behalf of the user
+// Users are identified by the sub member, as in id tokens, clients by the client_id member
+func actorClaim(actor Actor) map[string]string {
+	act := map[string]string{}
+	if actor.UserID != 0 {
+		act["sub"] = strconv.FormatUint(uint64(actor.UserID), 10)
+	}
+	if actor.ClientID != "" {
+		act["client_id"] = actor.ClientID
+	}
+	if len(act) == 0 {
+		return nil
+	}
+
+	return act
+}
+
+// parseActorClaim reads the act claim of a token, which is nil when the token is not delegated
+func parseActorClaim(v interface{}) (*Actor, error) {
+	if v == nil {
+		return nil, nil
 	}
+	act, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New(ErrTokenClaimsInvalid + " <act>")
+	}
+
+	actor := &Actor{}
+	actor.ClientID, _ = act["client_id"].(string)
+	if sub, ok := act["sub"].(string); ok {
+		uid, err := strconv.ParseUint(sub, 10, 0)
+		if err != nil {
+			return nil, errors.New(ErrTokenClaimsInvalid + " <act>")
+		}
+		actor.UserID = uint(uid)
+	}
+	if actor.UserID == 0 && actor.ClientID == "" {
+		return nil, errors.New(ErrTokenClaimsInvalid + " <act>")
+	}
+
+	return actor, nil
+}
+
+// sessionActor returns who acts in the session of a refresh token, or nil
+func sessionActor(rt *tokenRepo.RefreshToken) *Actor {
+	if rt.ActorID == 0 && rt.ActorClientID == "" {
+		return nil
+	}
+
+	return &Actor{UserID: rt.ActorID, ClientID: rt.ActorClientID}
+}
 
-	return 0, "", errors.New(ErrTokenInvalid)
-}
\ No newline at end of file
+// stringsClaim converts a JSON array claim to a string slice
+func stringsClaim(v interface{}) []string {
+	items, _ := v.([]interface{})
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			values = append(values, str)
+		}
+	}
+
+	return values
+}
+
+// intersect returns the values of a that are also in b
+func intersect(a []string, b []string) []string {
+	values := []string{}
+	for _, va := range a {
+		for _, vb := range b {
+			if va == vb {
+				values = append(values, va)
+				break
+			}
+		}
+	}
+
+	return values
+}
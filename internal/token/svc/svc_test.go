@@ -0,0 +1,463 @@
+package tokenSvc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/jwklib"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/key/svc"
+	"github.com/selatoz/gateway/internal/role/repo"
+	"github.com/selatoz/gateway/internal/token/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	testUserAgent	= "test-agent"
+	testIP			= "192.0.2.1"
+)
+
+// fakeTokenRepo holds the refresh tokens and the security events in memory
+// Only the methods used by the refresh token rotation keep state
+type fakeTokenRepo struct {
+	refreshTokens	[]*tokenRepo.RefreshToken
+	accessTokens	[]*tokenRepo.AccessToken
+	events			[]string
+}
+
+func (r *fakeTokenRepo) CreateAccessToken(at *tokenRepo.AccessToken) (*tokenRepo.AccessToken, error) {
+	at.ID = uint(len(r.accessTokens) + 1)
+	r.accessTokens = append(r.accessTokens, at)
+	return at, nil
+}
+
+func (r *fakeTokenRepo) GetAccessToken(token string) (*tokenRepo.AccessToken, error) {
+	for _, at := range r.accessTokens {
+		if at.TokenString == token {
+			return at, nil
+		}
+	}
+	return nil, errors.New("token not found")
+}
+
+func (r *fakeTokenRepo) DeleteAccessToken(token string, deleteRefreshToken bool) error {
+	return nil
+}
+
+func (r *fakeTokenRepo) DeleteAccessTokensByRefreshToken(refreshTokenID uint) error {
+	kept := r.accessTokens[:0]
+	for _, at := range r.accessTokens {
+		if at.RefreshTokenID != refreshTokenID {
+			kept = append(kept, at)
+		}
+	}
+	r.accessTokens = kept
+	return nil
+}
+
+func (r *fakeTokenRepo) CreateRefreshToken(rt *tokenRepo.RefreshToken) (*tokenRepo.RefreshToken, error) {
+	rt.ID = uint(len(r.refreshTokens) + 1)
+	rt.CreatedAt = time.Now()
+	r.refreshTokens = append(r.refreshTokens, rt)
+	return rt, nil
+}
+
+// GetRefreshToken returns a copy, as a read from the database would
+func (r *fakeTokenRepo) GetRefreshToken(token string) (*tokenRepo.RefreshToken, error) {
+	for _, rt := range r.refreshTokens {
+		if rt.TokenString == token {
+			c := *rt
+			return &c, nil
+		}
+	}
+	return nil, errors.New("token not found")
+}
+
+func (r *fakeTokenRepo) GetActiveRefreshTokensByUser(userID uint) ([]tokenRepo.RefreshToken, error) {
+	return nil, nil
+}
+
+func (r *fakeTokenRepo) GetRefreshTokenFamilyStarts(familyIDs []string) (map[string]time.Time, error) {
+	return nil, nil
+}
+
+func (r *fakeTokenRepo) MarkRefreshTokenRotated(id uint, rotatedAt time.Time) (bool, error) {
+	for _, rt := range r.refreshTokens {
+		if rt.ID == id {
+			if rt.RotatedAt != nil {
+				return false, nil
+			}
+			rt.RotatedAt = &rotatedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeTokenRepo) TouchRefreshToken(id uint, ip string, usedAt time.Time, interval time.Duration) error {
+	return nil
+}
+
+func (r *fakeTokenRepo) DeleteRefreshToken(token string) error {
+	return nil
+}
+
+func (r *fakeTokenRepo) DeleteRefreshTokenFamily(familyID string) error {
+	kept := r.refreshTokens[:0]
+	for _, rt := range r.refreshTokens {
+		if rt.FamilyID != familyID {
+			kept = append(kept, rt)
+		}
+	}
+	r.refreshTokens = kept
+	return nil
+}
+
+func (r *fakeTokenRepo) DeleteRefreshTokenFamiliesByUser(userID uint, exceptFamilyID string) error {
+	return nil
+}
+
+func (r *fakeTokenRepo) DeleteTokensByUser(userID uint) error {
+	return nil
+}
+
+func (r *fakeTokenRepo) CreateClientAccessToken(at *tokenRepo.ClientAccessToken) (*tokenRepo.ClientAccessToken, error) {
+	return at, nil
+}
+
+func (r *fakeTokenRepo) GetClientAccessToken(token string) (*tokenRepo.ClientAccessToken, error) {
+	return nil, errors.New("token not found")
+}
+
+func (r *fakeTokenRepo) DeleteClientAccessToken(token string) error {
+	return nil
+}
+
+func (r *fakeTokenRepo) CreateSecurityEvent(userID uint, familyID string, eventType string, userAgent string, ip string) (*tokenRepo.SecurityEvent, error) {
+	r.events = append(r.events, eventType)
+	return &tokenRepo.SecurityEvent{UserID: userID, FamilyID: familyID, EventType: eventType}, nil
+}
+
+func (r *fakeTokenRepo) CreateAuthorizationCode(code string, ac *tokenRepo.AuthorizationCode) (*tokenRepo.AuthorizationCode, error) {
+	return ac, nil
+}
+
+func (r *fakeTokenRepo) ConsumeAuthorizationCode(code string, usedAt time.Time) (*tokenRepo.AuthorizationCode, bool, error) {
+	return nil, false, errors.New("code not found")
+}
+
+func (r *fakeTokenRepo) SetAuthorizationCodeFamily(id uint, familyID string) error {
+	return nil
+}
+
+// family returns the stored refresh tokens of the family
+func (r *fakeTokenRepo) family(familyID string) []*tokenRepo.RefreshToken {
+	rts := []*tokenRepo.RefreshToken{}
+	for _, rt := range r.refreshTokens {
+		if rt.FamilyID == familyID {
+			rts = append(rts, rt)
+		}
+	}
+	return rts
+}
+
+// fakeUserRepo knows a single user
+type fakeUserRepo struct{}
+
+func (r *fakeUserRepo) GetByEmail(email string) (*userRepo.User, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeUserRepo) GetByEmailFold(email string) (*userRepo.User, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeUserRepo) GetById(userID uint) (*userRepo.User, error) {
+	if userID != 1 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	u := &userRepo.User{Email: "user@example.com"}
+	u.ID = userID
+	return u, nil
+}
+
+func (r *fakeUserRepo) NewUser(email string, password string) (*userRepo.User, error) {
+	return nil, errors.New("not supported")
+}
+
+func (r *fakeUserRepo) SetEmailVerified(userID uint, verifiedAt time.Time) error {
+	return nil
+}
+
+func (r *fakeUserRepo) UpdatePassword(userID uint, password string) error {
+	return nil
+}
+
+// fakeKeySvc signs with a single ES256 key
+type fakeKeySvc struct {
+	key	*keySvc.Key
+}
+
+func (s *fakeKeySvc) SigningKey() (*keySvc.Key, error) {
+	return s.key, nil
+}
+
+func (s *fakeKeySvc) VerificationKey(kid string) (*keySvc.Key, error) {
+	if kid != s.key.Kid {
+		return nil, errors.New(keySvc.ErrKeyNotFound)
+	}
+	return s.key, nil
+}
+
+func (s *fakeKeySvc) Rotate() (*keySvc.Key, error) {
+	return s.key, nil
+}
+
+func (s *fakeKeySvc) JWKS() (*jwklib.JWKSet, error) {
+	return &jwklib.JWKSet{}, nil
+}
+
+// fakeRoleSvc grants no role and no scope
+type fakeRoleSvc struct{}
+
+func (s *fakeRoleSvc) GetUserRoles(userID uint) ([]roleRepo.Role, error) {
+	return nil, nil
+}
+
+func (s *fakeRoleSvc) GetUserAccess(userID uint) ([]string, []string, error) {
+	return []string{}, []string{}, nil
+}
+
+func (s *fakeRoleSvc) AssignRole(userID uint, role string) error {
+	return nil
+}
+
+func (s *fakeRoleSvc) RemoveRole(userID uint, role string) error {
+	return nil
+}
+
+func (s *fakeRoleSvc) Seed(adminEmail string) error {
+	return nil
+}
+
+// fakeAuditSvc keeps the recorded event types, failing every write when err is set
+type fakeAuditSvc struct {
+	events	[]string
+	err		error
+}
+
+func (s *fakeAuditSvc) Record(e *auditRepo.AuditEvent) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.events = append(s.events, e.Type)
+	return nil
+}
+
+func (s *fakeAuditSvc) ListEvents(filter *auditRepo.EventFilter) ([]auditRepo.AuditEvent, error) {
+	return nil, nil
+}
+
+// newTestSvc returns a service storing its tokens in memory, with a refresh grace of 10 seconds
+func newTestSvc(t *testing.T) (*svc, *fakeTokenRepo, *fakeAuditSvc) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := cfglib.DefaultConf
+	cfglib.DefaultConf = &cfglib.Config{
+		TokenExpAccess:		1,
+		TokenExpRefresh:		168,
+		TokenRefreshGrace:	10,
+	}
+	t.Cleanup(func() { cfglib.DefaultConf = prev })
+
+	r := &fakeTokenRepo{}
+	audit := &fakeAuditSvc{}
+	s := &svc{
+		repo:				r,
+		userRepo:		&fakeUserRepo{},
+		keyService:		&fakeKeySvc{key: &keySvc.Key{Kid: "test-key", Method: jwt.SigningMethodES256, Private: priv, Public: priv.Public()}},
+		roleService:	&fakeRoleSvc{},
+		auditService:	audit,
+	}
+
+	return s, r, audit
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	cases := []struct {
+		name			string
+		clientID		string
+		binding		Binding
+		err			string
+	}{
+		{"same client", "", Binding{}, ""},
+		{"another client", "other-client", Binding{}, ErrTokenInvalid},
+		{"bound to a key", "", Binding{JKT: "thumbprint"}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, r, _ := newTestSvc(t)
+			_, rt, err := s.GenerateTokens(1, Binding{}, testUserAgent, testIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			at, next, err := s.RotateRefreshToken(rt.TokenString, tc.clientID, tc.binding, testUserAgent, testIP)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected %s, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The new pair continues the family of the old token
+			if next.FamilyID != rt.FamilyID || next.ParentID == nil || *next.ParentID != rt.ID {
+				t.Fatalf("new token not in the family: %+v", next)
+			}
+			if at.RefreshTokenID != next.ID {
+				t.Fatal("access token not linked to the new refresh token")
+			}
+			if next.JKT != tc.binding.JKT {
+				t.Fatal("unbound token not bound to the key of the proof")
+			}
+			if len(r.family(rt.FamilyID)) != 2 {
+				t.Fatal("family does not hold both tokens")
+			}
+		})
+	}
+}
+
+func TestRotateRefreshTokenBoundKey(t *testing.T) {
+	s, _, _ := newTestSvc(t)
+	_, rt, err := s.GenerateTokens(1, Binding{JKT: "thumbprint"}, testUserAgent, testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token bound to a DPoP key needs a proof of the same key
+	for _, jkt := range []string{"", "another"} {
+		if _, _, err := s.RotateRefreshToken(rt.TokenString, "", Binding{JKT: jkt}, testUserAgent, testIP); err == nil || err.Error() != ErrTokenBindingInvalid {
+			t.Errorf("key %q: expected %s, got %v", jkt, ErrTokenBindingInvalid, err)
+		}
+	}
+}
+
+func TestCertificateBinding(t *testing.T) {
+	s, _, _ := newTestSvc(t)
+	at, rt, err := s.GenerateTokens(1, Binding{CertThumbprint: "thumbprint"}, testUserAgent, testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The access token carries the thumbprint in its x5t#S256 confirmation
+	claims, err := s.ParseToken(at.TokenString, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.CertThumbprint != "thumbprint" || claims.JKT != "" {
+		t.Fatalf("unexpected confirmation %q %q", claims.CertThumbprint, claims.JKT)
+	}
+
+	// The refresh token is only rotated over the same certificate
+	for _, thumbprint := range []string{"", "another"} {
+		if _, _, err := s.RotateRefreshToken(rt.TokenString, "", Binding{CertThumbprint: thumbprint}, testUserAgent, testIP); err == nil || err.Error() != ErrTokenBindingInvalid {
+			t.Errorf("certificate %q: expected %s, got %v", thumbprint, ErrTokenBindingInvalid, err)
+		}
+	}
+	at, next, err := s.RotateRefreshToken(rt.TokenString, "", Binding{CertThumbprint: "thumbprint"}, testUserAgent, testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.CertThumbprint != "thumbprint" {
+		t.Fatal("rotated token not bound to the certificate")
+	}
+	if claims, err := s.ParseToken(at.TokenString, false); err != nil || claims.CertThumbprint != "thumbprint" {
+		t.Fatalf("rotated access token not bound to the certificate: %v", err)
+	}
+
+	// Unbound tokens carry no confirmation
+	at, _, err = s.GenerateTokens(1, Binding{}, testUserAgent, testIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := s.ParseToken(at.TokenString, false); err != nil || claims.CertThumbprint != "" {
+		t.Fatalf("unbound token carries a confirmation: %v", err)
+	}
+}
+
+func TestRotateRefreshTokenReuse(t *testing.T) {
+	cases := []struct {
+		name			string
+		rotatedAgo	time.Duration
+		userAgent	string
+		auditErr		error
+		revoked		bool
+	}{
+		{"within the grace window", time.Second, testUserAgent, nil, false},
+		{"within the grace window from another client", time.Second, "other-agent", nil, true},
+		{"after the grace window", time.Minute, testUserAgent, nil, true},
+		{"after the grace window with the audit log down", time.Minute, testUserAgent, errors.New("audit down"), true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, r, audit := newTestSvc(t)
+			_, rt, err := s.GenerateTokens(1, Binding{}, testUserAgent, testIP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.RotateRefreshToken(rt.TokenString, "", Binding{}, testUserAgent, testIP); err != nil {
+				t.Fatal(err)
+			}
+
+			// Present the rotated token again
+			rotatedAt := time.Now().Add(-tc.rotatedAgo)
+			r.refreshTokens[0].RotatedAt = &rotatedAt
+			audit.err = tc.auditErr
+			_, _, err = s.RotateRefreshToken(rt.TokenString, "", Binding{}, tc.userAgent, testIP)
+
+			if !tc.revoked {
+				if err != nil {
+					t.Fatalf("reuse within the grace window refused: %v", err)
+				}
+				if len(r.family(rt.FamilyID)) != 3 {
+					t.Fatal("family revoked")
+				}
+				return
+			}
+
+			// The whole family is revoked and the reuse recorded, even when the audit log fails
+			if err == nil || err.Error() != ErrTokenReused {
+				t.Fatalf("expected %s, got %v", ErrTokenReused, err)
+			}
+			if len(r.family(rt.FamilyID)) != 0 {
+				t.Fatal("family not revoked")
+			}
+			if len(r.events) != 1 || r.events[0] != EventRefreshTokenReused {
+				t.Fatalf("security event not recorded: %v", r.events)
+			}
+			if tc.auditErr == nil && (len(audit.events) != 1 || audit.events[0] != EventRefreshTokenReused) {
+				t.Fatalf("audit event not recorded: %v", audit.events)
+			}
+
+			// Every token of the family is now refused
+			if _, _, err := s.RotateRefreshToken(rt.TokenString, "", Binding{}, testUserAgent, testIP); err == nil || err.Error() != ErrTokenInvalid {
+				t.Fatalf("revoked token accepted: %v", err)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package userRepo
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -12,13 +14,17 @@ type User struct {
 	gorm.Model
 	Email 		string 	`json:"email",gorm:"uniqueIndex;index"`
 	Password 	string	`json:"password"`
+	EmailVerifiedAt	*time.Time	`json:"email_verified_at"`
 }
 
 // Repository provides methods for interacting with the profiles in the database
 type Repo interface {
 	GetByEmail(email string) (*User, error)
+	GetByEmailFold(email string) (*User, error)
 	GetById(userID uint) (*User, error)
 	NewUser(email string, password string) (*User, error)
+	SetEmailVerified(userID uint, verifiedAt time.Time) (error)
+	UpdatePassword(userID uint, password string) (error)
 }
 
 type repo struct {
@@ -40,6 +46,16 @@ func (r *repo) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// GetByEmailFold returns a user record whose email matches the provided one regardless of case
+func (r *repo) GetByEmailFold(email string) (*User, error) {
+	var user User
+	err := r.db.Where("LOWER(email) = LOWER(?)", email).Order("id asc").First(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 // GetById returns a user record based on the provided id
 func (r *repo) GetById(userID uint) (*User, error) {
 	var user User
@@ -67,3 +83,13 @@ func (r *repo) NewUser(email string, password string) (*User, error) {
 
 	return &u, nil
 }
+
+// SetEmailVerified records that the user proved ownership of the email
+func (r *repo) SetEmailVerified(userID uint, verifiedAt time.Time) error {
+	return r.db.Model(&User{}).Where("id = ?", userID).Update("email_verified_at", verifiedAt).Error
+}
+
+// UpdatePassword replaces the password hash of the user
+func (r *repo) UpdatePassword(userID uint, password string) error {
+	return r.db.Model(&User{}).Where("id = ?", userID).Update("password", password).Error
+}
@@ -2,10 +2,14 @@ package userSvc
 
 import (
 	"errors"
+	"log"
+	"sync"
 
 	"gorm.io/gorm"
-	"golang.org/x/crypto/bcrypt"
 
+	"github.com/selatoz/gateway/pkg/passwordlib"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/audit/svc"
 	"github.com/selatoz/gateway/internal/user/repo"
 )
 
@@ -23,18 +27,31 @@ type Svc interface {
 	Register(email string, password string) (*userRepo.User, error)
 	GetById(id uint) (*userRepo.User, error)
 	GetByEmail(email string) (*userRepo.User, error)
+	SetPassword(userID uint, password string) (error)
+	ValidatePassword(userID uint, password string) (error)
 	// Add more methods here as needed
 }
 
 // svc is an implementation of the UserSvc interface that handles the business logic for user-related operations.
 type svc struct {
-	repo userRepo.Repo
+	repo			userRepo.Repo
+	policy		*passwordlib.Policy
+	hasher		passwordlib.Hasher
+	audit			auditSvc.Svc
+
+	dummyMu		sync.Mutex
+	dummyHash	string
 }
 
 // NewSvc creates a new instance of svc and returns it as a Svc interface.
-func NewSvc(db *gorm.DB) Svc {
-	repo := userRepo.NewRepo(db)
-	return &svc{repo}
+// New passwords must follow the given policy and are hashed with the given hasher.
+func NewSvc(db *gorm.DB, policy *passwordlib.Policy, hasher passwordlib.Hasher, auditService auditSvc.Svc) Svc {
+	return &svc{
+		repo: userRepo.NewRepo(db),
+		policy: policy,
+		hasher: hasher,
+		audit: auditService,
+	}
 }
 
 // GetById returns a user record based on the given id
@@ -48,33 +65,64 @@ func (s *svc) GetByEmail(email string) (*userRepo.User, error) {
 }
 
 // Login checks if a user exists with the given credentials
+// passwordlib.ErrBusy is returned as is, the credentials were not checked
+// Unknown emails are checked against a dummy hash, so the response time does not reveal which accounts exist
+// Hashes made with an outdated algorithm or parameters are replaced once the password is known
 func (s *svc) Login(email string, password string) (*userRepo.User, error) {
 	// Get the user by email
 	u, err := s.repo.GetByEmail(email)
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if _, err := s.hasher.Verify(password, s.dummy()); err == passwordlib.ErrBusy {
+				return nil, err
+			}
+			return nil, ErrInvalidPassword
+		}
 		return nil, err
 	}
 
 	// Check password matches
-	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
-	if err != nil {
+	ok, err := s.hasher.Verify(password, u.Password)
+	if err == passwordlib.ErrBusy {
+		return nil, err
+	}
+	if err != nil || !ok {
 		return nil, ErrInvalidPassword
 	}
 
+	// Upgrade the hash, the old one keeps working if this fails so the next login tries again
+	if s.hasher.NeedsRehash(u.Password) {
+		if hash, err := s.hasher.Hash(password); err == nil {
+			if err := s.repo.UpdatePassword(u.ID, hash); err == nil {
+				u.Password = hash
+				s.audit.Record(&auditRepo.AuditEvent{Type: auditSvc.EventPasswordRehashed, UserID: u.ID})
+			}
+		}
+	}
+
 	// Implement logic for creating a new user
 	return u, nil
 }
 
 // Register creates a new user with the given information
+// A password breaking the policy returns a *passwordlib.PolicyError
 func (s *svc) Register(email string, password string) (*userRepo.User, error) {
+	// Check the password
+	if err := s.policy.Check(password, email); err != nil {
+		return nil, err
+	}
+
 	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := s.hasher.Hash(password)
+	if err == passwordlib.ErrBusy {
+		return nil, err
+	}
 	if err != nil {
 		return nil, ErrFailedToHashPassword
 	}
 
 	// Create a new user
-	u, err := s.repo.NewUser(email, string(hashedPassword))
+	u, err := s.repo.NewUser(email, hashedPassword)
 	if err != nil {
 		return nil, ErrFailedToCreateUser
 	}
@@ -83,8 +131,51 @@ func (s *svc) Register(email string, password string) (*userRepo.User, error) {
 	return u, nil
 }
 
-// Check if the provided password matches the password hash
-func passwordsMatch(password string, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
\ No newline at end of file
+// SetPassword replaces the password of the user
+// A password breaking the policy returns a *passwordlib.PolicyError
+func (s *svc) SetPassword(userID uint, password string) error {
+	// Check the password
+	if err := s.ValidatePassword(userID, password); err != nil {
+		return err
+	}
+
+	// Hash the password
+	hashedPassword, err := s.hasher.Hash(password)
+	if err == passwordlib.ErrBusy {
+		return err
+	}
+	if err != nil {
+		return ErrFailedToHashPassword
+	}
+
+	if err := s.repo.UpdatePassword(userID, hashedPassword); err != nil {
+		return err
+	}
+
+	// The password is changed, an audit failure must not fail the change
+	if err := s.audit.Record(&auditRepo.AuditEvent{Type: auditSvc.EventPasswordChanged, ActorID: userID, UserID: userID}); err != nil {
+		log.Printf("audit of password change failed: %s", err)
+	}
+	return nil
+}
+
+// ValidatePassword checks a new password of the user against the policy without setting it
+func (s *svc) ValidatePassword(userID uint, password string) error {
+	u, err := s.repo.GetById(userID)
+	if err != nil {
+		return err
+	}
+
+	return s.policy.Check(password, u.Email)
+}
+
+// dummy returns a hash made with the current hasher, computed until it succeeds once
+func (s *svc) dummy() string {
+	s.dummyMu.Lock()
+	defer s.dummyMu.Unlock()
+
+	if s.dummyHash == "" {
+		s.dummyHash, _ = s.hasher.Hash("dummy password")
+	}
+	return s.dummyHash
+}
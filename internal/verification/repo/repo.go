@@ -0,0 +1,96 @@
+package verificationRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// File handles data logic related to the single-use links mailed to users
+
+// This defines a VerificationToken struct that records a link mailed to a user
+// Only the hash of the random nonce is stored, Email is the address the link was sent to
+type VerificationToken struct {
+	gorm.Model
+	User      		*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	Purpose			string				`json:"purpose"`
+	Email				string				`json:"email"`
+	NonceHash		string				`json:"-" gorm:"uniqueIndex"`
+	ExpiresAt		time.Time			`json:"expires_at" gorm:"index"`
+	UsedAt			*time.Time			`json:"used_at"`
+}
+
+// Repository provides methods for interacting with the verification tokens in the database
+type Repo interface {
+	CreateToken(vt *VerificationToken) (*VerificationToken, error)
+	GetUnusedToken(nonceHash string, at time.Time) (*VerificationToken, error)
+	ConsumeToken(nonceHash string, usedAt time.Time) (*VerificationToken, error)
+	DeleteUnusedTokens(userID uint, purpose string) (error)
+	DeleteExpiredTokens(before time.Time) (error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// CreateToken creates an entry in the verification tokens table
+func (r *repo) CreateToken(vt *VerificationToken) (*VerificationToken, error) {
+	if err := r.db.Create(vt).Error; err != nil {
+		return nil, err
+	}
+
+	return vt, nil
+}
+
+// GetUnusedToken returns an unused and unexpired token without using it
+func (r *repo) GetUnusedToken(nonceHash string, at time.Time) (*VerificationToken, error) {
+	var vt VerificationToken
+	err := r.db.Where("nonce_hash = ? AND used_at IS NULL AND expires_at > ?", nonceHash, at).First(&vt).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("verification token not found")
+		}
+		return nil, err
+	}
+	return &vt, nil
+}
+
+// ConsumeToken marks an unused and unexpired token as used and returns it
+// Only one request can consume a token
+func (r *repo) ConsumeToken(nonceHash string, usedAt time.Time) (*VerificationToken, error) {
+	res := r.db.Model(&VerificationToken{}).
+		Where("nonce_hash = ? AND used_at IS NULL AND expires_at > ?", nonceHash, usedAt).
+		Update("used_at", usedAt)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected != 1 {
+		return nil, errors.New("verification token not found")
+	}
+
+	var vt VerificationToken
+	if err := r.db.Where("nonce_hash = ?", nonceHash).First(&vt).Error; err != nil {
+		return nil, err
+	}
+	return &vt, nil
+}
+
+// DeleteUnusedTokens deletes the pending tokens of a user for a purpose, so only the latest link works
+func (r *repo) DeleteUnusedTokens(userID uint, purpose string) error {
+	return r.db.Unscoped().Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).Delete(&VerificationToken{}).Error
+}
+
+// DeleteExpiredTokens deletes the tokens that expired before the given time
+func (r *repo) DeleteExpiredTokens(before time.Time) error {
+	return r.db.Unscoped().Where("expires_at < ?", before).Delete(&VerificationToken{}).Error
+}
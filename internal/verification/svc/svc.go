@@ -0,0 +1,264 @@
+package verificationSvc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/maillib"
+	"github.com/selatoz/gateway/internal/verification/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	// Purposes a link can be used for
+	PurposeEmailVerification	= "email_verification"
+	PurposePasswordReset			= "password_reset"
+
+	// Time the user has to open a verification link
+	EmailVerificationLifetime = 24 * time.Hour
+
+	// Time the user has to open a password reset link
+	PasswordResetLifetime = 30 * time.Minute
+)
+
+// Define errors
+var (
+	ErrTokenInvalid				= errors.New("invalid or expired link")
+	ErrEmailAlreadyVerified		= errors.New("email already verified")
+)
+
+// Svc is an interface for defining the methods that the verification service will provide.
+type Svc interface {
+	SendEmailVerification(userID uint) (error)
+	VerifyEmail(token string) (uint, error)
+	SendPasswordReset(email string) (error)
+	CheckPasswordReset(token string) (uint, error)
+	ConsumePasswordReset(token string) (uint, error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for the links mailed to users.
+type svc struct {
+	repo			verificationRepo.Repo
+	userRepo		userRepo.Repo
+	mailer		maillib.Mailer
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB, mailer maillib.Mailer) Svc {
+	return &svc{
+		repo: verificationRepo.NewRepo(db),
+		userRepo: userRepo.NewRepo(db),
+		mailer: mailer,
+	}
+}
+
+// SendEmailVerification mails a link proving the user owns the email, earlier links stop working
+func (s *svc) SendEmailVerification(userID uint) error {
+	u, err := s.userRepo.GetById(userID)
+	if err != nil {
+		return err
+	}
+	if u.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+
+	token, err := s.issue(u, PurposeEmailVerification, EmailVerificationLifetime)
+	if err != nil {
+		return err
+	}
+
+	// Send the link
+	msg, err := maillib.Render("verify_email", u.Email, map[string]interface{}{
+		"AppName":		cfglib.DefaultConf.AppName,
+		"Email":			u.Email,
+		"Link":			link(issuerURL("/auth/verify-email"), token),
+		"ExpiresIn":	"24 hours",
+	})
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(msg)
+}
+
+// VerifyEmail marks the email of the user as verified and returns the user
+func (s *svc) VerifyEmail(token string) (uint, error) {
+	u, err := s.consume(token, PurposeEmailVerification)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.userRepo.SetEmailVerified(u.ID, time.Now()); err != nil {
+		return 0, err
+	}
+
+	return u.ID, nil
+}
+
+// SendPasswordReset mails a password reset link, unknown emails are ignored so accounts cannot be enumerated
+func (s *svc) SendPasswordReset(email string) error {
+	u, err := s.userRepo.GetByEmailFold(email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	token, err := s.issue(u, PurposePasswordReset, PasswordResetLifetime)
+	if err != nil {
+		return err
+	}
+
+	// Send the link
+	base := cfglib.DefaultConf.PasswordResetURL
+	if base == "" {
+		base = issuerURL("/auth/password/reset")
+	}
+	msg, err := maillib.Render("password_reset", u.Email, map[string]interface{}{
+		"AppName":		cfglib.DefaultConf.AppName,
+		"Email":			u.Email,
+		"Link":			link(base, token),
+		"ExpiresIn":	"30 minutes",
+	})
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(msg)
+}
+
+// CheckPasswordReset returns the user of a password reset link without using it
+// It lets the new password be validated before the link is spent
+func (s *svc) CheckPasswordReset(token string) (uint, error) {
+	u, err := s.check(token, PurposePasswordReset, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return u.ID, nil
+}
+
+// ConsumePasswordReset uses a password reset link and returns the user allowed to set a new password
+// Opening the link proves the user owns the email, so it is marked as verified
+func (s *svc) ConsumePasswordReset(token string) (uint, error) {
+	u, err := s.consume(token, PurposePasswordReset)
+	if err != nil {
+		return 0, err
+	}
+
+	if u.EmailVerifiedAt == nil {
+		if err := s.userRepo.SetEmailVerified(u.ID, time.Now()); err != nil {
+			return 0, err
+		}
+	}
+
+	return u.ID, nil
+}
+
+// issue stores a new link for the user and returns its signed token
+// Tokens look like <user id>.<expiry>.<nonce>.<signature>
+func (s *svc) issue(u *userRepo.User, purpose string, lifetime time.Duration) (string, error) {
+	// Remove the abandoned links and the pending ones of the same purpose
+	now := time.Now()
+	if err := s.repo.DeleteExpiredTokens(now); err != nil {
+		return "", err
+	}
+	if err := s.repo.DeleteUnusedTokens(u.ID, purpose); err != nil {
+		return "", err
+	}
+
+	nonce, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := now.Add(lifetime)
+	_, err = s.repo.CreateToken(&verificationRepo.VerificationToken{
+		UserID:		u.ID,
+		Purpose:		purpose,
+		Email:		u.Email,
+		NonceHash:	cryptolib.HashValue(nonce),
+		ExpiresAt:	expiresAt,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%d.%d.%s", u.ID, expiresAt.Unix(), nonce)
+	return payload + "." + sign(purpose, payload), nil
+}
+
+// consume checks the signature of the token and uses it, it returns the user the link was sent to
+func (s *svc) consume(token string, purpose string) (*userRepo.User, error) {
+	return s.check(token, purpose, true)
+}
+
+// check checks the signature of the token and returns the user the link was sent to, using the token when asked
+// The link only works while the user still has the email it was sent to
+func (s *svc) check(token string, purpose string, use bool) (*userRepo.User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return nil, ErrTokenInvalid
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(sign(purpose, payload)), []byte(parts[3])) {
+		return nil, ErrTokenInvalid
+	}
+
+	// Refuse expired tokens before reaching the database
+	userID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil, ErrTokenInvalid
+	}
+
+	var vt *verificationRepo.VerificationToken
+	if use {
+		vt, err = s.repo.ConsumeToken(cryptolib.HashValue(parts[2]), time.Now())
+	} else {
+		vt, err = s.repo.GetUnusedToken(cryptolib.HashValue(parts[2]), time.Now())
+	}
+	if err != nil || vt.UserID != uint(userID) || vt.Purpose != purpose {
+		return nil, ErrTokenInvalid
+	}
+	u, err := s.userRepo.GetById(vt.UserID)
+	if err != nil || u.Email != vt.Email {
+		return nil, ErrTokenInvalid
+	}
+
+	return u, nil
+}
+
+// issuerURL returns the absolute URL of a path of the gateway
+func issuerURL(path string) string {
+	return strings.TrimSuffix(cfglib.DefaultConf.AppIssuer, "/") + path
+}
+
+// link adds the token to the query of the URL
+func link(base string, token string) string {
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + "token=" + url.QueryEscape(token)
+}
+
+// sign returns the HMAC of the payload for the purpose, keyed with the app secret
+func sign(purpose string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(cfglib.DefaultConf.AppSecret))
+	mac.Write([]byte(purpose + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
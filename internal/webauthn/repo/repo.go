@@ -0,0 +1,160 @@
+package webauthnRepo
+
+import (
+	"time"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// File handles data logic related to WebAuthn credentials
+
+// This defines a WebAuthnCredential struct that holds a passkey registered by a user
+// CredentialID is base64url encoded, PublicKey is the COSE key returned by the authenticator
+// SignCount is the last counter reported by the authenticator, used to detect cloned keys
+type WebAuthnCredential struct {
+	gorm.Model
+	User      		*userRepo.User  	`json:"user" gorm:"foreignKey:UserID;references:ID"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	CredentialID	string				`json:"credential_id" gorm:"uniqueIndex"`
+	PublicKey		[]byte				`json:"-"`
+	Algorithm		int					`json:"algorithm"`
+	SignCount		uint32				`json:"-"`
+	Name				string				`json:"name"`
+	Transports		string				`json:"transports"`
+	LastUsedAt		*time.Time			`json:"last_used_at"`
+}
+
+// This defines a WebAuthnChallenge struct that holds a pending registration or authentication ceremony
+// UserID is zero for a login where the authenticator picks the credential
+type WebAuthnChallenge struct {
+	gorm.Model
+	TokenHash		string				`json:"-" gorm:"uniqueIndex"`
+	Challenge		string				`json:"-"`
+	UserID			uint					`json:"user_id" gorm:"index"`
+	Ceremony			string				`json:"ceremony"`
+	ExpiresAt		time.Time			`json:"expires_at" gorm:"index"`
+}
+
+// Repository provides methods for interacting with the WebAuthn records in the database
+type Repo interface {
+	CreateCredential(cred *WebAuthnCredential) (*WebAuthnCredential, error)
+	GetCredential(credentialID string) (*WebAuthnCredential, error)
+	GetCredentialsByUser(userID uint) ([]WebAuthnCredential, error)
+	CountCredentialsByUser(userID uint) (int64, error)
+	UpdateSignCount(id uint, previous uint32, signCount uint32, usedAt time.Time) (bool, error)
+	DeleteCredential(userID uint, id uint) (bool, error)
+
+	CreateChallenge(ch *WebAuthnChallenge) (*WebAuthnChallenge, error)
+	ConsumeChallenge(tokenHash string) (*WebAuthnChallenge, error)
+	DeleteExpiredChallenges(before time.Time) (error)
+}
+
+// Provides the implementation of the repo
+type repo struct {
+	db *gorm.DB
+}
+
+// NewRepo returns a new instance of the repository with a provided database connection.
+func NewRepo(db *gorm.DB) Repo {
+	return &repo{db}
+}
+
+// CreateCredential creates an entry in the WebAuthn credentials table
+func (r *repo) CreateCredential(cred *WebAuthnCredential) (*WebAuthnCredential, error) {
+	if err := r.db.Create(cred).Error; err != nil {
+		return nil, err
+	}
+
+	return cred, nil
+}
+
+// GetCredential returns the credential with the given credential id
+func (r *repo) GetCredential(credentialID string) (*WebAuthnCredential, error) {
+	var cred WebAuthnCredential
+	err := r.db.Where("credential_id = ?", credentialID).First(&cred).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("credential not found")
+		}
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// GetCredentialsByUser returns the credentials registered by a user
+func (r *repo) GetCredentialsByUser(userID uint) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	if err := r.db.Where("user_id = ?", userID).Order("id").Find(&creds).Error; err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// CountCredentialsByUser returns the number of credentials registered by a user
+func (r *repo) CountCredentialsByUser(userID uint) (int64, error) {
+	var count int64
+	if err := r.db.Model(&WebAuthnCredential{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// UpdateSignCount records a successful assertion, reporting false when the counter changed in between
+func (r *repo) UpdateSignCount(id uint, previous uint32, signCount uint32, usedAt time.Time) (bool, error) {
+	res := r.db.Model(&WebAuthnCredential{}).Where("id = ? AND sign_count = ?", id, previous).
+		Updates(map[string]interface{}{"sign_count": signCount, "last_used_at": usedAt})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// DeleteCredential deletes a credential of a user, reporting false when it does not exist
+func (r *repo) DeleteCredential(userID uint, id uint) (bool, error) {
+	res := r.db.Unscoped().Where("id = ? AND user_id = ?", id, userID).Delete(&WebAuthnCredential{})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// CreateChallenge creates an entry in the WebAuthn challenges table
+func (r *repo) CreateChallenge(ch *WebAuthnChallenge) (*WebAuthnChallenge, error) {
+	if err := r.db.Create(ch).Error; err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// ConsumeChallenge returns and deletes the challenge with the given token hash, so it can only be used once
+func (r *repo) ConsumeChallenge(tokenHash string) (*WebAuthnChallenge, error) {
+	var ch WebAuthnChallenge
+	err := r.db.Where("token_hash = ?", tokenHash).First(&ch).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("challenge not found")
+		}
+		return nil, err
+	}
+
+	res := r.db.Unscoped().Where("id = ?", ch.ID).Delete(&WebAuthnChallenge{})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected != 1 {
+		return nil, errors.New("challenge not found")
+	}
+
+	return &ch, nil
+}
+
+// DeleteExpiredChallenges deletes the challenges that expired before the given time
+func (r *repo) DeleteExpiredChallenges(before time.Time) error {
+	return r.db.Unscoped().Where("expires_at < ?", before).Delete(&WebAuthnChallenge{}).Error
+}
@@ -0,0 +1,368 @@
+package webauthnSvc
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cryptolib"
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/webauthnlib"
+	"github.com/selatoz/gateway/internal/webauthn/repo"
+	"github.com/selatoz/gateway/internal/user/repo"
+)
+
+// Define constants
+const (
+	// Ceremonies a challenge can be used for
+	CeremonyRegistration	= "registration"
+	CeremonyLogin			= "login"
+	CeremonySecondFactor	= "second_factor"
+
+	// Time the user has to complete a ceremony
+	ChallengeLifetime = 5 * time.Minute
+
+	// Name given to a credential registered without one
+	DefaultCredentialName = "Passkey"
+)
+
+// Define errors
+var (
+	ErrChallengeInvalid		= errors.New("invalid or expired webauthn challenge")
+	ErrCredentialInvalid		= errors.New("invalid webauthn credential")
+	ErrCredentialExists		= errors.New("webauthn credential already registered")
+	ErrCredentialNotFound	= errors.New("webauthn credential not found")
+	ErrCredentialCloned		= errors.New("webauthn credential sign count regressed")
+	ErrNoCredentials			= errors.New("no webauthn credentials registered")
+)
+
+// Attestation is the response of the browser to a registration ceremony, binary fields are base64url encoded
+type Attestation struct {
+	ClientDataJSON		string
+	AttestationObject	string
+	Transports			[]string
+}
+
+// Assertion is the response of the browser to an authentication ceremony, binary fields are base64url encoded
+type Assertion struct {
+	CredentialID			string
+	ClientDataJSON			string
+	AuthenticatorData		string
+	Signature				string
+	UserHandle				string
+}
+
+// Svc is an interface for defining the methods that the WebAuthn service will provide.
+type Svc interface {
+	BeginRegistration(userID uint) (string, *webauthnlib.CreationOptions, error)
+	FinishRegistration(userID uint, token string, name string, attestation *Attestation) (*webauthnRepo.WebAuthnCredential, error)
+	BeginLogin() (string, *webauthnlib.RequestOptions, error)
+	FinishLogin(token string, assertion *Assertion) (uint, error)
+	BeginSecondFactor(userID uint) (string, *webauthnlib.RequestOptions, error)
+	FinishSecondFactor(userID uint, token string, assertion *Assertion) (error)
+	HasCredentials(userID uint) (bool, error)
+	ListCredentials(userID uint) ([]webauthnRepo.WebAuthnCredential, error)
+	DeleteCredential(userID uint, id uint) (error)
+}
+
+// svc is an implementation of the Svc interface that handles the business logic for WebAuthn credentials.
+type svc struct {
+	repo			webauthnRepo.Repo
+	userRepo		userRepo.Repo
+}
+
+// NewSvc creates a new instance of svc and returns it as a Svc interface.
+func NewSvc(db *gorm.DB) Svc {
+	return &svc{
+		repo: webauthnRepo.NewRepo(db),
+		userRepo: userRepo.NewRepo(db),
+	}
+}
+
+// BeginRegistration starts the registration of a new passkey for the user
+// It returns the token identifying the ceremony and the options to pass to navigator.credentials.create
+func (s *svc) BeginRegistration(userID uint) (string, *webauthnlib.CreationOptions, error) {
+	u, err := s.userRepo.GetById(userID)
+	if err != nil {
+		return "", nil, err
+	}
+	creds, err := s.repo.GetCredentialsByUser(userID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, challenge, err := s.createChallenge(userID, CeremonyRegistration)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Build the options, the user handle is the user id so it does not reveal the email
+	params := make([]webauthnlib.CredentialParameter, 0, len(webauthnlib.SupportedAlgorithms))
+	for _, alg := range webauthnlib.SupportedAlgorithms {
+		params = append(params, webauthnlib.CredentialParameter{Type: "public-key", Alg: alg})
+	}
+	return token, &webauthnlib.CreationOptions{
+		Challenge:	challenge,
+		RP:			webauthnlib.RelyingParty{ID: cfglib.DefaultConf.WebAuthnRPID, Name: cfglib.DefaultConf.AppName},
+		User:			webauthnlib.User{ID: userHandle(userID), Name: u.Email, DisplayName: u.Email},
+		PubKeyCredParams:	params,
+		Timeout:		ChallengeLifetime.Milliseconds(),
+		ExcludeCredentials:	descriptors(creds),
+		AuthenticatorSelection:	webauthnlib.AuthenticatorSelection{
+			ResidentKey:			"preferred",
+			UserVerification:		"preferred",
+		},
+		Attestation:	"none",
+	}, nil
+}
+
+// FinishRegistration verifies the response of the authenticator and stores the new credential
+func (s *svc) FinishRegistration(userID uint, token string, name string, attestation *Attestation) (*webauthnRepo.WebAuthnCredential, error) {
+	ch, err := s.consumeChallenge(token, CeremonyRegistration)
+	if err != nil || ch.UserID != userID {
+		return nil, ErrChallengeInvalid
+	}
+
+	// Verify the response
+	clientData, err := webauthnlib.Decode(attestation.ClientDataJSON)
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+	object, err := webauthnlib.Decode(attestation.AttestationObject)
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+	cred, err := webauthnlib.VerifyRegistration(object, clientData, ch.Challenge, cfglib.DefaultConf.WebAuthnRPID, cfglib.DefaultConf.WebAuthnOrigins, false)
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+
+	// A credential can only belong to one user
+	credentialID := webauthnlib.Encode(cred.ID)
+	if _, err := s.repo.GetCredential(credentialID); err == nil {
+		return nil, ErrCredentialExists
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = DefaultCredentialName
+	}
+	return s.repo.CreateCredential(&webauthnRepo.WebAuthnCredential{
+		UserID:			userID,
+		CredentialID:	credentialID,
+		PublicKey:		cred.PublicKey,
+		Algorithm:		cred.Algorithm,
+		SignCount:		cred.SignCount,
+		Name:				name,
+		Transports:		strings.Join(attestation.Transports, " "),
+	})
+}
+
+// BeginLogin starts a passwordless login, the authenticator picks one of its discoverable credentials
+func (s *svc) BeginLogin() (string, *webauthnlib.RequestOptions, error) {
+	token, challenge, err := s.createChallenge(0, CeremonyLogin)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &webauthnlib.RequestOptions{
+		Challenge:				challenge,
+		RPID:						cfglib.DefaultConf.WebAuthnRPID,
+		Timeout:					ChallengeLifetime.Milliseconds(),
+		AllowCredentials:		[]webauthnlib.CredentialDescriptor{},
+		UserVerification:		"required",
+	}, nil
+}
+
+// FinishLogin verifies a passwordless login and returns the user
+// The passkey replaces both factors, so the authenticator must have verified the user
+func (s *svc) FinishLogin(token string, assertion *Assertion) (uint, error) {
+	ch, err := s.consumeChallenge(token, CeremonyLogin)
+	if err != nil {
+		return 0, ErrChallengeInvalid
+	}
+
+	cred, err := s.verifyAssertion(ch, assertion, true)
+	if err != nil {
+		return 0, err
+	}
+
+	// The user handle returned by the authenticator must match the owner of the credential
+	if strings.TrimRight(assertion.UserHandle, "=") != userHandle(cred.UserID) {
+		return 0, ErrCredentialInvalid
+	}
+
+	return cred.UserID, nil
+}
+
+// BeginSecondFactor starts the second step of a password login with one of the user's credentials
+func (s *svc) BeginSecondFactor(userID uint) (string, *webauthnlib.RequestOptions, error) {
+	creds, err := s.repo.GetCredentialsByUser(userID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(creds) == 0 {
+		return "", nil, ErrNoCredentials
+	}
+
+	token, challenge, err := s.createChallenge(userID, CeremonySecondFactor)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &webauthnlib.RequestOptions{
+		Challenge:				challenge,
+		RPID:						cfglib.DefaultConf.WebAuthnRPID,
+		Timeout:					ChallengeLifetime.Milliseconds(),
+		AllowCredentials:		descriptors(creds),
+		UserVerification:		"discouraged",
+	}, nil
+}
+
+// FinishSecondFactor verifies the assertion of the user completing a password login
+func (s *svc) FinishSecondFactor(userID uint, token string, assertion *Assertion) error {
+	ch, err := s.consumeChallenge(token, CeremonySecondFactor)
+	if err != nil || ch.UserID != userID {
+		return ErrChallengeInvalid
+	}
+
+	_, err = s.verifyAssertion(ch, assertion, false)
+	return err
+}
+
+// HasCredentials reports whether the user registered a passkey
+func (s *svc) HasCredentials(userID uint) (bool, error) {
+	count, err := s.repo.CountCredentialsByUser(userID)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// ListCredentials returns the passkeys registered by the user
+func (s *svc) ListCredentials(userID uint) ([]webauthnRepo.WebAuthnCredential, error) {
+	return s.repo.GetCredentialsByUser(userID)
+}
+
+// DeleteCredential removes a passkey of the user
+func (s *svc) DeleteCredential(userID uint, id uint) error {
+	deleted, err := s.repo.DeleteCredential(userID, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrCredentialNotFound
+	}
+
+	return nil
+}
+
+// verifyAssertion checks the assertion against the stored credential and records the new sign count
+// For the second factor the credential must belong to the user of the challenge
+func (s *svc) verifyAssertion(ch *webauthnRepo.WebAuthnChallenge, assertion *Assertion, requireUV bool) (*webauthnRepo.WebAuthnCredential, error) {
+	cred, err := s.repo.GetCredential(strings.TrimRight(assertion.CredentialID, "="))
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+	if ch.UserID != 0 && cred.UserID != ch.UserID {
+		return nil, ErrCredentialInvalid
+	}
+
+	// Verify the signature
+	clientData, err := webauthnlib.Decode(assertion.ClientDataJSON)
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+	authData, err := webauthnlib.Decode(assertion.AuthenticatorData)
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+	signature, err := webauthnlib.Decode(assertion.Signature)
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+	signCount, err := webauthnlib.VerifyAssertion(cred.PublicKey, authData, clientData, signature, ch.Challenge, cfglib.DefaultConf.WebAuthnRPID, cfglib.DefaultConf.WebAuthnOrigins, requireUV)
+	if err != nil {
+		return nil, ErrCredentialInvalid
+	}
+
+	// Authenticators with a counter must report a greater value each time, otherwise the key may be cloned
+	if (signCount != 0 || cred.SignCount != 0) && signCount <= cred.SignCount {
+		return nil, ErrCredentialCloned
+	}
+	updated, err := s.repo.UpdateSignCount(cred.ID, cred.SignCount, signCount, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		return nil, ErrCredentialCloned
+	}
+
+	return cred, nil
+}
+
+// createChallenge stores a new challenge for the ceremony, removing the abandoned ones
+// It returns the token the client sends back with the response and the challenge to sign
+func (s *svc) createChallenge(userID uint, ceremony string) (string, string, error) {
+	now := time.Now()
+	if err := s.repo.DeleteExpiredChallenges(now); err != nil {
+		return "", "", err
+	}
+
+	token, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	challenge, err := cryptolib.RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = s.repo.CreateChallenge(&webauthnRepo.WebAuthnChallenge{
+		TokenHash:	cryptolib.HashValue(token),
+		Challenge:	challenge,
+		UserID:		userID,
+		Ceremony:	ceremony,
+		ExpiresAt:	now.Add(ChallengeLifetime),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, challenge, nil
+}
+
+// consumeChallenge returns the pending challenge of the ceremony, it can only be used once
+func (s *svc) consumeChallenge(token string, ceremony string) (*webauthnRepo.WebAuthnChallenge, error) {
+	ch, err := s.repo.ConsumeChallenge(cryptolib.HashValue(token))
+	if err != nil || ch.Ceremony != ceremony || time.Now().After(ch.ExpiresAt) {
+		return nil, ErrChallengeInvalid
+	}
+
+	return ch, nil
+}
+
+// descriptors lists the credentials for the options of a ceremony
+func descriptors(creds []webauthnRepo.WebAuthnCredential) []webauthnlib.CredentialDescriptor {
+	list := make([]webauthnlib.CredentialDescriptor, 0, len(creds))
+	for _, cred := range creds {
+		list = append(list, webauthnlib.CredentialDescriptor{
+			Type:				"public-key",
+			ID:				cred.CredentialID,
+			Transports:		strings.Fields(cred.Transports),
+		})
+	}
+
+	return list
+}
+
+// userHandle returns the base64url encoded user handle of a user, the big endian user id
+func userHandle(userID uint) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(userID))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
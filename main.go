@@ -2,16 +2,47 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"	
 	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/cookielib"
 	"github.com/selatoz/gateway/pkg/dblib"
+	"github.com/selatoz/gateway/pkg/dpoplib"
+	"github.com/selatoz/gateway/pkg/maillib"
+	"github.com/selatoz/gateway/pkg/passwordlib"
+	"github.com/selatoz/gateway/pkg/ratelib"
+	"github.com/selatoz/gateway/pkg/tlslib"
 	"github.com/selatoz/gateway/internal/routes"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/audit/svc"
+	"github.com/selatoz/gateway/internal/apikey/repo"
+	"github.com/selatoz/gateway/internal/key/repo"
+	"github.com/selatoz/gateway/internal/key/svc"
+	"github.com/selatoz/gateway/internal/mfa/repo"
+	"github.com/selatoz/gateway/internal/client/repo"
+	"github.com/selatoz/gateway/internal/federation/repo"
+	"github.com/selatoz/gateway/internal/magiclink/repo"
+	"github.com/selatoz/gateway/internal/lockout/repo"
+	"github.com/selatoz/gateway/internal/role/repo"
+	"github.com/selatoz/gateway/internal/role/svc"
+	"github.com/selatoz/gateway/internal/user/repo"
+	"github.com/selatoz/gateway/internal/token/repo"
+	"github.com/selatoz/gateway/internal/verification/repo"
+	"github.com/selatoz/gateway/internal/webauthn/repo"
 )
 
 // var db = make(map[string]string)
 
 func main() {
+	// Print the password hashing parameters reaching a target latency, e.g. "calibrate-password 500ms"
+	if len(os.Args) == 3 && os.Args[1] == "calibrate-password" {
+		calibratePassword(os.Args[2])
+		return
+	}
+
 	// Initialize configuration
 	err := cfglib.Load();
 	if err != nil {
@@ -24,10 +55,142 @@ func main() {
 		panic(fmt.Errorf("failed to initialize database: %w", err))
 	}
 
+	// Migrate the stored tokens to hashes, then the database schema
+	err = tokenRepo.MigrateTokenHashes(db)
+	if err != nil {
+		panic(fmt.Errorf("failed to migrate tokens: %w", err))
+	}
+	err = db.AutoMigrate(
+		&userRepo.User{},
+		&tokenRepo.RefreshToken{},
+		&tokenRepo.AccessToken{},
+		&tokenRepo.ClientAccessToken{},
+		&tokenRepo.SecurityEvent{},
+		&tokenRepo.AuthorizationCode{},
+		&apiKeyRepo.APIKey{},
+		&federationRepo.FederatedIdentity{},
+		&federationRepo.FederationState{},
+		&mfaRepo.TOTPSecret{},
+		&mfaRepo.RecoveryCode{},
+		&mfaRepo.MFAChallenge{},
+		&verificationRepo.VerificationToken{},
+		&magicLinkRepo.MagicLogin{},
+		&lockoutRepo.LoginThrottle{},
+		&lockoutRepo.LockoutEvent{},
+		&webauthnRepo.WebAuthnCredential{},
+		&webauthnRepo.WebAuthnChallenge{},
+		&keyRepo.SigningKey{},
+		&clientRepo.Client{},
+		&roleRepo.Permission{},
+		&roleRepo.Role{},
+		&roleRepo.UserRole{},
+		&ratelib.RateLimitWindow{},
+		&auditRepo.AuditEvent{},
+		&dpoplib.UsedProof{},
+	)
+	if err != nil {
+		panic(fmt.Errorf("failed to migrate database: %w", err))
+	}
+	err = auditRepo.MigrateAppendOnly(db)
+	if err != nil {
+		panic(fmt.Errorf("failed to protect the audit log: %w", err))
+	}
+
+	// Seed the default roles
+	err = roleSvc.NewSvc(db).Seed(cfglib.DefaultConf.AppAdminEmail)
+	if err != nil {
+		panic(fmt.Errorf("failed to seed roles: %w", err))
+	}
+
+	// Initialize the mailer
+	mailer, err := maillib.NewMailer(cfglib.DefaultConf)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize mailer: %w", err))
+	}
+
+	// Initialize the rate limits
+	rateLimits, err := ratelib.NewBackend(cfglib.DefaultConf, db)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize rate limits: %w", err))
+	}
+
+	// Initialize the cache of the used DPoP proofs
+	dpopReplay, err := dpoplib.NewReplayCache(cfglib.DefaultConf, db)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize DPoP replay cache: %w", err))
+	}
+
+	// Initialize the password policy
+	passwordPolicy, err := passwordlib.NewPolicy(cfglib.DefaultConf)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize password policy: %w", err))
+	}
+
+	passwordHasher, err := passwordlib.NewHasher(cfglib.DefaultConf)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize password hasher: %w", err))
+	}
+
+	// Check the token transport
+	if err := cookielib.CheckConfig(cfglib.DefaultConf); err != nil {
+		panic(fmt.Errorf("failed to initialize token transport: %w", err))
+	}
+
+	// Check the token signing algorithm
+	if err := keySvc.CheckConfig(cfglib.DefaultConf); err != nil {
+		panic(fmt.Errorf("failed to initialize token signing: %w", err))
+	}
+
+	// Initialize the audit log sinks
+	auditSinks, err := auditSvc.NewSinks(cfglib.DefaultConf)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize audit log: %w", err))
+	}
+
 	// Initialize the routes
 	router := gin.Default()
-	routes.NewRoutes(router, db)
+
+	// Only trust the forwarded client IP from the configured proxies, none when unset
+	var trustedProxies []string
+	if len(cfglib.DefaultConf.TrustedProxies) > 0 {
+		trustedProxies = cfglib.DefaultConf.TrustedProxies
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		panic(fmt.Errorf("failed to set trusted proxies: %w", err))
+	}
+	routes.NewRoutes(router, db, mailer, rateLimits, dpopReplay, passwordPolicy, passwordHasher, auditSinks)
 
 	// Listen and Server in 0.0.0.0:8080
-	router.Run(fmt.Sprintf(":%d", cfglib.DefaultConf.AppPort))
+	addr := fmt.Sprintf(":%d", cfglib.DefaultConf.AppPort)
+	if cfglib.DefaultConf.TLSCertFile == "" {
+		router.Run(addr)
+		return
+	}
+
+	// Serve over TLS, verifying the client certificates when enabled
+	tlsConfig, err := tlslib.NewServerConfig(cfglib.DefaultConf)
+	if err != nil {
+		panic(fmt.Errorf("failed to initialize TLS: %w", err))
+	}
+	server := &http.Server{
+		Addr:			addr,
+		Handler:		router,
+		TLSConfig:	tlsConfig,
+	}
+	err = server.ListenAndServeTLS(cfglib.DefaultConf.TLSCertFile, cfglib.DefaultConf.TLSKeyFile)
+	if err != nil {
+		panic(fmt.Errorf("failed to serve: %w", err))
+	}
+}
+
+// calibratePassword prints the configuration of each password hashing algorithm reaching the target latency
+func calibratePassword(target string) {
+	d, err := time.ParseDuration(target)
+	if err != nil {
+		panic(fmt.Errorf("invalid target latency: %w", err))
+	}
+
+	params := passwordlib.CalibrateArgon2(d, passwordlib.DefaultArgon2Memory, passwordlib.DefaultArgon2Threads)
+	fmt.Printf("PASSWORD_ARGON2_MEMORY=\"%d\"\nPASSWORD_ARGON2_TIME=\"%d\"\nPASSWORD_ARGON2_THREADS=\"%d\"\n", params.Memory, params.Time, params.Threads)
+	fmt.Printf("PASSWORD_BCRYPT_COST=\"%d\"\n", passwordlib.CalibrateBcrypt(d))
 }
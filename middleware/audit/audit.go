@@ -0,0 +1,73 @@
+package mwaudit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/audit/svc"
+)
+
+// Define constants
+const (
+	// Headers
+	HeaderRequestID = "X-Request-ID"
+)
+
+// Request ids sent by a proxy are kept when they are short and plain
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Capture is a middleware that gives each request an id and lets the handlers record audit events.
+// The id is taken from the X-Request-ID header when a proxy set one, and sent back in the response.
+func Capture(auditService auditSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderRequestID)
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		// Add audit context to request context
+		c.Set("request_id", id)
+		c.Set("audit", auditService)
+		c.Header(HeaderRequestID, id)
+		c.Next()
+	}
+}
+
+// Define errors
+var ErrAuditUnavailable = errors.New("audit log unavailable")
+
+// Record records the event with the address, the user agent and the id of the request
+// Failures are attached to the request errors, an audit failure does not fail the request
+func Record(c *gin.Context, e *auditRepo.AuditEvent) {
+	if err := RecordRequired(c, e); err != nil && err != ErrAuditUnavailable {
+		c.Error(err)
+	}
+}
+
+// RecordRequired is Record for the actions that must not happen unrecorded, it returns the failure instead
+func RecordRequired(c *gin.Context, e *auditRepo.AuditEvent) error {
+	v, ok := c.Get("audit")
+	if !ok {
+		return ErrAuditUnavailable
+	}
+	auditService, ok := v.(auditSvc.Svc)
+	if !ok {
+		return ErrAuditUnavailable
+	}
+
+	e.IP = c.ClientIP()
+	e.UserAgent = c.Request.UserAgent()
+	e.RequestID = c.GetString("request_id")
+	return auditService.Record(e)
+}
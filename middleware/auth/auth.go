@@ -8,65 +8,457 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/cookielib"
+	"github.com/selatoz/gateway/pkg/dpoplib"
 	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/audit"
+	"github.com/selatoz/gateway/middleware/mtls"
+	"github.com/selatoz/gateway/internal/apikey/svc"
+	"github.com/selatoz/gateway/internal/audit/repo"
+	"github.com/selatoz/gateway/internal/audit/svc"
 	"github.com/selatoz/gateway/internal/token/svc"
+	"github.com/selatoz/gateway/internal/user/svc"
 )
 
 // Define constants
 const (
 	// Errors
 	ErrNoAuthorization = "Missing authorization"
+	ErrInsufficientScope = "insufficient_scope"
+	ErrInsufficientRole = "Insufficient role"
+	ErrPrincipalNotAllowed = "Principal not allowed"
+	ErrEmailNotVerified = "Email not verified"
+	ErrDPoPRequired = "DPoP proof required"
+	ErrDPoPNotBound = "Token not bound to a DPoP key"
+	ErrDPoPKeyMismatch = "DPoP key does not match the token"
+	ErrCertificateMismatch = "Certificate does not match the token"
+	ErrImpersonationForbidden = "Not allowed while impersonating"
+	ErrFirstPartyOnly = "Requires a first party session"
+	ErrAudienceMismatch = "Token not issued for this gateway"
+
+	// Principals
+	PrincipalUser		= tokenSvc.PrincipalUser
+	PrincipalClient	= tokenSvc.PrincipalClient
 
 	// Headers
 	HeaderAuthorization 				= "Authorization"
 	HeaderRefreshAuthorization 	= "Refresh-Authorization"
 	HeaderChallengeAuthorization	= "WWW-Authenticate"
+	HeaderAPIKey						= "X-API-Key"
+	HeaderDPoP							= "DPoP"
+
+	// Authorization schemes
+	SchemeAPIKey = "ApiKey "
+	SchemeBearer = "Bearer "
+	SchemeDPoP = "DPoP "
 
 	// Header values
 	ChallengeExpiredAccessToken 	= "Bearer realm=\"%s\",error=\"access_token_expired\""
+	ChallengeInsufficientScope		= "Bearer realm=\"%s\",error=\"insufficient_scope\",scope=\"%s\""
+	ChallengeDPoP						= "DPoP realm=\"%s\",error=\"%s\",algs=\"%s\""
+	ChallengeInvalidToken			= "Bearer realm=\"%s\",error=\"invalid_token\""
+
+	// Error codes of the DPoP challenge
+	CodeInvalidToken			= "invalid_token"
+	CodeInvalidDPoPProof		= "invalid_dpop_proof"
 )
 
+// AuthContext describes who the request is authorized for
+// UserID is the subject, ActorID and ActorClientID are set when a user or a client acts on their behalf (RFC 8693)
 type AuthContext struct {
+	Principal		string
 	UserID			uint
+	ActorID			uint
+	ActorClientID	string
 	AccessToken		string
+	SessionID		string
+	ClientID			string
+	APIKeyID			uint
+	CertThumbprint	string
+	Roles				[]string
+	Scopes			[]string
 }
 
 // Middleware is a function that wraps an gin.HandlerFunc and provides some extra functionality.
 type NewAuthMiddleware func(gin.HandlerFunc) gin.HandlerFunc
 
 // authMiddleware is a middleware that requires an authorization header with a valid token to access a route.
-func Authorize(tokenService tokenSvc.Svc) gin.HandlerFunc {
+// Only tokens and API keys held by users are accepted.
+// Tokens bound to a DPoP key must be sent with the DPoP scheme and a proof of the key.
+func Authorize(tokenService tokenSvc.Svc, apiKeyService apiKeySvc.Svc, dpopVerifier *dpoplib.Verifier) gin.HandlerFunc {
+	return AuthorizePrincipals(tokenService, apiKeyService, dpopVerifier, PrincipalUser)
+}
+
+// AuthorizePrincipals is a middleware like Authorize that accepts tokens held by any of the given principals.
+// Tokens held by clients have no user and no session.
+// Without token, a client certificate registered to a client authorizes the client with its allowed scopes.
+// In cookie mode, the access token of browsers is read from the session cookie when no header is sent.
+func AuthorizePrincipals(tokenService tokenSvc.Svc, apiKeyService apiKeySvc.Svc, dpopVerifier *dpoplib.Verifier, principals ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Handle API key, sent in its own header or with the ApiKey scheme
 		at := c.GetHeader(HeaderAuthorization)
+		key := c.GetHeader(HeaderAPIKey)
+		if strings.HasPrefix(at, SchemeAPIKey) {
+			key = strings.TrimPrefix(at, SchemeAPIKey)
+		}
+		if key != "" {
+			authorizeAPIKey(c, apiKeyService, key, principals)
+			return
+		}
+
+		// Read the session cookie of browsers, the CSRF token is checked by mwcsrf.Protect
+		if at == "" && cookielib.TokensInCookies() {
+			if v, err := c.Cookie(cookielib.CookieAccessToken); err == nil && v != "" {
+				at = SchemeBearer + v
+			}
+		}
+
 		if at == "" {
+			if certCtx := mwmtls.Certificate(c); certCtx != nil && certCtx.ClientID != "" {
+				authorizeCertificate(c, certCtx, principals)
+				return
+			}
 			c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: ErrNoAuthorization})
 			return
 		}
 
+		// Read the scheme, bearer tokens may be sent without it
+		scheme := SchemeBearer
+		token := strings.TrimPrefix(at, SchemeBearer)
+		if strings.HasPrefix(at, SchemeDPoP) {
+			scheme = SchemeDPoP
+			token = strings.TrimPrefix(at, SchemeDPoP)
+		}
+
 		// Validate token
 		isLoggingOut := (c.Request.Method == http.MethodPost && c.Request.URL.Path == "/user/logout")
-		uid, _, err := tokenService.ValidateToken(at, isLoggingOut)
+		claims, err := tokenService.ParseToken(token, isLoggingOut)
 		if err != nil {
 			// Check if the error is due to an expired token
 			if err.Error() == tokenSvc.ErrTokenExpired {
 				// Challenge the client to send the refresh token
+				recordFailure(c, 0, "", err.Error())
 				c.Writer.Header().Set(HeaderChallengeAuthorization, fmt.Sprintf(ChallengeExpiredAccessToken, cfglib.DefaultConf.AppName))
 				c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
 				return
 		  }
 
+			recordFailure(c, 0, "", err.Error())
 			c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
 			return
 		}
 
+		// Ensure the principal may access the route
+		if !contains(principals, claims.Principal) {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrPrincipalNotAllowed})
+			return
+		}
+
+		// Ensure the token is meant for this gateway and sent as its bindings require
+		if !checkAudience(c, claims) || !checkCertificate(c, claims) || !checkBinding(c, dpopVerifier, scheme, token, claims) {
+			return
+		}
+
+		// Handle client held token
+		if claims.Principal == PrincipalClient {
+			record, err := tokenService.GetClientAccessToken(token)
+			if err != nil || record.ClientID != claims.ClientID {
+				recordFailure(c, 0, claims.ClientID, tokenSvc.ErrTokenRevoked)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: tokenSvc.ErrTokenRevoked})
+				return
+			}
+
+			c.Set("auth", &AuthContext{
+				Principal:    PrincipalClient,
+				AccessToken:  token,
+				ClientID:     claims.ClientID,
+				CertThumbprint: claims.CertThumbprint,
+				Roles:        claims.Roles,
+				Scopes:       claims.Scopes,
+			})
+			c.Next()
+			return
+		}
+
+		// Ensure the token has not been revoked
+		record, err := tokenService.GetAccessToken(token)
+		if err != nil || record.UserID != claims.UserID || record.RefreshToken == nil {
+			recordFailure(c, claims.UserID, claims.ClientID, tokenSvc.ErrTokenRevoked)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: tokenSvc.ErrTokenRevoked})
+			return
+		}
+
+		// Record the session activity
+		if err := tokenService.TouchSession(record, c.ClientIP()); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
 		// Create auth context
 		authContext := AuthContext{
-			UserID:       uid,
-			AccessToken:  strings.TrimPrefix(at, "Bearer "),
+			Principal:    PrincipalUser,
+			UserID:       claims.UserID,
+			ActorID:      actorID(claims.Actor),
+			ActorClientID: actorClientID(claims.Actor),
+			AccessToken:  token,
+			SessionID:    record.RefreshToken.FamilyID,
+			ClientID:     claims.ClientID,
+			CertThumbprint: claims.CertThumbprint,
+			Roles:        claims.Roles,
+			Scopes:       claims.Scopes,
 		}
 
 		// Add auth context to request context
 		c.Set("auth", &authContext)
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// authorizeAPIKey authorizes the request with an API key, which acts on behalf of its user
+func authorizeAPIKey(c *gin.Context, apiKeyService apiKeySvc.Svc, key string, principals []string) {
+	if !contains(principals, PrincipalUser) {
+		c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrPrincipalNotAllowed})
+		return
+	}
+
+	// Validate the key
+	k, scopes, err := apiKeyService.Authenticate(key, c.ClientIP())
+	if err != nil {
+		if err == apiKeySvc.ErrKeyInvalid || err == apiKeySvc.ErrKeyExpired {
+			recordFailure(c, 0, "", err.Error())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// Add auth context to request context, API keys hold no roles
+	c.Set("auth", &AuthContext{
+		Principal:    PrincipalUser,
+		UserID:       k.UserID,
+		APIKeyID:     k.ID,
+		Roles:        []string{},
+		Scopes:       scopes,
+	})
+	c.Next()
+}
+
+// authorizeCertificate authorizes the request with the verified client certificate, which acts as its client
+func authorizeCertificate(c *gin.Context, certCtx *mwmtls.CertContext, principals []string) {
+	if !contains(principals, PrincipalClient) {
+		c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrPrincipalNotAllowed})
+		return
+	}
+
+	// Add auth context to request context, clients hold no roles
+	c.Set("auth", &AuthContext{
+		Principal:    PrincipalClient,
+		ClientID:     certCtx.ClientID,
+		CertThumbprint: certCtx.Thumbprint,
+		Roles:        []string{},
+		Scopes:       certCtx.Scopes,
+	})
+	c.Next()
+}
+
+// checkAudience refuses tokens exchanged for an audience other than the issuer of this gateway
+func checkAudience(c *gin.Context, claims *tokenSvc.Claims) bool {
+	if claims.Audience == "" || claims.Audience == cfglib.DefaultConf.AppIssuer {
+		return true
+	}
+
+	recordFailure(c, claims.UserID, claims.ClientID, ErrAudienceMismatch)
+	c.Writer.Header().Set(HeaderChallengeAuthorization, fmt.Sprintf(ChallengeInvalidToken, cfglib.DefaultConf.AppName))
+	c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: ErrAudienceMismatch})
+	return false
+}
+
+// checkCertificate refuses a token bound to a client certificate unless the request came over that certificate
+func checkCertificate(c *gin.Context, claims *tokenSvc.Claims) bool {
+	if claims.CertThumbprint == "" {
+		return true
+	}
+
+	certCtx := mwmtls.Certificate(c)
+	if certCtx == nil || certCtx.Thumbprint != claims.CertThumbprint {
+		recordFailure(c, claims.UserID, claims.ClientID, ErrCertificateMismatch)
+		c.Writer.Header().Set(HeaderChallengeAuthorization, fmt.Sprintf(ChallengeInvalidToken, cfglib.DefaultConf.AppName))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: ErrCertificateMismatch})
+		return false
+	}
+
+	return true
+}
+
+// recordFailure records a refused token or API key in the audit log
+func recordFailure(c *gin.Context, userID uint, clientID string, reason string) {
+	mwaudit.Record(c, &auditRepo.AuditEvent{
+		Type:			auditSvc.EventTokenValidation,
+		Outcome:		auditSvc.OutcomeFailure,
+		Reason:		reason,
+		UserID:		userID,
+		ClientID:	clientID,
+	})
+}
+
+// RequireScopes is a middleware that requires the authorized token to hold all the given scopes.
+// It must be placed after Authorize.
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authCtx, ok := c.MustGet("auth").(*AuthContext)
+		if !ok || !authCtx.HasScopes(scopes...) {
+			c.Writer.Header().Set(HeaderChallengeAuthorization, fmt.Sprintf(ChallengeInsufficientScope, cfglib.DefaultConf.AppName, strings.Join(scopes, " ")))
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrInsufficientScope})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireRole is a middleware that requires the authorized user to hold one of the given roles.
+// It must be placed after Authorize.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authCtx, ok := c.MustGet("auth").(*AuthContext)
+		if !ok || !authCtx.HasAnyRole(roles...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrInsufficientRole})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireVerifiedEmail is a middleware that requires the authorized user to have verified their email.
+// It must be placed after Authorize.
+func RequireVerifiedEmail(userService userSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authCtx, ok := c.MustGet("auth").(*AuthContext)
+		if !ok || authCtx.Principal != PrincipalUser {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrPrincipalNotAllowed})
+			return
+		}
+
+		u, err := userService.GetById(authCtx.UserID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: tokenSvc.ErrTokenUserInvalid})
+			return
+		}
+		if u.EmailVerifiedAt == nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrEmailNotVerified})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ForbidImpersonation is a middleware that refuses delegated tokens, so no one acting on behalf of a user can reach the route.
+// Each refusal is recorded in the audit log. It must be placed after Authorize.
+func ForbidImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authCtx, ok := c.MustGet("auth").(*AuthContext)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrPrincipalNotAllowed})
+			return
+		}
+		if authCtx.Impersonated() {
+			refuseImpersonation(c, authCtx)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireFirstParty is a middleware that only accepts the sessions the user signed in to themselves, for account management.
+// Tokens delegated to OAuth clients, API keys and impersonated sessions are refused. It must be placed after Authorize.
+func RequireFirstParty() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authCtx, ok := c.MustGet("auth").(*AuthContext)
+		if !ok || authCtx.Principal != PrincipalUser {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrPrincipalNotAllowed})
+			return
+		}
+		if authCtx.Impersonated() {
+			refuseImpersonation(c, authCtx)
+			return
+		}
+		if authCtx.ClientID != "" || authCtx.APIKeyID != 0 || authCtx.SessionID == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrFirstPartyOnly})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// refuseImpersonation refuses a delegated token and records the refusal in the audit log
+func refuseImpersonation(c *gin.Context, authCtx *AuthContext) {
+	mwaudit.Record(c, &auditRepo.AuditEvent{
+		Type:			auditSvc.EventImpersonation,
+		Outcome:		auditSvc.OutcomeFailure,
+		Reason:		c.Request.Method + " " + c.FullPath() + " forbidden",
+		ActorID:		authCtx.ActorID,
+		UserID:		authCtx.UserID,
+		ClientID:	authCtx.ActorClientID,
+	})
+	c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrImpersonationForbidden})
+}
+
+// Impersonated reports whether someone acts on behalf of the user of the context
+func (a *AuthContext) Impersonated() bool {
+	return a.ActorID != 0 || a.ActorClientID != ""
+}
+
+// HasScopes reports whether the context holds all the given scopes
+func (a *AuthContext) HasScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		if !contains(a.Scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HasAnyRole reports whether the context holds one of the given roles
+func (a *AuthContext) HasAnyRole(roles ...string) bool {
+	for _, role := range roles {
+		if contains(a.Roles, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// actorID returns the user acting on behalf of the subject of a token, or 0
+func actorID(actor *tokenSvc.Actor) uint {
+	if actor == nil {
+		return 0
+	}
+
+	return actor.UserID
+}
+
+// actorClientID returns the client acting on behalf of the subject of a token, or an empty string
+func actorClientID(actor *tokenSvc.Actor) string {
+	if actor == nil {
+		return ""
+	}
+
+	return actor.ClientID
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package mwauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/tlslib"
+	"github.com/selatoz/gateway/middleware/mtls"
+	"github.com/selatoz/gateway/internal/client/repo"
+	"github.com/selatoz/gateway/internal/token/svc"
+)
+
+// fakeClientSvc knows no client, certificates then only serve to bind tokens
+type fakeClientSvc struct{}
+
+func (s *fakeClientSvc) Authenticate(clientID string, secret string) (*clientRepo.Client, error) {
+	return nil, errors.New("client not found")
+}
+
+func (s *fakeClientSvc) AuthenticatePublic(clientID string) (*clientRepo.Client, error) {
+	return nil, errors.New("client not found")
+}
+
+func (s *fakeClientSvc) AuthenticateCertificate(identities []string) (*clientRepo.Client, error) {
+	return nil, errors.New("client not found")
+}
+
+func (s *fakeClientSvc) GetClient(clientID string) (*clientRepo.Client, error) {
+	return nil, errors.New("client not found")
+}
+
+func (s *fakeClientSvc) CreateClient(name string, redirectURIs []string, scopes []string, grantTypes []string, public bool, tlsSubject string) (*clientRepo.Client, string, error) {
+	return nil, "", errors.New("not supported")
+}
+
+// newCertificate returns a self-signed client certificate with the common name
+func newCertificate(t *testing.T, name string) *x509.Certificate {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:	big.NewInt(1),
+		Subject:			pkix.Name{CommonName: name},
+		NotBefore:		time.Now().Add(-time.Hour),
+		NotAfter:		time.Now().Add(time.Hour),
+		ExtKeyUsage:		[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestCheckCertificate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := cfglib.DefaultConf
+	cfglib.DefaultConf = &cfglib.Config{AppName: "gateway"}
+	t.Cleanup(func() { cfglib.DefaultConf = prev })
+
+	cert := newCertificate(t, "partner")
+	other := newCertificate(t, "partner")
+	verified := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	cases := []struct {
+		name			string
+		thumbprint	string
+		tls			*tls.ConnectionState
+		allowed		bool
+	}{
+		{"bearer token without a certificate", "", nil, true},
+		{"bearer token over a certificate", "", verified(cert), true},
+		{"bound token over its certificate", tlslib.Thumbprint(cert), verified(cert), true},
+		{"bound token without a certificate", tlslib.Thumbprint(cert), nil, false},
+		{"bound token over another certificate with the same subject", tlslib.Thumbprint(cert), verified(other), false},
+		{"bound token over an unverified certificate", tlslib.Thumbprint(cert), &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, false},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.TLS = tc.tls
+
+		// Read the certificate as the router does before the routes
+		mwmtls.Capture(&fakeClientSvc{})(c)
+
+		allowed := checkCertificate(c, &tokenSvc.Claims{UserID: 1, CertThumbprint: tc.thumbprint})
+		if allowed != tc.allowed {
+			t.Errorf("%s: allowed = %v, want %v", tc.name, allowed, tc.allowed)
+			continue
+		}
+		if !allowed && (w.Code != http.StatusUnauthorized || w.Header().Get(HeaderChallengeAuthorization) == "") {
+			t.Errorf("%s: refused with %d and challenge %q", tc.name, w.Code, w.Header().Get(HeaderChallengeAuthorization))
+		}
+	}
+}
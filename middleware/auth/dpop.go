@@ -0,0 +1,94 @@
+package mwauth
+
+import (
+	"fmt"
+	"strings"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/dpoplib"
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/internal/token/svc"
+)
+
+// VerifyDPoP verifies the DPoP proof sent with the request, no proof is returned when the request has none
+// The access token is given when the request is sent to a resource, the proof must then carry its hash
+func VerifyDPoP(c *gin.Context, dpopVerifier *dpoplib.Verifier, accessToken string) (*dpoplib.Proof, error) {
+	proofs := c.Request.Header.Values(HeaderDPoP)
+	if len(proofs) == 0 {
+		return nil, nil
+	}
+	if len(proofs) > 1 {
+		return nil, dpoplib.ErrProofInvalid
+	}
+
+	// Proofs are made for the public URL of the gateway
+	uri := strings.TrimSuffix(cfglib.DefaultConf.AppIssuer, "/") + c.Request.URL.Path
+	return dpopVerifier.Verify(proofs[0], c.Request.Method, uri, accessToken)
+}
+
+// checkBinding refuses a DPoP bound token sent without a valid proof of its key,
+// and a plain token sent with the DPoP scheme or to a route requiring DPoP, certificate bound tokens are not plain
+func checkBinding(c *gin.Context, dpopVerifier *dpoplib.Verifier, scheme string, token string, claims *tokenSvc.Claims) bool {
+	// Handle plain bearer token
+	if claims.JKT == "" {
+		if scheme == SchemeDPoP {
+			refuseDPoP(c, claims, CodeInvalidToken, ErrDPoPNotBound)
+			return false
+		}
+		if claims.CertThumbprint == "" && requiresDPoP(c.FullPath()) {
+			refuseDPoP(c, claims, CodeInvalidToken, ErrDPoPRequired)
+			return false
+		}
+		return true
+	}
+
+	// Handle bound token, which is useless without the key
+	if scheme != SchemeDPoP {
+		refuseDPoP(c, claims, CodeInvalidToken, ErrDPoPRequired)
+		return false
+	}
+	proof, err := VerifyDPoP(c, dpopVerifier, token)
+	if err != nil {
+		if !dpoplib.Refused(err) {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return false
+		}
+		refuseDPoP(c, claims, CodeInvalidDPoPProof, err.Error())
+		return false
+	}
+	if proof == nil {
+		refuseDPoP(c, claims, CodeInvalidDPoPProof, ErrDPoPRequired)
+		return false
+	}
+	if proof.JKT != claims.JKT {
+		refuseDPoP(c, claims, CodeInvalidDPoPProof, ErrDPoPKeyMismatch)
+		return false
+	}
+
+	return true
+}
+
+// refuseDPoP records the refused token and challenges the client to send a DPoP bound token
+func refuseDPoP(c *gin.Context, claims *tokenSvc.Claims, code string, reason string) {
+	recordFailure(c, claims.UserID, claims.ClientID, reason)
+	c.Writer.Header().Set(HeaderChallengeAuthorization, fmt.Sprintf(ChallengeDPoP, cfglib.DefaultConf.AppName, code, strings.Join(dpoplib.SigningAlgs, " ")))
+	c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: reason})
+}
+
+// requiresDPoP reports whether the route refuses plain bearer tokens
+// Routes are matched against DPOP_REQUIRED_ROUTES, a trailing * matches every route starting with the prefix
+func requiresDPoP(route string) bool {
+	for _, pattern := range cfglib.DefaultConf.DPoPRequiredRoutes {
+		if pattern == route {
+			return true
+		}
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(route, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,66 @@
+package mwclient
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/mtls"
+	"github.com/selatoz/gateway/internal/client/repo"
+	"github.com/selatoz/gateway/internal/client/svc"
+)
+
+// Define constants
+const (
+	// Headers
+	HeaderChallengeAuthorization	= "WWW-Authenticate"
+
+	// Header values
+	ChallengeClient = "Basic realm=\"client\""
+)
+
+type ClientContext struct {
+	ClientID		string
+	Public		bool
+}
+
+// Authenticate is a middleware that requires valid client credentials to access a route.
+// Credentials are read from the basic authorization header or the client_id and client_secret form fields.
+// When allowPublic is set, public clients may identify themselves with their client_id alone.
+// Clients may also authenticate with the certificate they are registered with, instead of the secret (RFC 8705).
+func Authenticate(clientService clientSvc.Svc, allowPublic bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, secret, ok := c.Request.BasicAuth()
+		if !ok {
+			clientID = c.PostForm("client_id")
+			secret = c.PostForm("client_secret")
+		}
+
+		// Handle client certificate, the client_id is optional but must match
+		certCtx := mwmtls.Certificate(c)
+		if secret == "" && certCtx != nil && certCtx.ClientID != "" && (clientID == "" || clientID == certCtx.ClientID) {
+			c.Set("client", &ClientContext{ClientID: certCtx.ClientID, Public: false})
+			c.Next()
+			return
+		}
+
+		// Validate the credentials
+		var cl *clientRepo.Client
+		var err error
+		if allowPublic && secret == "" {
+			cl, err = clientService.AuthenticatePublic(clientID)
+		} else {
+			cl, err = clientService.Authenticate(clientID, secret)
+		}
+		if err != nil {
+			c.Writer.Header().Set(HeaderChallengeAuthorization, ChallengeClient)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Add client context to request context
+		c.Set("client", &ClientContext{ClientID: cl.ClientID, Public: cl.Public})
+		c.Next()
+	}
+}
@@ -0,0 +1,73 @@
+package mwcsrf
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/pkg/cookielib"
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/auth"
+)
+
+// Define constants
+const (
+	// Errors
+	ErrCSRFInvalid = "Invalid CSRF token"
+
+	// Headers
+	HeaderCSRF = "X-CSRF-Token"
+)
+
+// Protect is a middleware that refuses state-changing requests authenticated by a session cookie without the CSRF token.
+// The token is read by the frontend from its cookie and sent back in the X-CSRF-Token header (double submit).
+// Requests carrying their credentials in headers cannot be forged by another site, so they are not checked.
+func Protect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if c.GetHeader(mwauth.HeaderAuthorization) != "" || c.GetHeader(mwauth.HeaderAPIKey) != "" || !hasSessionCookie(c) {
+			c.Next()
+			return
+		}
+
+		// Compare the header with the cookie
+		cookie, err := c.Cookie(cookielib.CookieCSRF)
+		header := c.GetHeader(HeaderCSRF)
+		if err != nil || cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+			c.AbortWithStatusJSON(http.StatusForbidden, validHttp.ErrorResponse{Error: ErrCSRFInvalid})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Issue sets a new CSRF token cookie, readable by the frontend, for a session ending at the given time
+func Issue(c *gin.Context, expiresAt time.Time) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	cookielib.Set(c, cookielib.CookieCSRF, base64.RawURLEncoding.EncodeToString(b), expiresAt, cookielib.PathSession, false)
+	return nil
+}
+
+// hasSessionCookie reports whether the request carries a token cookie
+func hasSessionCookie(c *gin.Context) bool {
+	for _, name := range []string{cookielib.CookieAccessToken, cookielib.CookieRefreshToken} {
+		if v, err := c.Cookie(name); err == nil && v != "" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,102 @@
+package mwcsrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/cookielib"
+	"github.com/selatoz/gateway/middleware/auth"
+)
+
+func TestProtect(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Protect())
+	r.Any("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	session := map[string]string{cookielib.CookieAccessToken: "token", cookielib.CookieCSRF: "csrf"}
+	cases := []struct {
+		name			string
+		method		string
+		cookies		map[string]string
+		headers		map[string]string
+		allowed		bool
+	}{
+		{"safe method", http.MethodGet, session, nil, true},
+		{"no session cookie", http.MethodPost, nil, nil, true},
+		{"matching header", http.MethodPost, session, map[string]string{HeaderCSRF: "csrf"}, true},
+		{"no header", http.MethodPost, session, nil, false},
+		{"other header", http.MethodDelete, session, map[string]string{HeaderCSRF: "other"}, false},
+		{"no CSRF cookie", http.MethodPost, map[string]string{cookielib.CookieAccessToken: "token"}, map[string]string{HeaderCSRF: "csrf"}, false},
+		{"empty CSRF cookie and header", http.MethodPost, map[string]string{cookielib.CookieAccessToken: "token", cookielib.CookieCSRF: ""}, map[string]string{HeaderCSRF: ""}, false},
+		{"refresh cookie only", http.MethodPost, map[string]string{cookielib.CookieRefreshToken: "token", cookielib.CookieCSRF: "csrf"}, nil, false},
+		{"token in the authorization header", http.MethodPost, session, map[string]string{mwauth.HeaderAuthorization: "Bearer token"}, true},
+		{"API key", http.MethodPut, session, map[string]string{mwauth.HeaderAPIKey: "key"}, true},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, "/", nil)
+		for name, value := range tc.cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if allowed := w.Code == http.StatusNoContent; allowed != tc.allowed {
+			t.Errorf("%s: got status %d", tc.name, w.Code)
+		}
+		if !tc.allowed && w.Code != http.StatusForbidden {
+			t.Errorf("%s: refused with %d", tc.name, w.Code)
+		}
+	}
+}
+
+func TestIssue(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	prev := cfglib.DefaultConf
+	cfglib.DefaultConf = &cfglib.Config{}
+	t.Cleanup(func() { cfglib.DefaultConf = prev })
+
+	issue := func() *http.Cookie {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		if err := Issue(c, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != cookielib.CookieCSRF {
+			t.Fatalf("unexpected cookies %v", cookies)
+		}
+		return cookies[0]
+	}
+	first, second := issue(), issue()
+
+	// The frontend reads the token to send it back, so the cookie is not http-only
+	if first.HttpOnly || !first.Secure || first.Path != cookielib.PathSession {
+		t.Fatalf("unexpected cookie %+v", first)
+	}
+	if len(first.Value) != 43 || first.Value == second.Value {
+		t.Fatalf("weak tokens %q and %q", first.Value, second.Value)
+	}
+
+	// The issued token passes Protect when sent back in the header
+	r := gin.New()
+	r.Use(Protect())
+	r.POST("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.AddCookie(&http.Cookie{Name: cookielib.CookieAccessToken, Value: "token"})
+	req.AddCookie(first)
+	req.Header.Set(HeaderCSRF, first.Value)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("issued token refused with %d", w.Code)
+	}
+}
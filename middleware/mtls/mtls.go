@@ -0,0 +1,67 @@
+package mwmtls
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+	"github.com/selatoz/gateway/pkg/tlslib"
+	"github.com/selatoz/gateway/internal/client/svc"
+)
+
+// CertContext describes the verified client certificate of the connection
+// The client is only set when a client is registered with one of the certificate identities
+type CertContext struct {
+	Thumbprint		string
+	Subject			string
+	ClientID			string
+	Scopes			[]string
+}
+
+// Capture is a middleware that reads the verified client certificate of the connection and the client it identifies.
+// It must be used before the routes reading the certificate, unverified certificates are ignored.
+func Capture(clientService clientSvc.Svc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.Next()
+			return
+		}
+
+		// Read the leaf certificate
+		cert := c.Request.TLS.PeerCertificates[0]
+		certCtx := &CertContext{
+			Thumbprint:	tlslib.Thumbprint(cert),
+			Subject:		cert.Subject.String(),
+		}
+
+		// Map the certificate to a client, unknown certificates only serve to bind tokens
+		if cl, err := clientService.AuthenticateCertificate(tlslib.Identities(cert)); err == nil {
+			certCtx.ClientID = cl.ClientID
+			certCtx.Scopes = cl.AllowedScopeList()
+		}
+
+		c.Set("certificate", certCtx)
+		c.Next()
+	}
+}
+
+// Certificate returns the verified client certificate of the request, or nil
+func Certificate(c *gin.Context) *CertContext {
+	v, ok := c.Get("certificate")
+	if !ok {
+		return nil
+	}
+
+	certCtx, _ := v.(*CertContext)
+	return certCtx
+}
+
+// BoundThumbprint returns the thumbprint the tokens issued to the request are bound to
+// It is empty unless binding is enabled and the request came with a verified certificate
+func BoundThumbprint(c *gin.Context) string {
+	certCtx := Certificate(c)
+	if !cfglib.DefaultConf.MTLSBindTokens || certCtx == nil {
+		return ""
+	}
+
+	return certCtx.Thumbprint
+}
@@ -0,0 +1,119 @@
+package mwratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/validation/http"
+	"github.com/selatoz/gateway/middleware/auth"
+	"github.com/selatoz/gateway/middleware/client"
+	"github.com/selatoz/gateway/pkg/ratelib"
+)
+
+// Define constants
+const (
+	// Errors
+	ErrTooManyRequests = "Too many requests"
+
+	// Headers
+	HeaderRetryAfter				= "Retry-After"
+	HeaderRateLimitLimit			= "RateLimit-Limit"
+	HeaderRateLimitRemaining	= "RateLimit-Remaining"
+	HeaderRateLimitReset			= "RateLimit-Reset"
+)
+
+// KeyFunc returns the key a request is counted under, reporting false when the request has none
+type KeyFunc func(c *gin.Context) (string, bool)
+
+// Limit is a middleware that counts the requests of a route under the first key found and refuses them past the limit.
+// Keys read from the auth or client context need the middleware to run after Authorize or Authenticate.
+func Limit(limiter ratelib.Limiter, keys ...KeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Find the key of the request
+		key, ok := "", false
+		for _, keyFunc := range keys {
+			if key, ok = keyFunc(c); ok {
+				break
+			}
+		}
+		if !ok {
+			c.Next()
+			return
+		}
+
+		// Count the request
+		res, err := limiter.Allow(key)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, validHttp.ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Describe the limit
+		c.Header(HeaderRateLimitLimit, strconv.Itoa(res.Limit))
+		c.Header(HeaderRateLimitRemaining, strconv.Itoa(res.Remaining))
+		c.Header(HeaderRateLimitReset, strconv.Itoa(seconds(time.Until(res.ResetAt))))
+		if !res.Allowed {
+			c.Header(HeaderRetryAfter, strconv.Itoa(seconds(res.RetryAfter)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, validHttp.ErrorResponse{Error: ErrTooManyRequests})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ByIP counts requests per client address
+func ByIP(c *gin.Context) (string, bool) {
+	return "ip:" + c.ClientIP(), true
+}
+
+// ByUser counts requests per authenticated user
+func ByUser(c *gin.Context) (string, bool) {
+	authCtx := authContext(c)
+	if authCtx == nil || authCtx.UserID == 0 {
+		return "", false
+	}
+	return "user:" + strconv.FormatUint(uint64(authCtx.UserID), 10), true
+}
+
+// ByAPIKey counts requests per API key
+func ByAPIKey(c *gin.Context) (string, bool) {
+	authCtx := authContext(c)
+	if authCtx == nil || authCtx.APIKeyID == 0 {
+		return "", false
+	}
+	return "api_key:" + strconv.FormatUint(uint64(authCtx.APIKeyID), 10), true
+}
+
+// ByClient counts requests per OAuth client, authenticated with its credentials or holding a token
+func ByClient(c *gin.Context) (string, bool) {
+	if v, ok := c.Get("client"); ok {
+		if clientCtx, ok := v.(*mwclient.ClientContext); ok && clientCtx.ClientID != "" {
+			return "client:" + clientCtx.ClientID, true
+		}
+	}
+	authCtx := authContext(c)
+	if authCtx == nil || authCtx.ClientID == "" {
+		return "", false
+	}
+	return "client:" + authCtx.ClientID, true
+}
+
+// authContext returns the auth context of the request, if any
+func authContext(c *gin.Context) *mwauth.AuthContext {
+	v, ok := c.Get("auth")
+	if !ok {
+		return nil
+	}
+	authCtx, _ := v.(*mwauth.AuthContext)
+	return authCtx
+}
+
+// seconds rounds a duration up to whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -16,8 +17,11 @@ type Config struct {
 	AppSecret	string
 	AppDebug   	bool
 	AppPort    	int
+	AppAdminEmail	string
+	AppIssuer		string
 
 	GinMode		string
+	TrustedProxies	[]string
 
 	DBHost     string
 	DBPort     int
@@ -27,6 +31,68 @@ type Config struct {
 
 	TokenExpAccess 	float32
 	TokenExpRefresh 	float32
+	TokenSigningAlg	string
+	TokenKeyRotation	float32
+	TokenRefreshGrace	float32
+
+	FederationProviders	map[string]FederationProvider
+
+	WebAuthnRPID		string
+	WebAuthnOrigins	[]string
+
+	MailDriver		string
+	MailFrom			string
+	MailDir			string
+	SMTPHost			string
+	SMTPPort			string
+	SMTPUser			string
+	SMTPPassword	string
+
+	PasswordResetURL	string
+	MagicLinkURL		string
+
+	RateLimitDriver	string
+	RateLimitAuth				int
+	RateLimitAPI				int
+	RateLimitAPIIP				int
+	RateLimitOAuth				int
+	RateLimitPasswordIP		int
+	RateLimitPasswordEmail	int
+	RateLimitMagicLinkIP		int
+	RateLimitMagicLinkEmail	int
+
+	PasswordMinLength			int
+	PasswordMinClasses		int
+	PasswordBreachCorpus		string
+	PasswordHashAlgorithm	string
+	PasswordArgon2Memory		int
+	PasswordArgon2Time		int
+	PasswordArgon2Threads	int
+	PasswordBcryptCost		int
+	PasswordHashConcurrency	int
+
+	AuditLogFile	string
+
+	DPoPReplayDriver		string
+	DPoPRequiredRoutes	[]string
+
+	TLSCertFile			string
+	TLSKeyFile			string
+	MTLSClientAuth		string
+	MTLSClientCA		string
+	MTLSBindTokens		bool
+
+	TokenTransport		string
+	CookieSameSite		string
+	CookieDomain		string
+}
+
+// FederationProvider configures an upstream OpenID Connect provider users can sign in with
+type FederationProvider struct {
+	Issuer			string
+	ClientID			string
+	ClientSecret	string
+	Scopes			[]string
 }
 
 // Variable to store the default config, can be imported and used in other packages
@@ -50,7 +116,10 @@ func Load() (error) {
 		AppSecret:        os.Getenv("APP_SECRET"),
 		AppDebug:         os.Getenv("APP_DEBUG") == "true",
 		AppPort:          strToInt(os.Getenv("APP_PORT")),
+		AppAdminEmail:    os.Getenv("APP_ADMIN_EMAIL"),
+		AppIssuer:        os.Getenv("APP_ISSUER"),
 		GinMode:				os.Getenv("GIN_MODE"),
+		TrustedProxies:		strings.Fields(strings.ReplaceAll(os.Getenv("TRUSTED_PROXIES"), ",", " ")),
 
 		DBHost:           os.Getenv("DB_HOST"),
 		DBPort:           strToInt(os.Getenv("DB_PORT")),
@@ -60,6 +129,60 @@ func Load() (error) {
 
 		TokenExpAccess:  strToFloat32(os.Getenv("TOKEN_EXP_ACCESS")),
 		TokenExpRefresh: strToFloat32(os.Getenv("TOKEN_EXP_REFRESH")),
+		TokenSigningAlg: strOr(os.Getenv("TOKEN_SIGNING_ALG"), "RS256"),
+		TokenKeyRotation: strToFloat32Or(os.Getenv("TOKEN_KEY_ROTATION"), 720),
+		TokenRefreshGrace: strToFloat32Or(os.Getenv("TOKEN_REFRESH_GRACE"), 10),
+
+		FederationProviders: federationProviders(os.Getenv("FEDERATION_PROVIDERS")),
+
+		WebAuthnRPID:		os.Getenv("WEBAUTHN_RP_ID"),
+		WebAuthnOrigins:	strings.Fields(strings.ReplaceAll(os.Getenv("WEBAUTHN_ORIGINS"), ",", " ")),
+
+		MailDriver:		os.Getenv("MAIL_DRIVER"),
+		MailFrom:		os.Getenv("MAIL_FROM"),
+		MailDir:			os.Getenv("MAIL_DIR"),
+		SMTPHost:		os.Getenv("SMTP_HOST"),
+		SMTPPort:		os.Getenv("SMTP_PORT"),
+		SMTPUser:		os.Getenv("SMTP_USER"),
+		SMTPPassword:	os.Getenv("SMTP_PASSWORD"),
+
+		PasswordResetURL:	os.Getenv("PASSWORD_RESET_URL"),
+		MagicLinkURL:		os.Getenv("MAGIC_LINK_URL"),
+
+		RateLimitDriver:	os.Getenv("RATE_LIMIT_DRIVER"),
+		RateLimitAuth:					strToIntOr(os.Getenv("RATE_LIMIT_AUTH"), 60),
+		RateLimitAPI:					strToIntOr(os.Getenv("RATE_LIMIT_API"), 600),
+		RateLimitAPIIP:				strToIntOr(os.Getenv("RATE_LIMIT_API_IP"), 1200),
+		RateLimitOAuth:				strToIntOr(os.Getenv("RATE_LIMIT_OAUTH"), 600),
+		RateLimitPasswordIP:			strToIntOr(os.Getenv("RATE_LIMIT_PASSWORD_IP"), 20),
+		RateLimitPasswordEmail:		strToIntOr(os.Getenv("RATE_LIMIT_PASSWORD_EMAIL"), 3),
+		RateLimitMagicLinkIP:		strToIntOr(os.Getenv("RATE_LIMIT_MAGIC_LINK_IP"), 20),
+		RateLimitMagicLinkEmail:	strToIntOr(os.Getenv("RATE_LIMIT_MAGIC_LINK_EMAIL"), 5),
+
+		PasswordMinLength:		strToIntOr(os.Getenv("PASSWORD_MIN_LENGTH"), 0),
+		PasswordMinClasses:		strToIntOr(os.Getenv("PASSWORD_MIN_CLASSES"), 0),
+		PasswordBreachCorpus:	os.Getenv("PASSWORD_BREACH_CORPUS"),
+		PasswordHashAlgorithm:	os.Getenv("PASSWORD_HASH_ALGORITHM"),
+		PasswordArgon2Memory:	strToIntOr(os.Getenv("PASSWORD_ARGON2_MEMORY"), 0),
+		PasswordArgon2Time:		strToIntOr(os.Getenv("PASSWORD_ARGON2_TIME"), 0),
+		PasswordArgon2Threads:	strToIntOr(os.Getenv("PASSWORD_ARGON2_THREADS"), 0),
+		PasswordBcryptCost:		strToIntOr(os.Getenv("PASSWORD_BCRYPT_COST"), 0),
+		PasswordHashConcurrency:	strToIntOr(os.Getenv("PASSWORD_HASH_CONCURRENCY"), 0),
+
+		AuditLogFile:	os.Getenv("AUDIT_LOG_FILE"),
+
+		DPoPReplayDriver:		os.Getenv("DPOP_REPLAY_DRIVER"),
+		DPoPRequiredRoutes:	strings.Fields(strings.ReplaceAll(os.Getenv("DPOP_REQUIRED_ROUTES"), ",", " ")),
+
+		TLSCertFile:		os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:			os.Getenv("TLS_KEY_FILE"),
+		MTLSClientAuth:	os.Getenv("MTLS_CLIENT_AUTH"),
+		MTLSClientCA:		os.Getenv("MTLS_CLIENT_CA"),
+		MTLSBindTokens:	os.Getenv("MTLS_BIND_TOKENS") == "true",
+
+		TokenTransport:	os.Getenv("TOKEN_TRANSPORT"),
+		CookieSameSite:	os.Getenv("COOKIE_SAME_SITE"),
+		CookieDomain:		os.Getenv("COOKIE_DOMAIN"),
   	}
 
 	// Set the app mode
@@ -71,6 +194,40 @@ func Load() (error) {
 	return nil
 }
 
+// federationProviders reads the configuration of each listed provider from FEDERATION_<NAME>_* variables
+func federationProviders(names string) (map[string]FederationProvider) {
+	providers := make(map[string]FederationProvider)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "FEDERATION_" + strings.ToUpper(name) + "_"
+		scopes := strings.Fields(os.Getenv(prefix + "SCOPES"))
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		providers[strings.ToLower(name)] = FederationProvider{
+			Issuer:			os.Getenv(prefix + "ISSUER"),
+			ClientID:		os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret:	os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:			scopes,
+		}
+	}
+
+	return providers
+}
+
+// strOr returns the default when the variable is unset
+func strOr(str string, def string) (string) {
+	if str == "" {
+		return def
+	}
+
+	return str
+}
+
 func strToInt(str string) (int) {
 	n, err := strconv.ParseInt(str, 10, 0)
 	if err != nil {
@@ -80,6 +237,15 @@ func strToInt(str string) (int) {
 	return int(n)
 }
 
+// strToIntOr is strToInt for optional variables, returning the default when the variable is unset
+func strToIntOr(str string, def int) (int) {
+	if str == "" {
+		return def
+	}
+
+	return strToInt(str)
+}
+
 func strToFloat32(str string) (float32) {
 	n, err := strconv.ParseFloat(str, 32)
 	if err != nil {
@@ -87,4 +253,13 @@ func strToFloat32(str string) (float32) {
 	}
 
 	return float32(n)
-}
\ No newline at end of file
+}
+
+// strToFloat32Or is strToFloat32 for optional variables, returning the default when the variable is unset
+func strToFloat32Or(str string, def float32) (float32) {
+	if str == "" {
+		return def
+	}
+
+	return strToFloat32(str)
+}
@@ -0,0 +1,106 @@
+package cookielib
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// File implements the cookies holding the tokens of browser sessions
+
+// Define constants
+const (
+	// Ways the tokens are handed to the client
+	TransportHeader	= "header"
+	TransportCookie	= "cookie"
+
+	// Cookies of a browser session
+	CookieAccessToken		= "access_token"
+	CookieRefreshToken	= "refresh_token"
+	CookieCSRF				= "csrf_token"
+
+	// Paths the cookies are sent to, the refresh token only goes to the refresh endpoint
+	PathSession	= "/"
+	PathRefresh	= "/auth/refresh-access"
+)
+
+// Define errors
+var (
+	ErrUnknownTransport	= errors.New("unknown token transport")
+	ErrInsecureIssuer		= errors.New("cookie transport requires an https issuer")
+)
+
+// CheckConfig refuses a token transport the gateway cannot serve safely
+// Tokens in cookies need https, browsers only treat localhost as secure without it
+func CheckConfig(config *cfglib.Config) error {
+	switch config.TokenTransport {
+	case "", TransportHeader:
+		return nil
+	case TransportCookie:
+	default:
+		return ErrUnknownTransport
+	}
+
+	u, err := url.Parse(config.AppIssuer)
+	if err != nil {
+		return ErrInsecureIssuer
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && u.Hostname() == "localhost") {
+		return ErrInsecureIssuer
+	}
+
+	return nil
+}
+
+// TokensInCookies reports whether the tokens of browser sessions are carried in cookies instead of headers
+func TokensInCookies() bool {
+	return cfglib.DefaultConf.TokenTransport == TransportCookie
+}
+
+// Set sets a cookie expiring at the given time
+// Cookies are always Secure, and use the configured SameSite mode and domain
+func Set(c *gin.Context, name string, value string, expiresAt time.Time, path string, httpOnly bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:			name,
+		Value:		value,
+		Path:			path,
+		Domain:		cfglib.DefaultConf.CookieDomain,
+		Expires:		expiresAt,
+		MaxAge:		int(time.Until(expiresAt).Seconds()),
+		Secure:		true,
+		HttpOnly:	httpOnly,
+		SameSite:	sameSite(),
+	})
+}
+
+// Clear removes a cookie, the path must be the one it was set with
+func Clear(c *gin.Context, name string, path string, httpOnly bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:			name,
+		Value:		"",
+		Path:			path,
+		Domain:		cfglib.DefaultConf.CookieDomain,
+		MaxAge:		-1,
+		Secure:		true,
+		HttpOnly:	httpOnly,
+		SameSite:	sameSite(),
+	})
+}
+
+// sameSite returns the configured SameSite mode, strict by default
+func sameSite() http.SameSite {
+	switch strings.ToLower(cfglib.DefaultConf.CookieSameSite) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+
+	return http.SameSiteStrictMode
+}
@@ -0,0 +1,188 @@
+package dpoplib
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/selatoz/gateway/pkg/jwklib"
+)
+
+// File implements the verification of DPoP proofs (RFC 9449), binding tokens to a key held by the client
+
+// Define constants
+const (
+	// Type of a proof JWT
+	ProofType = "dpop+jwt"
+
+	// Age after which a proof is refused, and tolerated skew for proofs issued in the future
+	ProofLifetime	= 5 * time.Minute
+	ClockSkew		= time.Minute
+
+	// Smallest RSA key accepted
+	MinRSABits = 2048
+)
+
+// SigningAlgs lists the algorithms proofs can be signed with
+var SigningAlgs = []string{"ES256", "RS256", "PS256", "EdDSA"}
+
+// Define errors
+var (
+	ErrProofInvalid	= errors.New("invalid DPoP proof")
+	ErrProofExpired	= errors.New("DPoP proof expired")
+	ErrProofReplayed	= errors.New("DPoP proof replayed")
+	ErrProofMismatch	= errors.New("DPoP proof does not match the request")
+)
+
+// Proof holds the validated claims of a proof
+type Proof struct {
+	JKT			string
+	JTI			string
+	IssuedAt		time.Time
+}
+
+// Verifier checks proofs and remembers their ids, so a proof is only accepted once
+type Verifier struct {
+	replay		ReplayCache
+}
+
+// NewVerifier returns a verifier storing the used proofs in the cache
+func NewVerifier(replay ReplayCache) *Verifier {
+	return &Verifier{replay: replay}
+}
+
+// Verify checks a proof sent with a request to the given method and URL, and returns it
+// The access token is given when the proof is sent to a resource, its hash must then be in the ath claim
+func (v *Verifier) Verify(proof string, method string, uri string, accessToken string) (*Proof, error) {
+	// Check the signature with the key embedded in the header
+	var key jwklib.JWK
+	parser := &jwt.Parser{ValidMethods: SigningAlgs, SkipClaimsValidation: true}
+	jt, err := parser.Parse(proof, func(jt *jwt.Token) (interface{}, error) {
+		if typ, _ := jt.Header["typ"].(string); typ != ProofType {
+			return nil, ErrProofInvalid
+		}
+
+		k, err := headerKey(jt.Header["jwk"])
+		if err != nil {
+			return nil, err
+		}
+		key = k
+		return key.PublicKey()
+	})
+	if err != nil || !jt.Valid {
+		return nil, ErrProofInvalid
+	}
+	claims, ok := jt.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrProofInvalid
+	}
+
+	// Read the claims
+	htm, _ := claims["htm"].(string)
+	htu, _ := claims["htu"].(string)
+	jti, _ := claims["jti"].(string)
+	iat, ok := claims["iat"].(float64)
+	if htm == "" || htu == "" || jti == "" || !ok {
+		return nil, ErrProofInvalid
+	}
+
+	// Ensure the proof was made for this request
+	target := normalizeURL(uri)
+	if htm != method || target == "" || normalizeURL(htu) != target {
+		return nil, ErrProofMismatch
+	}
+	if accessToken != "" {
+		ath, _ := claims["ath"].(string)
+		if subtle.ConstantTimeCompare([]byte(ath), []byte(TokenHash(accessToken))) != 1 {
+			return nil, ErrProofMismatch
+		}
+	}
+
+	// Refuse stale proofs, then proofs already used within their lifetime
+	now := time.Now()
+	issuedAt := time.Unix(int64(iat), 0)
+	if issuedAt.Before(now.Add(-ProofLifetime)) || issuedAt.After(now.Add(ClockSkew)) {
+		return nil, ErrProofExpired
+	}
+	jkt, err := key.Thumbprint()
+	if err != nil {
+		return nil, ErrProofInvalid
+	}
+	fresh, err := v.replay.Use(replayKey(jkt, jti), issuedAt.Add(ProofLifetime + ClockSkew))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrProofReplayed
+	}
+
+	return &Proof{JKT: jkt, JTI: jti, IssuedAt: issuedAt}, nil
+}
+
+// Refused reports whether the error refuses the proof, other errors come from the replay cache
+func Refused(err error) bool {
+	return err == ErrProofInvalid || err == ErrProofExpired || err == ErrProofReplayed || err == ErrProofMismatch
+}
+
+// TokenHash returns the hash of an access token as carried in the ath claim
+func TokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// headerKey reads the public key of the jwk header, keys holding private members are refused
+func headerKey(v interface{}) (jwklib.JWK, error) {
+	members, ok := v.(map[string]interface{})
+	if !ok {
+		return jwklib.JWK{}, ErrProofInvalid
+	}
+	for _, private := range []string{"d", "p", "q", "dp", "dq", "qi", "k"} {
+		if _, ok := members[private]; ok {
+			return jwklib.JWK{}, ErrProofInvalid
+		}
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		return jwklib.JWK{}, ErrProofInvalid
+	}
+	var key jwklib.JWK
+	if err := json.Unmarshal(b, &key); err != nil {
+		return jwklib.JWK{}, ErrProofInvalid
+	}
+
+	pub, err := key.PublicKey()
+	if err != nil {
+		return jwklib.JWK{}, ErrProofInvalid
+	}
+	if rsaKey, ok := pub.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < MinRSABits {
+		return jwklib.JWK{}, ErrProofInvalid
+	}
+
+	return key, nil
+}
+
+// normalizeURL drops the query and the fragment of the URL, the scheme and the host are compared case insensitively
+func normalizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+}
+
+// replayKey identifies a proof, ids are only unique per key
+func replayKey(jkt string, jti string) string {
+	sum := sha256.Sum256([]byte(jkt + ":" + jti))
+	return hex.EncodeToString(sum[:])
+}
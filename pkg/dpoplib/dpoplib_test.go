@@ -0,0 +1,183 @@
+package dpoplib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/selatoz/gateway/pkg/jwklib"
+)
+
+const (
+	testMethod	= "POST"
+	testURI		= "https://gateway.example/oauth/token"
+	testToken	= "access-token"
+)
+
+// headerJWK returns the public key as a jwk header member
+func headerJWK(t *testing.T, pub crypto.PublicKey) map[string]interface{} {
+	key, err := jwklib.FromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(key)
+	members := map[string]interface{}{}
+	json.Unmarshal(b, &members)
+
+	return members
+}
+
+// proofClaims returns the claims of a proof for the test request, changed by edit
+func proofClaims(jti string, edit func(jwt.MapClaims)) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"htm": testMethod,
+		"htu": testURI,
+		"jti": jti,
+		"iat": time.Now().Unix(),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+
+	return claims
+}
+
+// signProof signs the claims with the key, jwk and typ go in the header
+func signProof(t *testing.T, method jwt.SigningMethod, key interface{}, jwk interface{}, typ string, claims jwt.MapClaims) string {
+	jt := jwt.NewWithClaims(method, claims)
+	jt.Header["typ"] = typ
+	if jwk != nil {
+		jt.Header["jwk"] = jwk
+	}
+	proof, err := jt.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return proof
+}
+
+func TestVerify(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	smallRSA, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecJWK := headerJWK(t, &ecKey.PublicKey)
+
+	// es256 returns a proof signed with the embedded EC key
+	es256 := func(edit func(jwt.MapClaims)) string {
+		return signProof(t, jwt.SigningMethodES256, ecKey, ecJWK, ProofType, proofClaims("proof-1", edit))
+	}
+
+	cases := []struct {
+		name			string
+		proof		string
+		uri			string
+		token		string
+		err			error
+	}{
+		{"valid", es256(nil), testURI, "", nil},
+		{"valid EdDSA", signProof(t, jwklib.EdDSA, edKey, headerJWK(t, edPub), ProofType, proofClaims("proof-1", nil)), testURI, "", nil},
+		{"query and case of the host ignored", es256(nil), "https://Gateway.Example/oauth/token?x=1", "", nil},
+		{"bound to the access token", es256(func(c jwt.MapClaims) { c["ath"] = TokenHash(testToken) }), testURI, testToken, nil},
+		{"other typ", signProof(t, jwt.SigningMethodES256, ecKey, ecJWK, "JWT", proofClaims("proof-1", nil)), testURI, "", ErrProofInvalid},
+		{"no jwk", signProof(t, jwt.SigningMethodES256, ecKey, nil, ProofType, proofClaims("proof-1", nil)), testURI, "", ErrProofInvalid},
+		{"private jwk", signProof(t, jwt.SigningMethodES256, ecKey, map[string]interface{}{"kty": "EC", "crv": "P-256", "x": ecJWK["x"], "y": ecJWK["y"], "d": "secret"}, ProofType, proofClaims("proof-1", nil)), testURI, "", ErrProofInvalid},
+		{"signed by another key", signProof(t, jwt.SigningMethodES256, otherKey, ecJWK, ProofType, proofClaims("proof-1", nil)), testURI, "", ErrProofInvalid},
+		{"symmetric algorithm", signProof(t, jwt.SigningMethodHS256, []byte("secret"), ecJWK, ProofType, proofClaims("proof-1", nil)), testURI, "", ErrProofInvalid},
+		{"small RSA key", signProof(t, jwt.SigningMethodRS256, smallRSA, headerJWK(t, &smallRSA.PublicKey), ProofType, proofClaims("proof-1", nil)), testURI, "", ErrProofInvalid},
+		{"no jti", es256(func(c jwt.MapClaims) { delete(c, "jti") }), testURI, "", ErrProofInvalid},
+		{"no iat", es256(func(c jwt.MapClaims) { delete(c, "iat") }), testURI, "", ErrProofInvalid},
+		{"other method", es256(func(c jwt.MapClaims) { c["htm"] = "GET" }), testURI, "", ErrProofMismatch},
+		{"other path", es256(nil), "https://gateway.example/oauth/revoke", "", ErrProofMismatch},
+		{"other host", es256(nil), "https://evil.example/oauth/token", "", ErrProofMismatch},
+		{"no ath", es256(nil), testURI, testToken, ErrProofMismatch},
+		{"ath of another token", es256(func(c jwt.MapClaims) { c["ath"] = TokenHash("other-token") }), testURI, testToken, ErrProofMismatch},
+		{"stale", es256(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-ProofLifetime - time.Second).Unix() }), testURI, "", ErrProofExpired},
+		{"within the skew", es256(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(ClockSkew / 2).Unix() }), testURI, "", nil},
+		{"from the future", es256(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(ClockSkew + time.Minute).Unix() }), testURI, "", ErrProofExpired},
+	}
+	for _, tc := range cases {
+		proof, err := NewVerifier(NewMemoryReplayCache()).Verify(tc.proof, testMethod, tc.uri, tc.token)
+		if err != tc.err {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+			continue
+		}
+		if err != nil {
+			if !Refused(err) {
+				t.Errorf("%s: error not reported as a refusal", tc.name)
+			}
+			continue
+		}
+		if proof.JTI != "proof-1" || proof.JKT == "" {
+			t.Errorf("%s: unexpected proof %+v", tc.name, proof)
+		}
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	proof := func(key *ecdsa.PrivateKey, jti string) string {
+		return signProof(t, jwt.SigningMethodES256, key, headerJWK(t, &key.PublicKey), ProofType, proofClaims(jti, nil))
+	}
+	v := NewVerifier(NewMemoryReplayCache())
+
+	first := proof(key, "proof-1")
+	if _, err := v.Verify(first, testMethod, testURI, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same proof is refused the second time
+	if _, err := v.Verify(first, testMethod, testURI, ""); err != ErrProofReplayed {
+		t.Fatalf("expected %v, got %v", ErrProofReplayed, err)
+	}
+
+	// So is another proof reusing the id with the same key
+	if _, err := v.Verify(proof(key, "proof-1"), testMethod, testURI, ""); err != ErrProofReplayed {
+		t.Fatalf("expected %v, got %v", ErrProofReplayed, err)
+	}
+
+	// Ids are only unique per key
+	if _, err := v.Verify(proof(otherKey, "proof-1"), testMethod, testURI, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(proof(key, "proof-2"), testMethod, testURI, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryReplayCacheExpiry(t *testing.T) {
+	r := NewMemoryReplayCache().(*memoryReplayCache)
+	now := time.Now()
+
+	if fresh, _ := r.Use("a", now.Add(time.Minute)); !fresh {
+		t.Fatal("first use refused")
+	}
+	if fresh, _ := r.Use("a", now.Add(time.Minute)); fresh {
+		t.Fatal("second use accepted")
+	}
+
+	// An expired record no longer blocks the key, and is swept once a lifetime passed
+	r.used["b"] = now.Add(-time.Second)
+	if fresh, _ := r.Use("b", now.Add(time.Minute)); !fresh {
+		t.Fatal("use after expiry refused")
+	}
+	r.used["c"] = now.Add(-time.Second)
+	r.lastSweep = now.Add(-ProofLifetime)
+	r.Use("d", now.Add(time.Minute))
+	if _, ok := r.used["c"]; ok {
+		t.Fatal("expired record kept")
+	}
+	if _, ok := r.used["a"]; !ok {
+		t.Fatal("live record swept")
+	}
+}
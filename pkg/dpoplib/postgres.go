@@ -0,0 +1,60 @@
+package dpoplib
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// This defines a UsedProof struct that records a DPoP proof until it expires
+type UsedProof struct {
+	Key				string		`gorm:"primaryKey"`
+	ExpiresAt		time.Time	`gorm:"index"`
+}
+
+// postgresReplayCache holds the used proofs in the database, they are shared between replicas
+type postgresReplayCache struct {
+	db				*gorm.DB
+
+	mu				sync.Mutex
+	lastSweep	time.Time
+}
+
+// NewPostgresReplayCache returns a cache holding the used proofs in the database
+func NewPostgresReplayCache(db *gorm.DB) ReplayCache {
+	return &postgresReplayCache{
+		db: db,
+		lastSweep: time.Now(),
+	}
+}
+
+func (r *postgresReplayCache) Use(key string, expiresAt time.Time) (bool, error) {
+	now := time.Now().UTC()
+	if err := r.sweep(now); err != nil {
+		return false, err
+	}
+
+	// Record the proof unless a live record exists, in a single statement so replicas cannot both accept it
+	tx := r.db.Exec(`INSERT INTO used_proofs (key, expires_at) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE used_proofs.expires_at <= ?`, key, expiresAt.UTC(), now)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+
+	return tx.RowsAffected == 1, nil
+}
+
+// sweep deletes the expired proofs, at most once per proof lifetime
+func (r *postgresReplayCache) sweep(now time.Time) error {
+	r.mu.Lock()
+	if now.Sub(r.lastSweep) < ProofLifetime {
+		r.mu.Unlock()
+		return nil
+	}
+	r.lastSweep = now
+	r.mu.Unlock()
+
+	return r.db.Where("expires_at <= ?", now).Delete(&UsedProof{}).Error
+}
@@ -0,0 +1,86 @@
+package dpoplib
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// Define constants
+const (
+	// Backends storing the used proofs
+	DriverMemory	= "memory"
+	DriverPostgres	= "postgres"
+)
+
+// Define errors
+var (
+	ErrUnknownDriver = errors.New("unknown DPoP replay driver")
+)
+
+// ReplayCache remembers the proofs used until they expire
+type ReplayCache interface {
+	// Use records the proof and reports whether it was not used before
+	Use(key string, expiresAt time.Time) (bool, error)
+}
+
+// NewReplayCache returns the cache selected by the configuration
+// The memory cache only knows the proofs sent to its replica, the postgres one shares them
+func NewReplayCache(config *cfglib.Config, db *gorm.DB) (ReplayCache, error) {
+	switch config.DPoPReplayDriver {
+	case DriverMemory, "":
+		return NewMemoryReplayCache(), nil
+	case DriverPostgres:
+		return NewPostgresReplayCache(db), nil
+	}
+
+	return nil, ErrUnknownDriver
+}
+
+// memoryReplayCache holds the used proofs in memory
+type memoryReplayCache struct {
+	mu				sync.Mutex
+	used			map[string]time.Time
+	lastSweep	time.Time
+}
+
+// NewMemoryReplayCache returns a cache holding the used proofs in memory
+func NewMemoryReplayCache() ReplayCache {
+	return &memoryReplayCache{
+		used: make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (r *memoryReplayCache) Use(key string, expiresAt time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweep(now)
+
+	if exp, ok := r.used[key]; ok && now.Before(exp) {
+		return false, nil
+	}
+
+	r.used[key] = expiresAt
+	return true, nil
+}
+
+// sweep drops the expired proofs, at most once per proof lifetime
+func (r *memoryReplayCache) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < ProofLifetime {
+		return
+	}
+	r.lastSweep = now
+
+	for key, exp := range r.used {
+		if !now.Before(exp) {
+			delete(r.used, key)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package maillib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// File implements the outgoing mail, sent over SMTP or written to files or the log for development and tests
+
+// Define constants
+const (
+	DriverSMTP	= "smtp"
+	DriverFile	= "file"
+	DriverLog	= "log"
+)
+
+// Define errors
+var (
+	ErrUnknownDriver		= errors.New("unknown mail driver")
+	ErrDriverRequired		= errors.New("mail driver required")
+	ErrInvalidRecipient	= errors.New("invalid recipient")
+)
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+var (
+	textTemplates = texttemplate.Must(texttemplate.ParseFS(templateFS, "templates/*.tmpl"))
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/*.tmpl"))
+)
+
+// Message is an email with a plain text body and an optional HTML alternative
+type Message struct {
+	To				string
+	Subject		string
+	Text			string
+	HTML			string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// NewMailer returns the mailer selected by the configuration
+// The driver must be set, the log driver prints the links and codes so it is only used when asked for
+func NewMailer(config *cfglib.Config) (Mailer, error) {
+	switch config.MailDriver {
+	case "":
+		return nil, ErrDriverRequired
+	case DriverSMTP:
+		return &smtpMailer{
+			addr:			net.JoinHostPort(config.SMTPHost, config.SMTPPort),
+			host:			config.SMTPHost,
+			user:			config.SMTPUser,
+			password:	config.SMTPPassword,
+			from:			config.MailFrom,
+		}, nil
+	case DriverFile:
+		if err := os.MkdirAll(config.MailDir, 0700); err != nil {
+			return nil, err
+		}
+		return &fileMailer{dir: config.MailDir, from: config.MailFrom}, nil
+	case DriverLog:
+		return &logMailer{}, nil
+	}
+
+	return nil, ErrUnknownDriver
+}
+
+// Render builds a message from a template of the templates directory
+// Each template defines a "subject", a "text" and an "html" block
+func Render(name string, to string, data interface{}) (*Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := textTemplates.ExecuteTemplate(&subject, name+".subject", data); err != nil {
+		return nil, err
+	}
+	if err := textTemplates.ExecuteTemplate(&text, name+".text", data); err != nil {
+		return nil, err
+	}
+	if err := htmlTemplates.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		To:			to,
+		Subject:		strings.TrimSpace(subject.String()),
+		Text:			text.String(),
+		HTML:			html.String(),
+	}, nil
+}
+
+// smtpMailer sends messages through an SMTP server, using STARTTLS when the server offers it
+type smtpMailer struct {
+	addr			string
+	host			string
+	user			string
+	password		string
+	from			string
+}
+
+func (m *smtpMailer) Send(msg *Message) error {
+	data, err := encode(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.user != "" {
+		auth = smtp.PlainAuth("", m.user, m.password, m.host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{msg.To}, data)
+}
+
+// fileMailer writes each message to an .eml file of the directory
+type fileMailer struct {
+	dir		string
+	from		string
+}
+
+func (m *fileMailer) Send(msg *Message) error {
+	data, err := encode(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), randomHex(4))
+	return os.WriteFile(filepath.Join(m.dir, name), data, 0600)
+}
+
+// logMailer writes the plain text of each message to the log
+type logMailer struct {}
+
+func (m *logMailer) Send(msg *Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return ErrInvalidRecipient
+	}
+
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
+
+// encode builds the MIME message, with a multipart alternative when there is an HTML body
+func encode(from string, msg *Message) ([]byte, error) {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		return nil, ErrInvalidRecipient
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&b, msg.Text)
+		return b.Bytes(), nil
+	}
+
+	boundary := randomHex(16)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{{"text/plain", msg.Text}, {"text/html", msg.HTML}} {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		writeQuotedPrintable(&b, part.body)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+	return b.Bytes(), nil
+}
+
+func writeQuotedPrintable(b *bytes.Buffer, body string) {
+	w := quotedprintable.NewWriter(b)
+	w.Write([]byte(body))
+	w.Close()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
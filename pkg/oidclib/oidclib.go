@@ -0,0 +1,284 @@
+package oidclib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/selatoz/gateway/pkg/jwklib"
+)
+
+// File implements the relying party side of OpenID Connect, used to sign in through upstream providers
+
+// Define errors
+var (
+	ErrDiscovery		= errors.New("oidc discovery failed")
+	ErrExchange			= errors.New("oidc code exchange failed")
+	ErrIDTokenInvalid	= errors.New("oidc id_token invalid")
+	ErrKeyNotFound		= errors.New("oidc signing key not found")
+)
+
+// Algorithms accepted for the id_tokens of upstream providers
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "EdDSA"}
+
+// Metadata holds the fields of the discovery document used by the relying party
+type Metadata struct {
+	Issuer						string	`json:"issuer"`
+	AuthorizationEndpoint	string	`json:"authorization_endpoint"`
+	TokenEndpoint				string	`json:"token_endpoint"`
+	UserInfoEndpoint			string	`json:"userinfo_endpoint"`
+	JWKSURI						string	`json:"jwks_uri"`
+}
+
+// Tokens holds the response of the token endpoint
+type Tokens struct {
+	AccessToken		string	`json:"access_token"`
+	TokenType		string	`json:"token_type"`
+	IDToken			string	`json:"id_token"`
+}
+
+// Identity holds the claims describing the authenticated user
+type Identity struct {
+	Subject			string
+	Email				string
+	EmailVerified	bool
+}
+
+// Provider is an upstream OpenID Connect provider
+type Provider struct {
+	Metadata		Metadata
+	ClientID		string
+	Secret		string
+	client		*http.Client
+	mu				sync.Mutex
+	keys			map[string]jwklib.JWK
+}
+
+// Discover fetches the discovery document of the issuer, which must match the configured issuer
+func Discover(issuer string, clientID string, secret string) (*Provider, error) {
+	p := &Provider{
+		ClientID: clientID,
+		Secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys: make(map[string]jwklib.JWK),
+	}
+
+	issuer = strings.TrimSuffix(issuer, "/")
+	if err := p.getJSON(issuer+"/.well-known/openid-configuration", &p.Metadata); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDiscovery, err)
+	}
+	if strings.TrimSuffix(p.Metadata.Issuer, "/") != issuer || p.Metadata.AuthorizationEndpoint == "" || p.Metadata.TokenEndpoint == "" || p.Metadata.JWKSURI == "" {
+		return nil, ErrDiscovery
+	}
+
+	return p, nil
+}
+
+// AuthCodeURL returns the URL to send the user to, using PKCE with the S256 method
+func (p *Provider) AuthCodeURL(redirectURI string, scopes []string, state string, nonce string, codeChallenge string) string {
+	params := url.Values{
+		"response_type":				{"code"},
+		"client_id":					{p.ClientID},
+		"redirect_uri":				{redirectURI},
+		"scope":							{strings.Join(scopes, " ")},
+		"state":							{state},
+		"nonce":							{nonce},
+		"code_challenge":				{codeChallenge},
+		"code_challenge_method":	{"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.Metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.Metadata.AuthorizationEndpoint + sep + params.Encode()
+}
+
+// Exchange exchanges the authorization code at the token endpoint, authenticating with client_secret_basic
+func (p *Provider) Exchange(code string, redirectURI string, codeVerifier string) (*Tokens, error) {
+	form := url.Values{
+		"grant_type":		{"authorization_code"},
+		"code":				{code},
+		"redirect_uri":	{redirectURI},
+		"code_verifier":	{codeVerifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.Metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.Secret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrExchange, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrExchange, res.StatusCode)
+	}
+
+	var tokens Tokens
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrExchange, err)
+	}
+	if tokens.IDToken == "" {
+		return nil, ErrIDTokenInvalid
+	}
+
+	return &tokens, nil
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of an id_token
+func (p *Provider) VerifyIDToken(raw string, nonce string) (*Identity, error) {
+	parser := &jwt.Parser{ValidMethods: validMethods}
+	jt, err := parser.Parse(raw, p.keyFunc)
+	if err != nil || !jt.Valid {
+		return nil, ErrIDTokenInvalid
+	}
+	claims, ok := jt.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrIDTokenInvalid
+	}
+
+	// Validate the claims, expiry is required
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	tokenNonce, _ := claims["nonce"].(string)
+	if iss != p.Metadata.Issuer || sub == "" || tokenNonce != nonce || !hasAudience(claims["aud"], p.ClientID) {
+		return nil, ErrIDTokenInvalid
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, ErrIDTokenInvalid
+	}
+
+	return identity(claims), nil
+}
+
+// UserInfo returns the identity from the userinfo endpoint, whose subject must match
+func (p *Provider) UserInfo(accessToken string, subject string) (*Identity, error) {
+	if p.Metadata.UserInfoEndpoint == "" {
+		return nil, ErrDiscovery
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.Metadata.UserInfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo status %d", res.StatusCode)
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&claims); err != nil {
+		return nil, err
+	}
+	id := identity(claims)
+	if id.Subject != subject {
+		return nil, ErrIDTokenInvalid
+	}
+
+	return id, nil
+}
+
+// keyFunc resolves the verification key from the provider key set, refreshing it for unknown key ids
+func (p *Provider) keyFunc(jt *jwt.Token) (interface{}, error) {
+	kid, _ := jt.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	k, ok := p.keys[kid]
+	if !ok {
+		var set jwklib.JWKSet
+		if err := p.getJSON(p.Metadata.JWKSURI, &set); err != nil {
+			return nil, err
+		}
+		p.keys = make(map[string]jwklib.JWK, len(set.Keys))
+		for _, key := range set.Keys {
+			if key.Use == "" || key.Use == "sig" {
+				p.keys[key.Kid] = key
+			}
+		}
+
+		k, ok = p.keys[kid]
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+	}
+
+	// The key must be meant for the token algorithm
+	if k.Alg != "" && k.Alg != jt.Method.Alg() {
+		return nil, ErrKeyNotFound
+	}
+
+	return k.PublicKey()
+}
+
+// getJSON fetches and decodes a JSON document
+func (p *Provider) getJSON(uri string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d from %s", res.StatusCode, uri)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// identity reads the identity claims, email_verified may be a boolean or a string
+func identity(claims map[string]interface{}) *Identity {
+	id := &Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+
+	return id
+}
+
+// hasAudience reports whether the aud claim, a string or an array, holds the client id
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
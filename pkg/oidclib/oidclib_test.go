@@ -0,0 +1,185 @@
+package oidclib
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/selatoz/gateway/pkg/jwklib"
+)
+
+// Define constants
+const (
+	testClientID	= "gateway"
+	testSecret		= "secret"
+	testKid			= "test-key"
+	testNonce		= "nonce"
+)
+
+// fakeProvider is a local OpenID Connect provider signing id_tokens with a test key
+type fakeProvider struct {
+	server	*httptest.Server
+	key		*rsa.PrivateKey
+}
+
+// newFakeProvider starts the provider, serving discovery and its key set
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fakeProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:						fp.server.URL,
+			AuthorizationEndpoint:	fp.server.URL + "/authorize",
+			TokenEndpoint:				fp.server.URL + "/token",
+			UserInfoEndpoint:			fp.server.URL + "/userinfo",
+			JWKSURI:						fp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, err := jwklib.FromPublicKey(&fp.key.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jwk.Use = "sig"
+		jwk.Kid = testKid
+		jwk.Alg = "RS256"
+		json.NewEncoder(w).Encode(jwklib.JWKSet{Keys: []jwklib.JWK{jwk}})
+	})
+	fp.server = httptest.NewServer(mux)
+	t.Cleanup(fp.server.Close)
+
+	return fp
+}
+
+// claims returns valid id_token claims for the test client
+func (fp *fakeProvider) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":					fp.server.URL,
+		"sub":					"subject",
+		"aud":					testClientID,
+		"nonce":				testNonce,
+		"exp":					time.Now().Add(time.Minute).Unix(),
+		"email":				"user@example.com",
+		"email_verified":	true,
+	}
+}
+
+// sign signs the claims with the provider key
+func (fp *fakeProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	jt := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	jt.Header["kid"] = testKid
+	raw, err := jt.SignedString(fp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	fp := newFakeProvider(t)
+	p, err := Discover(fp.server.URL, testClientID, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handle valid token
+	id, err := p.VerifyIDToken(fp.sign(t, fp.claims()), testNonce)
+	if err != nil {
+		t.Fatalf("valid token refused: %v", err)
+	}
+	if id.Subject != "subject" || id.Email != "user@example.com" || !id.EmailVerified {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+
+	// Handle invalid claims
+	cases := map[string]func(jwt.MapClaims){
+		"wrong issuer":			func(c jwt.MapClaims) { c["iss"] = "https://attacker.example" },
+		"wrong audience":		func(c jwt.MapClaims) { c["aud"] = "another-client" },
+		"wrong nonce":			func(c jwt.MapClaims) { c["nonce"] = "replayed" },
+		"missing nonce":		func(c jwt.MapClaims) { delete(c, "nonce") },
+		"expired":				func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"missing expiry":		func(c jwt.MapClaims) { delete(c, "exp") },
+		"missing subject":		func(c jwt.MapClaims) { delete(c, "sub") },
+	}
+	for name, mutate := range cases {
+		claims := fp.claims()
+		mutate(claims)
+		if _, err := p.VerifyIDToken(fp.sign(t, claims), testNonce); err != ErrIDTokenInvalid {
+			t.Errorf("%s: expected ErrIDTokenInvalid, got %v", name, err)
+		}
+	}
+}
+
+func TestVerifyIDTokenAlgorithm(t *testing.T) {
+	fp := newFakeProvider(t)
+	p, err := Discover(fp.server.URL, testClientID, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handle HMAC signed with the client secret
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, fp.claims())
+	hs.Header["kid"] = testKid
+	raw, err := hs.SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(raw, testNonce); err == nil {
+		t.Error("HS256 token accepted")
+	}
+
+	// Handle unsigned token
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, fp.claims())
+	none.Header["kid"] = testKid
+	raw, err = none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(raw, testNonce); err == nil {
+		t.Error("unsigned token accepted")
+	}
+
+	// Handle algorithm not matching the key
+	ps := jwt.NewWithClaims(jwt.SigningMethodPS256, fp.claims())
+	ps.Header["kid"] = testKid
+	raw, err = ps.SignedString(fp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(raw, testNonce); err == nil {
+		t.Error("token with an algorithm other than the key accepted")
+	}
+
+	// Handle unknown key
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, fp.claims())
+	unknown.Header["kid"] = "unknown"
+	raw, err = unknown.SignedString(fp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.VerifyIDToken(raw, testNonce); err == nil {
+		t.Error("token signed with an unknown key accepted")
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	fp := newFakeProvider(t)
+
+	// The discovery document must be for the configured issuer
+	if _, err := Discover(fp.server.URL+"/other", testClientID, testSecret); err == nil {
+		t.Error("discovery accepted for another issuer")
+	}
+}
@@ -0,0 +1,173 @@
+package passwordlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File checks passwords against a local copy of the Have I Been Pwned corpus
+// Two layouts are read, both holding uppercase SHA-1 hashes with their count:
+// a directory of range files named after the 5 character hash prefix, with HASH_SUFFIX:COUNT lines,
+// or a single file of HASH:COUNT lines sorted by hash, searched without loading it
+
+// BreachChecker reports whether a password is known from data breaches
+type BreachChecker interface {
+	Breached(password string) (bool, error)
+}
+
+// NewBreachChecker returns the checker of the corpus at the path, a directory of range files or a sorted file
+func NewBreachChecker(path string) (BreachChecker, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &rangeDirChecker{dir: path}, nil
+	}
+
+	return &sortedFileChecker{path: path}, nil
+}
+
+// rangeDirChecker reads the range file of the hash prefix
+type rangeDirChecker struct {
+	dir		string
+}
+
+func (c *rangeDirChecker) Breached(password string) (bool, error) {
+	hash := sha1Hex(password)
+	prefix, suffix := hash[:5], hash[5:]
+
+	// Range files are named after the prefix, with or without an extension
+	f, err := os.Open(filepath.Join(c.dir, prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(c.dir, prefix + ".txt"))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if h, ok := parseLine(scanner.Text()); ok && h == suffix {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// sortedFileChecker binary searches the lines of a sorted file
+type sortedFileChecker struct {
+	path		string
+}
+
+func (c *sortedFileChecker) Breached(password string) (bool, error) {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// Search the lines starting in [lo, hi)
+	target := sha1Hex(password)
+	lo, hi := int64(0), info.Size()
+	for lo < hi {
+		mid := lo + (hi - lo) / 2
+		start, end, line, err := lineAt(f, mid, info.Size())
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		h, ok := parseLine(line)
+		switch {
+		case ok && h == target:
+			return true, nil
+		case h < target:
+			lo = end
+		default:
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+// lineAt returns the first line starting at or after the offset, with its start and the start of the next line
+func lineAt(f *os.File, offset int64, size int64) (int64, int64, string, error) {
+	// Skip to the start of a line
+	start := offset
+	if offset > 0 {
+		next, err := indexByteAt(f, offset - 1, size, '\n')
+		if err != nil {
+			return 0, 0, "", err
+		}
+		start = next + 1
+	}
+	if start >= size {
+		return size, size, "", nil
+	}
+
+	end, err := indexByteAt(f, start, size, '\n')
+	if err != nil {
+		return 0, 0, "", err
+	}
+	buf := make([]byte, end - start)
+	if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+		return 0, 0, "", err
+	}
+
+	return start, end + 1, string(buf), nil
+}
+
+// indexByteAt returns the offset of the first byte b at or after the offset, or the size when there is none
+func indexByteAt(f *os.File, offset int64, size int64, b byte) (int64, error) {
+	buf := make([]byte, 128)
+	for offset < size {
+		n, err := f.ReadAt(buf, offset)
+		if i := bytes.IndexByte(buf[:n], b); i >= 0 {
+			return offset + int64(i), nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		offset += int64(n)
+	}
+
+	return size, nil
+}
+
+// parseLine returns the uppercase hash of a HASH:COUNT line, lines counted zero times are padding
+func parseLine(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return strings.ToUpper(line), line != ""
+	}
+	return strings.ToUpper(line[:i]), strings.TrimSpace(line[i+1:]) != "0"
+}
+
+// sha1Hex returns the uppercase hex SHA-1 digest used by the corpus
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,275 @@
+package passwordlib
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// File hashes passwords with argon2id or bcrypt
+// argon2id hashes use the PHC string format, $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<hash>,
+// bcrypt hashes keep their modular crypt format, $2a$<cost>$..., so existing hashes stay readable
+
+// Define constants
+const (
+	// Hashing algorithms
+	AlgArgon2id	= "argon2id"
+	AlgBcrypt	= "bcrypt"
+
+	// Defaults of the argon2id parameters, the second recommendation of RFC 9106
+	DefaultArgon2Memory		= 64 * 1024
+	DefaultArgon2Time			= 3
+	DefaultArgon2Threads		= 4
+
+	// Lengths of the argon2id salt and key in bytes
+	argon2SaltLength	= 16
+	argon2KeyLength	= 32
+
+	// Upper bound of the calibrated argon2id passes
+	maxArgon2Time = 32
+
+	// Time a hash waits for a free slot before the hasher reports it is busy
+	queueTimeout = time.Second
+)
+
+// Define errors
+var (
+	ErrUnknownAlgorithm	= errors.New("unknown password hashing algorithm")
+	ErrHashInvalid			= errors.New("password hash invalid")
+	ErrBusy					= errors.New("too many password hashes in progress")
+)
+
+// Hasher hashes and verifies passwords
+// Hash and Verify return ErrBusy when the configured number of hashes is already running
+// NeedsRehash reports whether a stored hash was made with another algorithm or other parameters than the configured ones
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2Params are the cost parameters of argon2id, Memory is in KiB
+type Argon2Params struct {
+	Memory		uint32
+	Time			uint32
+	Threads		uint8
+}
+
+// hasher hashes with the configured algorithm and verifies hashes of both algorithms
+type hasher struct {
+	algorithm	string
+	argon2		Argon2Params
+	bcryptCost	int
+	slots			chan struct{}
+}
+
+// NewHasher returns the hasher of the configuration, argon2id unless bcrypt is asked for
+func NewHasher(config *cfglib.Config) (Hasher, error) {
+	h := &hasher{
+		algorithm: config.PasswordHashAlgorithm,
+		argon2: Argon2Params{
+			Memory:		uint32(config.PasswordArgon2Memory),
+			Time:			uint32(config.PasswordArgon2Time),
+			Threads:		uint8(config.PasswordArgon2Threads),
+		},
+		bcryptCost: config.PasswordBcryptCost,
+	}
+
+	// Bound the concurrent hashes, each argon2id hash holds its memory until done
+	concurrency := config.PasswordHashConcurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	h.slots = make(chan struct{}, concurrency)
+
+	if h.algorithm == "" {
+		h.algorithm = AlgArgon2id
+	}
+	if h.algorithm != AlgArgon2id && h.algorithm != AlgBcrypt {
+		return nil, ErrUnknownAlgorithm
+	}
+	if h.argon2.Memory == 0 {
+		h.argon2.Memory = DefaultArgon2Memory
+	}
+	if h.argon2.Time == 0 {
+		h.argon2.Time = DefaultArgon2Time
+	}
+	if h.argon2.Threads == 0 {
+		h.argon2.Threads = DefaultArgon2Threads
+	}
+	if h.bcryptCost == 0 {
+		h.bcryptCost = bcrypt.DefaultCost
+	}
+	if h.bcryptCost < bcrypt.MinCost || h.bcryptCost > bcrypt.MaxCost {
+		return nil, bcrypt.InvalidCostError(h.bcryptCost)
+	}
+
+	return h, nil
+}
+
+func (h *hasher) Hash(password string) (string, error) {
+	if err := h.acquire(); err != nil {
+		return "", err
+	}
+	defer h.release()
+
+	if h.algorithm == AlgBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	return hashArgon2(password, h.argon2)
+}
+
+func (h *hasher) Verify(password string, encoded string) (bool, error) {
+	if err := h.acquire(); err != nil {
+		return false, err
+	}
+	defer h.release()
+
+	if isBcrypt(encoded) {
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	params, salt, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *hasher) NeedsRehash(encoded string) bool {
+	if isBcrypt(encoded) {
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return h.algorithm != AlgBcrypt || err != nil || cost != h.bcryptCost
+	}
+
+	params, salt, key, err := decodeArgon2(encoded)
+	if err != nil {
+		return true
+	}
+	return h.algorithm != AlgArgon2id || params != h.argon2 || len(salt) != argon2SaltLength || len(key) != argon2KeyLength
+}
+
+// acquire takes a hashing slot, waiting at most queueTimeout for one to free up
+func (h *hasher) acquire() error {
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrBusy
+	}
+}
+
+// release frees the slot taken by acquire
+func (h *hasher) release() {
+	<-h.slots
+}
+
+// CalibrateArgon2 returns the argon2id parameters with the given memory and threads
+// whose number of passes makes a hash take at least the target latency on this machine
+func CalibrateArgon2(target time.Duration, memory uint32, threads uint8) Argon2Params {
+	params := Argon2Params{Memory: memory, Time: 1, Threads: threads}
+	for params.Time < maxArgon2Time && measure(func() { hashArgon2("calibration", params) }) < target {
+		params.Time++
+	}
+
+	return params
+}
+
+// CalibrateBcrypt returns the lowest bcrypt cost making a hash take at least the target latency on this machine
+func CalibrateBcrypt(target time.Duration) int {
+	cost := bcrypt.DefaultCost
+	for cost < bcrypt.MaxCost && measure(func() { bcrypt.GenerateFromPassword([]byte("calibration"), cost) }) < target {
+		cost++
+	}
+
+	return cost
+}
+
+// measure returns the fastest of a few runs, so a busy moment does not inflate the result
+func measure(run func()) time.Duration {
+	var best time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		run()
+		if d := time.Since(start); i == 0 || d < best {
+			best = d
+		}
+	}
+
+	return best
+}
+
+// hashArgon2 hashes the password with a random salt and encodes it in the PHC string format
+func hashArgon2(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// decodeArgon2 parses an argon2id hash in the PHC string format
+func decodeArgon2(encoded string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != AlgArgon2id {
+		return params, nil, nil, ErrHashInvalid
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrHashInvalid
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrHashInvalid
+	}
+	if params.Memory == 0 || params.Time == 0 || params.Threads == 0 {
+		return params, nil, nil, ErrHashInvalid
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrHashInvalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrHashInvalid
+	}
+
+	return params, salt, key, nil
+}
+
+// isBcrypt reports whether the hash is in the bcrypt modular crypt format
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
@@ -0,0 +1,129 @@
+package passwordlib
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// Cheap argon2id parameters keep the tests fast
+var testArgon2 = Argon2Params{Memory: 64, Time: 1, Threads: 1}
+
+// newTestHasher returns a hasher of the algorithm with the cheap parameters
+func newTestHasher(t *testing.T, algorithm string, argon2 Argon2Params, bcryptCost int) Hasher {
+	h, err := NewHasher(&cfglib.Config{
+		PasswordHashAlgorithm:	algorithm,
+		PasswordArgon2Memory:	int(argon2.Memory),
+		PasswordArgon2Time:		int(argon2.Time),
+		PasswordArgon2Threads:	int(argon2.Threads),
+		PasswordBcryptCost:		bcryptCost,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func TestDecodeArgon2(t *testing.T) {
+	salt := "c2FsdHNhbHRzYWx0c2FsdA"
+	key := "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	cases := []struct {
+		name			string
+		encoded		string
+		params		Argon2Params
+		valid			bool
+	}{
+		{"valid", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key, Argon2Params{65536, 3, 4}, true},
+		{"other variant", "$argon2i$v=19$m=65536,t=3,p=4$" + salt + "$" + key, Argon2Params{}, false},
+		{"other version", "$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key, Argon2Params{}, false},
+		{"no version", "$argon2id$m=65536,t=3,p=4$" + salt + "$" + key, Argon2Params{}, false},
+		{"extra field", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key + "$x", Argon2Params{}, false},
+		{"text before", "x$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key, Argon2Params{}, false},
+		{"parameters out of order", "$argon2id$v=19$t=3,m=65536,p=4$" + salt + "$" + key, Argon2Params{}, false},
+		{"zero memory", "$argon2id$v=19$m=0,t=3,p=4$" + salt + "$" + key, Argon2Params{}, false},
+		{"zero passes", "$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key, Argon2Params{}, false},
+		{"threads overflow", "$argon2id$v=19$m=65536,t=3,p=256$" + salt + "$" + key, Argon2Params{}, false},
+		{"padded salt", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "==$" + key, Argon2Params{}, false},
+		{"empty key", "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$", Argon2Params{}, false},
+		{"bcrypt", "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", Argon2Params{}, false},
+		{"empty", "", Argon2Params{}, false},
+	}
+	for _, tc := range cases {
+		params, _, _, err := decodeArgon2(tc.encoded)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: valid = %v, want %v", tc.name, err == nil, tc.valid)
+			continue
+		}
+		if err != nil && err != ErrHashInvalid {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+		if tc.valid && params != tc.params {
+			t.Errorf("%s: got %+v, want %+v", tc.name, params, tc.params)
+		}
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{AlgArgon2id, AlgBcrypt} {
+		h := newTestHasher(t, algorithm, testArgon2, bcrypt.MinCost)
+		encoded, err := h.Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algorithm == AlgArgon2id && !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+			t.Fatalf("unexpected hash %s", encoded)
+		}
+
+		if ok, err := h.Verify("correct horse", encoded); !ok || err != nil {
+			t.Errorf("%s: password refused: %v", algorithm, err)
+		}
+		if ok, err := h.Verify("wrong horse", encoded); ok || err != nil {
+			t.Errorf("%s: wrong password accepted: %v", algorithm, err)
+		}
+		if h.NeedsRehash(encoded) {
+			t.Errorf("%s: fresh hash needs a rehash", algorithm)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	hash := func(algorithm string, argon2 Argon2Params, bcryptCost int) string {
+		encoded, err := newTestHasher(t, algorithm, argon2, bcryptCost).Hash("correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	current := hash(AlgArgon2id, testArgon2, bcrypt.MinCost)
+	parts := strings.Split(current, "$")
+
+	cases := []struct {
+		name			string
+		algorithm	string
+		encoded		string
+		rehash		bool
+	}{
+		{"argon2id with the parameters", AlgArgon2id, current, false},
+		{"argon2id with less memory", AlgArgon2id, hash(AlgArgon2id, Argon2Params{Memory: 32, Time: 1, Threads: 1}, 0), true},
+		{"argon2id with fewer passes", AlgArgon2id, hash(AlgArgon2id, Argon2Params{Memory: 64, Time: 2, Threads: 1}, 0), true},
+		{"argon2id with more threads", AlgArgon2id, hash(AlgArgon2id, Argon2Params{Memory: 64, Time: 1, Threads: 2}, 0), true},
+		{"argon2id with a short salt", AlgArgon2id, strings.Join(append(parts[:4:4], "c2FsdA", parts[5]), "$"), true},
+		{"argon2id with a short key", AlgArgon2id, strings.Join(append(parts[:5:5], "a2V5"), "$"), true},
+		{"bcrypt under argon2id", AlgArgon2id, hash(AlgBcrypt, testArgon2, bcrypt.MinCost), true},
+		{"bcrypt with the cost", AlgBcrypt, hash(AlgBcrypt, testArgon2, bcrypt.MinCost), false},
+		{"bcrypt with another cost", AlgBcrypt, hash(AlgBcrypt, testArgon2, bcrypt.MinCost + 1), true},
+		{"argon2id under bcrypt", AlgBcrypt, current, true},
+		{"malformed", AlgArgon2id, "$argon2id$v=19$m=64", true},
+		{"malformed bcrypt", AlgBcrypt, "$2a$xx$", true},
+	}
+	for _, tc := range cases {
+		h := newTestHasher(t, tc.algorithm, testArgon2, bcrypt.MinCost)
+		if got := h.NeedsRehash(tc.encoded); got != tc.rehash {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.rehash)
+		}
+	}
+}
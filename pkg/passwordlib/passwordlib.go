@@ -0,0 +1,161 @@
+package passwordlib
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// File implements the password policy applied when a password is chosen
+
+// Define constants
+const (
+	// Codes of the rules a password can break
+	CodeTooShort			= "too_short"
+	CodeTooLong				= "too_long"
+	CodeTooFewClasses		= "too_few_classes"
+	CodeContainsEmail		= "contains_email"
+	CodeBreached			= "breached"
+
+	// bcrypt ignores the bytes past the 72nd, longer passwords would be silently truncated
+	MaxBcryptBytes = 72
+
+	// argon2id reads the whole password, the bound only keeps hashing cheap
+	MaxArgon2Bytes = 1024
+
+	// Defaults of the configurable rules
+	DefaultMinLength		= 8
+	DefaultMinClasses		= 1
+
+	// Shortest part of an email looked for in a password
+	minEmailPart = 3
+)
+
+// Violation is a rule a password breaks
+type Violation struct {
+	Code			string
+	Message		string
+}
+
+// PolicyError lists the rules a password breaks
+type PolicyError struct {
+	Violations	[]Violation
+}
+
+func (e *PolicyError) Error() string {
+	return "password does not meet the policy"
+}
+
+// Policy holds the rules a new password must follow
+type Policy struct {
+	MinLength		int
+	MaxBytes			int
+	MinClasses		int
+	DisallowEmail	bool
+	Breaches			BreachChecker
+}
+
+// NewPolicy returns the policy of the configuration, opening the breached password corpus when one is set
+func NewPolicy(config *cfglib.Config) (*Policy, error) {
+	p := &Policy{
+		MinLength:		config.PasswordMinLength,
+		MaxBytes:		MaxArgon2Bytes,
+		MinClasses:		config.PasswordMinClasses,
+		DisallowEmail:	true,
+	}
+	if p.MinLength <= 0 {
+		p.MinLength = DefaultMinLength
+	}
+	if p.MinClasses <= 0 {
+		p.MinClasses = DefaultMinClasses
+	}
+	if config.PasswordHashAlgorithm == AlgBcrypt {
+		p.MaxBytes = MaxBcryptBytes
+	}
+
+	if config.PasswordBreachCorpus != "" {
+		breaches, err := NewBreachChecker(config.PasswordBreachCorpus)
+		if err != nil {
+			return nil, err
+		}
+		p.Breaches = breaches
+	}
+
+	return p, nil
+}
+
+// Check returns a *PolicyError listing the rules the password breaks, or nil when it follows them all
+// Other errors come from reading the breached password corpus
+func (p *Policy) Check(password string, email string) error {
+	var violations []Violation
+
+	// Length, counted in characters with the upper bound in bytes
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, Violation{Code: CodeTooShort, Message: fmt.Sprintf("must be at least %d characters", p.MinLength)})
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		violations = append(violations, Violation{Code: CodeTooLong, Message: fmt.Sprintf("must be at most %d bytes", p.MaxBytes)})
+	}
+
+	// Character classes
+	if classes(password) < p.MinClasses {
+		violations = append(violations, Violation{Code: CodeTooFewClasses, Message: fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses)})
+	}
+
+	// Derived from the email
+	if p.DisallowEmail && email != "" && containsEmail(password, email) {
+		violations = append(violations, Violation{Code: CodeContainsEmail, Message: "must not be derived from the email"})
+	}
+
+	// Known from data breaches, only checked for otherwise valid passwords
+	if len(violations) == 0 && p.Breaches != nil {
+		breached, err := p.Breaches.Breached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, Violation{Code: CodeBreached, Message: "appeared in a data breach, choose another one"})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// classes returns the number of character classes used in the password
+func classes(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// containsEmail reports whether the password holds the email or its local part, or is a part of them
+func containsEmail(password string, email string) bool {
+	password = strings.ToLower(password)
+	email = strings.ToLower(email)
+	local := email
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		local = email[:at]
+	}
+
+	if strings.Contains(password, email) || strings.Contains(email, password) {
+		return true
+	}
+	return len(local) >= minEmailPart && strings.Contains(password, local)
+}
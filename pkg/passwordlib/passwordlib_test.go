@@ -0,0 +1,192 @@
+package passwordlib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeBreaches knows the listed passwords, failing every check when err is set
+type fakeBreaches struct {
+	passwords	[]string
+	err			error
+}
+
+func (b *fakeBreaches) Breached(password string) (bool, error) {
+	if b.err != nil {
+		return false, b.err
+	}
+	for _, p := range b.passwords {
+		if p == password {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := &Policy{
+		MinLength:		8,
+		MaxBytes:		MaxBcryptBytes,
+		MinClasses:		3,
+		DisallowEmail:	true,
+		Breaches:		&fakeBreaches{passwords: []string{"Password1!"}},
+	}
+
+	cases := []struct {
+		name			string
+		password		string
+		codes			[]string
+	}{
+		{"valid", "Correct-Horse-9", nil},
+		{"too short", "Ab1!", []string{CodeTooShort}},
+		{"length counted in characters", "Ééééé1!a", nil},
+		{"too long", "Aa1!" + strings.Repeat("x", MaxBcryptBytes), []string{CodeTooLong}},
+		{"too few classes", "correcthorse", []string{CodeTooFewClasses}},
+		{"contains the email", "X1!alice@example.com", []string{CodeContainsEmail}},
+		{"contains the local part", "Alice-2024!", []string{CodeContainsEmail}},
+		{"part of the email", "alice@exa", []string{CodeTooFewClasses, CodeContainsEmail}},
+		{"breached", "Password1!", []string{CodeBreached}},
+		{"several rules", "abc", []string{CodeTooShort, CodeTooFewClasses}},
+	}
+	for _, tc := range cases {
+		err := policy.Check(tc.password, "Alice@Example.com")
+		if tc.codes == nil {
+			if err != nil {
+				t.Errorf("%s: refused: %v", tc.name, err)
+			}
+			continue
+		}
+
+		pe, ok := err.(*PolicyError)
+		if !ok {
+			t.Errorf("%s: expected a *PolicyError, got %v", tc.name, err)
+			continue
+		}
+		codes := []string{}
+		for _, v := range pe.Violations {
+			codes = append(codes, v.Code)
+		}
+		if strings.Join(codes, " ") != strings.Join(tc.codes, " ") {
+			t.Errorf("%s: got %v, want %v", tc.name, codes, tc.codes)
+		}
+	}
+}
+
+func TestPolicyCheckBreachError(t *testing.T) {
+	policy := &Policy{MinLength: 8, MinClasses: 1, Breaches: &fakeBreaches{err: errors.New("corpus unreadable")}}
+
+	// Reading the corpus fails the check instead of skipping it
+	if err := policy.Check("long enough password", ""); err == nil {
+		t.Fatal("password accepted without the breach check")
+	} else if _, ok := err.(*PolicyError); ok {
+		t.Fatalf("read failure reported as a violation: %v", err)
+	}
+}
+
+// writeCorpus writes the hashes of the passwords as a sorted HASH:COUNT file, padding lines have a zero count
+func writeCorpus(t *testing.T, passwords []string, padding []string, trailingNewline bool) string {
+	lines := []string{}
+	for i, p := range passwords {
+		lines = append(lines, fmt.Sprintf("%s:%d", sha1Hex(p), i + 1))
+	}
+	for _, p := range padding {
+		lines = append(lines, sha1Hex(p) + ":0")
+	}
+	sort.Strings(lines)
+
+	content := strings.Join(lines, "\r\n")
+	if trailingNewline && content != "" {
+		content += "\r\n"
+	}
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestSortedFileCheckerBreached(t *testing.T) {
+	breached := []string{}
+	for i := 0; i < 300; i++ {
+		breached = append(breached, fmt.Sprintf("breached-%d", i))
+	}
+	padding := []string{"padding-0", "padding-1", "padding-2"}
+
+	cases := []struct {
+		name				string
+		passwords		[]string
+		trailingNewline	bool
+	}{
+		{"many lines", breached, true},
+		{"no trailing newline", breached, false},
+		{"single line", breached[:1], true},
+		{"two lines", breached[:2], false},
+		{"empty", nil, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewBreachChecker(writeCorpus(t, tc.passwords, padding, tc.trailingNewline))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := c.(*sortedFileChecker); !ok {
+				t.Fatalf("unexpected checker %T", c)
+			}
+
+			// Every listed password is found, wherever its line is
+			for _, p := range tc.passwords {
+				ok, err := c.Breached(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					t.Fatalf("%q not found", p)
+				}
+			}
+
+			// Unlisted and padding passwords are not
+			for _, p := range append([]string{"not-breached", "another-one", ""}, padding...) {
+				ok, err := c.Breached(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok {
+					t.Fatalf("%q found", p)
+				}
+			}
+		})
+	}
+}
+
+func TestRangeDirCheckerBreached(t *testing.T) {
+	dir := t.TempDir()
+	hash := sha1Hex("breached")
+	content := fmt.Sprintf("%s:12\n%s:0\n", hash[5:], sha1Hex("padding")[5:])
+	if err := os.WriteFile(filepath.Join(dir, hash[:5] + ".txt"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, sha1Hex("padding")[:5]), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewBreachChecker(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{"breached": true, "padding": false, "unknown": false}
+	for p, want := range cases {
+		got, err := c.Breached(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%q: got %v, want %v", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ratelib
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// This defines a RateLimitWindow struct that counts the requests of a key in a fixed window
+// Keys are prefixed with the name of their limiter, so limiters can share the table
+type RateLimitWindow struct {
+	Key				string		`gorm:"primaryKey"`
+	WindowStart		time.Time	`gorm:"primaryKey;index"`
+	Count				int
+}
+
+// postgresLimiter is the sliding window limiter of memoryLimiter stored in the database, limits are shared between replicas
+type postgresLimiter struct {
+	db				*gorm.DB
+	name			string
+	limit			int
+	window		time.Duration
+
+	mu				sync.Mutex
+	lastSweep	time.Time
+}
+
+// NewPostgresLimiter returns a limiter allowing limit requests per key in any window of the given duration
+// The name must be unique among the limiters sharing the database
+func NewPostgresLimiter(db *gorm.DB, name string, limit int, window time.Duration) Limiter {
+	return &postgresLimiter{
+		db: db,
+		name: name,
+		limit: limit,
+		window: window,
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *postgresLimiter) Allow(key string) (*Result, error) {
+	now := time.Now().UTC()
+	if err := l.sweep(now); err != nil {
+		return nil, err
+	}
+
+	// Read the count of the previous window
+	key = l.name + ":" + key
+	start := now.Truncate(l.window)
+	var previous RateLimitWindow
+	err := l.db.Where("key = ? AND window_start = ?", key, start.Add(-l.window)).Limit(1).Find(&previous).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Requests left in the current window once the previous one is weighted by its overlap
+	elapsed := now.Sub(start)
+	weight := float64(l.window - elapsed) / float64(l.window)
+	budget := l.limit - int(float64(previous.Count) * weight)
+
+	res := &Result{Limit: l.limit, ResetAt: start.Add(l.window)}
+	if budget <= 0 {
+		res.RetryAfter = res.ResetAt.Sub(now)
+		return res, nil
+	}
+
+	// Count the request unless the budget is spent, in a single statement so replicas cannot both take the last one
+	var current RateLimitWindow
+	tx := l.db.Raw(`INSERT INTO rate_limit_windows (key, window_start, count) VALUES (?, ?, 1)
+		ON CONFLICT (key, window_start) DO UPDATE SET count = rate_limit_windows.count + 1
+		WHERE rate_limit_windows.count < ? RETURNING key, window_start, count`, key, start, budget).Scan(&current)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		res.RetryAfter = res.ResetAt.Sub(now)
+		return res, nil
+	}
+
+	res.Allowed = true
+	res.Remaining = budget - current.Count
+	return res, nil
+}
+
+// sweep deletes the windows of the limiter without requests in the last two windows, at most once per window
+func (l *postgresLimiter) sweep(now time.Time) error {
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) < l.window {
+		l.mu.Unlock()
+		return nil
+	}
+	l.lastSweep = now
+	l.mu.Unlock()
+
+	return l.db.Where("key LIKE ? AND window_start < ?", l.name + ":%", now.Add(-2 * l.window)).Delete(&RateLimitWindow{}).Error
+}
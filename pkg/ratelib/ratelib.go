@@ -0,0 +1,150 @@
+package ratelib
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// File implements request rate limits counted per key, such as an IP address or an email
+
+// Define constants
+const (
+	// Backends storing the request counts
+	DriverMemory	= "memory"
+	DriverPostgres	= "postgres"
+)
+
+// Define errors
+var (
+	ErrUnknownDriver = errors.New("unknown rate limit driver")
+)
+
+// Result describes the state of a key after a request was counted
+type Result struct {
+	Allowed		bool
+	Limit			int
+	Remaining	int
+	RetryAfter	time.Duration
+	ResetAt		time.Time
+}
+
+// Limiter counts requests per key and reports whether they are allowed
+type Limiter interface {
+	Allow(key string) (*Result, error)
+}
+
+// memoryLimiter is a sliding window limiter held in memory, limits are not shared between replicas
+// The count of the previous window is weighted by its overlap with the sliding window
+type memoryLimiter struct {
+	mu				sync.Mutex
+	limit			int
+	window		time.Duration
+	windows		map[string]*memoryWindow
+	lastSweep	time.Time
+	now			func() time.Time
+}
+
+type memoryWindow struct {
+	start		time.Time
+	count		int
+	previous	int
+}
+
+// NewMemoryLimiter returns a limiter allowing limit requests per key in any window of the given duration
+func NewMemoryLimiter(limit int, window time.Duration) Limiter {
+	return &memoryLimiter{
+		limit: limit,
+		window: window,
+		windows: make(map[string]*memoryWindow),
+		lastSweep: time.Now(),
+		now: time.Now,
+	}
+}
+
+func (l *memoryLimiter) Allow(key string) (*Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	// Move the window forward
+	start := now.Truncate(l.window)
+	w, ok := l.windows[key]
+	switch {
+	case !ok:
+		w = &memoryWindow{start: start}
+		l.windows[key] = w
+	case w.start.Equal(start.Add(-l.window)):
+		w.previous, w.count, w.start = w.count, 0, start
+	case !w.start.Equal(start):
+		w.previous, w.count, w.start = 0, 0, start
+	}
+
+	// Estimate the requests in the sliding window
+	elapsed := now.Sub(start)
+	weight := float64(l.window - elapsed) / float64(l.window)
+	used := int(float64(w.previous) * weight) + w.count
+
+	res := &Result{Limit: l.limit, ResetAt: start.Add(l.window)}
+	if used >= l.limit {
+		res.RetryAfter = res.ResetAt.Sub(now)
+		return res, nil
+	}
+
+	w.count++
+	res.Allowed = true
+	res.Remaining = l.limit - used - 1
+	return res, nil
+}
+
+// sweep drops the keys without requests in the last two windows, at most once per window
+func (l *memoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= 2 * l.window {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// Backend creates the limiters of the gateway, limiters of the same backend share its storage
+type Backend interface {
+	NewLimiter(name string, limit int, window time.Duration) Limiter
+}
+
+// NewBackend returns the backend selected by the configuration
+// The memory backend keeps the limits of each replica apart, the postgres one shares them
+func NewBackend(config *cfglib.Config, db *gorm.DB) (Backend, error) {
+	switch config.RateLimitDriver {
+	case DriverMemory, "":
+		return &memoryBackend{}, nil
+	case DriverPostgres:
+		return &postgresBackend{db: db}, nil
+	}
+
+	return nil, ErrUnknownDriver
+}
+
+type memoryBackend struct {}
+
+func (b *memoryBackend) NewLimiter(name string, limit int, window time.Duration) Limiter {
+	return NewMemoryLimiter(limit, window)
+}
+
+type postgresBackend struct {
+	db		*gorm.DB
+}
+
+func (b *postgresBackend) NewLimiter(name string, limit int, window time.Duration) Limiter {
+	return NewPostgresLimiter(b.db, name, limit, window)
+}
@@ -0,0 +1,105 @@
+package ratelib
+
+import (
+	"testing"
+	"time"
+)
+
+// step is a request made at an offset from the start of the first window
+type step struct {
+	at				time.Duration
+	key			string
+	allowed		bool
+	remaining	int
+}
+
+func TestMemoryLimiterAllow(t *testing.T) {
+	cases := []struct {
+		name		string
+		steps		[]step
+	}{
+		{"fills the window", []step{
+			{10 * time.Second, "a", true, 3},
+			{10 * time.Second, "a", true, 2},
+			{20 * time.Second, "a", true, 1},
+			{30 * time.Second, "a", true, 0},
+			{40 * time.Second, "a", false, 0},
+		}},
+		{"keys are counted apart", []step{
+			{10 * time.Second, "a", true, 3},
+			{10 * time.Second, "a", true, 2},
+			{10 * time.Second, "a", true, 1},
+			{10 * time.Second, "a", true, 0},
+			{10 * time.Second, "b", true, 3},
+			{10 * time.Second, "a", false, 0},
+		}},
+		{"weights the previous window by its overlap", []step{
+			{50 * time.Second, "a", true, 3},
+			{50 * time.Second, "a", true, 2},
+			{50 * time.Second, "a", true, 1},
+			{50 * time.Second, "a", true, 0},
+			// 45s of the previous window overlap: 4 * 0.75 = 3 requests counted
+			{75 * time.Second, "a", true, 0},
+			{75 * time.Second, "a", false, 0},
+			// 15s overlap: 4 * 0.25 = 1 request counted, with 1 in this window
+			{105 * time.Second, "a", true, 1},
+			{105 * time.Second, "a", true, 0},
+			{105 * time.Second, "a", false, 0},
+		}},
+		{"forgets windows older than the previous one", []step{
+			{50 * time.Second, "a", true, 3},
+			{50 * time.Second, "a", true, 2},
+			{50 * time.Second, "a", true, 1},
+			{50 * time.Second, "a", true, 0},
+			{185 * time.Second, "a", true, 3},
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			var now time.Time
+			l := NewMemoryLimiter(4, time.Minute).(*memoryLimiter)
+			l.now = func() time.Time { return now }
+
+			for i, s := range tc.steps {
+				now = base.Add(s.at)
+				res, err := l.Allow(s.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Allowed != s.allowed || res.Remaining != s.remaining {
+					t.Fatalf("step %d: allowed = %v remaining = %d, want %v and %d", i, res.Allowed, res.Remaining, s.allowed, s.remaining)
+				}
+
+				// Refused requests wait for the next window
+				reset := now.Truncate(time.Minute).Add(time.Minute)
+				if !res.ResetAt.Equal(reset) || (!res.Allowed && res.RetryAfter != reset.Sub(now)) {
+					t.Fatalf("step %d: reset at %s, retry after %s", i, res.ResetAt, res.RetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryLimiterSweep(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewMemoryLimiter(4, time.Minute).(*memoryLimiter)
+	l.lastSweep = now
+	l.now = func() time.Time { return now }
+
+	if _, err := l.Allow("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys idle for two windows are dropped
+	now = now.Add(2 * time.Minute)
+	if _, err := l.Allow("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.windows["a"]; ok {
+		t.Error("idle key kept")
+	}
+	if _, ok := l.windows["b"]; !ok {
+		t.Error("active key dropped")
+	}
+}
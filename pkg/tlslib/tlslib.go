@@ -0,0 +1,94 @@
+package tlslib
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"os"
+
+	"github.com/selatoz/gateway/pkg/cfglib"
+)
+
+// File configures the TLS server and reads the identities of client certificates (RFC 8705)
+
+// Define constants
+const (
+	// Ways the server asks for client certificates
+	ClientAuthOff			= "off"
+	ClientAuthOptional	= "optional"
+	ClientAuthRequire		= "require"
+
+	// Prefixes of the subject alternative names of a certificate
+	PrefixDNS	= "dns:"
+	PrefixURI	= "uri:"
+	PrefixEmail	= "email:"
+	PrefixIP		= "ip:"
+)
+
+// Define errors
+var (
+	ErrUnknownClientAuth	= errors.New("unknown client certificate mode")
+	ErrMissingClientCA	= errors.New("client certificates require a CA bundle")
+	ErrInvalidClientCA	= errors.New("no certificate found in the CA bundle")
+)
+
+// NewServerConfig returns the TLS configuration of the server
+// Client certificates are verified against the CA bundle, they are optional or required depending on the configuration
+func NewServerConfig(config *cfglib.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch config.MTLSClientAuth {
+	case ClientAuthOff, "":
+		return tlsConfig, nil
+	case ClientAuthOptional:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, ErrUnknownClientAuth
+	}
+
+	// Load the CA bundle
+	if config.MTLSClientCA == "" {
+		return nil, ErrMissingClientCA
+	}
+	pem, err := os.ReadFile(config.MTLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrInvalidClientCA
+	}
+	tlsConfig.ClientCAs = pool
+
+	return tlsConfig, nil
+}
+
+// Thumbprint returns the base64url encoded SHA-256 hash of the certificate, as carried in the x5t#S256 confirmation
+func Thumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Identities lists the names a certificate can be registered with
+// The subject distinguished name comes first, e.g. "CN=partner,O=Acme", then the prefixed alternative names, e.g. "dns:api.partner.com"
+func Identities(cert *x509.Certificate) []string {
+	identities := []string{cert.Subject.String()}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, PrefixDNS + name)
+	}
+	for _, uri := range cert.URIs {
+		identities = append(identities, PrefixURI + uri.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		identities = append(identities, PrefixEmail + email)
+	}
+	for _, ip := range cert.IPAddresses {
+		identities = append(identities, PrefixIP + ip.String())
+	}
+
+	return identities
+}
@@ -0,0 +1,142 @@
+package webauthnlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// File implements the subset of CBOR (RFC 8949) used by authenticators, only definite lengths are accepted
+
+// Define errors
+var (
+	ErrCBORInvalid = errors.New("cbor invalid")
+)
+
+// Maximum nesting of arrays and maps
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR item and returns it with the remaining bytes
+// Maps are decoded to map[interface{}]interface{} with int64 or string keys
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeItem(b, 0)
+}
+
+func decodeItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth || len(b) == 0 {
+		return nil, nil, ErrCBORInvalid
+	}
+
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+
+	// Handle simple values and floats
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b[1:], nil
+		case 21:
+			return true, b[1:], nil
+		case 22, 23:
+			return nil, b[1:], nil
+		case 26:
+			if len(b) < 5 {
+				return nil, nil, ErrCBORInvalid
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b[1:5]))), b[5:], nil
+		case 27:
+			if len(b) < 9 {
+				return nil, nil, ErrCBORInvalid
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), b[9:], nil
+		}
+		return nil, nil, ErrCBORInvalid
+	}
+
+	n, rest, err := readArgument(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, ErrCBORInvalid
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, ErrCBORInvalid
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, ErrCBORInvalid
+		}
+		if major == 2 {
+			return append([]byte{}, rest[:n]...), rest[n:], nil
+		}
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		if n > uint64(len(rest)) {
+			return nil, nil, ErrCBORInvalid
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			item, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if n > uint64(len(rest)) {
+			return nil, nil, ErrCBORInvalid
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			key, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrCBORInvalid
+			}
+			value, rest, err = decodeItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	case 6:
+		// Tags are ignored, the tagged item is returned
+		return decodeItem(rest, depth+1)
+	}
+
+	return nil, nil, ErrCBORInvalid
+}
+
+// readArgument reads the argument of an item head
+func readArgument(b []byte) (uint64, []byte, error) {
+	info := b[0] & 0x1f
+	switch {
+	case info < 24:
+		return uint64(info), b[1:], nil
+	case info == 24 && len(b) >= 2:
+		return uint64(b[1]), b[2:], nil
+	case info == 25 && len(b) >= 3:
+		return uint64(binary.BigEndian.Uint16(b[1:3])), b[3:], nil
+	case info == 26 && len(b) >= 5:
+		return uint64(binary.BigEndian.Uint32(b[1:5])), b[5:], nil
+	case info == 27 && len(b) >= 9:
+		return binary.BigEndian.Uint64(b[1:9]), b[9:], nil
+	}
+
+	return 0, nil, ErrCBORInvalid
+}
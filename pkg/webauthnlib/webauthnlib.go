@@ -0,0 +1,345 @@
+package webauthnlib
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+// File implements the relying party checks of the WebAuthn registration and authentication ceremonies
+// Attestation statements are not verified, so any authenticator model is accepted
+
+// Define errors
+var (
+	ErrClientDataInvalid				= errors.New("client data invalid")
+	ErrAuthenticatorDataInvalid	= errors.New("authenticator data invalid")
+	ErrAttestationInvalid			= errors.New("attestation invalid")
+	ErrUnsupportedKey					= errors.New("unsupported credential key")
+	ErrSignatureInvalid				= errors.New("signature invalid")
+	ErrUserPresenceRequired			= errors.New("user presence required")
+	ErrUserVerificationRequired	= errors.New("user verification required")
+)
+
+// Define constants
+const (
+	// Client data types
+	TypeCreate	= "webauthn.create"
+	TypeGet		= "webauthn.get"
+
+	// COSE algorithms
+	AlgES256		= -7
+	AlgEdDSA		= -8
+	AlgRS256		= -257
+
+	// Authenticator data flags
+	flagUserPresent		= 0x01
+	flagUserVerified		= 0x04
+	flagAttestedData		= 0x40
+)
+
+// SupportedAlgorithms lists the COSE algorithms accepted for credentials, in order of preference
+var SupportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// Credential is a verified public key credential
+type Credential struct {
+	ID				[]byte
+	PublicKey	[]byte
+	Algorithm	int
+	SignCount	uint32
+}
+
+// Options of the registration ceremony (PublicKeyCredentialCreationOptions)
+type CreationOptions struct {
+	Challenge					string						`json:"challenge"`
+	RP								RelyingParty				`json:"rp"`
+	User							User							`json:"user"`
+	PubKeyCredParams			[]CredentialParameter	`json:"pubKeyCredParams"`
+	Timeout						int64							`json:"timeout"`
+	ExcludeCredentials		[]CredentialDescriptor	`json:"excludeCredentials"`
+	AuthenticatorSelection	AuthenticatorSelection	`json:"authenticatorSelection"`
+	Attestation					string						`json:"attestation"`
+}
+
+// Options of the authentication ceremony (PublicKeyCredentialRequestOptions)
+type RequestOptions struct {
+	Challenge				string						`json:"challenge"`
+	RPID						string						`json:"rpId"`
+	Timeout					int64							`json:"timeout"`
+	AllowCredentials		[]CredentialDescriptor	`json:"allowCredentials"`
+	UserVerification		string						`json:"userVerification"`
+}
+
+type RelyingParty struct {
+	ID		string	`json:"id"`
+	Name	string	`json:"name"`
+}
+
+type User struct {
+	ID					string	`json:"id"`
+	Name				string	`json:"name"`
+	DisplayName		string	`json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type	string	`json:"type"`
+	Alg	int		`json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type			string		`json:"type"`
+	ID				string		`json:"id"`
+	Transports	[]string		`json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey				string	`json:"residentKey"`
+	UserVerification		string	`json:"userVerification"`
+}
+
+// clientData holds the fields of the client data checked by the relying party
+type clientData struct {
+	Type			string	`json:"type"`
+	Challenge	string	`json:"challenge"`
+	Origin		string	`json:"origin"`
+}
+
+// authenticatorData holds the parsed authenticator data
+type authenticatorData struct {
+	RPIDHash			[]byte
+	Flags				byte
+	SignCount		uint32
+	CredentialID	[]byte
+	PublicKey		[]byte
+}
+
+// Encode returns the base64url encoding used for binary WebAuthn fields
+func Encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decode accepts base64url with or without padding
+func Decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(trimPadding(s))
+}
+
+// VerifyRegistration checks a registration response and returns the new credential
+func VerifyRegistration(attestationObject []byte, clientDataJSON []byte, challenge string, rpID string, origins []string, requireUV bool) (*Credential, error) {
+	if err := verifyClientData(clientDataJSON, TypeCreate, challenge, origins); err != nil {
+		return nil, err
+	}
+
+	// Read the authenticator data from the attestation object
+	obj, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, ErrAttestationInvalid
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrAttestationInvalid
+	}
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, ErrAttestationInvalid
+	}
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyAuthenticatorData(ad, rpID, requireUV); err != nil {
+		return nil, err
+	}
+	if ad.CredentialID == nil {
+		return nil, ErrAttestationInvalid
+	}
+
+	// Ensure the key is usable
+	_, alg, err := ParsePublicKey(ad.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:				ad.CredentialID,
+		PublicKey:		ad.PublicKey,
+		Algorithm:		alg,
+		SignCount:		ad.SignCount,
+	}, nil
+}
+
+// VerifyAssertion checks an authentication response against the stored credential key
+// It returns the sign count reported by the authenticator
+func VerifyAssertion(publicKey []byte, authData []byte, clientDataJSON []byte, signature []byte, challenge string, rpID string, origins []string, requireUV bool) (uint32, error) {
+	if err := verifyClientData(clientDataJSON, TypeGet, challenge, origins); err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+	if err := verifyAuthenticatorData(ad, rpID, requireUV); err != nil {
+		return 0, err
+	}
+
+	// The signature covers the authenticator data and the client data hash
+	key, alg, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	if !verifySignature(key, alg, signed, signature) {
+		return 0, ErrSignatureInvalid
+	}
+
+	return ad.SignCount, nil
+}
+
+// ParsePublicKey parses a COSE key (RFC 9053) and returns it with its algorithm
+func ParsePublicKey(coseKey []byte) (crypto.PublicKey, int, error) {
+	obj, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, 0, ErrUnsupportedKey
+	}
+	m, ok := obj.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, ErrUnsupportedKey
+	}
+
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrUnsupportedKey
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, ErrUnsupportedKey
+		}
+		return pub, AlgES256, nil
+	case kty == 1 && alg == AlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrUnsupportedKey
+		}
+		return ed25519.PublicKey(x), AlgEdDSA, nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrUnsupportedKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, AlgRS256, nil
+	}
+
+	return nil, 0, ErrUnsupportedKey
+}
+
+// verifyClientData checks the type, challenge and origin of the client data
+func verifyClientData(clientDataJSON []byte, ceremony string, challenge string, origins []string) error {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return ErrClientDataInvalid
+	}
+	if cd.Type != ceremony || subtle.ConstantTimeCompare([]byte(trimPadding(cd.Challenge)), []byte(challenge)) != 1 {
+		return ErrClientDataInvalid
+	}
+	for _, origin := range origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+
+	return ErrClientDataInvalid
+}
+
+// verifyAuthenticatorData checks the relying party id hash and the user flags
+func verifyAuthenticatorData(ad *authenticatorData, rpID string, requireUV bool) error {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return ErrAuthenticatorDataInvalid
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return ErrUserPresenceRequired
+	}
+	if requireUV && ad.Flags&flagUserVerified == 0 {
+		return ErrUserVerificationRequired
+	}
+
+	return nil
+}
+
+// parseAuthenticatorData parses the authenticator data, with the attested credential when present
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrAuthenticatorDataInvalid
+	}
+
+	ad := &authenticatorData{
+		RPIDHash:	b[:32],
+		Flags:		b[32],
+		SignCount:	binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.Flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	// The attested credential data is the AAGUID, the credential id and the COSE key
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, ErrAuthenticatorDataInvalid
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || len(rest) < idLen {
+		return nil, ErrAuthenticatorDataInvalid
+	}
+	ad.CredentialID = append([]byte{}, rest[:idLen]...)
+	rest = rest[idLen:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, ErrAuthenticatorDataInvalid
+	}
+	ad.PublicKey = append([]byte{}, rest[:len(rest)-len(after)]...)
+
+	return ad, nil
+}
+
+// verifySignature checks the signature with the algorithm of the credential
+func verifySignature(key crypto.PublicKey, alg int, signed []byte, signature []byte) bool {
+	switch alg {
+	case AlgES256:
+		digest := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature)
+	case AlgEdDSA:
+		return ed25519.Verify(key.(ed25519.PublicKey), signed, signature)
+	case AlgRS256:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+
+	return false
+}
+
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
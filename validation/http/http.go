@@ -1,5 +1,11 @@
 package validHttp
 
+import (
+	"time"
+
+	"github.com/selatoz/gateway/pkg/webauthnlib"
+)
+
 // Generic types
 type ErrorResponse struct {
 	Error		string	`json:"error"`
@@ -11,6 +17,18 @@ type SuccessResponse struct {
 
 type EmptyRequest struct {}
 
+// FieldError describes why the value of a field was refused
+type FieldError struct {
+	Field		string	`json:"field"`
+	Code		string	`json:"code"`
+	Message	string	`json:"message"`
+}
+
+type ValidationErrorResponse struct {
+	Error		string			`json:"error"`
+	Fields	[]FieldError	`json:"fields"`
+}
+
 // Types related to auth
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
@@ -19,11 +37,398 @@ type LoginRequest struct {
 
 type RegisterRequest struct {
 	Email    string `form:"email" binding:"required,email"`
-	Password string `form:"password" binding:"required,min=6"`
+	Password string `form:"password" binding:"required"`
 }
 
 type RefreshAccessRequest struct {}
 
+type MFAChallengeResponse struct {
+	MFARequired		bool			`json:"mfa_required"`
+	MFAToken			string		`json:"mfa_token"`
+	Methods			[]string		`json:"methods"`
+	ExpiresAt		time.Time	`json:"expires_at"`
+}
+
+type MFAVerifyRequest struct {
+	MFAToken			string		`json:"mfa_token" binding:"required"`
+	Code				string		`json:"code" binding:"required"`
+}
+
+type VerifyEmailRequest struct {
+	Token		string	`form:"token" binding:"required"`
+}
+
+type PasswordForgotRequest struct {
+	Email		string	`json:"email" binding:"required,email"`
+}
+
+type PasswordResetRequest struct {
+	Token		string	`json:"token" binding:"required"`
+	Password	string	`json:"password" binding:"required"`
+}
+
+type MagicLinkRequest struct {
+	Email		string	`json:"email" binding:"required,email"`
+	Method	string	`json:"method"`
+}
+
+type MagicLinkResponse struct {
+	RequestID	string		`json:"request_id"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+}
+
+type MagicLinkVerifyRequest struct {
+	Token		string	`form:"token" binding:"required"`
+}
+
+type MagicCodeVerifyRequest struct {
+	RequestID	string	`json:"request_id" binding:"required"`
+	Code			string	`json:"code" binding:"required"`
+}
+
+type FederatedCallbackRequest struct {
+	Code		string	`form:"code"`
+	State		string	`form:"state"`
+	Error		string	`form:"error"`
+}
+
+// Types related to sessions
+type SessionResponse struct {
+	ID				string		`json:"id"`
+	UserAgent	string		`json:"user_agent"`
+	IP				string		`json:"ip"`
+	CreatedAt	time.Time	`json:"created_at"`
+	LastUsedAt	*time.Time	`json:"last_used_at"`
+	Current		bool			`json:"current"`
+}
+
+type SessionsResponse struct {
+	Sessions		[]SessionResponse	`json:"sessions"`
+}
+
+// Types related to API keys
+type CreateAPIKeyRequest struct {
+	Name			string		`json:"name" binding:"required"`
+	Scopes		[]string		`json:"scopes"`
+	ExpiresAt	*time.Time	`json:"expires_at"`
+}
+
+type APIKeyResponse struct {
+	ID				uint			`json:"id"`
+	Name			string		`json:"name"`
+	Prefix		string		`json:"prefix"`
+	Key			string		`json:"key,omitempty"`
+	Scopes		[]string		`json:"scopes"`
+	CreatedAt	time.Time	`json:"created_at"`
+	ExpiresAt	*time.Time	`json:"expires_at"`
+	LastUsedAt	*time.Time	`json:"last_used_at"`
+	LastUsedIP	string		`json:"last_used_ip"`
+}
+
+type APIKeysResponse struct {
+	APIKeys		[]APIKeyResponse	`json:"api_keys"`
+}
+
+// Types related to MFA
+type MFACodeRequest struct {
+	Code				string		`json:"code" binding:"required"`
+}
+
+type TOTPEnrollmentResponse struct {
+	Secret			string		`json:"secret"`
+	OTPAuthURI		string		`json:"otpauth_uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes	[]string		`json:"recovery_codes"`
+}
+
+// Types related to WebAuthn
+// The code proves the second factor when the user enabled one
+type WebAuthnRegistrationBeginRequest struct {
+	Code				string		`json:"code"`
+}
+
+type WebAuthnCredentialDeleteRequest struct {
+	Code				string		`json:"code"`
+}
+
+type WebAuthnRegistrationOptionsResponse struct {
+	Token				string									`json:"token"`
+	PublicKey		*webauthnlib.CreationOptions		`json:"publicKey"`
+}
+
+type WebAuthnLoginOptionsResponse struct {
+	Token				string									`json:"token"`
+	PublicKey		*webauthnlib.RequestOptions		`json:"publicKey"`
+}
+
+type WebAuthnRegistrationRequest struct {
+	Token					string		`json:"token" binding:"required"`
+	Name					string		`json:"name"`
+	ClientDataJSON		string		`json:"client_data_json" binding:"required"`
+	AttestationObject	string		`json:"attestation_object" binding:"required"`
+	Transports			[]string		`json:"transports"`
+}
+
+type WebAuthnAssertionRequest struct {
+	Token					string		`json:"token" binding:"required"`
+	CredentialID		string		`json:"credential_id" binding:"required"`
+	ClientDataJSON		string		`json:"client_data_json" binding:"required"`
+	AuthenticatorData	string		`json:"authenticator_data" binding:"required"`
+	Signature			string		`json:"signature" binding:"required"`
+	UserHandle			string		`json:"user_handle"`
+}
+
+type WebAuthnMFABeginRequest struct {
+	MFAToken				string		`json:"mfa_token" binding:"required"`
+}
+
+type WebAuthnMFAAssertionRequest struct {
+	MFAToken				string		`json:"mfa_token" binding:"required"`
+	WebAuthnAssertionRequest
+}
+
+type WebAuthnCredentialResponse struct {
+	ID				uint			`json:"id"`
+	Name			string		`json:"name"`
+	Transports	[]string		`json:"transports"`
+	CreatedAt	time.Time	`json:"created_at"`
+	LastUsedAt	*time.Time	`json:"last_used_at"`
+}
+
+type WebAuthnCredentialsResponse struct {
+	Credentials		[]WebAuthnCredentialResponse	`json:"credentials"`
+}
+
+// Types related to federated identities
+type IdentityResponse struct {
+	Provider		string		`json:"provider"`
+	Email			string		`json:"email"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+type IdentitiesResponse struct {
+	Identities	[]IdentityResponse	`json:"identities"`
+}
+
+// Types related to OAuth
+type IntrospectRequest struct {
+	Token				string	`form:"token" binding:"required"`
+	TokenTypeHint	string	`form:"token_type_hint"`
+}
+
+type IntrospectResponse struct {
+	Active		bool		`json:"active"`
+	Sub			string	`json:"sub,omitempty"`
+	Exp			int64		`json:"exp,omitempty"`
+	Iat			int64		`json:"iat,omitempty"`
+	Scope			string	`json:"scope,omitempty"`
+	ClientID		string	`json:"client_id,omitempty"`
+	TokenType	string	`json:"token_type,omitempty"`
+	Cnf			*Confirmation	`json:"cnf,omitempty"`
+	Act			*ActorClaim		`json:"act,omitempty"`
+	Aud			string	`json:"aud,omitempty"`
+}
+
+// Confirmation holds the key a token is bound to (RFC 7800)
+type Confirmation struct {
+	JKT		string	`json:"jkt,omitempty"`
+	X5T		string	`json:"x5t#S256,omitempty"`
+}
+
+// ActorClaim identifies who acts on behalf of the subject of a delegated token (RFC 8693)
+type ActorClaim struct {
+	Sub			string	`json:"sub,omitempty"`
+	ClientID		string	`json:"client_id,omitempty"`
+}
+
+type RevokeRequest struct {
+	Token				string	`form:"token" binding:"required"`
+	TokenTypeHint	string	`form:"token_type_hint"`
+}
+
+type OAuthErrorResponse struct {
+	Error					string	`json:"error"`
+	ErrorDescription	string	`json:"error_description,omitempty"`
+	RedirectTo			string	`json:"redirect_to,omitempty"`
+}
+
+type AuthorizeRequest struct {
+	ResponseType			string	`form:"response_type" json:"response_type" binding:"required"`
+	ClientID					string	`form:"client_id" json:"client_id" binding:"required"`
+	RedirectURI				string	`form:"redirect_uri" json:"redirect_uri"`
+	Scope						string	`form:"scope" json:"scope"`
+	State						string	`form:"state" json:"state"`
+	CodeChallenge			string	`form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod	string	`form:"code_challenge_method" json:"code_challenge_method"`
+	Nonce						string	`form:"nonce" json:"nonce"`
+	MaxAge					*int		`form:"max_age" json:"max_age"`
+}
+
+type ConsentRequest struct {
+	AuthorizeRequest
+	Approved		bool		`json:"approved"`
+}
+
+type ConsentResponse struct {
+	ClientID			string		`json:"client_id"`
+	ClientName		string		`json:"client_name"`
+	RedirectURI		string		`json:"redirect_uri"`
+	Scopes			[]string		`json:"scopes"`
+}
+
+type AuthorizeResponse struct {
+	RedirectTo		string	`json:"redirect_to"`
+}
+
+type TokenRequest struct {
+	GrantType		string	`form:"grant_type" binding:"required"`
+	Code				string	`form:"code"`
+	RedirectURI		string	`form:"redirect_uri"`
+	CodeVerifier	string	`form:"code_verifier"`
+	RefreshToken	string	`form:"refresh_token"`
+	Scope				string	`form:"scope"`
+
+	// Token exchange (RFC 8693)
+	SubjectToken			string	`form:"subject_token"`
+	SubjectTokenType		string	`form:"subject_token_type"`
+	ActorToken				string	`form:"actor_token"`
+	ActorTokenType			string	`form:"actor_token_type"`
+	RequestedTokenType	string	`form:"requested_token_type"`
+	Audience					[]string	`form:"audience"`
+}
+
+type TokenResponse struct {
+	AccessToken		string	`json:"access_token"`
+	TokenType		string	`json:"token_type"`
+	ExpiresIn		int64		`json:"expires_in"`
+	RefreshToken	string	`json:"refresh_token,omitempty"`
+	Scope				string	`json:"scope,omitempty"`
+	IDToken			string	`json:"id_token,omitempty"`
+	IssuedTokenType	string	`json:"issued_token_type,omitempty"`
+}
+
+// Types related to OpenID Connect
+type OpenIDConfigurationResponse struct {
+	Issuer										string		`json:"issuer"`
+	AuthorizationEndpoint					string		`json:"authorization_endpoint"`
+	TokenEndpoint								string		`json:"token_endpoint"`
+	UserInfoEndpoint							string		`json:"userinfo_endpoint"`
+	JWKSURI										string		`json:"jwks_uri"`
+	IntrospectionEndpoint					string		`json:"introspection_endpoint"`
+	RevocationEndpoint						string		`json:"revocation_endpoint"`
+	ScopesSupported							[]string		`json:"scopes_supported"`
+	ResponseTypesSupported					[]string		`json:"response_types_supported"`
+	GrantTypesSupported						[]string		`json:"grant_types_supported"`
+	SubjectTypesSupported					[]string		`json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported		[]string		`json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported	[]string		`json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported			[]string		`json:"code_challenge_methods_supported"`
+	ClaimsSupported							[]string		`json:"claims_supported"`
+}
+
+type UserInfoResponse struct {
+	Sub				string	`json:"sub"`
+	Email				string	`json:"email,omitempty"`
+	EmailVerified	*bool		`json:"email_verified,omitempty"`
+	UpdatedAt		int64		`json:"updated_at,omitempty"`
+}
+
+// Types related to roles
+type AssignRoleRequest struct {
+	Role		string	`json:"role" binding:"required"`
+}
+
+type RoleResponse struct {
+	Name				string		`json:"name"`
+	Permissions		[]string		`json:"permissions"`
+}
+
+type RolesResponse struct {
+	Roles		[]RoleResponse	`json:"roles"`
+}
+
+// Types related to clients
+type CreateClientRequest struct {
+	Name				string		`json:"name" binding:"required"`
+	RedirectURIs	[]string		`json:"redirect_uris"`
+	Scopes			[]string		`json:"scopes"`
+	GrantTypes		[]string		`json:"grant_types"`
+	Public			bool			`json:"public"`
+	TLSSubject		string		`json:"tls_subject"`
+}
+
+type ClientResponse struct {
+	ClientID			string		`json:"client_id"`
+	ClientSecret	string		`json:"client_secret,omitempty"`
+	Name				string		`json:"name"`
+	RedirectURIs	[]string		`json:"redirect_uris"`
+	Scopes			[]string		`json:"scopes"`
+	GrantTypes		[]string		`json:"grant_types"`
+	Public			bool			`json:"public"`
+	TLSSubject		string		`json:"tls_subject,omitempty"`
+}
+
+// Types related to lockouts
+type LockoutEventsRequest struct {
+	UserID		uint		`form:"user_id"`
+	EventType	string	`form:"event_type"`
+	Before		uint		`form:"before"`
+	Limit			int		`form:"limit"`
+}
+
+type LockoutEventResponse struct {
+	ID					uint			`json:"id"`
+	Key				string		`json:"key"`
+	UserID			uint			`json:"user_id,omitempty"`
+	EventType		string		`json:"event_type"`
+	IP					string		`json:"ip,omitempty"`
+	Failures			int			`json:"failures"`
+	LockedUntil		*time.Time	`json:"locked_until,omitempty"`
+	ActorID			uint			`json:"actor_id,omitempty"`
+	CreatedAt		time.Time	`json:"created_at"`
+}
+
+type LockoutEventsResponse struct {
+	Events		[]LockoutEventResponse	`json:"events"`
+	NextBefore	uint							`json:"next_before,omitempty"`
+}
+
+// Types related to the audit log
+type AuditEventsRequest struct {
+	Type			string		`form:"type"`
+	Outcome		string		`form:"outcome"`
+	ActorID		uint			`form:"actor_id"`
+	UserID		uint			`form:"user_id"`
+	IP				string		`form:"ip"`
+	RequestID	string		`form:"request_id"`
+	Since			*time.Time	`form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until			*time.Time	`form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	Before		uint			`form:"before"`
+	Limit			int			`form:"limit"`
+}
+
+type AuditEventResponse struct {
+	ID				uint			`json:"id"`
+	CreatedAt	time.Time	`json:"created_at"`
+	Type			string		`json:"type"`
+	Outcome		string		`json:"outcome"`
+	Reason		string		`json:"reason,omitempty"`
+	Method		string		`json:"method,omitempty"`
+	ActorID		uint			`json:"actor_id,omitempty"`
+	UserID		uint			`json:"user_id,omitempty"`
+	ClientID		string		`json:"client_id,omitempty"`
+	IP				string		`json:"ip,omitempty"`
+	UserAgent	string		`json:"user_agent,omitempty"`
+	RequestID	string		`json:"request_id,omitempty"`
+}
+
+type AuditEventsResponse struct {
+	Events		[]AuditEventResponse		`json:"events"`
+	NextBefore	uint							`json:"next_before,omitempty"`
+}
+
 // Types related to profile
 type UpdateUserProfileRequest struct {
 	Message string `json:"message"`